@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/20af02/MosaicFS/erasure"
+)
+
+// defaultChunkSize is the average chunk size, chunks range from a quarter to four times of it.
+const defaultChunkSize = 1 << 20 // 1MB
+
+// manifestMagic starts every manifest, telling it apart from files stored
+// as a single blob before chunking.
+const manifestMagic = "mosaicfs manifest\n"
+
+// Manifest is stored under the file key and lists the chunks the file is made of, in order.
+type Manifest struct {
+	Size int64
+	// ChunkSize is the average chunk size the file was split with.
+	ChunkSize int
+	Chunks    []ChunkRef
+	// EC is set when the chunks are stored as erasure coded shards instead of replicas.
+	EC *erasure.Scheme
+}
+
+// ChunkRef is a chunk of a file, addressed by its content.
+type ChunkRef struct {
+	Hash string
+	Size int64
+	// Key is the key the chunk, or its shards, are encrypted with on other nodes. Manifests
+	// are encrypted with their file's data key, so peers don't get to see it. Chunks
+	// stored before chunk keys have none, they're encrypted with the master key.
+	Key []byte
+}
+
+func (m *Manifest) encode() ([]byte, error) {
+	buf := bytes.NewBufferString(manifestMagic)
+	if err := gob.NewEncoder(buf).Encode(m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// errNotManifest is returned by decodeManifest for files stored before chunking.
+var errNotManifest = errors.New("not a manifest")
+
+func decodeManifest(b []byte) (*Manifest, error) {
+	if !bytes.HasPrefix(b, []byte(manifestMagic)) {
+		return nil, errNotManifest
+	}
+	var m Manifest
+	if err := gob.NewDecoder(bytes.NewReader(b[len(manifestMagic):])).Decode(&m); err != nil {
+		return nil, fmt.Errorf("decode manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// chunkHash addresses a chunk by its content. The hash is keyed with the owner's
+// encryption key, so the peers holding a chunk can't tell what's in it.
+func chunkHash(encKey []byte, data []byte) string {
+	mac := hmac.New(sha256.New, encKey)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// chunkKey is the store key of a chunk, locally and on our peers.
+func chunkKey(hash string) string {
+	return "chunks/" + hash
+}
+
+// ref is the name chunk c is stored and reference counted under. Erasure coded
+// chunks are stored differently, so they don't deduplicate against replicated ones.
+func (m *Manifest) ref(c ChunkRef) string {
+	if m.EC == nil {
+		return c.Hash
+	}
+	return c.Hash + "." + m.EC.String()
+}
+
+// objectKeys returns the store keys holding chunk c: the chunk itself, or its shards.
+func (m *Manifest) objectKeys(c ChunkRef) []string {
+	if m.EC == nil {
+		return []string{chunkKey(c.Hash)}
+	}
+	keys := make([]string, m.EC.Total())
+	for i := range keys {
+		keys[i] = shardKey(m.ref(c), i)
+	}
+	return keys
+}
+
+// readManifest loads the manifest of a file we have on disk. For files stored
+// before chunking, it returns errNotManifest.
+func (s *FileServer) readManifest(key string) (*Manifest, error) {
+	_, r, err := s.store.Read(s.ID, key)
+	if err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return decodeManifest(b)
+}
+
+// verifyChunk checks the chunk on disk matches its hash.
+func (s *FileServer) verifyChunk(c ChunkRef) error {
+	_, err := s.readChunk(c)
+	return err
+}
+
+// readChunk returns the chunk on disk, once checked against its hash.
+func (s *FileServer) readChunk(c ChunkRef) ([]byte, error) {
+	_, r, err := s.store.Read(s.ID, chunkKey(c.Hash))
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != c.Size || !hmac.Equal([]byte(chunkHash(s.keys.hashKey(), data)), []byte(c.Hash)) {
+		return nil, fmt.Errorf("chunk (%s) is corrupt", c.Hash)
+	}
+	return data, nil
+}
+
+// chunkReader streams the file described by m from the chunks on disk.
+func (s *FileServer) chunkReader(m *Manifest) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		for _, c := range m.Chunks {
+			var data []byte
+			var err error
+			if m.EC != nil {
+				data, err = s.decodeShards(m, c)
+			} else {
+				data, err = s.readChunk(c)
+			}
+			if err == nil {
+				_, err = pw.Write(data)
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+	return pr
+}
@@ -0,0 +1,141 @@
+// Package chunker splits a stream into content-defined chunks with FastCDC.
+//
+// Chunk boundaries depend on the bytes around them rather than on their offset,
+// so inserting or removing data only changes the chunks next to the edit and
+// the rest of the file still deduplicates against earlier versions.
+package chunker
+
+import (
+	"errors"
+	"io"
+	"math/bits"
+)
+
+// Opts bounds the size of the chunks. Sizes are in bytes.
+type Opts struct {
+	MinSize int
+	AvgSize int
+	MaxSize int
+}
+
+// NewOpts returns the usual FastCDC bounds around avgSize: a quarter of it at least, four times at most.
+func NewOpts(avgSize int) Opts {
+	return Opts{
+		MinSize: avgSize / 4,
+		AvgSize: avgSize,
+		MaxSize: avgSize * 4,
+	}
+}
+
+// Chunker reads chunks from a stream.
+type Chunker struct {
+	Opts
+	r io.Reader
+
+	// Normalized chunking: a harder mask before AvgSize and an easier one after it
+	// keeps chunk sizes close to the average.
+	maskS uint64
+	maskL uint64
+
+	buf  []byte
+	data []byte // Unconsumed part of buf
+	eof  bool
+}
+
+func New(r io.Reader, opts Opts) (*Chunker, error) {
+	if opts.MinSize <= 0 || opts.MinSize > opts.AvgSize || opts.AvgSize > opts.MaxSize {
+		return nil, errors.New("chunker: sizes must satisfy 0 < min <= avg <= max")
+	}
+
+	avgBits := bits.Len(uint(opts.AvgSize)) - 1
+	return &Chunker{
+		Opts:  opts,
+		r:     r,
+		maskS: mask(avgBits + 1),
+		maskL: mask(max(avgBits-1, 1)),
+		buf:   make([]byte, 2*opts.MaxSize),
+	}, nil
+}
+
+// mask returns a mask with n bits set in the high end, where the gear hash mixes best.
+func mask(n int) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+// Next returns the next chunk, or io.EOF once the stream is exhausted.
+// The chunk is only valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+	if len(c.data) < c.MaxSize && !c.eof {
+		if err := c.fill(); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.data) == 0 {
+		return nil, io.EOF
+	}
+
+	n := c.cut(c.data)
+	chunk := c.data[:n]
+	c.data = c.data[n:]
+	return chunk, nil
+}
+
+// fill moves the unconsumed data to the front of buf and reads until it's full or the stream ends.
+func (c *Chunker) fill() error {
+	n := copy(c.buf, c.data)
+	for n < len(c.buf) {
+		m, err := c.r.Read(c.buf[n:])
+		n += m
+		if err == io.EOF {
+			c.eof = true
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	c.data = c.buf[:n]
+	return nil
+}
+
+// cut returns the length of the chunk at the start of data.
+func (c *Chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.MinSize {
+		return n
+	}
+	n = min(n, c.MaxSize)
+	normal := min(n, c.AvgSize)
+
+	var fp uint64
+	i := c.MinSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// gear maps every byte to a random value. It must never change,
+// or chunks would stop matching the ones already stored.
+var gear [256]uint64
+
+func init() {
+	// splitmix64 from a fixed seed
+	x := uint64(0x6d6f73616963) // "mosaic"
+	for i := range gear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
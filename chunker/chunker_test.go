@@ -0,0 +1,77 @@
+package chunker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func chunks(t *testing.T, data []byte, opts Opts) [][]byte {
+	c, err := New(bytes.NewReader(data), opts)
+	assert.Nil(t, err)
+
+	var all [][]byte
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return all
+		}
+		assert.Nil(t, err)
+		all = append(all, bytes.Clone(chunk))
+	}
+}
+
+func TestChunkerSizes(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	opts := NewOpts(8 * 1024)
+
+	all := chunks(t, data, opts)
+	assert.Equal(t, data, bytes.Join(all, nil))
+	for _, chunk := range all[:len(all)-1] {
+		assert.GreaterOrEqual(t, len(chunk), opts.MinSize)
+		assert.LessOrEqual(t, len(chunk), opts.MaxSize)
+	}
+	// Close to the average on random data
+	avg := len(data) / len(all)
+	assert.InDelta(t, opts.AvgSize, avg, float64(opts.AvgSize)/2)
+}
+
+func TestChunkerInsertion(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(2)).Read(data)
+	opts := NewOpts(8 * 1024)
+
+	// Insert a few bytes in the middle
+	edited := append(bytes.Clone(data[:len(data)/2]), []byte("inserted")...)
+	edited = append(edited, data[len(data)/2:]...)
+
+	before := make(map[[32]byte]bool)
+	for _, chunk := range chunks(t, data, opts) {
+		before[sha256.Sum256(chunk)] = true
+	}
+	after := chunks(t, edited, opts)
+	changed := 0
+	for _, chunk := range after {
+		if !before[sha256.Sum256(chunk)] {
+			changed++
+		}
+	}
+	// Only the chunks around the edit differ
+	assert.LessOrEqual(t, changed, 2)
+	assert.Greater(t, len(after), 50)
+}
+
+func TestChunkerSmallInput(t *testing.T) {
+	all := chunks(t, []byte("tiny"), NewOpts(1024))
+	assert.Equal(t, [][]byte{[]byte("tiny")}, all)
+
+	assert.Empty(t, chunks(t, nil, NewOpts(1024)))
+
+	_, err := New(nil, Opts{MinSize: 10, AvgSize: 5, MaxSize: 20})
+	assert.NotNil(t, err)
+}
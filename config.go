@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -8,10 +9,14 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/20af02/MosaicFS/crypto"
+	"github.com/20af02/MosaicFS/erasure"
 	"github.com/20af02/MosaicFS/p2p"
+	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 )
 
@@ -20,7 +25,50 @@ type NodeConfig struct {
 	BootstrapNodes []string `json:"bootstrap_nodes"`
 	ServerID       string   `json:"server_id"`
 	EncKey         []byte
-	DBFile         string
+	// KeyVersion counts the rotations of EncKey, see FileServer.RotateKey.
+	KeyVersion int
+	// KeySource supplies the key EncKey is wrapped with in the .env file, see ParseKeySource.
+	// EncKey is stored in plaintext when empty.
+	KeySource string `json:"key_source"`
+	// WrappedKey is EncKey wrapped with the key from KeySource, and KeySalt the salt that
+	// key is derived from a passphrase with.
+	WrappedKey []byte
+	KeySalt    []byte
+	// kek is the key from KeySource, once unlocked.
+	kek    []byte
+	DBFile string
+	// NodeKey is the identity key used to authenticate this node to its peers.
+	NodeKey ed25519.PrivateKey
+	// TrustedKeys are the hex encoded identity keys of the nodes allowed to connect.
+	// Any authenticated node may connect when empty.
+	TrustedKeys []string `json:"trusted_keys"`
+	// MaxPeers caps the peers dialed after learning about them from other nodes.
+	MaxPeers int `json:"max_peers"`
+	// Replicas is the number of copies of each stored file, this node's included.
+	Replicas int `json:"replicas"`
+	// Placement names the policy picking the peers that hold replicas: random, hash or least-used.
+	Placement string `json:"placement"`
+	// Weight is the node's share of the hash ring, e.g. relative to its capacity.
+	Weight int `json:"weight"`
+	// ErasureCoding is the k+m scheme files are stored with, e.g. "4+2". Files are replicated when empty.
+	ErasureCoding string `json:"erasure_coding"`
+	// RepairInterval is how often missing copies are restored, e.g. "5m". Defaults to a minute, "off" disables repair.
+	RepairInterval string `json:"repair_interval"`
+	// RepairBandwidth caps the bytes per second sent to restore copies. 0 means no limit.
+	RepairBandwidth int64 `json:"repair_bandwidth"`
+	// Capacity is the storage in bytes this node offers to its peers. 0 means no limit.
+	Capacity int64 `json:"capacity"`
+	// RebalanceDelay is how long after a node joined or left replicas start moving, e.g. "1m".
+	// Defaults to 30s, "off" disables rebalancing.
+	RebalanceDelay string `json:"rebalance_delay"`
+	// RebalanceBandwidth caps the bytes per second sent to move replicas. 0 means no limit.
+	RebalanceBandwidth int64 `json:"rebalance_bandwidth"`
+	// Readers are the IDs of the nodes allowed to list and locate this node's files, "*" for any node.
+	Readers []string `json:"readers"`
+	// WriteConsistency is how many copies must be on disk for a store to succeed: one (default), quorum or all.
+	WriteConsistency string `json:"write_consistency"`
+	// ReadConsistency is how many copies of a file must agree for a get to succeed: one (default), quorum or all.
+	ReadConsistency string `json:"read_consistency"`
 }
 
 const envDir = "./.env" // Directory to store .env files
@@ -32,7 +80,12 @@ func loadConfig(envDir, listenAddr string) (*NodeConfig, error) {
 	// Clear MOSAICFS_DB_FILE environment variable
 	os.Unsetenv("MOSAICFS_DB_FILE")
 	os.Unsetenv("MOSAICFS_ENC_KEY")
+	os.Unsetenv("MOSAICFS_KEY_VERSION")
+	os.Unsetenv("MOSAICFS_ENC_KEY_WRAPPED")
+	os.Unsetenv("MOSAICFS_KEY_SALT")
 	os.Unsetenv("MOSAICFS_SERVER_ID")
+	os.Unsetenv("MOSAICFS_NODE_KEY")
+	os.Unsetenv("MOSAICFS_TRUSTED_KEYS")
 
 	err := godotenv.Load(envFile)
 	if err != nil {
@@ -44,8 +97,10 @@ func loadConfig(envDir, listenAddr string) (*NodeConfig, error) {
 		return nil, errors.New("MOSAICFS_SERVER_ID environment variable not set")
 	}
 
+	// The key is stored either in plaintext or wrapped, see unlockKey
 	encKeyStr := os.Getenv("MOSAICFS_ENC_KEY")
-	if encKeyStr == "" {
+	wrappedKeyStr := os.Getenv("MOSAICFS_ENC_KEY_WRAPPED")
+	if encKeyStr == "" && wrappedKeyStr == "" {
 		return nil, errors.New("MOSAICFS_ENC_KEY environment variable not set")
 	}
 
@@ -53,6 +108,22 @@ func loadConfig(envDir, listenAddr string) (*NodeConfig, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error decoding encryption key: %w", err)
 	}
+	wrappedKey, err := hex.DecodeString(wrappedKeyStr)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding wrapped encryption key: %w", err)
+	}
+	keySalt, err := hex.DecodeString(os.Getenv("MOSAICFS_KEY_SALT"))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding key salt: %w", err)
+	}
+
+	// Keys that were never rotated have no version
+	var keyVersion int
+	if v := os.Getenv("MOSAICFS_KEY_VERSION"); v != "" {
+		if keyVersion, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("error decoding key version: %w", err)
+		}
+	}
 
 	dbFile := os.Getenv("MOSAICFS_DB_FILE")
 	if dbFile == "" {
@@ -60,22 +131,104 @@ func loadConfig(envDir, listenAddr string) (*NodeConfig, error) {
 	}
 	fmt.Printf("dbFile: %s\n", dbFile)
 
+	// Configs created before peers were authenticated have no node key yet
+	nodeKey, err := parseNodeKey(os.Getenv("MOSAICFS_NODE_KEY"))
+	if err != nil {
+		return nil, err
+	}
+
+	var trustedKeys []string
+	if trusted := os.Getenv("MOSAICFS_TRUSTED_KEYS"); trusted != "" {
+		trustedKeys = strings.Split(trusted, ",")
+	}
+
 	return &NodeConfig{
 		ListenAddr:     listenAddr,
 		BootstrapNodes: []string{}, // Load this from the main config file
 		ServerID:       serverID,
 		EncKey:         encKey,
+		KeyVersion:     keyVersion,
+		WrappedKey:     wrappedKey,
+		KeySalt:        keySalt,
 		DBFile:         dbFile,
+		NodeKey:        nodeKey,
+		TrustedKeys:    trustedKeys,
 	}, nil
 }
 
 // saveConfig saves the node configuration to a .env file in the specified directory.
+// The file is replaced at once, a crash leaves either the old or the new configuration.
 func (c *NodeConfig) saveConfig(envDir string) error {
 	envFile := filepath.Join(envDir, fmt.Sprintf("server_%s.env", c.ListenAddr[1:]))
 
-	content := fmt.Sprintf("MOSAICFS_SERVER_ID=%s\nMOSAICFS_ENC_KEY=%s\nMOSAICFS_DB_FILE=%s", c.ServerID, hex.EncodeToString(c.EncKey), c.DBFile)
-	return os.WriteFile(envFile, []byte(content), 0600)
+	content := fmt.Sprintf("MOSAICFS_SERVER_ID=%s\nMOSAICFS_DB_FILE=%s", c.ServerID, c.DBFile)
+	if c.kek != nil {
+		// Only the key source can unlock it
+		wrapped, err := crypto.WrapKey(c.kek, c.EncKey)
+		if err != nil {
+			return err
+		}
+		content += fmt.Sprintf("\nMOSAICFS_ENC_KEY_WRAPPED=%s", hex.EncodeToString(wrapped))
+		if len(c.KeySalt) > 0 {
+			content += fmt.Sprintf("\nMOSAICFS_KEY_SALT=%s", hex.EncodeToString(c.KeySalt))
+		}
+	} else {
+		content += fmt.Sprintf("\nMOSAICFS_ENC_KEY=%s", hex.EncodeToString(c.EncKey))
+	}
+	content += fmt.Sprintf("\nMOSAICFS_NODE_KEY=%s", hex.EncodeToString(c.NodeKey))
+	if c.KeyVersion > 0 {
+		content += fmt.Sprintf("\nMOSAICFS_KEY_VERSION=%d", c.KeyVersion)
+	}
+	if len(c.TrustedKeys) > 0 {
+		content += fmt.Sprintf("\nMOSAICFS_TRUSTED_KEYS=%s", strings.Join(c.TrustedKeys, ","))
+	}
+
+	tmp, err := os.CreateTemp(envDir, filepath.Base(envFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), envFile)
+}
 
+// unlockKey gets the key from the key source, when there is one, and unwraps the master
+// key with it. It reports whether the .env file has to be saved again: a master key
+// stored in plaintext is wrapped, and removed from it.
+func (c *NodeConfig) unlockKey() (bool, error) {
+	if c.KeySource == "" {
+		if len(c.EncKey) == 0 && len(c.WrappedKey) > 0 {
+			return false, errors.New("the encryption key is wrapped, set key_source to unlock it")
+		}
+		return false, nil
+	}
+	source, err := ParseKeySource(c.KeySource)
+	if err != nil {
+		return false, err
+	}
+	kek, err := source.UnlockKey(c)
+	if err != nil {
+		return false, fmt.Errorf("unlock the encryption key: %w", err)
+	}
+	c.kek = kek
+	if len(c.WrappedKey) == 0 {
+		// A new key, or one stored in plaintext until now
+		return true, nil
+	}
+	if c.EncKey, err = crypto.UnwrapKey(kek, c.WrappedKey); err != nil {
+		return false, fmt.Errorf("unlock the encryption key, wrong key or passphrase: %w", err)
+	}
+	return false, nil
 }
 
 // EnsureEnvDirExists creates the .env directory if it doesn't exist.
@@ -107,11 +260,98 @@ func fileExists(filename string) bool {
 	return !os.IsNotExist(err) && !info.IsDir()
 }
 
+// parseNodeKey decodes a hex encoded node key, nil when empty.
+func parseNodeKey(s string) (ed25519.PrivateKey, error) {
+	if s == "" {
+		return nil, nil
+	}
+	nodeKey, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding node key: %w", err)
+	}
+	if len(nodeKey) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid node key size: %d", len(nodeKey))
+	}
+	return nodeKey, nil
+}
+
+// loadNodeKey returns the node key of the .env file in envDir, even when the rest of the
+// configuration is missing, nil when there is none.
+func loadNodeKey(envDir, listenAddr string) (ed25519.PrivateKey, error) {
+	env, err := godotenv.Read(filepath.Join(envDir, fmt.Sprintf("server_%s.env", listenAddr[1:])))
+	if err != nil {
+		return nil, nil
+	}
+	return parseNodeKey(env["MOSAICFS_NODE_KEY"])
+}
+
+// nodeID returns the ID of the node with the identity key, peers only accept it by that ID
+// or a legacy one.
+func nodeID(key ed25519.PrivateKey) string {
+	return p2p.NodeID(key.Public().(ed25519.PublicKey))
+}
+
+// isLegacyID reports whether id is one of the random IDs nodes were given before IDs were
+// derived from identity keys. Nodes keep theirs, as their files are stored under it.
+func isLegacyID(id string) bool {
+	_, err := uuid.Parse(id)
+	return err == nil && len(id) == 36
+}
+
+// checkServerID makes sure peers accept a node going by serverID with the identity key:
+// it's the ID of the key, or a legacy ID peers bind to the key when it first connects.
+func checkServerID(listenAddr, serverID string, key ed25519.PrivateKey) error {
+	id := nodeID(key)
+	if serverID == id {
+		return nil
+	}
+	if !isLegacyID(serverID) {
+		return fmt.Errorf("server ID (%s) isn't the ID of the node key (%s), peers would reject it", serverID, id)
+	}
+	log.Printf("[%s] Keeping legacy server ID (%s), bound to the node key by peers on first connect", listenAddr, serverID)
+	return nil
+}
+
 // loadOrCreateConfig handles loading or initializing the NodeConfig
 func loadOrCreateConfig(envDir string, baseConfig *NodeConfig) (*NodeConfig, error) {
 	loadedConfig, err := loadConfig(envDir, baseConfig.ListenAddr)
 	if err == nil {
 		loadedConfig.BootstrapNodes = baseConfig.BootstrapNodes
+		if len(baseConfig.TrustedKeys) > 0 {
+			loadedConfig.TrustedKeys = baseConfig.TrustedKeys
+		}
+		loadedConfig.MaxPeers = baseConfig.MaxPeers
+		loadedConfig.Replicas = baseConfig.Replicas
+		loadedConfig.Placement = baseConfig.Placement
+		loadedConfig.Weight = baseConfig.Weight
+		loadedConfig.ErasureCoding = baseConfig.ErasureCoding
+		loadedConfig.RepairInterval = baseConfig.RepairInterval
+		loadedConfig.RepairBandwidth = baseConfig.RepairBandwidth
+		loadedConfig.Capacity = baseConfig.Capacity
+		loadedConfig.RebalanceDelay = baseConfig.RebalanceDelay
+		loadedConfig.RebalanceBandwidth = baseConfig.RebalanceBandwidth
+		loadedConfig.WriteConsistency = baseConfig.WriteConsistency
+		loadedConfig.ReadConsistency = baseConfig.ReadConsistency
+		if len(baseConfig.Readers) > 0 {
+			loadedConfig.Readers = baseConfig.Readers
+		}
+		loadedConfig.KeySource = baseConfig.KeySource
+		save, err := loadedConfig.unlockKey()
+		if err != nil {
+			return nil, err
+		}
+		if len(loadedConfig.NodeKey) == 0 {
+			loadedConfig.NodeKey = crypto.NewNodeKey()
+			save = true
+		}
+		if err := checkServerID(loadedConfig.ListenAddr, loadedConfig.ServerID, loadedConfig.NodeKey); err != nil {
+			return nil, err
+		}
+		if save {
+			if err := loadedConfig.saveConfig(envDir); err != nil {
+				return nil, fmt.Errorf("save config: %w", err)
+			}
+		}
 		// Handle config creation (error or not found)
 		if baseConfig.ServerID == "" {
 			if len(loadedConfig.ListenAddr) == 0 {
@@ -134,25 +374,30 @@ func loadOrCreateConfig(envDir string, baseConfig *NodeConfig) (*NodeConfig, err
 		return loadedConfig, nil // Successfully loaded from file
 	}
 
-	// Handle config creation (error or not found)
-	if baseConfig.ServerID == "" {
-
-		if len(loadedConfig.ListenAddr) == 0 {
-			baseConfig.ServerID = crypto.GenerateID()
-		} else {
-			baseConfig.ServerID = loadedConfig.ServerID
+	// Handle config creation (error or not found), there is no loaded config to take from.
+	// A .env file holding only the node key keeps the node's ID, e.g. to recover its master key
+	if len(baseConfig.NodeKey) == 0 {
+		if baseConfig.NodeKey, err = loadNodeKey(envDir, baseConfig.ListenAddr); err != nil {
+			return nil, err
 		}
 	}
+	if len(baseConfig.NodeKey) == 0 {
+		baseConfig.NodeKey = crypto.NewNodeKey()
+	}
+	if baseConfig.ServerID == "" {
+		baseConfig.ServerID = nodeID(baseConfig.NodeKey)
+	} else if err := checkServerID(baseConfig.ListenAddr, baseConfig.ServerID, baseConfig.NodeKey); err != nil {
+		return nil, err
+	}
 	if len(baseConfig.EncKey) == 0 {
-		if len(loadedConfig.EncKey) == 0 {
-			baseConfig.EncKey = crypto.NewEncryptionKey()
-		} else {
-			baseConfig.EncKey = loadedConfig.EncKey
-		}
+		baseConfig.EncKey = crypto.NewEncryptionKey()
 	}
 	if len(baseConfig.DBFile) == 0 || !fileExists(baseConfig.DBFile) {
 		baseConfig.DBFile = filepath.Join(envDir, "db", fmt.Sprintf("server_%s.db", baseConfig.ListenAddr[1:]))
 	}
+	if _, err := baseConfig.unlockKey(); err != nil {
+		return nil, err
+	}
 
 	if err := baseConfig.saveConfig(envDir); err != nil {
 		return nil, fmt.Errorf("save config: %w", err)
@@ -163,51 +408,157 @@ func loadOrCreateConfig(envDir string, baseConfig *NodeConfig) (*NodeConfig, err
 	return baseConfig, nil
 }
 
-func makeServer(initialConfig *NodeConfig) *FileServer {
+func makeServer(initialConfig *NodeConfig) (*FileServer, error) {
 	if err := EnsureEnvDirExists(envDir); err != nil {
-		log.Fatalf("Error creating .env directory: %s", err)
+		return nil, fmt.Errorf("error creating .env directory: %w", err)
 	}
 
 	// Load or create node config
 
 	nodeConfig, err := loadOrCreateConfig(envDir, initialConfig)
 	if err != nil {
-		return nil
+		return nil, fmt.Errorf("[%s] failed to load config: %w", initialConfig.ListenAddr, err)
 	}
 	log.Printf("[%s] Config loaded/created", nodeConfig.ListenAddr)
 
+	trustedKeys, err := parseTrustedKeys(nodeConfig.TrustedKeys)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] invalid trusted keys: %w", nodeConfig.ListenAddr, err)
+	}
+	placement, err := NewPlacementPolicy(nodeConfig.Placement)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] invalid placement: %w", nodeConfig.ListenAddr, err)
+	}
+	var ec *erasure.Scheme
+	if nodeConfig.ErasureCoding != "" {
+		scheme, err := erasure.Parse(nodeConfig.ErasureCoding)
+		if err != nil {
+			return nil, fmt.Errorf("[%s] invalid erasure coding: %w", nodeConfig.ListenAddr, err)
+		}
+		ec = &scheme
+	}
+	var repairInterval time.Duration
+	switch nodeConfig.RepairInterval {
+	case "":
+	case "off":
+		repairInterval = -1
+	default:
+		repairInterval, err = time.ParseDuration(nodeConfig.RepairInterval)
+		if err != nil || repairInterval <= 0 {
+			return nil, fmt.Errorf("[%s] invalid repair interval: %q", nodeConfig.ListenAddr, nodeConfig.RepairInterval)
+		}
+	}
+
+	var rebalanceDelay time.Duration
+	switch nodeConfig.RebalanceDelay {
+	case "":
+	case "off":
+		rebalanceDelay = -1
+	default:
+		rebalanceDelay, err = time.ParseDuration(nodeConfig.RebalanceDelay)
+		if err != nil || rebalanceDelay <= 0 {
+			return nil, fmt.Errorf("[%s] invalid rebalance delay: %q", nodeConfig.ListenAddr, nodeConfig.RebalanceDelay)
+		}
+	}
+	var writeConsistency, readConsistency Consistency
+	if nodeConfig.WriteConsistency != "" {
+		if writeConsistency, err = ParseConsistency(nodeConfig.WriteConsistency); err != nil {
+			return nil, fmt.Errorf("[%s] invalid write consistency: %w", nodeConfig.ListenAddr, err)
+		}
+	}
+	if nodeConfig.ReadConsistency != "" {
+		if readConsistency, err = ParseConsistency(nodeConfig.ReadConsistency); err != nil {
+			return nil, fmt.Errorf("[%s] invalid read consistency: %w", nodeConfig.ListenAddr, err)
+		}
+	}
+
+	handshake := p2p.NewSecureHandshake(nodeConfig.NodeKey, trustedKeys)
+	log.Printf("[%s] Node identity key: %x", nodeConfig.ListenAddr, []byte(handshake.PublicKey()))
+
 	// 3. Create TCP Transport
 	tcpTransport := p2p.NewTCPTransport(p2p.TCPTransportOpts{
 		ListenAddr:    nodeConfig.ListenAddr,
-		HandshakeFunc: p2p.NOPHandshakeFunc,
+		NodeID:        nodeConfig.ServerID,
+		HandshakeFunc: handshake.Handshake,
 		Decoder:       p2p.DefaultDecoder{},
 		//   OnPeer: 	OnPeer,
 	})
 
 	// 4. Create FileServer
 	fileServer := NewFileServer(FileServerOpts{
-		ID:                nodeConfig.ServerID,
-		EncKey:            nodeConfig.EncKey,
-		StorageRoot:       nodeConfig.ListenAddr[1:] + "_network",
-		PathTransformFunc: CASPathTransformFunc,
-		Transport:         tcpTransport,
-		BootStrapNodes:    nodeConfig.BootstrapNodes,
-		DBFile:            nodeConfig.DBFile,
+		ID:                 nodeConfig.ServerID,
+		NodeKey:            nodeConfig.NodeKey,
+		EncKey:             nodeConfig.EncKey,
+		KeyVersion:         nodeConfig.KeyVersion,
+		StorageRoot:        nodeConfig.ListenAddr[1:] + "_network",
+		PathTransformFunc:  CASPathTransformFunc,
+		Transport:          tcpTransport,
+		BootStrapNodes:     nodeConfig.BootstrapNodes,
+		DBFile:             nodeConfig.DBFile,
+		MaxPeers:           nodeConfig.MaxPeers,
+		ReplicationFactor:  nodeConfig.Replicas,
+		Placement:          placement,
+		Weight:             nodeConfig.Weight,
+		ErasureCoding:      ec,
+		RepairInterval:     repairInterval,
+		RepairBandwidth:    nodeConfig.RepairBandwidth,
+		Capacity:           nodeConfig.Capacity,
+		RebalanceDelay:     rebalanceDelay,
+		RebalanceBandwidth: nodeConfig.RebalanceBandwidth,
+		MetadataReaders:    nodeConfig.Readers,
+		WriteConsistency:   writeConsistency,
+		ReadConsistency:    readConsistency,
 	})
 
 	tcpTransport.OnPeer = fileServer.OnPeer
+	tcpTransport.OnPeerDisconnect = fileServer.OnPeerDisconnect
+	tcpTransport.VerifyPeerID = fileServer.verifyPeerID
+	fileServer.SaveKey = func(key []byte, version int) error {
+		nodeConfig.EncKey, nodeConfig.KeyVersion = key, version
+		return nodeConfig.saveConfig(envDir)
+	}
+
+	return fileServer, nil
+}
 
-	return fileServer
+// parseTrustedKeys decodes the hex encoded identity keys of trusted nodes.
+func parseTrustedKeys(keys []string) ([]ed25519.PublicKey, error) {
+	var trusted []ed25519.PublicKey
+	for _, k := range keys {
+		k = strings.TrimSpace(k)
+		if len(k) == 0 {
+			continue
+		}
+		key, err := hex.DecodeString(k)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid node key (%s)", k)
+		}
+		trusted = append(trusted, ed25519.PublicKey(key))
+	}
+	return trusted, nil
 }
 
 // createAndStartServers creates FileServer instances based on the configurations and starts them concurrently.
+// Servers failing to be created are skipped, it only fails when none could be.
 func createAndStartServers(configs []NodeConfig) ([]*FileServer, error) {
-	var servers []*FileServer
+	var (
+		servers []*FileServer
+		errs    []error
+	)
 
 	for _, config := range configs {
-		servers = append(servers, makeServer(&config))
+		server, err := makeServer(&config)
+		if err != nil {
+			log.Printf("Failed to create server: %s", err)
+			errs = append(errs, err)
+			continue
+		}
+		servers = append(servers, server)
 	}
 	log.Printf("Created %d servers\n", len(servers))
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no server could be created: %w", errors.Join(errs...))
+	}
 
 	for _, server := range servers {
 		go func(s *FileServer) {
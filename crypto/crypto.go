@@ -1,11 +1,17 @@
 package crypto
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ed25519"
 	"crypto/md5"
 	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 
 	"github.com/google/uuid"
@@ -31,6 +37,12 @@ func NewEncryptionKey() []byte {
 	return keyBuf
 }
 
+// NewNodeKey generates the long-term ed25519 identity key of a node.
+func NewNodeKey() ed25519.PrivateKey {
+	_, privKey, _ := ed25519.GenerateKey(rand.Reader)
+	return privKey
+}
+
 func copyStream(stream cipher.Stream, blockSize int, src io.Reader, dst io.Writer) (int, error) {
 	var (
 		buf = make([]byte, 32*1024)
@@ -58,36 +70,207 @@ func copyStream(stream cipher.Stream, blockSize int, src io.Reader, dst io.Write
 	return nw, nil
 }
 
-func CopyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
-	block, err := aes.NewCipher(key)
+// Encrypted streams start with a header: the magic bytes, the format version, the
+// plaintext size of a segment and the nonce prefix. Then come the segments, each
+// sealed with AES-GCM under the nonce prefix, its index and whether it's the last
+// one, with the header as additional data. Reordering, dropping or cutting segments
+// off the end fails to authenticate. Streams from before versioning have no magic
+// bytes: a random IV followed by the AES-CTR ciphertext, with no MAC. Only
+// CopyDecryptLegacy reads them.
+const (
+	magic = "MFS\xae"
+	// VersionGCM is the format version of streams sealed in AES-GCM segments.
+	VersionGCM = 1
+
+	segmentSize = 64 * 1024
+	prefixSize  = 7
+	headerSize  = len(magic) + 1 + 4 + prefixSize
+)
+
+// ErrAuth is returned when an encrypted stream was tampered with, cut short, or
+// encrypted with another key.
+var ErrAuth = errors.New("message authentication failed")
+
+// CopyEncrypt encrypts src to dst in the current format and returns the number of bytes written to dst.
+func CopyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+	aead, err := newGCM(key)
 	if err != nil {
 		return 0, err
 	}
 
-	// Read IV from the given src (block.BlockSize() bytes)
-	println(block.BlockSize())
-	iv := make([]byte, block.BlockSize())
-	if _, err := io.ReadFull(src, iv); err != nil {
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	header[len(magic)] = VersionGCM
+	binary.BigEndian.PutUint32(header[len(magic)+1:], segmentSize)
+	if _, err := io.ReadFull(rand.Reader, header[headerSize-prefixSize:]); err != nil {
 		return 0, err
 	}
+	nw, err := dst.Write(header)
+	if err != nil {
+		return nw, err
+	}
 
-	stream := cipher.NewCTR(block, iv)
-	return copyStream(stream, block.BlockSize(), src, dst)
+	// Read a byte ahead, so the last segment is known when sealing it
+	r := bufio.NewReaderSize(src, segmentSize+1)
+	buf := make([]byte, segmentSize, segmentSize+aead.Overhead())
+	for i := uint32(0); ; i++ {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nw, err
+		}
+		last := err != nil
+		if !last {
+			if _, err := r.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return nw, err
+			}
+		}
+		sealed := aead.Seal(buf[:0], segmentNonce(header, i, last), buf[:n], header)
+		nn, err := dst.Write(sealed)
+		nw += nn
+		if err != nil {
+			return nw, err
+		}
+		if last {
+			return nw, nil
+		}
+		if i == ^uint32(0) {
+			return nw, errors.New("stream too long to encrypt")
+		}
+	}
 }
 
-func CopyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+// CopyDecrypt decrypts src to dst and returns the number of bytes read from src.
+// Segments are only written once authenticated, but a stream failing midway leaves
+// the segments before the failure in dst: the error is ErrAuth then.
+func CopyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+	return copyDecrypt(key, src, dst, false)
+}
+
+// CopyDecryptLegacy is CopyDecrypt also accepting streams from before versioning,
+// which nothing authenticates. Only use it for objects known to be that old: anyone
+// able to hand us a stream can strip its header to get it decrypted unchecked.
+func CopyDecryptLegacy(key []byte, src io.Reader, dst io.Writer) (int, error) {
+	return copyDecrypt(key, src, dst, true)
+}
+
+func copyDecrypt(key []byte, src io.Reader, dst io.Writer, legacy bool) (int, error) {
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(src, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return n, err
+	}
+	if !bytes.HasPrefix(header[:n], []byte(magic)) {
+		if !legacy {
+			return n, fmt.Errorf("%w: no format header", ErrAuth)
+		}
+		return copyDecryptCTR(key, io.MultiReader(bytes.NewReader(header[:n]), src), dst)
+	}
+	if err != nil {
+		return n, fmt.Errorf("%w: truncated header", ErrAuth)
+	}
+	if version := header[len(magic)]; version != VersionGCM {
+		return n, fmt.Errorf("unsupported encryption format version %d", version)
+	}
+	size := binary.BigEndian.Uint32(header[len(magic)+1:])
+	if size == 0 || size > 16*segmentSize {
+		return n, fmt.Errorf("%w: invalid segment size %d", ErrAuth, size)
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return n, err
+	}
+	nr := n
+	r := bufio.NewReaderSize(src, int(size)+aead.Overhead()+1)
+	buf := make([]byte, int(size)+aead.Overhead())
+	for i := uint32(0); ; i++ {
+		n, err := io.ReadFull(r, buf)
+		nr += n
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nr, err
+		}
+		last := err != nil
+		if !last {
+			if _, err := r.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return nr, err
+			}
+		}
+		plain, err := aead.Open(buf[:0], segmentNonce(header, i, last), buf[:n], header)
+		if err != nil {
+			// A stream cut at a segment boundary fails here too, its last segment isn't sealed as such
+			return nr, fmt.Errorf("%w: segment %d", ErrAuth, i)
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return nr, err
+		}
+		if last {
+			return nr, nil
+		}
+	}
+}
+
+// WrapKey encrypts key with the key encryption key kek, e.g. a data key with the node's master key.
+func WrapKey(kek, key []byte) ([]byte, error) {
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, key, nil), nil
+}
+
+// UnwrapKey decrypts a key wrapped with kek. It fails with ErrAuth when kek isn't the key it was wrapped with.
+func UnwrapKey(kek, wrapped []byte) ([]byte, error) {
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, fmt.Errorf("%w: wrapped key too short", ErrAuth)
+	}
+	key, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrAuth
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	return cipher.NewGCM(block)
+}
 
-	iv := make([]byte, block.BlockSize()) // 16 bytes
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+// segmentNonce is the nonce of segment i of the stream with the given header.
+func segmentNonce(header []byte, i uint32, last bool) []byte {
+	nonce := make([]byte, prefixSize+4+1)
+	copy(nonce, header[headerSize-prefixSize:])
+	binary.BigEndian.PutUint32(nonce[prefixSize:], i)
+	if last {
+		nonce[prefixSize+4] = 1
+	}
+	return nonce
+}
+
+// copyDecryptCTR decrypts a stream from before versioning. Nothing authenticates it.
+func copyDecryptCTR(key []byte, src io.Reader, dst io.Writer) (int, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
 		return 0, err
 	}
 
-	// Prepend the IV to the encrypted file
-	if _, err := dst.Write(iv); err != nil {
+	// Read IV from the given src (block.BlockSize() bytes)
+	iv := make([]byte, block.BlockSize())
+	if _, err := io.ReadFull(src, iv); err != nil {
 		return 0, err
 	}
 
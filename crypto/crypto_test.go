@@ -2,8 +2,16 @@ package crypto
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"testing"
+
+	"golang.org/x/crypto/scrypt"
 )
 
 func TestCopyEncryptDecrypt(t *testing.T) {
@@ -20,13 +28,14 @@ func TestCopyEncryptDecrypt(t *testing.T) {
 	fmt.Println(len(dst.String()))
 	out := new(bytes.Buffer)
 
+	encrypted := dst.Len()
 	nw, err := CopyDecrypt(key, dst, out)
 	if err != nil {
 		t.Errorf("Failed to copyDecrypt: %v", err)
 	}
 
-	if nw != 16+len(payload) {
-		t.Errorf("Decryption Failed: Expected: %d Actual: %d", len(payload), nw)
+	if nw != encrypted {
+		t.Errorf("Decryption Failed: Expected: %d Actual: %d", encrypted, nw)
 	}
 
 	if !bytes.Equal(out.Bytes(), []byte(payload)) {
@@ -34,3 +43,180 @@ func TestCopyEncryptDecrypt(t *testing.T) {
 	}
 
 }
+
+func TestCopyDecryptTampered(t *testing.T) {
+	key := NewEncryptionKey()
+	payload := make([]byte, 3*segmentSize)
+	rand.Read(payload)
+	sealed := new(bytes.Buffer)
+	if _, err := CopyEncrypt(key, bytes.NewReader(payload), sealed); err != nil {
+		t.Fatalf("Failed to copyEncrypt: %v", err)
+	}
+	enc := sealed.Bytes()
+	segment := segmentSize + 16
+
+	flipped := bytes.Clone(enc)
+	flipped[headerSize+segment+10] ^= 1
+	version := bytes.Clone(enc)
+	version[len(magic)+1] ^= 1
+	// Without the magic bytes, the stream would be taken as one from before versioning
+	unmarked := bytes.Clone(enc)
+	unmarked[0] ^= 1
+	tests := map[string][]byte{
+		"flipped bit":       flipped,
+		"altered header":    version,
+		"altered magic":     unmarked,
+		"stripped header":   enc[headerSize:],
+		"truncated":         enc[:len(enc)-1],
+		"cut at a segment":  enc[:headerSize+2*segment],
+		"dropped segment":   append(bytes.Clone(enc[:headerSize+segment]), enc[headerSize+2*segment:]...),
+		"header only":       enc[:headerSize],
+		"truncated header":  enc[:headerSize-1],
+		"another key":       enc,
+		"reordered segment": append(append(bytes.Clone(enc[:headerSize]), enc[headerSize+segment:headerSize+2*segment]...), enc[headerSize+segment:]...),
+	}
+	for name, data := range tests {
+		k := key
+		if name == "another key" {
+			k = NewEncryptionKey()
+		}
+		_, err := CopyDecrypt(k, bytes.NewReader(data), io.Discard)
+		if !errors.Is(err, ErrAuth) {
+			t.Errorf("%s: expected an authentication failure, got %v", name, err)
+		}
+	}
+
+	out := new(bytes.Buffer)
+	if _, err := CopyDecrypt(key, bytes.NewReader(enc), out); err != nil {
+		t.Fatalf("Failed to copyDecrypt: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), payload) {
+		t.Errorf("Decryption Failed: payload differs")
+	}
+}
+
+func TestCopyDecryptLegacy(t *testing.T) {
+	payload := "encrypted before versioning"
+	key := NewEncryptionKey()
+	legacy := new(bytes.Buffer)
+	if _, err := copyEncryptCTR(key, bytes.NewReader([]byte(payload)), legacy); err != nil {
+		t.Fatalf("Failed to encrypt: %v", err)
+	}
+
+	// Only read when asked for
+	if _, err := CopyDecrypt(key, bytes.NewReader(legacy.Bytes()), io.Discard); !errors.Is(err, ErrAuth) {
+		t.Errorf("Expected an authentication failure, got %v", err)
+	}
+	out := new(bytes.Buffer)
+	nw, err := CopyDecryptLegacy(key, legacy, out)
+	if err != nil {
+		t.Fatalf("Failed to copyDecrypt: %v", err)
+	}
+	if nw != 16+len(payload) {
+		t.Errorf("Decryption Failed: Expected: %d Actual: %d", 16+len(payload), nw)
+	}
+	if out.String() != payload {
+		t.Errorf("Decryption Failed: Expected: %s Actual: %s", payload, out)
+	}
+
+	// Current streams are still authenticated
+	sealed := new(bytes.Buffer)
+	if _, err := CopyEncrypt(key, bytes.NewReader([]byte(payload)), sealed); err != nil {
+		t.Fatalf("Failed to copyEncrypt: %v", err)
+	}
+	enc := sealed.Bytes()
+	enc[len(enc)-1] ^= 1
+	if _, err := CopyDecryptLegacy(key, bytes.NewReader(enc), io.Discard); !errors.Is(err, ErrAuth) {
+		t.Errorf("Expected an authentication failure, got %v", err)
+	}
+}
+
+func TestWrapKey(t *testing.T) {
+	master := NewEncryptionKey()
+	key := NewEncryptionKey()
+	wrapped, err := WrapKey(master, key)
+	if err != nil {
+		t.Fatalf("Failed to wrap: %v", err)
+	}
+	if bytes.Contains(wrapped, key) {
+		t.Errorf("Expected the wrapped key not to contain the key")
+	}
+
+	unwrapped, err := UnwrapKey(master, wrapped)
+	if err != nil {
+		t.Fatalf("Failed to unwrap: %v", err)
+	}
+	if !bytes.Equal(unwrapped, key) {
+		t.Errorf("Expected the unwrapped key to match")
+	}
+
+	if _, err := UnwrapKey(NewEncryptionKey(), wrapped); !errors.Is(err, ErrAuth) {
+		t.Errorf("Expected unwrapping with another key to fail, got %v", err)
+	}
+	wrapped[len(wrapped)-1] ^= 1
+	if _, err := UnwrapKey(master, wrapped); !errors.Is(err, ErrAuth) {
+		t.Errorf("Expected unwrapping a tampered key to fail, got %v", err)
+	}
+}
+
+func TestScrypt(t *testing.T) {
+	// Test vectors of RFC 7914, checking the scrypt we build on
+	tests := []struct {
+		password, salt string
+		N, r, p        int
+		want           string
+	}{
+		{"", "", 16, 1, 1, "77d6576238657b203b19ca42c18a0497f16b4844e3074ae8dfdffa3fede21442fcd0069ded0948f8326a753a0fc81f17e8d3e0fb2e0d3628cf35e20c38d18906"},
+		{"password", "NaCl", 1024, 8, 16, "fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b3731622eaf30d92e22a3886ff109279d9830dac727afb94a83ee6d8360cbdfa2cc0640"},
+	}
+	for _, tt := range tests {
+		key, err := scrypt.Key([]byte(tt.password), []byte(tt.salt), tt.N, tt.r, tt.p, 64)
+		if err != nil {
+			t.Fatalf("Failed to derive: %v", err)
+		}
+		if got := hex.EncodeToString(key); got != tt.want {
+			t.Errorf("scrypt(%q, %q): got %s, want %s", tt.password, tt.salt, got, tt.want)
+		}
+	}
+
+	if _, err := scrypt.Key(nil, nil, 1000, 8, 1, 32); err == nil {
+		t.Errorf("Expected N not a power of 2 to fail")
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	salt := NewSalt()
+	key, err := DeriveKey([]byte("correct horse"), salt)
+	if err != nil {
+		t.Fatalf("Failed to derive: %v", err)
+	}
+	if len(key) != 32 {
+		t.Errorf("Expected a 32 bytes key, got %d", len(key))
+	}
+	again, _ := DeriveKey([]byte("correct horse"), salt)
+	other, _ := DeriveKey([]byte("correct horse"), NewSalt())
+	if !bytes.Equal(key, again) || bytes.Equal(key, other) {
+		t.Errorf("Expected the key to depend on the passphrase and salt only")
+	}
+}
+
+// copyEncryptCTR encrypts src in the format from before versioning.
+func copyEncryptCTR(key []byte, src io.Reader, dst io.Writer) (int, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return 0, err
+	}
+
+	iv := make([]byte, block.BlockSize()) // 16 bytes
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return 0, err
+	}
+
+	// Prepend the IV to the encrypted file
+	if _, err := dst.Write(iv); err != nil {
+		return 0, err
+	}
+
+	stream := cipher.NewCTR(block, iv)
+	return copyStream(stream, block.BlockSize(), src, dst)
+}
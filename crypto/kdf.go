@@ -0,0 +1,33 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Passphrases are turned into keys with scrypt (RFC 7914), which takes a lot of memory
+// to compute: guessing a passphrase takes as much for every guess.
+
+// Cost of DeriveKey: 128*scryptN*scryptR bytes of memory, 32MB.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// SaltSize is the size of the salts returned by NewSalt.
+const SaltSize = 16
+
+// NewSalt returns a random salt for DeriveKey.
+func NewSalt() []byte {
+	salt := make([]byte, SaltSize)
+	io.ReadFull(rand.Reader, salt)
+	return salt
+}
+
+// DeriveKey derives a 32 bytes key from passphrase and salt.
+func DeriveKey(passphrase, salt []byte) ([]byte, error) {
+	return scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, 32)
+}
@@ -2,8 +2,13 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/20af02/MosaicFS/crypto"
 	"github.com/boltdb/bolt"
@@ -14,6 +19,8 @@ type DBHandler struct {
 	db       *bolt.DB
 	serverID string
 	envDir   string // For storing the .env file
+	// onUpdate is called after this node changed a record of its namespace, to share it with others.
+	onUpdate func(fmd FileMetadata)
 }
 
 type FileMetadata struct {
@@ -21,6 +28,25 @@ type FileMetadata struct {
 	Size             int64
 	Replicas         int
 	ReplicaLocations []string
+	// ErasureCoding is the k+m scheme of erasure coded files, empty for replicated ones.
+	ErasureCoding string
+	// ShardLocations lists, for every shard index, the nodes holding that shard of some chunk.
+	ShardLocations [][]string
+	// DataKey is the key the manifest of the file is encrypted with, wrapped with the
+	// owner's master key. Files stored before data keys are encrypted with the master key.
+	DataKey []byte
+	// KeyVersion is the version of the master key DataKey is wrapped with, see RotateKey.
+	KeyVersion int
+	// Format is the encryption format of the copies of the file, crypto.VersionGCM. Files
+	// stored before formats were versioned have none, their copies may be unauthenticated.
+	Format int
+
+	// Version counts the changes every node made to the record and Modified is when the
+	// last one was made. They decide which record wins when nodes disagree, see MergeFile.
+	Version  VersionVector
+	Modified time.Time
+	// Deleted marks the record of a deleted file, kept so the deletion reaches other nodes.
+	Deleted bool
 }
 
 // NewDBHandler creates a new DBHandler instance.
@@ -54,24 +80,95 @@ func (dh *DBHandler) UpdateFile(fmd FileMetadata) (bool, error) {
 			return err
 		}
 
-		// Store the file metadata
-		buf := new(bytes.Buffer)
-		if err := gob.NewEncoder(buf).Encode(fmd); err != nil {
-			return err
+		// Every change made here is one more in our entry of the version
+		version := VersionVector{}
+		if data := bucket.Get([]byte(hashedKey)); data != nil {
+			old, err := decodeFileMetadata(data)
+			if err != nil {
+				return err
+			}
+			version = old.Version.Merge(nil)
 		}
-		err = bucket.Put([]byte(hashedKey), buf.Bytes())
-		if err != nil {
+		version[dh.serverID]++
+		fmd.Version = version
+		fmd.Modified = time.Now()
+
+		// Store the file metadata
+		if err := putFileMetadata(bucket, fmd); err != nil {
 			return err
 		}
 		added = true
 
 		return nil
 	})
+	if err == nil && dh.onUpdate != nil {
+		dh.onUpdate(fmd)
+	}
 
 	return added, err
 
 }
 
+// MergeFile applies a record of namespace ns received from another node. The record
+// with the newer version wins, and when neither is, the one modified last.
+// It returns the record stored and whether it changed.
+func (dh *DBHandler) MergeFile(ns string, fmd FileMetadata) (FileMetadata, bool, error) {
+	if ns == dh.serverID {
+		return fmd, false, errors.New("records of our namespace are only changed here")
+	}
+	hashedKey := crypto.HashKey(fmd.Key)
+
+	var changed bool
+	err := dh.db.Update(func(tx *bolt.Tx) error {
+		parent, err := tx.CreateBucketIfNotExists(dh.namespacesBucket())
+		if err != nil {
+			return err
+		}
+		bucket, err := parent.CreateBucketIfNotExists([]byte(ns))
+		if err != nil {
+			return err
+		}
+
+		if data := bucket.Get([]byte(hashedKey)); data != nil {
+			old, err := decodeFileMetadata(data)
+			if err != nil {
+				return err
+			}
+			switch fmd.Version.Compare(old.Version) {
+			case Before, Equal:
+				return nil
+			case Concurrent:
+				// Both changed since they last agreed: keep the latest, with both histories
+				version := fmd.Version.Merge(old.Version)
+				if old.Modified.After(fmd.Modified) || (old.Modified.Equal(fmd.Modified) && old.Deleted) {
+					fmd = *old
+				}
+				fmd.Version = version
+			}
+		}
+
+		changed = true
+		return putFileMetadata(bucket, fmd)
+	})
+	return fmd, changed, err
+}
+
+func putFileMetadata(bucket *bolt.Bucket, fmd FileMetadata) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(fmd); err != nil {
+		return err
+	}
+	return bucket.Put([]byte(crypto.HashKey(fmd.Key)), buf.Bytes())
+}
+
+func decodeFileMetadata(data []byte) (*FileMetadata, error) {
+	var fmd FileMetadata
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&fmd); err != nil {
+		return nil, err
+	}
+	return &fmd, nil
+}
+
 func (dh *DBHandler) RemoveLocalMetadata(key string) error {
 	var fmd *FileMetadata
 	fmd, err := dh.GetFileMetadata(key)
@@ -81,13 +178,8 @@ func (dh *DBHandler) RemoveLocalMetadata(key string) error {
 		return err
 	}
 
-	fmd.Replicas--
-	if fmd.Replicas < 0 {
-		return fmt.Errorf("number of replicas is less than 0")
-	} else if fmd.Replicas == 0 {
-		return dh.DeleteFileMetadata(key)
-	}
-	fmd.ReplicaLocations = fmd.ReplicaLocations[1:]
+	// Replicas is the number of copies we want, the repair loop restores the one removed here
+	fmd.ReplicaLocations = slices.DeleteFunc(fmd.ReplicaLocations, func(id string) bool { return id == dh.serverID })
 
 	// Write
 	added, err := dh.UpdateFile(*fmd)
@@ -106,7 +198,9 @@ func (dh *DBHandler) AddLocalMetaDataToExistingKey(key string, addr string) erro
 		return err
 	}
 
-	fmd.Replicas++
+	if slices.Contains(fmd.ReplicaLocations, addr) {
+		return nil
+	}
 	fmd.ReplicaLocations = append([]string{addr}, fmd.ReplicaLocations...)
 	added, err := dh.UpdateFile(*fmd)
 	if !added {
@@ -131,10 +225,14 @@ func (dh *DBHandler) GetFileMetadata(key string) (*FileMetadata, error) {
 			return fmt.Errorf("file not found")
 		}
 
-		buf := bytes.NewBuffer(data)
-		if err := gob.NewDecoder(buf).Decode(&fmd); err != nil {
+		var err error
+		fmd, err = decodeFileMetadata(data)
+		if err != nil {
 			return err
 		}
+		if fmd.Deleted {
+			return fmt.Errorf("file not found")
+		}
 
 		return nil
 	})
@@ -143,45 +241,599 @@ func (dh *DBHandler) GetFileMetadata(key string) (*FileMetadata, error) {
 }
 
 // DeleteFileMetadata deletes the metadata of a file from the database.
+// A deleted record is kept to tell the other nodes about it.
 func (dh *DBHandler) DeleteFileMetadata(key string) error {
-	hashedKey := crypto.HashKey(key)
-
 	fmt.Printf("Deleting file metadata for key: %s\n", key)
 
-	err := dh.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(dh.serverID))
-		if bucket == nil {
-			return fmt.Errorf("bucket not found")
-		}
-
-		return bucket.Delete([]byte(hashedKey))
-	})
+	fmd, err := dh.GetFileMetadata(key)
+	if err != nil && err.Error() == "file not found" {
+		return nil
+	} else if err != nil {
+		return err
+	}
 
+	*fmd = FileMetadata{Key: fmd.Key, Deleted: true}
+	_, err = dh.UpdateFile(*fmd)
 	return err
 }
 
 // ListFiles returns a list of all files stored in the database under the server's ID.
 func (dh *DBHandler) ListFiles() ([]FileMetadata, error) {
+	return dh.ListNamespace(dh.serverID)
+}
+
+// ListNamespace returns the files of the namespace ns, ours or one synchronized from other nodes.
+func (dh *DBHandler) ListNamespace(ns string) ([]FileMetadata, error) {
+	records, err := dh.Records(ns)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(records, func(fmd FileMetadata) bool { return fmd.Deleted }), nil
+}
+
+// Records returns every record of the namespace ns, those of deleted files included.
+func (dh *DBHandler) Records(ns string) ([]FileMetadata, error) {
 	var files []FileMetadata
 
 	err := dh.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(dh.serverID))
+		bucket := tx.Bucket([]byte(ns))
+		if ns != dh.serverID {
+			bucket = nil
+			if parent := tx.Bucket(dh.namespacesBucket()); parent != nil {
+				bucket = parent.Bucket([]byte(ns))
+			}
+		}
 		if bucket == nil {
 			// return fmt.Errorf("bucket not found")
 			return nil
 		}
 
 		return bucket.ForEach(func(k, v []byte) error {
-			buf := bytes.NewBuffer(v)
-			var fmd FileMetadata
-			if err := gob.NewDecoder(buf).Decode(&fmd); err != nil {
+			fmd, err := decodeFileMetadata(v)
+			if err != nil {
 				return err
 			}
 
-			files = append(files, fmd)
+			files = append(files, *fmd)
 			return nil
 		})
 	})
 
 	return files, err
 }
+
+// namespacesBucket holds a bucket of records for every namespace synchronized from other nodes.
+func (dh *DBHandler) namespacesBucket() []byte {
+	return []byte(dh.serverID + "/namespaces")
+}
+
+// readersBucket holds the nodes the owner of a namespace lets read its records.
+func (dh *DBHandler) readersBucket() []byte {
+	return []byte(dh.serverID + "/readers")
+}
+
+// SetReaders records the nodes allowed to read the records of the namespace ns, as told by its owner.
+func (dh *DBHandler) SetReaders(ns string, readers []string) error {
+	return dh.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(dh.readersBucket())
+		if err != nil {
+			return err
+		}
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(readers); err != nil {
+			return err
+		}
+		return bucket.Put([]byte(ns), buf.Bytes())
+	})
+}
+
+// Readers returns the nodes allowed to read the records of the namespace ns, as last told by its owner.
+func (dh *DBHandler) Readers(ns string) ([]string, error) {
+	var readers []string
+	err := dh.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dh.readersBucket())
+		if bucket == nil {
+			return nil
+		}
+		if v := bucket.Get([]byte(ns)); v != nil {
+			return gob.NewDecoder(bytes.NewReader(v)).Decode(&readers)
+		}
+		return nil
+	})
+	return readers, err
+}
+
+// chunksBucket holds the reference counts of the chunks stored by the server.
+func (dh *DBHandler) chunksBucket() []byte {
+	return []byte(dh.serverID + "/chunks")
+}
+
+// AddChunkRef records one more reference to a chunk and returns the new count.
+// A count of 1 means the chunk wasn't stored yet.
+func (dh *DBHandler) AddChunkRef(hash string) (uint64, error) {
+	return dh.updateChunkRef(hash, 1)
+}
+
+// ReleaseChunkRef drops a reference to a chunk and returns how many are left.
+// The chunk can be deleted once none are.
+func (dh *DBHandler) ReleaseChunkRef(hash string) (uint64, error) {
+	return dh.updateChunkRef(hash, -1)
+}
+
+// ChunkRefs returns the number of references to a chunk.
+func (dh *DBHandler) ChunkRefs(hash string) (uint64, error) {
+	var refs uint64
+	err := dh.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dh.chunksBucket())
+		if bucket == nil {
+			return nil
+		}
+		if v := bucket.Get([]byte(hash)); v != nil {
+			refs = binary.BigEndian.Uint64(v)
+		}
+		return nil
+	})
+	return refs, err
+}
+
+func (dh *DBHandler) updateChunkRef(hash string, delta int) (uint64, error) {
+	var refs uint64
+	err := dh.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(dh.chunksBucket())
+		if err != nil {
+			return err
+		}
+
+		if v := bucket.Get([]byte(hash)); v != nil {
+			refs = binary.BigEndian.Uint64(v)
+		}
+		if delta < 0 && refs == 0 {
+			return fmt.Errorf("chunk (%s) has no references", hash)
+		}
+		refs = uint64(int64(refs) + int64(delta))
+
+		if refs == 0 {
+			if keys := tx.Bucket(dh.chunkKeysBucket()); keys != nil {
+				if err := keys.Delete([]byte(hash)); err != nil {
+					return err
+				}
+			}
+			return bucket.Delete([]byte(hash))
+		}
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, refs)
+		return bucket.Put([]byte(hash), buf)
+	})
+	return refs, err
+}
+
+// chunkKeysBucket holds the wrapped keys the chunks stored by the server are encrypted with.
+func (dh *DBHandler) chunkKeysBucket() []byte {
+	return []byte(dh.serverID + "/chunkkeys")
+}
+
+// SetChunkKey records the wrapped key of a chunk. It's dropped with the last reference to the chunk.
+func (dh *DBHandler) SetChunkKey(hash string, wrapped []byte) error {
+	return dh.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(dh.chunkKeysBucket())
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(hash), wrapped)
+	})
+}
+
+// ChunkKey returns the wrapped key of a chunk, nil for chunks stored before chunk keys.
+func (dh *DBHandler) ChunkKey(hash string) ([]byte, error) {
+	var wrapped []byte
+	err := dh.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dh.chunkKeysBucket())
+		if bucket == nil {
+			return nil
+		}
+		if v := bucket.Get([]byte(hash)); v != nil {
+			wrapped = bytes.Clone(v)
+		}
+		return nil
+	})
+	return wrapped, err
+}
+
+// ChunkKeys returns the wrapped keys of the chunks stored by the server, by chunk.
+func (dh *DBHandler) ChunkKeys() (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	err := dh.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dh.chunkKeysBucket())
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			keys[string(k)] = bytes.Clone(v)
+			return nil
+		})
+	})
+	return keys, err
+}
+
+// keysBucket holds the keys derived from the master key, and the progress of a key rotation.
+func (dh *DBHandler) keysBucket() []byte {
+	return []byte(dh.serverID + "/keys")
+}
+
+// SetHashKey records the wrapped key chunks are addressed with.
+func (dh *DBHandler) SetHashKey(wrapped []byte) error {
+	return dh.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(dh.keysBucket())
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("hash"), wrapped)
+	})
+}
+
+// HashKey returns the wrapped key chunks are addressed with, nil until the master key is first rotated.
+func (dh *DBHandler) HashKey() ([]byte, error) {
+	var wrapped []byte
+	err := dh.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dh.keysBucket())
+		if bucket == nil {
+			return nil
+		}
+		if v := bucket.Get([]byte("hash")); v != nil {
+			wrapped = bytes.Clone(v)
+		}
+		return nil
+	})
+	return wrapped, err
+}
+
+// KeyRotation is a master key rotation in progress.
+type KeyRotation struct {
+	// Version is the version of the new master key.
+	Version int
+	// Key is the new master key, wrapped with the one it replaces.
+	Key []byte
+}
+
+// SetRotation records the rotation in progress, nil forgets it.
+func (dh *DBHandler) SetRotation(r *KeyRotation) error {
+	return dh.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(dh.keysBucket())
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			return bucket.Delete([]byte("rotation"))
+		}
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(r); err != nil {
+			return err
+		}
+		return bucket.Put([]byte("rotation"), buf.Bytes())
+	})
+}
+
+// Rotation returns the rotation in progress, nil when there is none.
+func (dh *DBHandler) Rotation() (*KeyRotation, error) {
+	var r *KeyRotation
+	err := dh.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dh.keysBucket())
+		if bucket == nil {
+			return nil
+		}
+		v := bucket.Get([]byte("rotation"))
+		if v == nil {
+			return nil
+		}
+		r = new(KeyRotation)
+		return gob.NewDecoder(bytes.NewReader(v)).Decode(r)
+	})
+	return r, err
+}
+
+// KeyEscrow records how our master key was last split into shares held by peers, see EscrowKey.
+type KeyEscrow struct {
+	// Version is the version of the escrowed master key.
+	Version int
+	// Threshold of the Shares shares are needed to recover it, and Holders hold them.
+	Shares    int
+	Threshold int
+	Holders   []string
+	Created   time.Time
+}
+
+// SetEscrow records the last escrow of our master key, or forgets it when e is nil.
+func (dh *DBHandler) SetEscrow(e *KeyEscrow) error {
+	return dh.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(dh.keysBucket())
+		if err != nil {
+			return err
+		}
+		if e == nil {
+			return bucket.Delete([]byte("escrow"))
+		}
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(e); err != nil {
+			return err
+		}
+		return bucket.Put([]byte("escrow"), buf.Bytes())
+	})
+}
+
+// Escrow returns the last escrow of our master key, nil when it was never escrowed.
+func (dh *DBHandler) Escrow() (*KeyEscrow, error) {
+	var e *KeyEscrow
+	err := dh.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dh.keysBucket())
+		if bucket == nil {
+			return nil
+		}
+		v := bucket.Get([]byte("escrow"))
+		if v == nil {
+			return nil
+		}
+		e = new(KeyEscrow)
+		return gob.NewDecoder(bytes.NewReader(v)).Decode(e)
+	})
+	return e, err
+}
+
+// escrowBucket holds the shares of their master key other nodes gave us, by node ID.
+func (dh *DBHandler) escrowBucket() []byte {
+	return []byte(dh.serverID + "/escrow")
+}
+
+// SetEscrowShare records the share of its master key the node owner gave us, replacing
+// the one it gave before, or drops it when share is nil.
+func (dh *DBHandler) SetEscrowShare(owner string, share *EscrowShare) error {
+	return dh.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(dh.escrowBucket())
+		if err != nil {
+			return err
+		}
+		if share == nil {
+			return bucket.Delete([]byte(owner))
+		}
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(share); err != nil {
+			return err
+		}
+		return bucket.Put([]byte(owner), buf.Bytes())
+	})
+}
+
+// EscrowShare returns the share of its master key the node owner gave us, nil when there is none.
+func (dh *DBHandler) EscrowShare(owner string) (*EscrowShare, error) {
+	var share *EscrowShare
+	err := dh.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dh.escrowBucket())
+		if bucket == nil {
+			return nil
+		}
+		v := bucket.Get([]byte(owner))
+		if v == nil {
+			return nil
+		}
+		share = new(EscrowShare)
+		return gob.NewDecoder(bytes.NewReader(v)).Decode(share)
+	})
+	return share, err
+}
+
+// Hint is an object we hold for another node, which was unreachable when it was stored.
+type Hint struct {
+	// Target is the node the object is meant for.
+	Target string
+	// ID is the namespace of the object and Key its store key.
+	ID  string
+	Key string
+	// Keep is set when we held the object already, so it stays once delivered.
+	Keep bool
+	// Proof lets Target take the object from us, see HintProof.
+	Proof   *HintProof
+	Created time.Time
+}
+
+// hintsBucket holds the hints of the objects waiting for their node to come back.
+func (dh *DBHandler) hintsBucket() []byte {
+	return []byte(dh.serverID + "/hints")
+}
+
+// hintKey groups the hints by target, IDs have no slashes.
+func hintKey(h Hint) []byte {
+	return []byte(h.Target + "/" + h.ID + "/" + h.Key)
+}
+
+// AddHint records an object to deliver to h.Target once it's back.
+func (dh *DBHandler) AddHint(h Hint) error {
+	return dh.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(dh.hintsBucket())
+		if err != nil {
+			return err
+		}
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(h); err != nil {
+			return err
+		}
+		return bucket.Put(hintKey(h), buf.Bytes())
+	})
+}
+
+// Hints returns the objects waiting to be delivered to target, or to any node when target is empty.
+func (dh *DBHandler) Hints(target string) ([]Hint, error) {
+	var hints []Hint
+	err := dh.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dh.hintsBucket())
+		if bucket == nil {
+			return nil
+		}
+		var prefix []byte
+		if target != "" {
+			prefix = []byte(target + "/")
+		}
+		c := bucket.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var h Hint
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&h); err != nil {
+				return err
+			}
+			hints = append(hints, h)
+		}
+		return nil
+	})
+	return hints, err
+}
+
+// RemoveHint forgets a delivered hint.
+func (dh *DBHandler) RemoveHint(h Hint) error {
+	return dh.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dh.hintsBucket())
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete(hintKey(h))
+	})
+}
+
+// HeldObject is an object we hold for another node: ID is its namespace, Key its store key.
+type HeldObject struct {
+	ID  string
+	Key string
+}
+
+// heldBucket lists the objects we hold for other nodes, their keys can't be told from their paths on disk.
+func (dh *DBHandler) heldBucket() []byte {
+	return []byte(dh.serverID + "/held")
+}
+
+// AddHeld records an object we stored for the node id.
+func (dh *DBHandler) AddHeld(id, key string) error {
+	return dh.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(dh.heldBucket())
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(id+"/"+key), nil)
+	})
+}
+
+// RemoveHeld forgets an object we no longer hold.
+func (dh *DBHandler) RemoveHeld(id, key string) error {
+	return dh.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dh.heldBucket())
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(id + "/" + key))
+	})
+}
+
+// Held returns the objects we hold for other nodes.
+func (dh *DBHandler) Held() ([]HeldObject, error) {
+	var held []HeldObject
+	err := dh.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dh.heldBucket())
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, _ []byte) error {
+			id, key, _ := strings.Cut(string(k), "/")
+			held = append(held, HeldObject{ID: id, Key: key})
+			return nil
+		})
+	})
+	return held, err
+}
+
+// peerKeysBucket binds the legacy IDs of peers to the identity key they first connected with.
+func (dh *DBHandler) peerKeysBucket() []byte {
+	return []byte(dh.serverID + "/peer_keys")
+}
+
+// BindPeerKey binds the legacy ID id to key the first time it's seen, and fails when
+// it's bound to another key already.
+func (dh *DBHandler) BindPeerKey(id string, key []byte) error {
+	return dh.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(dh.peerKeysBucket())
+		if err != nil {
+			return err
+		}
+		if bound := bucket.Get([]byte(id)); bound != nil {
+			if !bytes.Equal(bound, key) {
+				return fmt.Errorf("(%s) is bound to another key", id)
+			}
+			return nil
+		}
+		return bucket.Put([]byte(id), key)
+	})
+}
+
+// PeerKey returns the key the legacy ID id is bound to, nil when it isn't bound.
+func (dh *DBHandler) PeerKey(id string) ([]byte, error) {
+	var key []byte
+	err := dh.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dh.peerKeysBucket())
+		if bucket == nil {
+			return nil
+		}
+		key = bytes.Clone(bucket.Get([]byte(id)))
+		return nil
+	})
+	return key, err
+}
+
+// drainBucket holds the progress of a drain, so an interrupted one resumes where it stopped.
+func (dh *DBHandler) drainBucket() []byte {
+	return []byte(dh.serverID + "/drain")
+}
+
+// SetDraining records whether the node is draining. Clearing it forgets the progress.
+func (dh *DBHandler) SetDraining(draining bool) error {
+	return dh.db.Update(func(tx *bolt.Tx) error {
+		if !draining {
+			err := tx.DeleteBucket(dh.drainBucket())
+			if errors.Is(err, bolt.ErrBucketNotFound) {
+				return nil
+			}
+			return err
+		}
+		bucket, err := tx.CreateBucketIfNotExists(dh.drainBucket())
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("active"), nil)
+	})
+}
+
+// Draining reports whether a drain was started and not cancelled.
+func (dh *DBHandler) Draining() (bool, error) {
+	var draining bool
+	err := dh.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dh.drainBucket())
+		draining = bucket != nil && bucket.Get([]byte("active")) != nil
+		return nil
+	})
+	return draining, err
+}
+
+// MarkDrained records that the copies of our file key no longer depend on this node.
+func (dh *DBHandler) MarkDrained(key string) error {
+	return dh.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(dh.drainBucket())
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("done/"+key), nil)
+	})
+}
+
+// Drained reports whether MarkDrained was called for key during the current drain.
+func (dh *DBHandler) Drained(key string) (bool, error) {
+	var done bool
+	err := dh.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dh.drainBucket())
+		done = bucket != nil && bucket.Get([]byte("done/"+key)) != nil
+		return nil
+	})
+	return done, err
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -50,6 +51,92 @@ func TestDBHandler(t *testing.T) {
 	require.Empty(t, files, "List should be empty after deletion")
 }
 
+func TestMergeFile(t *testing.T) {
+	dbFile := createTempDBFile(t)
+	defer os.Remove(dbFile)
+
+	dh, err := NewDBHandler("server1", dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+
+	now := time.Now()
+	fmd := FileMetadata{Key: "a.txt", Size: 10, Version: VersionVector{"server2": 1}, Modified: now}
+	_, changed, err := dh.MergeFile("server2", fmd)
+	require.NoError(t, err)
+	require.True(t, changed, "New records should be stored")
+
+	_, changed, err = dh.MergeFile("server2", fmd)
+	require.NoError(t, err)
+	require.False(t, changed, "Known versions should be ignored")
+
+	// Concurrent changes: the latest wins and the versions are merged
+	newer := FileMetadata{Key: "a.txt", Size: 20, Version: VersionVector{"server2": 2}, Modified: now.Add(time.Second)}
+	concurrent := FileMetadata{Key: "a.txt", Size: 30, Version: VersionVector{"server2": 1, "server3": 1}, Modified: now}
+	_, changed, err = dh.MergeFile("server2", newer)
+	require.NoError(t, err)
+	require.True(t, changed)
+	merged, changed, err := dh.MergeFile("server2", concurrent)
+	require.NoError(t, err)
+	require.True(t, changed, "The versions should be merged")
+	require.Equal(t, int64(20), merged.Size)
+	require.Equal(t, Equal, merged.Version.Compare(VersionVector{"server2": 2, "server3": 1}))
+
+	// Tombstones hide the file
+	deleted := FileMetadata{Key: "a.txt", Deleted: true, Version: VersionVector{"server2": 3, "server3": 1}}
+	_, changed, err = dh.MergeFile("server2", deleted)
+	require.NoError(t, err)
+	require.True(t, changed)
+	files, err := dh.ListNamespace("server2")
+	require.NoError(t, err)
+	require.Empty(t, files)
+	records, err := dh.Records("server2")
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+}
+
+func TestHints(t *testing.T) {
+	dbFile := createTempDBFile(t)
+	defer os.Remove(dbFile)
+
+	dh, err := NewDBHandler("server1", dbFile)
+	require.NoError(t, err)
+	hint := Hint{Target: "server2", ID: "server3", Key: "chunks/abc", Created: time.Now()}
+	require.NoError(t, dh.AddHint(hint))
+	require.NoError(t, dh.AddHint(Hint{Target: "server4", ID: "server3", Key: "chunks/def"}))
+	require.NoError(t, dh.Close())
+
+	// Hints survive restarts
+	dh, err = NewDBHandler("server1", dbFile)
+	require.NoError(t, err)
+	defer dh.Close()
+	hints, err := dh.Hints("server2")
+	require.NoError(t, err)
+	require.Len(t, hints, 1)
+	require.Equal(t, "chunks/abc", hints[0].Key)
+
+	require.NoError(t, dh.RemoveHint(hint))
+	hints, err = dh.Hints("server2")
+	require.NoError(t, err)
+	require.Empty(t, hints)
+}
+
+func TestBindPeerKey(t *testing.T) {
+	dbFile := createTempDBFile(t)
+	defer os.Remove(dbFile)
+
+	dh, err := NewDBHandler("server1", dbFile)
+	require.NoError(t, err)
+	defer dh.Close()
+
+	// The first key a legacy ID shows up with is the only one it's accepted with
+	require.NoError(t, dh.BindPeerKey("server2", []byte("key2")))
+	require.NoError(t, dh.BindPeerKey("server2", []byte("key2")))
+	require.Error(t, dh.BindPeerKey("server2", []byte("key3")))
+	require.NoError(t, dh.BindPeerKey("server3", []byte("key3")))
+}
+
 // Helper function to create a temporary database file for testing
 func createTempDBFile(t *testing.T) string {
 	f, err := os.CreateTemp("", "test_db_*.db")
@@ -78,3 +165,107 @@ func equalStringSlices(s1, s2 []string) bool {
 	}
 	return true
 }
+
+func TestChunkKey(t *testing.T) {
+	dbFile := createTempDBFile(t)
+	defer os.Remove(dbFile)
+
+	dh, err := NewDBHandler("server1", dbFile)
+	require.NoError(t, err)
+	defer dh.Close()
+
+	key, err := dh.ChunkKey("abc")
+	require.NoError(t, err)
+	require.Nil(t, key)
+
+	_, err = dh.AddChunkRef("abc")
+	require.NoError(t, err)
+	require.NoError(t, dh.SetChunkKey("abc", []byte("wrapped")))
+	_, err = dh.AddChunkRef("abc")
+	require.NoError(t, err)
+
+	_, err = dh.ReleaseChunkRef("abc")
+	require.NoError(t, err)
+	key, err = dh.ChunkKey("abc")
+	require.NoError(t, err)
+	require.Equal(t, []byte("wrapped"), key)
+
+	// The key goes with the last reference
+	_, err = dh.ReleaseChunkRef("abc")
+	require.NoError(t, err)
+	key, err = dh.ChunkKey("abc")
+	require.NoError(t, err)
+	require.Nil(t, key)
+}
+
+func TestRotation(t *testing.T) {
+	dbFile := createTempDBFile(t)
+	defer os.Remove(dbFile)
+
+	dh, err := NewDBHandler("server1", dbFile)
+	require.NoError(t, err)
+	defer dh.Close()
+
+	r, err := dh.Rotation()
+	require.NoError(t, err)
+	require.Nil(t, r)
+
+	require.NoError(t, dh.SetRotation(&KeyRotation{Version: 2, Key: []byte("wrapped")}))
+	r, err = dh.Rotation()
+	require.NoError(t, err)
+	require.Equal(t, &KeyRotation{Version: 2, Key: []byte("wrapped")}, r)
+
+	require.NoError(t, dh.SetHashKey([]byte("hash")))
+	require.NoError(t, dh.SetRotation(nil))
+	r, err = dh.Rotation()
+	require.NoError(t, err)
+	require.Nil(t, r)
+
+	// The hash key outlives the rotation
+	hash, err := dh.HashKey()
+	require.NoError(t, err)
+	require.Equal(t, []byte("hash"), hash)
+}
+
+func TestEscrow(t *testing.T) {
+	dbFile := createTempDBFile(t)
+	defer os.Remove(dbFile)
+
+	dh, err := NewDBHandler("server1", dbFile)
+	require.NoError(t, err)
+	defer dh.Close()
+
+	e, err := dh.Escrow()
+	require.NoError(t, err)
+	require.Nil(t, e)
+
+	require.NoError(t, dh.SetEscrow(&KeyEscrow{Version: 1, Shares: 3, Threshold: 2, Holders: []string{"a", "b", "c"}}))
+	e, err = dh.Escrow()
+	require.NoError(t, err)
+	require.Equal(t, &KeyEscrow{Version: 1, Shares: 3, Threshold: 2, Holders: []string{"a", "b", "c"}}, e)
+	require.NoError(t, dh.SetEscrow(nil))
+	e, err = dh.Escrow()
+	require.NoError(t, err)
+	require.Nil(t, e)
+
+	share, err := dh.EscrowShare("server2")
+	require.NoError(t, err)
+	require.Nil(t, share)
+
+	// A new share replaces the last one
+	require.NoError(t, dh.SetEscrowShare("server2", &EscrowShare{Salt: []byte("salt"), Data: []byte("old")}))
+	require.NoError(t, dh.SetEscrowShare("server2", &EscrowShare{Salt: []byte("salt"), Data: []byte("new")}))
+	share, err = dh.EscrowShare("server2")
+	require.NoError(t, err)
+	require.Equal(t, &EscrowShare{Salt: []byte("salt"), Data: []byte("new")}, share)
+
+	share, err = dh.EscrowShare("server3")
+	require.NoError(t, err)
+	require.Nil(t, share)
+
+	// Revoked
+	require.NoError(t, dh.SetEscrowShare("server2", nil))
+	share, err = dh.EscrowShare("server2")
+	require.NoError(t, err)
+	require.Nil(t, share)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/20af02/MosaicFS/crypto"
+	"github.com/20af02/MosaicFS/dht"
+	"github.com/20af02/MosaicFS/p2p"
+)
+
+type MessageDHTRequest struct {
+	Request dht.Request
+}
+
+type MessageDHTResponse struct {
+	Response dht.Response
+}
+
+// dhtNetwork carries DHT requests over streams to our peers, connecting to them as needed.
+type dhtNetwork struct {
+	s *FileServer
+}
+
+func (n dhtNetwork) Call(ctx context.Context, to dht.Contact, req dht.Request) (dht.Response, error) {
+	peer, err := n.s.connect(ctx, to.NodeID, to.Addr)
+	if err != nil {
+		return dht.Response{}, err
+	}
+
+	st, err := peer.OpenStream()
+	if err != nil {
+		return dht.Response{}, err
+	}
+	defer st.Close()
+
+	// Unblock the read below if the caller gives up
+	stop := context.AfterFunc(ctx, func() { st.Close() })
+	defer stop()
+
+	if err := writeMessage(st, &Message{Payload: MessageDHTRequest{Request: req}}); err != nil {
+		return dht.Response{}, err
+	}
+	msg, err := readMessage(st)
+	if err != nil {
+		return dht.Response{}, err
+	}
+	v, ok := msg.Payload.(MessageDHTResponse)
+	if !ok {
+		return dht.Response{}, fmt.Errorf("unexpected dht response: %T", msg.Payload)
+	}
+	return v.Response, nil
+}
+
+// connect returns the peer with the given ID, dialing addr if we aren't connected to it yet.
+func (s *FileServer) connect(ctx context.Context, id, addr string) (p2p.Peer, error) {
+	if peer, ok := s.peer(id); ok {
+		return peer, nil
+	}
+	if len(addr) == 0 {
+		return nil, fmt.Errorf("peer (%s) is not connected", id)
+	}
+	if err := s.Transport.Dial(addr); err != nil {
+		return nil, err
+	}
+
+	// The peer shows up once the handshake is done
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if peer, ok := s.peer(id); ok {
+				return peer, nil
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (s *FileServer) handleMessageDHTRequest(from string, msg MessageDHTRequest, st p2p.Stream) error {
+	req := msg.Request
+	// The DHT trusts From to tell who may withdraw a record
+	if req.From.NodeID != from {
+		return fmt.Errorf("dht request from (%s) claims to come from (%s)", from, req.From.NodeID)
+	}
+	req.From.ID = dht.NewID(from)
+
+	// A node only knows the address it listens on, not the one we reach it at
+	if peer, ok := s.peer(from); ok {
+		if req.From.NodeID == from {
+			req.From.Addr = peer.ListenAddr()
+		}
+		if req.Provider.NodeID == from {
+			req.Provider.Addr = peer.ListenAddr()
+		}
+	}
+
+	resp := s.dht.HandleRequest(req)
+	return writeMessage(st, &Message{Payload: MessageDHTResponse{Response: resp}})
+}
+
+// self returns the DHT contact of this node.
+func (s *FileServer) self() dht.Contact {
+	return dht.NewContact(s.ID, s.Transport.Addr())
+}
+
+// providerKey is the DHT key of the file hashedKey stored by the node with the given ID.
+func providerKey(id, hashedKey string) dht.ID {
+	return dht.NewID(id + "/" + hashedKey)
+}
+
+// provide announces that we hold the file of the node with the given ID.
+func (s *FileServer) provide(id, hashedKey string) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.RequestTimeout)
+	defer cancel()
+
+	if err := s.dht.Provide(ctx, providerKey(id, hashedKey), s.self()); err != nil {
+		log.Printf("[%s] failed to announce (%s): %v", s.Transport.Addr(), hashedKey, err)
+	}
+}
+
+// republishLoop announces the objects we hold again before their provider records
+// expire, until the server stops.
+func (s *FileServer) republishLoop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-s.quitch
+		cancel()
+	}()
+
+	ticker := time.NewTicker(s.dht.ProviderTTL / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n, err := s.republish(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("[%s] republish failed: %v", s.Transport.Addr(), err)
+			}
+			log.Printf("[%s] announced (%d) objects again", s.Transport.Addr(), n)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// republish announces every object we hold: the manifests, chunks and shards of our
+// files, and the objects we hold for other nodes. It returns the number announced.
+func (s *FileServer) republish(ctx context.Context) (int, error) {
+	files, err := s.store.dbHandler.ListFiles()
+	if err != nil {
+		return 0, err
+	}
+	seen := make(map[string]bool)
+	var objects []HeldObject
+	add := func(id, local, remote string) {
+		if !seen[id+"/"+remote] && s.store.Has(id, local) {
+			seen[id+"/"+remote] = true
+			objects = append(objects, HeldObject{ID: id, Key: remote})
+		}
+	}
+	for _, fmd := range files {
+		add(s.ID, fmd.Key, crypto.HashKey(fmd.Key))
+		m, err := s.readManifest(fmd.Key)
+		if err != nil {
+			continue
+		}
+		for _, c := range m.Chunks {
+			for _, objectKey := range m.objectKeys(c) {
+				add(s.ID, objectKey, objectKey)
+			}
+		}
+	}
+	held, err := s.store.dbHandler.Held()
+	if err != nil {
+		return 0, err
+	}
+	for _, o := range held {
+		add(o.ID, o.Key, o.Key)
+	}
+
+	for i, o := range objects {
+		if err := ctx.Err(); err != nil {
+			return i, err
+		}
+		s.provide(o.ID, o.Key)
+	}
+	return len(objects), nil
+}
+
+// unprovide withdraws what provide announced, once the file is gone.
+func (s *FileServer) unprovide(id, hashedKey string) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.RequestTimeout)
+	defer cancel()
+
+	if err := s.dht.Unprovide(ctx, providerKey(id, hashedKey), s.self()); err != nil {
+		log.Printf("[%s] failed to withdraw (%s): %v", s.Transport.Addr(), hashedKey, err)
+	}
+}
+
+// providerPeers returns the peers holding the file hashedKey of the node with the given ID.
+// When the DHT doesn't know of any, e.g. for files stored before providers were announced,
+// it falls back to all of our peers.
+func (s *FileServer) providerPeers(ctx context.Context, id, hashedKey string) []p2p.Peer {
+	providers, err := s.dht.FindProviders(ctx, providerKey(id, hashedKey))
+	if err != nil {
+		log.Printf("[%s] failed to look up (%s): %v", s.Transport.Addr(), hashedKey, err)
+	}
+
+	var peers []p2p.Peer
+	for _, c := range providers {
+		if c.NodeID == s.ID {
+			continue
+		}
+		peer, err := s.connect(ctx, c.NodeID, c.Addr)
+		if err != nil {
+			log.Printf("[%s] failed to reach provider (%s): %v", s.Transport.Addr(), c.NodeID, err)
+			continue
+		}
+		peers = append(peers, peer)
+	}
+
+	if len(peers) == 0 {
+		return s.peerList()
+	}
+	return peers
+}
@@ -0,0 +1,342 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultK is the bucket size, and the number of nodes records are stored on.
+	DefaultK = 20
+	// DefaultAlpha is the number of requests a lookup keeps in flight.
+	DefaultAlpha = 3
+	// DefaultProviderTTL is how long a provider record is kept without being refreshed.
+	DefaultProviderTTL = 24 * time.Hour
+)
+
+type RequestType byte
+
+const (
+	// FindNodeRequest asks for the contacts closest to Target.
+	FindNodeRequest RequestType = iota + 1
+	// FindValueRequest asks for the providers of the key Target, along with the closest contacts.
+	FindValueRequest
+	// StoreRequest asks to record Provider as holding the key Target.
+	StoreRequest
+)
+
+// Request is sent from one node of the DHT to another.
+type Request struct {
+	Type RequestType
+	From Contact
+	// Target is a node ID for FindNodeRequest and a key otherwise.
+	Target   ID
+	Provider Contact
+	// Remove turns a StoreRequest into a removal of the provider record,
+	// only accepted from the provider itself.
+	Remove bool
+}
+
+// Response answers a Request.
+type Response struct {
+	Contacts  []Contact
+	Providers []Contact
+}
+
+// Network delivers requests to other nodes, it's how the DHT talks over a transport.
+type Network interface {
+	Call(ctx context.Context, to Contact, req Request) (Response, error)
+}
+
+type Opts struct {
+	Self    Contact
+	Network Network
+	// K defaults to DefaultK.
+	K int
+	// Alpha defaults to DefaultAlpha.
+	Alpha int
+	// ProviderTTL defaults to DefaultProviderTTL.
+	ProviderTTL time.Duration
+}
+
+// DHT is a Kademlia node, locating the nodes providing a key.
+type DHT struct {
+	Opts
+
+	table *RoutingTable
+
+	lock      sync.Mutex
+	providers map[ID]map[string]providerRecord
+}
+
+type providerRecord struct {
+	Contact
+	expires time.Time
+}
+
+func New(opts Opts) *DHT {
+	if opts.K <= 0 {
+		opts.K = DefaultK
+	}
+	if opts.Alpha <= 0 {
+		opts.Alpha = DefaultAlpha
+	}
+	if opts.ProviderTTL <= 0 {
+		opts.ProviderTTL = DefaultProviderTTL
+	}
+
+	return &DHT{
+		Opts:      opts,
+		table:     NewRoutingTable(opts.Self.ID, opts.K),
+		providers: make(map[ID]map[string]providerRecord),
+	}
+}
+
+// Table returns the routing table of the node.
+func (d *DHT) Table() *RoutingTable {
+	return d.table
+}
+
+// Bootstrap joins the DHT through the given contacts by looking up our own ID,
+// which fills the routing table with our neighbours.
+func (d *DHT) Bootstrap(ctx context.Context, seeds ...Contact) error {
+	for _, c := range seeds {
+		d.table.Update(c)
+	}
+	if d.table.Len() == 0 {
+		return errors.New("no contacts to bootstrap from")
+	}
+	_, err := d.FindNode(ctx, d.Self.ID)
+	return err
+}
+
+// HandleRequest answers a request from another node.
+func (d *DHT) HandleRequest(req Request) Response {
+	if len(req.From.Addr) > 0 {
+		d.table.Update(req.From)
+	}
+
+	var resp Response
+	switch req.Type {
+	case FindNodeRequest:
+		resp.Contacts = d.table.Closest(req.Target, d.K)
+	case FindValueRequest:
+		resp.Providers = d.localProviders(req.Target)
+		resp.Contacts = d.table.Closest(req.Target, d.K)
+	case StoreRequest:
+		// Nobody withdraws a record on behalf of another node
+		if req.Remove && req.Provider.NodeID != req.From.NodeID {
+			break
+		}
+		d.storeProvider(req.Target, req.Provider, req.Remove)
+	}
+	return resp
+}
+
+// FindNode returns the k contacts closest to target found on the network.
+func (d *DHT) FindNode(ctx context.Context, target ID) ([]Contact, error) {
+	closest, _, err := d.lookup(ctx, target, false)
+	return closest, err
+}
+
+// FindProviders returns the nodes known to provide key.
+func (d *DHT) FindProviders(ctx context.Context, key ID) ([]Contact, error) {
+	_, providers, err := d.lookup(ctx, key, true)
+
+	seen := make(map[string]struct{})
+	var all []Contact
+	for _, c := range append(d.localProviders(key), providers...) {
+		if _, ok := seen[c.NodeID]; ok {
+			continue
+		}
+		seen[c.NodeID] = struct{}{}
+		all = append(all, c)
+	}
+	if len(all) > 0 {
+		return all, nil
+	}
+	return nil, err
+}
+
+// Provide announces that provider holds key to the nodes closest to it.
+func (d *DHT) Provide(ctx context.Context, key ID, provider Contact) error {
+	return d.store(ctx, key, provider, false)
+}
+
+// Unprovide withdraws a record announced by Provide.
+func (d *DHT) Unprovide(ctx context.Context, key ID, provider Contact) error {
+	return d.store(ctx, key, provider, true)
+}
+
+func (d *DHT) store(ctx context.Context, key ID, provider Contact, remove bool) error {
+	// Keep a copy ourselves, so small networks never lose track of a key
+	d.storeProvider(key, provider, remove)
+
+	closest, err := d.FindNode(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	req := Request{
+		Type:     StoreRequest,
+		From:     d.Self,
+		Target:   key,
+		Provider: provider,
+		Remove:   remove,
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range closest {
+		wg.Add(1)
+		go func(c Contact) {
+			defer wg.Done()
+			d.call(ctx, c, req)
+		}(c)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+func (d *DHT) storeProvider(key ID, provider Contact, remove bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	records := d.providers[key]
+	if remove {
+		delete(records, provider.NodeID)
+		if len(records) == 0 {
+			delete(d.providers, key)
+		}
+		return
+	}
+
+	if records == nil {
+		records = make(map[string]providerRecord)
+		d.providers[key] = records
+	}
+	records[provider.NodeID] = providerRecord{
+		Contact: provider,
+		expires: time.Now().Add(d.ProviderTTL),
+	}
+}
+
+func (d *DHT) localProviders(key ID) []Contact {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var providers []Contact
+	for nodeID, rec := range d.providers[key] {
+		if time.Now().After(rec.expires) {
+			delete(d.providers[key], nodeID)
+			continue
+		}
+		providers = append(providers, rec.Contact)
+	}
+	return providers
+}
+
+// call sends req to c, forgetting c if it doesn't answer.
+func (d *DHT) call(ctx context.Context, c Contact, req Request) (Response, error) {
+	resp, err := d.Network.Call(ctx, c, req)
+	if err != nil {
+		if ctx.Err() == nil {
+			d.table.Remove(c.ID)
+		}
+		return resp, err
+	}
+	d.table.Update(c)
+	return resp, nil
+}
+
+// lookup iteratively queries the nodes closest to target, alpha at a time, until the k closest
+// nodes it heard of have all answered. When findValue is set it stops at the first providers found.
+func (d *DHT) lookup(ctx context.Context, target ID, findValue bool) ([]Contact, []Contact, error) {
+	type result struct {
+		from Contact
+		resp Response
+		err  error
+	}
+
+	var (
+		shortlist = d.table.Closest(target, d.K)
+		seen      = make(map[ID]bool)
+		queried   = make(map[ID]bool)
+		resultch  = make(chan result, d.Alpha)
+		inflight  = 0
+	)
+	for _, c := range shortlist {
+		seen[c.ID] = true
+	}
+
+	reqType := FindNodeRequest
+	if findValue {
+		reqType = FindValueRequest
+	}
+	req := Request{
+		Type:   reqType,
+		From:   d.Self,
+		Target: target,
+	}
+
+	for {
+		// Keep alpha requests in flight to the closest nodes we haven't asked yet
+		for _, c := range shortlist {
+			if inflight >= d.Alpha {
+				break
+			}
+			if queried[c.ID] {
+				continue
+			}
+			queried[c.ID] = true
+			inflight++
+			go func(c Contact) {
+				resp, err := d.call(ctx, c, req)
+				resultch <- result{from: c, resp: resp, err: err}
+			}(c)
+		}
+		if inflight == 0 {
+			break
+		}
+
+		var res result
+		select {
+		case res = <-resultch:
+			inflight--
+		case <-ctx.Done():
+			return shortlist, nil, ctx.Err()
+		}
+
+		if res.err != nil {
+			shortlist = removeContact(shortlist, res.from.ID)
+			continue
+		}
+		if findValue && len(res.resp.Providers) > 0 {
+			return shortlist, res.resp.Providers, nil
+		}
+
+		for _, c := range res.resp.Contacts {
+			if c.ID == d.Self.ID || seen[c.ID] {
+				continue
+			}
+			seen[c.ID] = true
+			shortlist = append(shortlist, c)
+		}
+		sortByDistance(shortlist, target)
+		if len(shortlist) > d.K {
+			shortlist = shortlist[:d.K]
+		}
+	}
+
+	return shortlist, nil, nil
+}
+
+func removeContact(contacts []Contact, id ID) []Contact {
+	for i, c := range contacts {
+		if c.ID == id {
+			return append(contacts[:i], contacts[i+1:]...)
+		}
+	}
+	return contacts
+}
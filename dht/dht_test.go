@@ -0,0 +1,132 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memNetwork delivers requests between in-process nodes.
+type memNetwork struct {
+	lock  sync.Mutex
+	nodes map[ID]*DHT
+}
+
+func (n *memNetwork) Call(ctx context.Context, to Contact, req Request) (Response, error) {
+	n.lock.Lock()
+	node, ok := n.nodes[to.ID]
+	n.lock.Unlock()
+	if !ok {
+		return Response{}, errors.New("unreachable")
+	}
+	return node.HandleRequest(req), nil
+}
+
+func makeNetwork(t *testing.T, size int) []*DHT {
+	net := &memNetwork{nodes: make(map[ID]*DHT)}
+	nodes := make([]*DHT, size)
+	for i := range nodes {
+		self := NewContact(fmt.Sprintf("node-%d", i), fmt.Sprintf("127.0.0.1:%d", 3000+i))
+		nodes[i] = New(Opts{Self: self, Network: net, K: 8})
+		net.nodes[self.ID] = nodes[i]
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// Everybody joins through the first node only
+	for _, node := range nodes[1:] {
+		assert.Nil(t, node.Bootstrap(ctx, nodes[0].Self))
+	}
+	return nodes
+}
+
+func TestRoutingTable(t *testing.T) {
+	self := NewID("self")
+	rt := NewRoutingTable(self, 2)
+
+	rt.Update(Contact{ID: self})
+	assert.Equal(t, 0, rt.Len())
+
+	var contacts []Contact
+	for i := 0; i < 50; i++ {
+		c := NewContact(fmt.Sprintf("node-%d", i), "")
+		contacts = append(contacts, c)
+		rt.Update(c)
+	}
+	// Buckets never grow past k
+	for _, bucket := range rt.buckets {
+		assert.LessOrEqual(t, len(bucket), 2)
+	}
+
+	target := NewID("target")
+	closest := rt.Closest(target, 5)
+	assert.Len(t, closest, 5)
+	for i := 1; i < len(closest); i++ {
+		assert.False(t, closer(target, closest[i].ID, closest[i-1].ID))
+	}
+
+	rt.Remove(closest[0].ID)
+	assert.NotEqual(t, closest[0].ID, rt.Closest(target, 1)[0].ID)
+}
+
+func TestFindNode(t *testing.T) {
+	nodes := makeNetwork(t, 64)
+
+	// Looking up an existing node from the other end of the network finds it
+	target := nodes[42].Self
+	found, err := nodes[7].FindNode(context.Background(), target.ID)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, found)
+	assert.Equal(t, target, found[0])
+}
+
+func TestProviders(t *testing.T) {
+	nodes := makeNetwork(t, 64)
+	ctx := context.Background()
+	key := NewID("some file")
+
+	assert.Nil(t, nodes[3].Provide(ctx, key, nodes[3].Self))
+	assert.Nil(t, nodes[50].Provide(ctx, key, nodes[50].Self))
+
+	providers, err := nodes[21].FindProviders(ctx, key)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []Contact{nodes[3].Self, nodes[50].Self}, providers)
+
+	assert.Nil(t, nodes[3].Unprovide(ctx, key, nodes[3].Self))
+	providers, err = nodes[60].FindProviders(ctx, key)
+	assert.Nil(t, err)
+	assert.Equal(t, []Contact{nodes[50].Self}, providers)
+
+	providers, err = nodes[60].FindProviders(ctx, NewID("missing"))
+	assert.Nil(t, err)
+	assert.Empty(t, providers)
+}
+
+func TestProviderRemovedOnlyByItself(t *testing.T) {
+	nodes := makeNetwork(t, 3)
+	key := NewID("some file")
+	nodes[0].HandleRequest(Request{Type: StoreRequest, From: nodes[1].Self, Target: key, Provider: nodes[1].Self})
+
+	nodes[0].HandleRequest(Request{Type: StoreRequest, From: nodes[2].Self, Target: key, Provider: nodes[1].Self, Remove: true})
+	assert.Equal(t, []Contact{nodes[1].Self}, nodes[0].localProviders(key))
+
+	nodes[0].HandleRequest(Request{Type: StoreRequest, From: nodes[1].Self, Target: key, Provider: nodes[1].Self, Remove: true})
+	assert.Empty(t, nodes[0].localProviders(key))
+}
+
+func TestUnreachableContactRemoved(t *testing.T) {
+	nodes := makeNetwork(t, 8)
+	gone := NewContact("gone", "127.0.0.1:1")
+	nodes[0].table.Update(gone)
+
+	_, err := nodes[0].FindNode(context.Background(), gone.ID)
+	assert.Nil(t, err)
+	for _, c := range nodes[0].table.Closest(gone.ID, 8) {
+		assert.NotEqual(t, gone.ID, c.ID)
+	}
+}
@@ -0,0 +1,55 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"math/bits"
+)
+
+// IDLength is the size of node and key IDs in bytes (160 bits, as in Kademlia).
+const IDLength = sha1.Size
+
+// IDBits is the number of bits in an ID, and so the number of buckets in a routing table.
+const IDBits = IDLength * 8
+
+// ID places nodes and keys in the same XOR keyspace.
+type ID [IDLength]byte
+
+// NewID hashes a node ID or a key into the keyspace.
+func NewID(s string) ID {
+	return ID(sha1.Sum([]byte(s)))
+}
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Distance returns the XOR distance between two IDs.
+func (id ID) Distance(other ID) ID {
+	var d ID
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// Less reports whether id is smaller than other, used to compare distances.
+func (id ID) Less(other ID) bool {
+	return bytes.Compare(id[:], other[:]) < 0
+}
+
+// commonPrefixLen returns the number of leading bits id shares with other.
+func (id ID) commonPrefixLen(other ID) int {
+	for i := range id {
+		if x := id[i] ^ other[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return IDBits
+}
+
+// closer reports whether a is closer to target than b.
+func closer(target, a, b ID) bool {
+	return a.Distance(target).Less(b.Distance(target))
+}
@@ -0,0 +1,115 @@
+package dht
+
+import (
+	"slices"
+	"sync"
+)
+
+// Contact is everything needed to reach a node of the DHT.
+type Contact struct {
+	ID ID
+	// NodeID is the node's ID on the network, which ID is derived from.
+	NodeID string
+	// Addr is the address the node listens on.
+	Addr string
+}
+
+// NewContact returns the contact of the node with the given network ID.
+func NewContact(nodeID, addr string) Contact {
+	return Contact{
+		ID:     NewID(nodeID),
+		NodeID: nodeID,
+		Addr:   addr,
+	}
+}
+
+// RoutingTable keeps up to k contacts per bucket, one bucket for every
+// length of the prefix a contact shares with our own ID.
+type RoutingTable struct {
+	self ID
+	k    int
+
+	lock sync.Mutex
+	// buckets are ordered from least to most recently seen.
+	buckets [IDBits][]Contact
+}
+
+func NewRoutingTable(self ID, k int) *RoutingTable {
+	return &RoutingTable{
+		self: self,
+		k:    k,
+	}
+}
+
+func (rt *RoutingTable) bucketIndex(id ID) int {
+	return min(rt.self.commonPrefixLen(id), IDBits-1)
+}
+
+// Update records that we've heard from c. Known contacts move to the back of their bucket,
+// new ones are only added while the bucket has room, as long-lived nodes are the most likely to stay.
+func (rt *RoutingTable) Update(c Contact) {
+	if c.ID == rt.self {
+		return
+	}
+
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	i := rt.bucketIndex(c.ID)
+	bucket := rt.buckets[i]
+	if j := slices.IndexFunc(bucket, func(b Contact) bool { return b.ID == c.ID }); j >= 0 {
+		bucket = slices.Delete(bucket, j, j+1)
+	} else if len(bucket) >= rt.k {
+		return
+	}
+	rt.buckets[i] = append(bucket, c)
+}
+
+// Remove drops a contact, e.g. after it failed to answer.
+func (rt *RoutingTable) Remove(id ID) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	i := rt.bucketIndex(id)
+	rt.buckets[i] = slices.DeleteFunc(rt.buckets[i], func(c Contact) bool { return c.ID == id })
+}
+
+// Closest returns up to n known contacts, ordered by their distance to target.
+func (rt *RoutingTable) Closest(target ID, n int) []Contact {
+	rt.lock.Lock()
+	var contacts []Contact
+	for _, bucket := range rt.buckets {
+		contacts = append(contacts, bucket...)
+	}
+	rt.lock.Unlock()
+
+	sortByDistance(contacts, target)
+	if len(contacts) > n {
+		contacts = contacts[:n]
+	}
+	return contacts
+}
+
+// Len returns the number of known contacts.
+func (rt *RoutingTable) Len() int {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	n := 0
+	for _, bucket := range rt.buckets {
+		n += len(bucket)
+	}
+	return n
+}
+
+func sortByDistance(contacts []Contact, target ID) {
+	slices.SortFunc(contacts, func(a, b Contact) int {
+		switch {
+		case closer(target, a.ID, b.ID):
+			return -1
+		case closer(target, b.ID, a.ID):
+			return 1
+		}
+		return 0
+	})
+}
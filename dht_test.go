@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestRepublish(t *testing.T) {
+	s1, s2, _ := startRepairServers(t)
+
+	key := "republished.txt"
+	if err := s1.StoreReplicas(key, bytes.NewReader([]byte("announced again")), 3); err != nil {
+		t.Fatalf("Failed to store: %v", err)
+	}
+	m, err := s1.readManifest(key)
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+
+	// The manifest and its chunks are ours, the peer holds its copies of them for us
+	n, err := s1.republish(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to republish: %v", err)
+	}
+	if want := 1 + len(m.Chunks); n != want {
+		t.Errorf("Expected %d objects of ours announced, got %d", want, n)
+	}
+	held, _ := s2.store.dbHandler.Held()
+	if n, _ := s2.republish(context.Background()); len(held) == 0 || n != len(held) {
+		t.Errorf("Expected the %d objects held for s1 announced, got %d", len(held), n)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// MessageDrain tells peers a node is leaving the cluster: while Draining it takes no
+// new copies. Done is set once nothing depends on it anymore.
+type MessageDrain struct {
+	Draining bool
+	Done     bool
+}
+
+// DrainReport tells how far a drain got.
+type DrainReport struct {
+	// Files are our own files, FilesDone the ones with enough copies on other nodes.
+	Files     int
+	FilesDone int
+	// ObjectsMoved counts the copies made on other nodes, of our files and of the objects we held for others.
+	ObjectsMoved int64
+	BytesMoved   int64
+	// Stuck counts the objects we held for others that no other node holds and none could take.
+	Stuck int64
+}
+
+// Safe reports whether the node can be shut down without losing any copy.
+func (r DrainReport) Safe() bool {
+	return r.FilesDone == r.Files && r.Stuck == 0
+}
+
+func (r DrainReport) String() string {
+	return fmt.Sprintf("%d of %d files done, moved %d objects (%d bytes), %d stuck",
+		r.FilesDone, r.Files, r.ObjectsMoved, r.BytesMoved, r.Stuck)
+}
+
+// drainer holds the state of a drain.
+type drainer struct {
+	// running is held during a drain, so drains never overlap
+	running sync.Mutex
+	// active is set from the start of a drain until it's cancelled, across restarts
+	active atomic.Bool
+}
+
+// Draining reports whether this node is draining.
+func (s *FileServer) Draining() bool {
+	return s.drain.active.Load()
+}
+
+// Drain prepares the node to leave the cluster: it stops taking new copies, makes sure
+// every file of ours has its number of copies on other nodes, and hands the objects we
+// hold for other nodes to nodes without a copy. Progress is kept in the database, an
+// interrupted drain resumes where it stopped when called again. Once the report is
+// Safe, peers are told to forget about us and the node can be shut down.
+func (s *FileServer) Drain(ctx context.Context) (DrainReport, error) {
+	if !s.drain.running.TryLock() {
+		return DrainReport{}, errors.New("a drain is already running")
+	}
+	defer s.drain.running.Unlock()
+
+	var report DrainReport
+	if !s.drain.active.Load() {
+		if err := s.store.dbHandler.SetDraining(true); err != nil {
+			return report, err
+		}
+		s.drain.active.Store(true)
+		log.Printf("[%s] draining: no longer taking new copies", s.Transport.Addr())
+	}
+	s.broadcast(&Message{Payload: MessageDrain{Draining: true}})
+
+	// Our files: the copies on disk here don't count anymore, see repairFile
+	files, err := s.store.dbHandler.ListFiles()
+	if err != nil {
+		return report, err
+	}
+	report.Files = len(files)
+	for _, fmd := range files {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if done, _ := s.store.dbHandler.Drained(fmd.Key); done {
+			report.FilesDone++
+			continue
+		}
+		var pass RepairStats
+		err := s.repairFile(ctx, fmd, &pass)
+		report.ObjectsMoved += pass.ObjectsRepaired
+		report.BytesMoved += pass.BytesRepaired
+		if err != nil || pass.UnderReplicated > 0 {
+			log.Printf("[%s] drain: (%s) still depends on this node: %v", s.Transport.Addr(), fmd.Key, err)
+			continue
+		}
+		if err := s.store.dbHandler.MarkDrained(fmd.Key); err != nil {
+			return report, err
+		}
+		report.FilesDone++
+	}
+
+	// The objects we hold for other nodes: hinted ones go to their node when it's
+	// around, the rest to a node without a copy
+	for _, peer := range s.peerList() {
+		s.deliverHints(peer)
+	}
+	held, err := s.store.dbHandler.Held()
+	if err != nil {
+		return report, err
+	}
+	for _, o := range held {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		n, err := s.drainObject(ctx, o)
+		if err != nil {
+			log.Printf("[%s] drain: failed to move (%s): %v", s.Transport.Addr(), o.Key, err)
+			report.Stuck++
+			continue
+		}
+		if n > 0 {
+			report.ObjectsMoved++
+			report.BytesMoved += n
+		}
+	}
+
+	log.Printf("[%s] drain: %s", s.Transport.Addr(), report)
+	if report.Safe() {
+		s.broadcast(&Message{Payload: MessageDrain{Draining: true, Done: true}})
+		log.Printf("[%s] drained, safe to shut down", s.Transport.Addr())
+	}
+	return report, nil
+}
+
+// CancelDrain makes the node take new copies again and forgets the progress of the drain.
+func (s *FileServer) CancelDrain() error {
+	if err := s.store.dbHandler.SetDraining(false); err != nil {
+		return err
+	}
+	s.drain.active.Store(false)
+	return s.broadcast(&Message{Payload: MessageDrain{}})
+}
+
+var errNoTarget = errors.New("no other node can take it and too few copies remain")
+
+// drainObject hands an object we hold for another node to a peer without a copy of it,
+// then drops ours. Ours is kept unless the peer acknowledged the new copy, or peers
+// confirmed holding ReplicationFactor copies already, or a copy each when there are
+// fewer of them left. It returns the number of bytes sent.
+func (s *FileServer) drainObject(ctx context.Context, o HeldObject) (int64, error) {
+	if !s.store.Has(o.ID, o.Key) {
+		return 0, s.store.dbHandler.RemoveHeld(o.ID, o.Key)
+	}
+
+	var hint *Hint
+	hints, err := s.store.dbHandler.Hints("")
+	if err != nil {
+		return 0, err
+	}
+	if i := slices.IndexFunc(hints, func(h Hint) bool { return h.ID == o.ID && h.Key == o.Key }); i >= 0 {
+		hint = &hints[i]
+	}
+
+	// The DHT may list nodes that lost their copy, ask the peers themselves
+	holders := s.heldBy(ctx, o.ID, o.Key)
+	_, r, err := s.store.Read(o.ID, o.Key)
+	if err != nil {
+		return 0, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	var left int
+	s.peerLock.Lock()
+	for id := range s.peers {
+		if !s.draining[id] {
+			left++
+		}
+	}
+	s.peerLock.Unlock()
+
+	var sent int64
+	if len(holders) < min(s.ReplicationFactor, left) || len(holders) == 0 {
+		peers := s.placeReplicas(o.Key, 1, int64(len(data)), holders...)
+		if len(peers) == 0 {
+			return 0, errNoTarget
+		}
+		msg := MessageStoreFile{
+			ID:   o.ID,
+			Key:  o.Key,
+			Size: int64(len(data)),
+		}
+		if hint != nil {
+			msg.Hint, msg.Proof = hint.Target, hint.Proof
+		}
+		if err := s.sendObjectTo(ctx, peers[0], &Message{Payload: msg}, data); err != nil {
+			return 0, err
+		}
+		sent = int64(len(data))
+	}
+
+	if hint != nil {
+		if err := s.store.dbHandler.RemoveHint(*hint); err != nil {
+			return sent, err
+		}
+	}
+	if err := s.store.discard(o.ID, o.Key); err != nil {
+		return sent, err
+	}
+	s.unprovide(o.ID, o.Key)
+	return sent, s.store.dbHandler.RemoveHeld(o.ID, o.Key)
+}
+
+func (s *FileServer) handleMessageDrain(from string, msg MessageDrain) error {
+	s.peerLock.Lock()
+	if msg.Draining {
+		s.draining[from] = true
+	} else {
+		delete(s.draining, from)
+	}
+	s.peerLock.Unlock()
+
+	if !msg.Done {
+		return nil
+	}
+	// The node is leaving, stop listing it among the holders of our files
+	files, err := s.store.dbHandler.ListFiles()
+	if err != nil {
+		return err
+	}
+	for _, fmd := range files {
+		i := slices.Index(fmd.ReplicaLocations, from)
+		if i < 0 {
+			continue
+		}
+		fmd.ReplicaLocations = slices.Delete(fmd.ReplicaLocations, i, i+1)
+		if _, err := s.store.dbHandler.UpdateFile(fmd); err != nil {
+			return err
+		}
+	}
+	log.Printf("[%s] (%s) left the cluster", s.Transport.Addr(), from)
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/20af02/MosaicFS/crypto"
+)
+
+func TestDrain(t *testing.T) {
+	s1, s2, s3 := startRepairServers(t)
+
+	if err := s1.StoreReplicas("mine.txt", bytes.NewReader([]byte("owned by s1")), 2); err != nil {
+		t.Fatalf("Failed to store: %v", err)
+	}
+	if err := s2.StoreReplicas("theirs.txt", bytes.NewReader([]byte("owned by s2")), 3); err != nil {
+		t.Fatalf("Failed to store: %v", err)
+	}
+	if !s1.store.Has(s2.ID, crypto.HashKey("theirs.txt")) {
+		t.Fatalf("Expected s1 to hold a copy for s2")
+	}
+
+	// Interrupted right away, the drain is remembered
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s1.Drain(ctx); err == nil {
+		t.Fatalf("Expected the cancelled drain to fail")
+	}
+	if draining, _ := s1.store.dbHandler.Draining(); !draining {
+		t.Fatalf("Expected the drain to be recorded")
+	}
+
+	report, err := s1.Drain(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to drain: %v", err)
+	}
+	if !report.Safe() {
+		t.Fatalf("Expected the drain to be safe: %s", report)
+	}
+	for _, s := range []*FileServer{s2, s3} {
+		if !s.store.Has(s1.ID, crypto.HashKey("mine.txt")) {
+			t.Errorf("[%s] Expected a copy of s1's file", s.Transport.Addr())
+		}
+	}
+	if s1.store.Has(s2.ID, crypto.HashKey("theirs.txt")) {
+		t.Errorf("Expected s1 to drop the copy it held for s2")
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	// No new copies for a draining node
+	if err := s2.StoreReplicas("later.txt", bytes.NewReader([]byte("after the drain")), 3); err != nil {
+		t.Fatalf("Failed to store: %v", err)
+	}
+	if s1.store.Has(s2.ID, crypto.HashKey("later.txt")) {
+		t.Errorf("Expected s1 to take no new copies")
+	}
+	fmd, err := s2.store.dbHandler.GetFileMetadata("theirs.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range fmd.ReplicaLocations {
+		if id == s1.ID {
+			t.Errorf("Expected s1 to be gone from the locations of s2's file")
+		}
+	}
+
+	if err := s1.CancelDrain(); err != nil {
+		t.Fatal(err)
+	}
+	if s1.Draining() {
+		t.Errorf("Expected the drain to be cancelled")
+	}
+}
+
+func TestDrainConfirmsHolders(t *testing.T) {
+	s1, s2, s3 := startRepairServers(t)
+
+	key := crypto.HashKey("theirs.txt")
+	if err := s2.StoreReplicas("theirs.txt", bytes.NewReader([]byte("owned by s2")), 3); err != nil {
+		t.Fatalf("Failed to store: %v", err)
+	}
+	// s3 lost its copy, the DHT still lists it
+	if err := s3.store.Delete(s2.ID, key); err != nil {
+		t.Fatal(err)
+	}
+	s1.Placement = preferPlacement{first: s3.ID}
+
+	report, err := s1.Drain(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to drain: %v", err)
+	}
+	if !report.Safe() {
+		t.Fatalf("Expected the drain to be safe: %s", report)
+	}
+	if !s3.store.Has(s2.ID, key) {
+		t.Errorf("Expected s3 to get the copy s1 held back")
+	}
+	if s1.store.Has(s2.ID, key) {
+		t.Errorf("Expected s1 to drop its copy")
+	}
+}
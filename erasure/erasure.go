@@ -0,0 +1,236 @@
+// Package erasure implements systematic Reed-Solomon erasure coding over GF(2^8).
+//
+// Data is split into k data shards and m parity shards are computed from them.
+// Any k of the k+m shards are enough to rebuild the data, so up to m shards may
+// be lost while using (k+m)/k times the space instead of m+1 full copies.
+package erasure
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Scheme is a k+m erasure coding scheme: Data shards and Parity shards.
+type Scheme struct {
+	Data   int
+	Parity int
+}
+
+// Parse reads a scheme written as "k+m", e.g. "4+2".
+func Parse(s string) (Scheme, error) {
+	k, m, ok := strings.Cut(s, "+")
+	if !ok {
+		return Scheme{}, fmt.Errorf("erasure: invalid scheme %q, want k+m", s)
+	}
+	var sc Scheme
+	var err error
+	if sc.Data, err = strconv.Atoi(strings.TrimSpace(k)); err != nil {
+		return Scheme{}, fmt.Errorf("erasure: invalid scheme %q: %w", s, err)
+	}
+	if sc.Parity, err = strconv.Atoi(strings.TrimSpace(m)); err != nil {
+		return Scheme{}, fmt.Errorf("erasure: invalid scheme %q: %w", s, err)
+	}
+	return sc, sc.Validate()
+}
+
+// Validate checks the scheme can be encoded.
+func (sc Scheme) Validate() error {
+	if sc.Data < 1 || sc.Parity < 0 || sc.Total() > 256 {
+		return fmt.Errorf("erasure: invalid scheme %s", sc)
+	}
+	return nil
+}
+
+// Total returns the number of shards, k+m.
+func (sc Scheme) Total() int {
+	return sc.Data + sc.Parity
+}
+
+func (sc Scheme) String() string {
+	return fmt.Sprintf("%d+%d", sc.Data, sc.Parity)
+}
+
+// ErrTooFewShards is returned by Reconstruct when less than k shards are present.
+var ErrTooFewShards = errors.New("erasure: too few shards to reconstruct")
+
+// Coder encodes and reconstructs shards for a scheme.
+type Coder struct {
+	Scheme
+	// matrix is the (k+m) x k encoding matrix: the identity on top, so data
+	// shards are stored as is, and a Cauchy matrix below. Every k x k submatrix
+	// of it is invertible, which is what makes any k shards enough.
+	matrix [][]byte
+}
+
+func New(sc Scheme) (*Coder, error) {
+	if err := sc.Validate(); err != nil {
+		return nil, err
+	}
+
+	matrix := make([][]byte, sc.Total())
+	for i := range matrix {
+		matrix[i] = make([]byte, sc.Data)
+		if i < sc.Data {
+			matrix[i][i] = 1
+			continue
+		}
+		for j := range matrix[i] {
+			// x = i and y = j never collide since i >= k > j
+			matrix[i][j] = inv(byte(i) ^ byte(j))
+		}
+	}
+	return &Coder{Scheme: sc, matrix: matrix}, nil
+}
+
+// Split cuts data into k zero-padded data shards and computes the m parity shards.
+// Join needs the original length to strip the padding.
+func (c *Coder) Split(data []byte) [][]byte {
+	size := max((len(data)+c.Data-1)/c.Data, 1)
+	buf := make([]byte, size*c.Total())
+	copy(buf, data)
+
+	shards := make([][]byte, c.Total())
+	for i := range shards {
+		shards[i] = buf[i*size : (i+1)*size]
+	}
+	c.encode(shards, c.Data)
+	return shards
+}
+
+// encode computes the shards from `from` on out of the data shards.
+func (c *Coder) encode(shards [][]byte, from int) {
+	for i := from; i < c.Total(); i++ {
+		clear(shards[i])
+		for j := 0; j < c.Data; j++ {
+			mulAdd(shards[i], shards[j], c.matrix[i][j])
+		}
+	}
+}
+
+// Reconstruct rebuilds the missing shards, given as nil, from any k of the others.
+// All the shards present must have the same size.
+func (c *Coder) Reconstruct(shards [][]byte) error {
+	if len(shards) != c.Total() {
+		return fmt.Errorf("erasure: got %d shards, want %d", len(shards), c.Total())
+	}
+
+	// Pick the first k shards present
+	rows := make([]int, 0, c.Data)
+	size := -1
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		if size >= 0 && len(shard) != size {
+			return errors.New("erasure: shards have different sizes")
+		}
+		size = len(shard)
+		if len(rows) < c.Data {
+			rows = append(rows, i)
+		}
+	}
+	if len(rows) < c.Data {
+		return ErrTooFewShards
+	}
+
+	missingData := false
+	for i := 0; i < c.Data; i++ {
+		if shards[i] == nil {
+			missingData = true
+		}
+	}
+	if missingData {
+		// The shards present are the data times the rows of the matrix they came from,
+		// inverting those rows gives the data back.
+		sub := make([][]byte, c.Data)
+		for i, row := range rows {
+			sub[i] = c.matrix[row]
+		}
+		decode, err := invert(sub)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < c.Data; i++ {
+			if shards[i] != nil {
+				continue
+			}
+			shard := make([]byte, size)
+			for j, row := range rows {
+				mulAdd(shard, shards[row], decode[i][j])
+			}
+			shards[i] = shard
+		}
+	}
+
+	for i := c.Data; i < c.Total(); i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, size)
+			for j := 0; j < c.Data; j++ {
+				mulAdd(shards[i], shards[j], c.matrix[i][j])
+			}
+		}
+	}
+	return nil
+}
+
+// Join concatenates the data shards and strips the padding Split added.
+func (c *Coder) Join(shards [][]byte, size int) ([]byte, error) {
+	if len(shards) < c.Data {
+		return nil, ErrTooFewShards
+	}
+	data := make([]byte, 0, size)
+	for _, shard := range shards[:c.Data] {
+		if shard == nil {
+			return nil, ErrTooFewShards
+		}
+		data = append(data, shard...)
+	}
+	if len(data) < size {
+		return nil, errors.New("erasure: shards shorter than the data")
+	}
+	return data[:size], nil
+}
+
+// invert returns the inverse of the square matrix m with Gauss-Jordan elimination.
+func invert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	// Work on [m | I]
+	work := make([][]byte, n)
+	for i := range work {
+		work[i] = make([]byte, 2*n)
+		copy(work[i], m[i])
+		work[i][n+i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for row := col; row < n; row++ {
+			if work[row][col] != 0 {
+				pivot = row
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, errors.New("erasure: singular matrix")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+
+		scale := inv(work[col][col])
+		for j := range work[col] {
+			work[col][j] = mul(work[col][j], scale)
+		}
+		for row := 0; row < n; row++ {
+			if row != col && work[row][col] != 0 {
+				mulAdd(work[row], work[col], work[row][col])
+			}
+		}
+	}
+
+	out := make([][]byte, n)
+	for i := range out {
+		out[i] = work[i][n:]
+	}
+	return out, nil
+}
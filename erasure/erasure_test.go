@@ -0,0 +1,70 @@
+package erasure
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	sc, err := Parse("4+2")
+	assert.Nil(t, err)
+	assert.Equal(t, Scheme{Data: 4, Parity: 2}, sc)
+	assert.Equal(t, "4+2", sc.String())
+	assert.Equal(t, 6, sc.Total())
+
+	for _, s := range []string{"", "4", "0+2", "4+-1", "a+b", "200+100"} {
+		_, err := Parse(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestGalois(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		assert.Equal(t, byte(1), mul(byte(a), inv(byte(a))))
+	}
+	assert.Equal(t, byte(0), mul(0, 7))
+}
+
+func TestReconstructAnyK(t *testing.T) {
+	c, err := New(Scheme{Data: 4, Parity: 2})
+	assert.Nil(t, err)
+
+	data := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(data)
+	shards := c.Split(data)
+	assert.Len(t, shards, 6)
+
+	// Lose every pair of shards
+	for i := 0; i < 6; i++ {
+		for j := i + 1; j < 6; j++ {
+			lost := make([][]byte, len(shards))
+			copy(lost, shards)
+			lost[i], lost[j] = nil, nil
+
+			assert.Nil(t, c.Reconstruct(lost))
+			assert.Equal(t, shards, lost)
+			got, err := c.Join(lost, len(data))
+			assert.Nil(t, err)
+			assert.Equal(t, data, got)
+		}
+	}
+
+	lost := make([][]byte, len(shards))
+	copy(lost, shards)
+	lost[0], lost[1], lost[2] = nil, nil, nil
+	assert.ErrorIs(t, c.Reconstruct(lost), ErrTooFewShards)
+}
+
+func TestSplitSmall(t *testing.T) {
+	c, err := New(Scheme{Data: 3, Parity: 1})
+	assert.Nil(t, err)
+
+	shards := c.Split([]byte("hi"))
+	shards[0] = nil
+	assert.Nil(t, c.Reconstruct(shards))
+	got, err := c.Join(shards, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hi"), got)
+}
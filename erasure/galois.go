@@ -0,0 +1,48 @@
+package erasure
+
+// Arithmetic in GF(2^8) with the polynomial x^8 + x^4 + x^3 + x^2 + 1 (0x11d),
+// the usual one for Reed-Solomon. Addition is XOR, multiplication goes through
+// logarithms of the generator 2.
+
+var (
+	expTable [510]byte // Doubled so exp[log a + log b] needs no modulo
+	logTable [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+// inv returns the multiplicative inverse of a, which must not be 0.
+func inv(a byte) byte {
+	return expTable[255-int(logTable[a])]
+}
+
+// mulAdd adds c*src to dst.
+func mulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	logC := int(logTable[c])
+	for i, b := range src {
+		if b != 0 {
+			dst[i] ^= expTable[logC+int(logTable[b])]
+		}
+	}
+}
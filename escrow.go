@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/20af02/MosaicFS/crypto"
+	"github.com/20af02/MosaicFS/p2p"
+	"github.com/20af02/MosaicFS/shamir"
+)
+
+// The master key only lives in the node's .env file: once lost, none of its files can be
+// read anymore. Escrowing it splits it into shares held by peers, a threshold of which
+// gives it back to a node started afresh. Peers keep the shares by the ID of the node
+// they are of, and only hand one back to whoever proves knowing the recovery passphrase:
+// the identity key may be lost along with the .env file. Shares are encrypted with a key
+// derived from the passphrase, so the holders can't pool them.
+
+// maxEscrowShareSize caps the shares peers may hand us to hold.
+const maxEscrowShareSize = 4096
+
+// EscrowShare is a share of a node's master key, as its holder keeps it.
+type EscrowShare struct {
+	// Salt is the salt the key Data is encrypted with is derived from the recovery
+	// passphrase with, the same for every share of an escrow.
+	Salt []byte
+	// Data is an escrowSecret, encrypted.
+	Data []byte
+	// Verifier is the hash of the token the share is handed back for, see escrowToken.
+	Verifier []byte
+}
+
+// escrowSecret is the content of a share.
+type escrowSecret struct {
+	// ID tells the escrows apart, only the shares of the same one combine.
+	ID string
+	// Version is the version of the master key and Threshold the shares needed to recover it.
+	Version   int
+	Threshold int
+	// X and Y are the share of the master key followed by the chunk hash key.
+	X byte
+	Y []byte
+}
+
+// MessageEscrow hands a peer a share of our master key to hold, or with Revoke set asks
+// it to drop the one it holds. Otherwise it asks for the share the peer holds for the
+// node Owner: its salt alone, the whole share when Token matches its verifier.
+type MessageEscrow struct {
+	Share  *EscrowShare
+	Revoke bool
+	Owner  string
+	Token  []byte
+}
+
+type MessageEscrowResponse struct {
+	Share *EscrowShare
+	Err   string
+}
+
+// EscrowKey splits the master key into n shares, t of which are needed to recover it with
+// RecoverKey, and hands them to holders, or to n peers picked by the placement policy when
+// there are none. Each share is encrypted with a key derived from passphrase.
+func (s *FileServer) EscrowKey(ctx context.Context, passphrase []byte, n, t int, holders []string) (KeyEscrow, error) {
+	if len(passphrase) == 0 {
+		return KeyEscrow{}, errors.New("empty passphrase")
+	}
+	var peers []p2p.Peer
+	if len(holders) > 0 {
+		n = len(holders)
+		for _, id := range holders {
+			peer, ok := s.peer(id)
+			if !ok {
+				return KeyEscrow{}, fmt.Errorf("peer (%s) not connected", id)
+			}
+			peers = append(peers, peer)
+		}
+	} else {
+		peers = s.placeReplicas("escrow/"+s.ID, n, 0)
+	}
+	if len(peers) < n {
+		return KeyEscrow{}, fmt.Errorf("only %d peers to hold %d shares", len(peers), n)
+	}
+
+	// A rotation would leave the shares with the old key
+	s.keys.rotate.RLock()
+	defer s.keys.rotate.RUnlock()
+	master, version := s.keys.current()
+	shares, err := shamir.Split(append(slices.Clone(master), s.keys.hashKey()...), n, t)
+	if err != nil {
+		return KeyEscrow{}, err
+	}
+	salt := crypto.NewSalt()
+	kek, err := crypto.DeriveKey(passphrase, salt)
+	if err != nil {
+		return KeyEscrow{}, err
+	}
+	verifier := sha256.Sum256(escrowToken(kek))
+
+	escrow := KeyEscrow{Version: version, Shares: n, Threshold: t, Created: time.Now()}
+	id := crypto.GenerateID()
+	var errs []error
+	for i, peer := range peers {
+		buf := new(bytes.Buffer)
+		secret := escrowSecret{ID: id, Version: version, Threshold: t, X: shares[i].X, Y: shares[i].Y}
+		if err := gob.NewEncoder(buf).Encode(secret); err != nil {
+			return KeyEscrow{}, err
+		}
+		data, err := crypto.WrapKey(kek, buf.Bytes())
+		if err != nil {
+			return KeyEscrow{}, err
+		}
+		share := &EscrowShare{Salt: salt, Data: data, Verifier: verifier[:]}
+		if _, err := s.callEscrow(ctx, peer, MessageEscrow{Share: share}); err != nil {
+			errs = append(errs, fmt.Errorf("(%s): %w", peer.ID(), err))
+			continue
+		}
+		escrow.Holders = append(escrow.Holders, peer.ID())
+	}
+	if err := errors.Join(errs...); err != nil {
+		return escrow, fmt.Errorf("%d of %d shares not escrowed: %w", len(errs), n, err)
+	}
+	if err := s.store.dbHandler.SetEscrow(&escrow); err != nil {
+		return escrow, err
+	}
+	log.Printf("[%s] escrowed the master key version %d: %d of %d shares held by %v", s.Transport.Addr(), version, t, n, escrow.Holders)
+	return escrow, nil
+}
+
+// Escrowed returns the last escrow of the master key, nil when it was never escrowed.
+func (s *FileServer) Escrowed() (*KeyEscrow, error) {
+	return s.store.dbHandler.Escrow()
+}
+
+// RecoverKey restores the master key the node owner escrowed with EscrowKey, ours when
+// owner is empty, from the shares its peers hold, and saves it with SaveKey. The shares
+// of the most recent key version reaching their threshold are used.
+//
+// It's meant for a node started afresh after its .env file was lost, with a new identity
+// key if that one was lost too: it refuses to run when files of ours are wrapped with
+// the current key, as replacing it would lose them.
+func (s *FileServer) RecoverKey(ctx context.Context, passphrase []byte, owner string) (int, error) {
+	if s.SaveKey == nil {
+		return 0, errors.New("no way to save the recovered master key")
+	}
+	if owner == "" {
+		owner = s.ID
+	}
+	if !s.keys.running.TryLock() {
+		return 0, errors.New("a key rotation is running")
+	}
+	defer s.keys.running.Unlock()
+	s.keys.rotate.Lock()
+	defer s.keys.rotate.Unlock()
+
+	files, err := s.store.dbHandler.ListFiles()
+	if err != nil {
+		return 0, err
+	}
+	for _, fmd := range files {
+		if fmd.DataKey == nil {
+			continue
+		}
+		if kek, err := s.keys.kek(fmd.KeyVersion); err == nil {
+			if _, err := crypto.UnwrapKey(kek, fmd.DataKey); err == nil {
+				return 0, fmt.Errorf("the master key is in use, by (%s)", fmd.Key)
+			}
+		}
+	}
+
+	// Shares of the same escrow, by ID
+	groups := make(map[string][]escrowSecret)
+	keks := make(map[string][]byte)
+	var got, locked int
+	for _, peer := range s.peerList() {
+		// The salt first, to derive the token the share is handed for
+		resp, err := s.callEscrow(ctx, peer, MessageEscrow{Owner: owner})
+		if err != nil {
+			log.Printf("[%s] failed to get a key share from (%s): %v", s.Transport.Addr(), peer.ID(), err)
+			continue
+		}
+		if resp.Share == nil {
+			continue
+		}
+		got++
+		kek, ok := keks[string(resp.Share.Salt)]
+		if !ok {
+			if kek, err = crypto.DeriveKey(passphrase, resp.Share.Salt); err != nil {
+				return 0, err
+			}
+			keks[string(resp.Share.Salt)] = kek
+		}
+		resp, err = s.callEscrow(ctx, peer, MessageEscrow{Owner: owner, Token: escrowToken(kek)})
+		if err != nil {
+			log.Printf("[%s] failed to get a key share from (%s): %v", s.Transport.Addr(), peer.ID(), err)
+			got--
+			continue
+		}
+		if resp.Share == nil || len(resp.Share.Data) == 0 {
+			locked++
+			continue
+		}
+		data, err := crypto.UnwrapKey(kek, resp.Share.Data)
+		if err != nil {
+			locked++
+			continue
+		}
+		var secret escrowSecret
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&secret); err != nil {
+			return 0, fmt.Errorf("key share from (%s): %w", peer.ID(), err)
+		}
+		groups[secret.ID] = append(groups[secret.ID], secret)
+	}
+	if got == 0 {
+		return 0, fmt.Errorf("no peer holds a share of the key of (%s)", owner)
+	}
+
+	var best []escrowSecret
+	for _, group := range groups {
+		if len(group) >= group[0].Threshold && (best == nil || group[0].Version > best[0].Version) {
+			best = group
+		}
+	}
+	if best == nil {
+		if locked == got {
+			return 0, errors.New("the passphrase unlocks none of the key shares")
+		}
+		return 0, fmt.Errorf("not enough key shares: %d from %d peers, %d not unlocked with the passphrase", got-locked, got, locked)
+	}
+	shares := make([]shamir.Share, len(best))
+	for i, secret := range best {
+		shares[i] = shamir.Share{X: secret.X, Y: secret.Y}
+	}
+	secret, err := shamir.Combine(shares)
+	if err != nil {
+		return 0, err
+	}
+	if len(secret) != 64 {
+		return 0, fmt.Errorf("invalid recovered key size: %d", len(secret))
+	}
+	master, hash := secret[:32], secret[32:]
+	version := best[0].Version
+
+	if err := s.SaveKey(master, version); err != nil {
+		return 0, fmt.Errorf("save the recovered key: %w", err)
+	}
+	wrapped, err := crypto.WrapKey(master, hash)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.store.dbHandler.SetHashKey(wrapped); err != nil {
+		return 0, err
+	}
+	if err := s.store.dbHandler.SetRotation(nil); err != nil {
+		return 0, err
+	}
+	s.keys.lock.Lock()
+	s.keys.master, s.keys.version, s.keys.next, s.keys.hash = master, version, nil, hash
+	s.keys.lock.Unlock()
+	log.Printf("[%s] recovered the master key version %d from %d key shares", s.Transport.Addr(), version, len(best))
+	return version, nil
+}
+
+func (s *FileServer) callEscrow(ctx context.Context, peer p2p.Peer, msg MessageEscrow) (MessageEscrowResponse, error) {
+	st, err := peer.OpenStream()
+	if err != nil {
+		return MessageEscrowResponse{}, err
+	}
+	defer st.Close()
+
+	stop := context.AfterFunc(ctx, func() { st.Close() })
+	defer stop()
+
+	if err := writeMessage(st, &Message{Payload: msg}); err != nil {
+		return MessageEscrowResponse{}, err
+	}
+	resp, err := readMessage(st)
+	if err != nil {
+		return MessageEscrowResponse{}, err
+	}
+	v, ok := resp.Payload.(MessageEscrowResponse)
+	if !ok {
+		return MessageEscrowResponse{}, fmt.Errorf("unexpected escrow response: %T", resp.Payload)
+	}
+	if v.Err != "" {
+		return v, errors.New(v.Err)
+	}
+	return v, nil
+}
+
+// escrowToken returns the token proving the knowledge of the recovery passphrase kek
+// is derived from. Holders only keep its hash, which gives neither it nor kek away.
+func escrowToken(kek []byte) []byte {
+	mac := hmac.New(sha256.New, kek)
+	mac.Write([]byte("mosaicfs escrow token"))
+	return mac.Sum(nil)
+}
+
+// authenticated reports whether peer proved it holds the identity key its ID is bound to.
+// It's false for peers that connected without a secure handshake.
+func authenticated(peer p2p.Peer) bool {
+	p, ok := peer.(interface{ PublicKey() ed25519.PublicKey })
+	return ok && p.PublicKey() != nil
+}
+
+// handleMessageEscrow keeps or drops the share of its key the peer hands us, or sends
+// the share of msg.Owner back. Only the node itself changes its share, while anyone
+// with the token gets it: it's of no use without the recovery passphrase anyway.
+func (s *FileServer) handleMessageEscrow(peer p2p.Peer, msg MessageEscrow, st p2p.Stream) error {
+	var resp MessageEscrowResponse
+	var err error
+	switch {
+	case (msg.Share != nil || msg.Revoke) && !authenticated(peer):
+		err = fmt.Errorf("(%s) isn't authenticated, key shares are only held for authenticated nodes", peer.ID())
+	case msg.Revoke:
+		if err = s.store.dbHandler.SetEscrowShare(peer.ID(), nil); err == nil {
+			log.Printf("[%s] dropped the key share of (%s)", s.Transport.Addr(), peer.ID())
+		}
+	case msg.Share != nil:
+		if size := len(msg.Share.Salt) + len(msg.Share.Data) + len(msg.Share.Verifier); size > maxEscrowShareSize {
+			err = fmt.Errorf("key share too large: %d bytes", size)
+		} else if len(msg.Share.Verifier) != sha256.Size {
+			err = errors.New("key share without a verifier")
+		} else if err = s.store.dbHandler.SetEscrowShare(peer.ID(), msg.Share); err == nil {
+			log.Printf("[%s] holding a key share of (%s)", s.Transport.Addr(), peer.ID())
+		}
+	default:
+		var share *EscrowShare
+		if share, err = s.store.dbHandler.EscrowShare(msg.Owner); share != nil {
+			resp.Share = &EscrowShare{Salt: share.Salt}
+			if sum := sha256.Sum256(msg.Token); len(msg.Token) > 0 && hmac.Equal(sum[:], share.Verifier) {
+				resp.Share = share
+			}
+		}
+	}
+	if err != nil {
+		resp.Err = err.Error()
+	}
+	return writeMessage(st, &Message{Payload: resp})
+}
+
+// RevokeEscrow has the holders of the shares of old, an escrow replaced by a later
+// EscrowKey, drop them. Holders of the current escrow are left alone: their share of
+// old was replaced by the new one.
+func (s *FileServer) RevokeEscrow(ctx context.Context, old KeyEscrow) error {
+	escrow, err := s.store.dbHandler.Escrow()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, id := range old.Holders {
+		if escrow != nil && slices.Contains(escrow.Holders, id) {
+			continue
+		}
+		peer, ok := s.peer(id)
+		if !ok {
+			errs = append(errs, fmt.Errorf("peer (%s) not connected", id))
+			continue
+		}
+		if _, err := s.callEscrow(ctx, peer, MessageEscrow{Revoke: true}); err != nil {
+			errs = append(errs, fmt.Errorf("(%s): %w", id, err))
+		}
+	}
+	log.Printf("[%s] revoked the key shares of version %d", s.Transport.Addr(), old.Version)
+	return errors.Join(errs...)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/20af02/MosaicFS/crypto"
+	"github.com/20af02/MosaicFS/p2p"
+)
+
+// makeSecureTestServer is MakeTestServer with peers authenticated by their identity keys.
+func makeSecureTestServer(listenAddr string, bootstrapNodes []string) *FileServer {
+	nodeKey := crypto.NewNodeKey()
+	id := nodeID(nodeKey)
+	tcpTransport := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    listenAddr,
+		NodeID:        id,
+		HandshakeFunc: p2p.NewSecureHandshake(nodeKey, nil).Handshake,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	fs := NewFileServer(FileServerOpts{
+		ID:                id,
+		NodeKey:           nodeKey,
+		EncKey:            crypto.NewEncryptionKey(),
+		StorageRoot:       "test" + listenAddr[1:] + "_network",
+		PathTransformFunc: CASPathTransformFunc,
+		Transport:         tcpTransport,
+		BootStrapNodes:    bootstrapNodes,
+		DBFile:            "./.env/.db/test_" + listenAddr[1:] + "_network.db",
+	})
+	tcpTransport.OnPeer = fs.OnPeer
+	tcpTransport.OnPeerDisconnect = fs.OnPeerDisconnect
+	return fs
+}
+
+func TestEscrowKey(t *testing.T) {
+	s1 := makeSecureTestServer(":3000", []string{})
+	s2 := makeSecureTestServer(":4000", []string{":3000"})
+	s3 := makeSecureTestServer(":5000", []string{":3000", ":4000"})
+	t.Cleanup(func() {
+		s1.Stop()
+		s2.Stop()
+		s3.Stop()
+		teardown(t, s1.store)
+		teardown(t, s2.store)
+		teardown(t, s3.store)
+	})
+	go func() { s1.Start() }()
+	go func() { s2.Start() }()
+	time.Sleep(2 * time.Second)
+	go func() { s3.Start() }()
+	time.Sleep(2 * time.Second)
+	var savedKey []byte
+	var savedVersion int
+	s1.SaveKey = func(key []byte, version int) error {
+		savedKey, savedVersion = key, version
+		return nil
+	}
+	ctx := context.Background()
+
+	data := make([]byte, 8*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := s1.StoreReplicas("escrowed.bin", bytes.NewReader(data), 2); err != nil {
+		t.Fatalf("Failed to store: %v", err)
+	}
+	// Rotated once, so the chunk hash key is no longer the master key
+	if _, err := s1.RotateKey(ctx); err != nil {
+		t.Fatalf("Failed to rotate: %v", err)
+	}
+	master, hash := savedKey, s1.keys.hashKey()
+
+	passphrase := []byte("correct horse battery staple")
+	escrow, err := s1.EscrowKey(ctx, passphrase, 2, 2, nil)
+	if err != nil {
+		t.Fatalf("Failed to escrow: %v", err)
+	}
+	slices.Sort(escrow.Holders)
+	want := []string{s2.ID, s3.ID}
+	slices.Sort(want)
+	if escrow.Version != 1 || !slices.Equal(escrow.Holders, want) {
+		t.Errorf("Expected version 1 held by s2 and s3, got version %d held by %v", escrow.Version, escrow.Holders)
+	}
+	if e, err := s1.Escrowed(); err != nil || e == nil || e.Threshold != 2 {
+		t.Errorf("Expected the escrow to be recorded, got %+v: %v", e, err)
+	}
+
+	// The key in use isn't replaced
+	if _, err := s1.RecoverKey(ctx, passphrase, ""); err == nil {
+		t.Errorf("Expected the recovery to refuse to replace the key in use")
+	}
+	// Shares are found by the ID of the node they are of
+	s2.SaveKey = func(key []byte, version int) error { return nil }
+	if _, err := s2.RecoverKey(ctx, passphrase, ""); err == nil {
+		t.Errorf("Expected s2 to get no shares")
+	}
+
+	// s1 loses its key
+	s1.keys = keyring{master: crypto.NewEncryptionKey(), hash: crypto.NewEncryptionKey()}
+	savedKey = nil
+	if _, err := s1.RecoverKey(ctx, []byte("wrong passphrase"), ""); err == nil {
+		t.Errorf("Expected the wrong passphrase not to recover the key")
+	}
+	version, err := s1.RecoverKey(ctx, passphrase, "")
+	if err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	if version != 1 || savedVersion != 1 || !bytes.Equal(savedKey, master) {
+		t.Errorf("Expected the master key version 1 to be recovered and saved, got version %d", version)
+	}
+	if !bytes.Equal(s1.keys.hashKey(), hash) {
+		t.Errorf("Expected the chunk hash key to be recovered")
+	}
+
+	// The file reads back from the peers
+	if err := s1.DeleteLocal("escrowed.bin"); err != nil {
+		t.Fatalf("Failed to delete locally: %v", err)
+	}
+	r, err := s1.Get("escrowed.bin")
+	if err != nil {
+		t.Fatalf("Failed to get: %v", err)
+	}
+	b := new(bytes.Buffer)
+	b.ReadFrom(r)
+	if !bytes.Equal(b.Bytes(), data) {
+		t.Errorf("Unexpected content")
+	}
+
+	// A node rebuilt with a new identity key recovers the key with the passphrase alone
+	s4 := makeSecureTestServer(":6000", []string{":4000", ":5000"})
+	t.Cleanup(func() {
+		s4.Stop()
+		teardown(t, s4.store)
+	})
+	go func() { s4.Start() }()
+	time.Sleep(2 * time.Second)
+	var rebuiltKey []byte
+	s4.SaveKey = func(key []byte, version int) error {
+		rebuiltKey = key
+		return nil
+	}
+	if _, err := s4.RecoverKey(ctx, passphrase, s1.ID); err != nil {
+		t.Fatalf("Failed to recover on a rebuilt node: %v", err)
+	}
+	if !bytes.Equal(rebuiltKey, master) {
+		t.Errorf("Expected the rebuilt node to recover the master key of s1")
+	}
+
+	// Rotating keeps the shares of the old key until the new one is escrowed
+	if _, err := s1.RotateKey(ctx); err != nil {
+		t.Fatalf("Failed to rotate: %v", err)
+	}
+	old, err := s1.Escrowed()
+	if err != nil || old == nil || old.Version != 1 {
+		t.Fatalf("Expected the escrow of version 1 to be kept, got %+v: %v", old, err)
+	}
+	if _, ok := s1.peer(s4.ID); !ok {
+		t.Fatalf("Expected s1 to be connected to s4")
+	}
+	escrow, err = s1.EscrowKey(ctx, passphrase, 2, 2, []string{s2.ID, s4.ID})
+	if err != nil {
+		t.Fatalf("Failed to escrow the new key: %v", err)
+	}
+	if err := s1.RevokeEscrow(ctx, *old); err != nil {
+		t.Fatalf("Failed to revoke: %v", err)
+	}
+	// s3 alone held a share of the old key only, s2 holds one of the new key instead
+	for s, held := range map[*FileServer]bool{s2: true, s3: false, s4: true} {
+		if share, _ := s.store.dbHandler.EscrowShare(s1.ID); (share != nil) != held {
+			t.Errorf("[%s] Expected a key share of s1 held: %t", s.Transport.Addr(), held)
+		}
+	}
+	if e, err := s1.Escrowed(); err != nil || e == nil || e.Version != 2 {
+		t.Errorf("Expected the escrow of version 2 to be recorded, got %+v: %v", e, err)
+	}
+}
+
+// keyPeer is a peer that proved it holds key.
+type keyPeer struct {
+	p2p.Peer
+	id  string
+	key ed25519.PublicKey
+}
+
+func (p keyPeer) ID() string                   { return p.id }
+func (p keyPeer) PublicKey() ed25519.PublicKey { return p.key }
+
+func TestEscrowShareAccess(t *testing.T) {
+	s := MakeTestServer(":3000", []string{})
+	defer func() {
+		s.Stop()
+		teardown(t, s.store)
+	}()
+	owner := crypto.NewNodeKey().Public().(ed25519.PublicKey)
+	other := crypto.NewNodeKey().Public().(ed25519.PublicKey)
+	call := func(peer p2p.Peer, msg MessageEscrow) MessageEscrowResponse {
+		var closed int
+		st := closeStream{Buffer: new(bytes.Buffer), closed: &closed}
+		if err := s.handleMessageEscrow(peer, msg, st); err != nil {
+			t.Fatalf("Failed to handle: %v", err)
+		}
+		resp, err := readMessage(st)
+		if err != nil {
+			t.Fatalf("Failed to read the response: %v", err)
+		}
+		return resp.Payload.(MessageEscrowResponse)
+	}
+
+	ownerPeer := keyPeer{id: p2p.NodeID(owner), key: owner}
+	token := escrowToken([]byte("kek"))
+	verifier := sha256.Sum256(token)
+	share := &EscrowShare{Salt: []byte("salt"), Data: []byte("share"), Verifier: verifier[:]}
+	if resp := call(keyPeer{id: p2p.NodeID(owner)}, MessageEscrow{Share: share}); resp.Err == "" {
+		t.Errorf("Expected an unauthenticated peer to be refused")
+	}
+	if resp := call(ownerPeer, MessageEscrow{Share: share}); resp.Err != "" {
+		t.Fatalf("Failed to escrow: %s", resp.Err)
+	}
+
+	// The salt is handed to anyone, the share only for the token
+	stranger := keyPeer{id: p2p.NodeID(other), key: other}
+	resp := call(stranger, MessageEscrow{Owner: ownerPeer.id})
+	if resp.Share == nil || !bytes.Equal(resp.Share.Salt, share.Salt) || resp.Share.Data != nil {
+		t.Errorf("Expected the salt alone, got %+v", resp)
+	}
+	resp = call(stranger, MessageEscrow{Owner: ownerPeer.id, Token: escrowToken([]byte("wrong"))})
+	if resp.Share == nil || resp.Share.Data != nil {
+		t.Errorf("Expected no share for the wrong token, got %+v", resp)
+	}
+	resp = call(stranger, MessageEscrow{Owner: ownerPeer.id, Token: token})
+	if resp.Share == nil || !bytes.Equal(resp.Share.Data, share.Data) {
+		t.Errorf("Expected the share for the token, got %+v", resp)
+	}
+
+	// Only the owner drops its share
+	call(stranger, MessageEscrow{Revoke: true})
+	if resp := call(stranger, MessageEscrow{Owner: ownerPeer.id}); resp.Share == nil {
+		t.Errorf("Expected another peer not to revoke the share")
+	}
+	call(ownerPeer, MessageEscrow{Revoke: true})
+	if resp := call(stranger, MessageEscrow{Owner: ownerPeer.id}); resp.Share != nil {
+		t.Errorf("Expected the owner to revoke its share")
+	}
+}
@@ -6,9 +6,12 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"text/tabwriter"
+	"time"
 
+	"github.com/20af02/MosaicFS/erasure"
 	"github.com/manifoldco/promptui"
 	"github.com/spf13/cobra"
 )
@@ -21,7 +24,11 @@ func NewFileServerCLI(fs *FileServer) *cobra.Command {
 	}
 
 	// get Command
-	var getNode string
+	var (
+		getNode        string
+		getTimeout     time.Duration
+		getConsistency string
+	)
 	getCmd := &cobra.Command{
 		Use:   "get [key]",
 		Short: "Get a file from the network",
@@ -29,17 +36,39 @@ func NewFileServerCLI(fs *FileServer) *cobra.Command {
 		Run: func(cmd *cobra.Command, args []string) {
 			key := args[0]
 
-			_, err := fs.Get(key)
+			var level Consistency
+			if getConsistency != "" {
+				var err error
+				if level, err = ParseConsistency(getConsistency); err != nil {
+					fmt.Printf("Error getting file [%s]: %v\n", key, err)
+					return
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(cmd.Context(), getTimeout)
+			defer cancel()
+
+			_, err := fs.GetConsistency(ctx, key, level)
 			if err != nil {
-				log.Fatalf("Error getting file: %v", err)
+				fmt.Printf("Error getting file [%s]: %v\n", key, err)
+				return
 			}
 			fmt.Printf("File [%s] retrieved successfully!\n", key)
 
 		},
+		PersistentPostRunE: func(cmd *cobra.Command, args []string) error {
+			// Reset flag to its default value before each run
+			return cmd.Flags().Set("consistency", "")
+		},
 	}
 	getCmd.Flags().StringVarP(&getNode, "node", "n", fs.Transport.Addr(), "Node address to fetch from")
+	getCmd.Flags().DurationVarP(&getTimeout, "timeout", "t", fs.RequestTimeout, "How long to wait for the network")
+	getCmd.Flags().StringVarP(&getConsistency, "consistency", "c", "", "How many copies must agree: one, quorum or all (defaults to read_consistency)")
 
 	// store Command
+	var storeReplicas int
+	var storeEC string
+	var storeConsistency string
 	storeCmd := &cobra.Command{
 		Use:   "store [filepath]",
 		Short: "Store a file on the network",
@@ -54,11 +83,57 @@ func NewFileServerCLI(fs *FileServer) *cobra.Command {
 			defer file.Close()
 
 			key := filePath
-			if err := fs.Store(key, file); err != nil {
+			var opts WriteOptions
+			if storeConsistency != "" {
+				if opts.Consistency, err = ParseConsistency(storeConsistency); err != nil {
+					fmt.Printf("Error storing file: %s\n", err)
+					return
+				}
+			}
+			switch {
+			case cmd.Flags().Changed("replicas"):
+				if storeReplicas < 1 {
+					fmt.Printf("Error storing file: invalid number of replicas: %d\n", storeReplicas)
+					return
+				}
+				opts.Replicas = storeReplicas
+			case storeEC != "":
+				ec, err := erasure.Parse(storeEC)
+				if err != nil {
+					fmt.Printf("Error storing file: %s\n", err)
+					return
+				}
+				opts.EC = &ec
+			}
+			if err := fs.StoreWith(key, file, opts); err != nil {
+				// Not enough copies were written, the node itself is fine
+				if errors.Is(err, ErrNoQuorum) {
+					fmt.Printf("Error storing file: %s\n", err)
+					return
+				}
 				log.Fatalf("Error storing file: %s", err)
 			}
 		},
+		PersistentPostRunE: func(cmd *cobra.Command, args []string) error {
+			// Reset flags to their default value before each run
+			if err := cmd.Flags().Set("ec", ""); err != nil {
+				return err
+			}
+			if err := cmd.Flags().Set("consistency", ""); err != nil {
+				return err
+			}
+			if err := cmd.Flags().Set("replicas", strconv.Itoa(fs.ReplicationFactor)); err != nil {
+				return err
+			}
+			cmd.Flags().Lookup("replicas").Changed = false
+			cmd.Flags().Lookup("ec").Changed = false
+			return nil
+		},
 	}
+	storeCmd.Flags().IntVarP(&storeReplicas, "replicas", "r", fs.ReplicationFactor, "Number of copies to keep, this node's included")
+	storeCmd.Flags().StringVar(&storeEC, "ec", "", "Erasure code the file as k data + m parity shards, e.g. 4+2")
+	storeCmd.Flags().StringVarP(&storeConsistency, "consistency", "c", "", "How many copies must be on disk: one, quorum or all (defaults to write_consistency)")
+	storeCmd.MarkFlagsMutuallyExclusive("replicas", "ec")
 
 	// delete Command
 	deleteCmd := &cobra.Command{
@@ -75,7 +150,7 @@ func NewFileServerCLI(fs *FileServer) *cobra.Command {
 			}
 
 			if deleteLocal {
-				if err := fs.store.Delete(fs.ID, key); err != nil {
+				if err := fs.DeleteLocal(key); err != nil {
 					fmt.Printf("Error deleting local file [%s]: %s\n", key, err)
 					return
 				}
@@ -101,7 +176,15 @@ func NewFileServerCLI(fs *FileServer) *cobra.Command {
 		Use:   "ls",
 		Short: "List all files on the network",
 		Run: func(cmd *cobra.Command, args []string) {
+			namespace, err := cmd.Flags().GetString("namespace")
+			if err != nil {
+				fmt.Printf("Error getting --namespace flag: %s\n", err)
+				return
+			}
 			files, err := fs.ListFiles()
+			if namespace != "" {
+				files, err = fs.ListNamespace(namespace)
+			}
 			if err != nil {
 				log.Fatalf("Error listing files: %v", err)
 			}
@@ -110,15 +193,256 @@ func NewFileServerCLI(fs *FileServer) *cobra.Command {
 			// Add rows to the tabwriter
 			fmt.Fprintln(w, "File\tSize (bytes)\tReplicas\tLocations")
 			for _, file := range files {
-				fmt.Fprintf(w, "%s\t%d\t%d\t%v\n", file.Key, file.Size, file.Replicas, file.ReplicaLocations)
+				replicas := strconv.Itoa(file.Replicas)
+				if file.ErasureCoding != "" {
+					replicas = "ec " + file.ErasureCoding
+				}
+				fmt.Fprintf(w, "%s\t%d\t%s\t%v\n", file.Key, file.Size, replicas, file.ReplicaLocations)
 			}
 
 			// Flush the tabwriter's buffer to output
 			w.Flush()
 		},
+		PersistentPostRunE: func(cmd *cobra.Command, args []string) error {
+			// Reset flag to its default value before each run
+			return cmd.Flags().Set("namespace", "")
+		},
+	}
+	lsCmd.Flags().StringP("namespace", "n", "", "List the files of another node, by its ID")
+
+	repairCmd := &cobra.Command{
+		Use:   "repair",
+		Short: "Restore the missing copies of our files now",
+		Run: func(cmd *cobra.Command, args []string) {
+			showStats, err := cmd.Flags().GetBool("stats")
+			if err != nil {
+				fmt.Printf("Error getting --stats flag: %s\n", err)
+				return
+			}
+			if !showStats {
+				pass, err := fs.Repair(context.Background())
+				if err != nil {
+					fmt.Printf("Error repairing files: %s\n", err)
+					return
+				}
+				fmt.Printf("Repair done: %s\n", pass)
+				return
+			}
+
+			stats := fs.RepairStats()
+			if stats.Runs == 0 {
+				fmt.Println("No repair has run yet")
+				return
+			}
+			fmt.Printf("%d runs, last at %s: %s\n", stats.Runs, stats.LastRun.Format(time.DateTime), stats)
+		},
+		PersistentPostRunE: func(cmd *cobra.Command, args []string) error {
+			// Reset flag to its default value before each run
+			return cmd.Flags().Set("stats", "false")
+		},
+	}
+	repairCmd.Flags().BoolP("stats", "s", false, "Show the totals of every repair so far instead of repairing")
+
+	drainCmd := &cobra.Command{
+		Use:   "drain",
+		Short: "Move everything off this node before shutting it down for good",
+		Run: func(cmd *cobra.Command, args []string) {
+			cancelDrain, err := cmd.Flags().GetBool("cancel")
+			if err != nil {
+				fmt.Printf("Error getting --cancel flag: %s\n", err)
+				return
+			}
+			if cancelDrain {
+				if err := fs.CancelDrain(); err != nil {
+					fmt.Printf("Error cancelling drain: %s\n", err)
+					return
+				}
+				fmt.Println("Drain cancelled, the node takes new copies again")
+				return
+			}
+
+			report, err := fs.Drain(context.Background())
+			if err != nil {
+				fmt.Printf("Error draining node: %s\n", err)
+				return
+			}
+			fmt.Printf("Drain: %s\n", report)
+			if report.Safe() {
+				fmt.Println("Safe to shut down")
+			} else {
+				fmt.Println("Not safe to shut down yet, run drain again to resume")
+			}
+		},
+		PersistentPostRunE: func(cmd *cobra.Command, args []string) error {
+			// Reset flag to its default value before each run
+			return cmd.Flags().Set("cancel", "false")
+		},
+	}
+	drainCmd.Flags().Bool("cancel", false, "Stop draining and take new copies again")
+
+	rebalanceCmd := &cobra.Command{
+		Use:   "rebalance",
+		Short: "Move replicas to where the placement policy puts them now, in the background",
+		Run: func(cmd *cobra.Command, args []string) {
+			flags := make(map[string]bool)
+			for _, name := range []string{"status", "pause", "resume"} {
+				v, err := cmd.Flags().GetBool(name)
+				if err != nil {
+					fmt.Printf("Error getting --%s flag: %s\n", name, err)
+					return
+				}
+				flags[name] = v
+			}
+			switch {
+			case flags["pause"]:
+				fs.PauseRebalance()
+				fmt.Println("Rebalance paused")
+			case flags["resume"]:
+				fs.ResumeRebalance()
+				fmt.Println("Rebalance resumed")
+			case !flags["status"] && !fs.RebalanceStatus().Running:
+				go fs.runRebalance()
+				fmt.Println("Rebalance started, see rebalance --status")
+				return
+			}
+
+			status := fs.RebalanceStatus()
+			if status.Started.IsZero() {
+				fmt.Println("No rebalance has run yet")
+				return
+			}
+			fmt.Printf("Rebalance started at %s: %s\n", status.Started.Format(time.DateTime), status)
+		},
+		PersistentPostRunE: func(cmd *cobra.Command, args []string) error {
+			// Reset flags to their default value before each run
+			for _, name := range []string{"status", "pause", "resume"} {
+				if err := cmd.Flags().Set(name, "false"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	rebalanceCmd.Flags().BoolP("status", "s", false, "Show what the rebalance is moving instead of starting one")
+	rebalanceCmd.Flags().Bool("pause", false, "Pause the rebalance after the move in progress")
+	rebalanceCmd.Flags().Bool("resume", false, "Resume a paused rebalance")
+
+	rotateKeyCmd := &cobra.Command{
+		Use:   "rotate-key",
+		Short: "Replace the master key, re-wrapping the keys of every file with the new one",
+		Run: func(cmd *cobra.Command, args []string) {
+			// The new key is escrowed the same way, and the shares of the old one revoked
+			// only once it is: a failed escrow would leave the old one to recover from
+			escrow, err := fs.Escrowed()
+			if err != nil {
+				fmt.Printf("Error rotating key: %s\n", err)
+				return
+			}
+			var passphrase []byte
+			if escrow != nil {
+				if passphrase, err = promptPassphrase("Recovery passphrase, to escrow the new key"); err != nil {
+					fmt.Printf("Error rotating key: %s\n", err)
+					return
+				}
+			}
+			report, err := fs.RotateKey(context.Background())
+			if err != nil {
+				fmt.Printf("Error rotating key: %s\n", err)
+				if report.Version > 0 {
+					fmt.Printf("Rotation to %s, run rotate-key again to resume\n", report)
+				}
+				return
+			}
+			fmt.Printf("Key rotated to %s\n", report)
+			if escrow == nil {
+				return
+			}
+			escrowed, err := fs.EscrowKey(context.Background(), passphrase, escrow.Shares, escrow.Threshold, escrow.Holders)
+			if err != nil {
+				fmt.Printf("Error escrowing the new key, run escrow-key: %s\n", err)
+				return
+			}
+			fmt.Printf("Key version %d escrowed, any %d of %d shares recover it: %s\n",
+				escrowed.Version, escrowed.Threshold, escrowed.Shares, strings.Join(escrowed.Holders, ", "))
+			if err := fs.RevokeEscrow(context.Background(), *escrow); err != nil {
+				fmt.Printf("Error revoking the shares of key version %d: %s\n", escrow.Version, err)
+			}
+		},
+	}
+
+	var (
+		escrowShares    int
+		escrowThreshold int
+		escrowPeers     []string
+	)
+	escrowKeyCmd := &cobra.Command{
+		Use:   "escrow-key",
+		Short: "Split the master key into shares held by peers, to recover it with recover-key",
+		Run: func(cmd *cobra.Command, args []string) {
+			passphrase, err := promptPassphrase("Recovery passphrase")
+			if err != nil {
+				fmt.Printf("Error escrowing key: %s\n", err)
+				return
+			}
+			// Peers left out of the new escrow would keep the shares of the previous one
+			previous, err := fs.Escrowed()
+			if err != nil {
+				fmt.Printf("Error escrowing key: %s\n", err)
+				return
+			}
+			escrow, err := fs.EscrowKey(context.Background(), passphrase, escrowShares, escrowThreshold, escrowPeers)
+			if err != nil {
+				fmt.Printf("Error escrowing key: %s\n", err)
+				return
+			}
+			fmt.Printf("Key version %d escrowed, any %d of %d shares recover it: %s\n",
+				escrow.Version, escrow.Threshold, escrow.Shares, strings.Join(escrow.Holders, ", "))
+			if previous != nil {
+				if err := fs.RevokeEscrow(context.Background(), *previous); err != nil {
+					fmt.Printf("Error revoking the shares of the previous escrow: %s\n", err)
+				}
+			}
+		},
+		PersistentPostRunE: func(cmd *cobra.Command, args []string) error {
+			// Reset flags to their default value before each run
+			for name, value := range map[string]string{"shares": "3", "threshold": "2"} {
+				if err := cmd.Flags().Set(name, value); err != nil {
+					return err
+				}
+			}
+			escrowPeers = nil
+			return nil
+		},
+	}
+	escrowKeyCmd.Flags().IntVarP(&escrowShares, "shares", "n", 3, "Number of shares, one per peer")
+	escrowKeyCmd.Flags().IntVarP(&escrowThreshold, "threshold", "t", 2, "Number of shares needed to recover the key")
+	escrowKeyCmd.Flags().StringSliceVar(&escrowPeers, "peers", nil, "IDs of the peers holding the shares, picked by the placement policy when empty")
+
+	var recoverNode string
+	recoverKeyCmd := &cobra.Command{
+		Use:   "recover-key",
+		Short: "Restore the escrowed master key of this node from the shares its peers hold",
+		Run: func(cmd *cobra.Command, args []string) {
+			passphrase, err := promptSecret("Recovery passphrase")
+			if err != nil {
+				fmt.Printf("Error recovering key: %s\n", err)
+				return
+			}
+			version, err := fs.RecoverKey(context.Background(), passphrase, recoverNode)
+			if err != nil {
+				fmt.Printf("Error recovering key: %s\n", err)
+				return
+			}
+			fmt.Printf("Key version %d recovered\n", version)
+		},
+		PersistentPostRunE: func(cmd *cobra.Command, args []string) error {
+			// Reset flags to their default value before each run
+			return cmd.Flags().Set("node", "")
+		},
 	}
+	recoverKeyCmd.Flags().StringVar(&recoverNode, "node", "", "ID the node had when it escrowed the key, this node's when empty")
 
-	rootCmd.AddCommand(getCmd, storeCmd, deleteCmd, lsCmd)
+	rootCmd.AddCommand(getCmd, storeCmd, deleteCmd, lsCmd, repairCmd, drainCmd, rebalanceCmd, rotateKeyCmd, escrowKeyCmd, recoverKeyCmd)
 
 	return rootCmd
 }
@@ -10,20 +10,24 @@ import (
 )
 
 func MakeTestServer(ListenAddr string, BootstrapNodes []string) *FileServer {
+	nodeKey := crypto.NewNodeKey()
 	NodeConfig := &NodeConfig{
 		ListenAddr:     ListenAddr,
 		BootstrapNodes: BootstrapNodes,
-		ServerID:       crypto.GenerateID(),
+		ServerID:       nodeID(nodeKey),
+		NodeKey:        nodeKey,
 	}
 
 	tcpTransport := p2p.NewTCPTransport(p2p.TCPTransportOpts{
 		ListenAddr:    NodeConfig.ListenAddr,
+		NodeID:        NodeConfig.ServerID,
 		HandshakeFunc: p2p.NOPHandshakeFunc,
 		Decoder:       p2p.DefaultDecoder{},
 	})
 
 	fs := NewFileServer(FileServerOpts{
 		ID:                NodeConfig.ServerID,
+		NodeKey:           NodeConfig.NodeKey,
 		EncKey:            crypto.NewEncryptionKey(),
 		StorageRoot:       "test" + NodeConfig.ListenAddr[1:] + "_network",
 		PathTransformFunc: CASPathTransformFunc,
@@ -32,6 +36,7 @@ func MakeTestServer(ListenAddr string, BootstrapNodes []string) *FileServer {
 		DBFile:            "./.env/.db/test_" + NodeConfig.ListenAddr[1:] + "_network.db",
 	})
 	tcpTransport.OnPeer = fs.OnPeer
+	tcpTransport.OnPeerDisconnect = fs.OnPeerDisconnect
 
 	return fs
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/20af02/MosaicFS/p2p"
+)
+
+// hintWindow is how long after losing the connection to a ring node the copies meant
+// for it are handed to a stand-in. A node gone longer is left to rebalancing.
+const hintWindow = 3 * time.Hour
+
+// offlineNode is a ring node we lost the connection to.
+type offlineNode struct {
+	weight int
+	since  time.Time
+}
+
+// HintProof is the consent of the owner of an object for a copy of it to be stored by
+// the node it's meant for, when a stand-in hands it on: the owner's identity key and its
+// signature of the object and that node, see hintMessage.
+type HintProof struct {
+	Owner ed25519.PublicKey
+	Sig   []byte
+}
+
+// hintMessage is what the owner id signs for the object key, encrypted as data, to be
+// stored by target.
+func hintMessage(id, key, target string, data []byte) []byte {
+	return fmt.Appendf(nil, "mosaicfs hint %s %s %s %x", id, key, target, sha256.Sum256(data))
+}
+
+// signHint returns our consent for target to store our object key, nil without a node key.
+func (s *FileServer) signHint(key, target string, data []byte) *HintProof {
+	if s.NodeKey == nil {
+		return nil
+	}
+	return &HintProof{
+		Owner: s.NodeKey.Public().(ed25519.PublicKey),
+		Sig:   ed25519.Sign(s.NodeKey, hintMessage(s.ID, key, target, data)),
+	}
+}
+
+// verifyHint checks the owner of the object msg carries consented to us storing it.
+func (s *FileServer) verifyHint(msg MessageStoreFile, data []byte) error {
+	p := msg.Proof
+	if p == nil || len(p.Owner) != ed25519.PublicKeySize {
+		return errors.New("no consent of the owner")
+	}
+	if p2p.NodeID(p.Owner) != msg.ID {
+		// A legacy ID, only once bound to its key
+		bound, err := s.store.dbHandler.PeerKey(msg.ID)
+		if err != nil {
+			return err
+		}
+		if !isLegacyID(msg.ID) || !bytes.Equal(bound, p.Owner) {
+			return errors.New("not signed by the owner")
+		}
+	}
+	if !ed25519.Verify(p.Owner, hintMessage(msg.ID, msg.Key, s.ID, data), p.Sig) {
+		return errors.New("invalid signature of the owner")
+	}
+	return nil
+}
+
+// recordHint remembers to hand the object we just stored to its intended node,
+// right away if we're connected to it.
+func (s *FileServer) recordHint(msg MessageStoreFile, held bool) {
+	h := Hint{
+		Target:  msg.Hint,
+		ID:      msg.ID,
+		Key:     msg.Key,
+		Keep:    held,
+		Proof:   msg.Proof,
+		Created: time.Now(),
+	}
+	if err := s.store.dbHandler.AddHint(h); err != nil {
+		log.Printf("[%s] failed to record hint for (%s): %v", s.Transport.Addr(), msg.Hint, err)
+		return
+	}
+	log.Printf("[%s] holding (%s) for (%s) until it's back", s.Transport.Addr(), msg.Key, msg.Hint)
+	if peer, ok := s.peer(msg.Hint); ok {
+		go s.deliverHints(peer)
+	}
+}
+
+// deliverHints hands peer the objects we stored for it while it was unreachable,
+// and drops our copies once it acknowledged them. What fails is tried again the
+// next time it connects.
+func (s *FileServer) deliverHints(peer p2p.Peer) {
+	// One delivery at a time, so no object is sent twice
+	s.handoff.Lock()
+	defer s.handoff.Unlock()
+
+	hints, err := s.store.dbHandler.Hints(peer.ID())
+	if err != nil {
+		log.Printf("[%s] failed to load hints for (%s): %v", s.Transport.Addr(), peer.ID(), err)
+		return
+	}
+	delivered := 0
+	for _, h := range hints {
+		if err := s.deliverHint(peer, h); err != nil {
+			log.Printf("[%s] failed to hand off (%s) to (%s): %v", s.Transport.Addr(), h.Key, peer.ID(), err)
+			return
+		}
+		delivered++
+	}
+	if delivered > 0 {
+		log.Printf("[%s] handed off %d objects to (%s)", s.Transport.Addr(), delivered, peer.ID())
+		go s.reportUsage(s.peerList()...)
+	}
+}
+
+func (s *FileServer) deliverHint(peer p2p.Peer, h Hint) error {
+	// Deleted in the meantime
+	if !s.store.Has(h.ID, h.Key) {
+		return s.store.dbHandler.RemoveHint(h)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.RequestTimeout)
+	defer cancel()
+
+	// Objects are stored as their owner encrypted them, they're sent as is
+	_, r, err := s.store.Read(h.ID, h.Key)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	msg := Message{
+		Payload: MessageStoreFile{
+			ID:    h.ID,
+			Key:   h.Key,
+			Size:  int64(len(data)),
+			Proof: h.Proof,
+		},
+	}
+	if err := s.sendObjectTo(ctx, peer, &msg, data); err != nil {
+		return err
+	}
+
+	if err := s.store.dbHandler.RemoveHint(h); err != nil {
+		return err
+	}
+	if !h.Keep {
+		if err := s.store.discard(h.ID, h.Key); err != nil {
+			return err
+		}
+		s.unprovide(h.ID, h.Key)
+		return s.store.dbHandler.RemoveHeld(h.ID, h.Key)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/20af02/MosaicFS/crypto"
+	"github.com/20af02/MosaicFS/p2p"
+)
+
+// preferPlacement picks the peer first, then the others by ID.
+type preferPlacement struct {
+	first string
+}
+
+func (p preferPlacement) Place(key string, candidates []Candidate, n int) []Candidate {
+	slices.SortFunc(candidates, func(a, b Candidate) int { return strings.Compare(a.ID, b.ID) })
+	if i := slices.IndexFunc(candidates, func(c Candidate) bool { return c.ID == p.first }); i > 0 {
+		candidates[0], candidates[i] = candidates[i], candidates[0]
+	}
+	return candidates[:min(n, len(candidates))]
+}
+
+func TestHintedHandoff(t *testing.T) {
+	s1, s2, s3 := startRepairServers(t)
+	s1.Placement = preferPlacement{first: s2.ID}
+
+	// s2 can't write anything of s1 for now
+	blocked := filepath.Join(s2.store.Root, s1.ID)
+	if err := os.MkdirAll(s2.store.Root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(blocked, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	key := "handoff.txt"
+	if err := s1.StoreWith(key, bytes.NewReader([]byte("held for s2")), WriteOptions{Replicas: 2, Consistency: ConsistencyAll}); err != nil {
+		t.Fatalf("Expected s3 to stand in for s2: %v", err)
+	}
+	hints, err := s3.store.dbHandler.Hints(s2.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hints) == 0 {
+		t.Fatalf("Expected s3 to hold hints for s2")
+	}
+
+	// s2 is back
+	if err := os.Remove(blocked); err != nil {
+		t.Fatal(err)
+	}
+	peer, ok := s3.peer(s2.ID)
+	if !ok {
+		t.Fatalf("Expected s2 to be a peer of s3")
+	}
+	s3.deliverHints(peer)
+	if !s2.store.Has(s1.ID, crypto.HashKey(key)) {
+		t.Errorf("Expected s2 to hold the manifest after the handoff")
+	}
+	if s3.store.Has(s1.ID, crypto.HashKey(key)) {
+		t.Errorf("Expected s3 to drop its copy after the handoff")
+	}
+	if hints, _ := s3.store.dbHandler.Hints(s2.ID); len(hints) != 0 {
+		t.Errorf("Expected no hints left, got %d", len(hints))
+	}
+}
+
+func TestHandoffOnConnect(t *testing.T) {
+	s1, _, s3 := startRepairServers(t)
+	s4 := MakeTestServer(":6000", []string{":5000"})
+	t.Cleanup(func() {
+		s4.Stop()
+		teardown(t, s4.store)
+	})
+
+	// s4 has never been online, s3 keeps the object for it
+	peer, ok := s1.peer(s3.ID)
+	if !ok {
+		t.Fatalf("Expected s3 to be a peer of s1")
+	}
+	key := crypto.HashKey("offline.txt")
+	if _, err := s1.sendObject(context.Background(), []p2p.Peer{peer}, key, s1.EncKey, []byte("for s4"), s4.ID); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	if hints, _ := s3.store.dbHandler.Hints(s4.ID); len(hints) != 1 {
+		t.Fatalf("Expected a hint for s4, got %d", len(hints))
+	}
+
+	go func() { s4.Start() }()
+	time.Sleep(2 * time.Second)
+
+	if !s4.store.Has(s1.ID, key) {
+		t.Errorf("Expected s4 to get the object once connected")
+	}
+	if s3.store.Has(s1.ID, key) {
+		t.Errorf("Expected s3 to drop its copy after the handoff")
+	}
+}
+
+func TestHandoffForOfflineOwner(t *testing.T) {
+	s1, s2, s3 := startRepairServers(t)
+	s1.Placement = HashPlacement{Ring: s1.ring}
+
+	// s4 was on the ring but went offline
+	s4 := MakeTestServer(":6000", []string{":5000"})
+	t.Cleanup(func() { teardown(t, s4.store) })
+	s1.peerLock.Lock()
+	s1.offline[s4.ID] = offlineNode{weight: 1, since: time.Now()}
+	s1.peerLock.Unlock()
+
+	// A key whose first replica belongs to s4
+	ring := s1.ring.Clone()
+	ring.Add(s4.ID, 1)
+	var key string
+	for i := 0; key == ""; i++ {
+		name := fmt.Sprintf("owned-%d.txt", i)
+		for _, id := range ring.Get(crypto.HashKey(crypto.HashKey(name)), 4) {
+			if id == s4.ID {
+				key = name
+			}
+			if id != s1.ID {
+				break
+			}
+		}
+	}
+
+	if err := s1.StoreWith(key, bytes.NewReader([]byte("owned by s4")), WriteOptions{Replicas: 2, Consistency: ConsistencyAll}); err != nil {
+		t.Fatalf("Failed to store: %v", err)
+	}
+	var hints []Hint
+	for _, s := range []*FileServer{s2, s3} {
+		h, err := s.store.dbHandler.Hints(s4.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hints = append(hints, h...)
+	}
+	if !slices.ContainsFunc(hints, func(h Hint) bool { return h.Key == crypto.HashKey(key) }) {
+		t.Errorf("Expected a stand-in to hold the manifest for s4, got %v", hints)
+	}
+}
@@ -0,0 +1,155 @@
+package hashring
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"maps"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DefaultVirtualNodes is the number of points a node of weight 1 gets on the ring.
+const DefaultVirtualNodes = 100
+
+// Ring is a consistent hash ring. Every node is placed on the ring at a number
+// of virtual points proportional to its weight, and a key belongs to the nodes
+// found walking clockwise from the key's hash. Adding or removing a node only
+// moves the keys falling between its points and their predecessors.
+type Ring struct {
+	vnodes int
+
+	lock    sync.RWMutex
+	weights map[string]int
+	// points is sorted by hash.
+	points []point
+}
+
+type point struct {
+	hash uint64
+	node string
+}
+
+// New returns an empty ring placing vnodes points per unit of weight.
+// A value <= 0 means DefaultVirtualNodes.
+func New(vnodes int) *Ring {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+	return &Ring{
+		vnodes:  vnodes,
+		weights: make(map[string]int),
+	}
+}
+
+// Add places node on the ring, or changes its weight if it's already there.
+// A weight <= 0 counts as 1.
+func (r *Ring) Add(node string, weight int) {
+	weight = max(weight, 1)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if w, ok := r.weights[node]; ok {
+		if w == weight {
+			return
+		}
+		r.removePoints(node)
+	}
+	r.weights[node] = weight
+
+	for i := 0; i < weight*r.vnodes; i++ {
+		r.points = append(r.points, point{hash: Hash(node + "#" + strconv.Itoa(i)), node: node})
+	}
+	slices.SortFunc(r.points, func(a, b point) int {
+		switch {
+		case a.hash < b.hash:
+			return -1
+		case a.hash > b.hash:
+			return 1
+		}
+		return 0
+	})
+}
+
+// Remove takes node off the ring.
+func (r *Ring) Remove(node string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.weights[node]; !ok {
+		return
+	}
+	delete(r.weights, node)
+	r.removePoints(node)
+}
+
+func (r *Ring) removePoints(node string) {
+	r.points = slices.DeleteFunc(r.points, func(p point) bool { return p.node == node })
+}
+
+// Weight returns the weight of node, 0 when it isn't on the ring.
+func (r *Ring) Weight(node string) int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.weights[node]
+}
+
+// Clone returns a copy of the ring, changed independently of it.
+func (r *Ring) Clone() *Ring {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return &Ring{
+		vnodes:  r.vnodes,
+		weights: maps.Clone(r.weights),
+		points:  slices.Clone(r.points),
+	}
+}
+
+// Nodes returns the nodes on the ring.
+func (r *Ring) Nodes() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	nodes := make([]string, 0, len(r.weights))
+	for node := range r.weights {
+		nodes = append(nodes, node)
+	}
+	slices.Sort(nodes)
+	return nodes
+}
+
+// Get returns the first n distinct nodes responsible for key, in ring order.
+// Fewer are returned when the ring doesn't hold n nodes.
+func (r *Ring) Get(key string, n int) []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	n = min(n, len(r.weights))
+	if n <= 0 {
+		return nil
+	}
+
+	h := Hash(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+
+	nodes := make([]string, 0, n)
+	seen := make(map[string]struct{}, n)
+	for i := 0; i < len(r.points) && len(nodes) < n; i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if _, ok := seen[p.node]; ok {
+			continue
+		}
+		seen[p.node] = struct{}{}
+		nodes = append(nodes, p.node)
+	}
+	return nodes
+}
+
+// Hash maps keys and virtual nodes onto the ring.
+func Hash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
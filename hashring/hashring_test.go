@@ -0,0 +1,99 @@
+package hashring
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	return keys
+}
+
+func TestRingGet(t *testing.T) {
+	r := New(0)
+	assert.Empty(t, r.Get("key", 3))
+
+	for i := 0; i < 5; i++ {
+		r.Add(fmt.Sprintf("node-%d", i), 1)
+	}
+
+	nodes := r.Get("key", 3)
+	assert.Len(t, nodes, 3)
+	assert.Equal(t, nodes, r.Get("key", 3))
+	assert.Equal(t, nodes[:1], r.Get("key", 1))
+
+	// Never more nodes than the ring holds, and never the same one twice
+	all := r.Get("key", 10)
+	assert.ElementsMatch(t, r.Nodes(), all)
+}
+
+func TestRingMinimalMovement(t *testing.T) {
+	r := New(0)
+	for i := 0; i < 5; i++ {
+		r.Add(fmt.Sprintf("node-%d", i), 1)
+	}
+
+	keys := testKeys(10_000)
+	before := make(map[string]string)
+	for _, key := range keys {
+		before[key] = r.Get(key, 1)[0]
+	}
+
+	// Keys only move to the node joining
+	r.Add("node-5", 1)
+	moved := 0
+	for _, key := range keys {
+		owner := r.Get(key, 1)[0]
+		if owner != before[key] {
+			assert.Equal(t, "node-5", owner)
+			moved++
+		}
+	}
+	// About 1/6 of the keys should move
+	assert.InDelta(t, len(keys)/6, moved, float64(len(keys))/20)
+
+	// And back to where they were once it leaves
+	r.Remove("node-5")
+	for _, key := range keys {
+		assert.Equal(t, before[key], r.Get(key, 1)[0])
+	}
+}
+
+func TestRingWeights(t *testing.T) {
+	r := New(0)
+	r.Add("small", 1)
+	r.Add("big", 3)
+
+	counts := make(map[string]int)
+	for _, key := range testKeys(10_000) {
+		counts[r.Get(key, 1)[0]]++
+	}
+	assert.InDelta(t, 3.0, float64(counts["big"])/float64(counts["small"]), 0.6)
+
+	// Reweighting replaces the node's points
+	r.Add("big", 1)
+	assert.Len(t, r.points, 2*DefaultVirtualNodes)
+}
+
+func TestRingClone(t *testing.T) {
+	r := New(0)
+	r.Add("node-1", 1)
+	r.Add("node-2", 2)
+
+	c := r.Clone()
+	c.Add("node-3", 1)
+	c.Remove("node-1")
+	assert.Equal(t, 2, c.Weight("node-2"))
+	assert.Equal(t, 0, c.Weight("node-1"))
+
+	// The original is left as it was
+	assert.Equal(t, 1, r.Weight("node-1"))
+	assert.Equal(t, 0, r.Weight("node-3"))
+	assert.Len(t, r.points, 3*DefaultVirtualNodes)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+
+	"github.com/20af02/MosaicFS/merkle"
+	"github.com/20af02/MosaicFS/p2p"
+)
+
+// MessageInventory asks a peer about the Merkle tree of the objects it holds for the node
+// with the given ID: its root hash, the hashes of the children of the node at Path, or,
+// with Keys set, the objects under that node.
+type MessageInventory struct {
+	ID   string
+	Path []byte
+	Root bool
+	Keys bool
+}
+
+type MessageInventoryResponse struct {
+	Root   merkle.Hash
+	Hashes []merkle.Hash
+	Keys   []string
+	Err    string
+}
+
+// remoteInventory is the tree of the objects a peer holds for the node id.
+type remoteInventory struct {
+	s    *FileServer
+	peer p2p.Peer
+	id   string
+}
+
+func (r remoteInventory) call(ctx context.Context, msg MessageInventory) (MessageInventoryResponse, error) {
+	st, err := r.peer.OpenStream()
+	if err != nil {
+		return MessageInventoryResponse{}, err
+	}
+	defer st.Close()
+
+	stop := context.AfterFunc(ctx, func() { st.Close() })
+	defer stop()
+
+	msg.ID = r.id
+	if err := writeMessage(st, &Message{Payload: msg}); err != nil {
+		return MessageInventoryResponse{}, err
+	}
+	resp, err := readMessage(st)
+	if err != nil {
+		return MessageInventoryResponse{}, err
+	}
+	v, ok := resp.Payload.(MessageInventoryResponse)
+	if !ok {
+		return MessageInventoryResponse{}, fmt.Errorf("unexpected inventory response: %T", resp.Payload)
+	}
+	if v.Err != "" {
+		return v, errors.New(v.Err)
+	}
+	return v, nil
+}
+
+func (r remoteInventory) Root(ctx context.Context) (merkle.Hash, error) {
+	resp, err := r.call(ctx, MessageInventory{Root: true})
+	return resp.Root, err
+}
+
+func (r remoteInventory) Children(ctx context.Context, path []byte) ([]merkle.Hash, error) {
+	resp, err := r.call(ctx, MessageInventory{Path: path})
+	return resp.Hashes, err
+}
+
+func (r remoteInventory) Keys(ctx context.Context, path []byte) ([]string, error) {
+	resp, err := r.call(ctx, MessageInventory{Path: path, Keys: true})
+	return resp.Keys, err
+}
+
+// syncInventory brings our copy of the inventory of the objects peer holds for us up to
+// date. Only the ranges of its Merkle tree that changed since the last sync are exchanged.
+func (s *FileServer) syncInventory(ctx context.Context, peer p2p.Peer) (*merkle.Tree, error) {
+	s.peerLock.Lock()
+	t, ok := s.inventories[peer.ID()]
+	if !ok {
+		t = merkle.New(0)
+		s.inventories[peer.ID()] = t
+	}
+	s.peerLock.Unlock()
+
+	added, removed, err := merkle.Sync(ctx, t, remoteInventory{s: s, peer: peer, id: s.ID})
+	if err != nil {
+		return nil, err
+	}
+	if added > 0 || removed > 0 {
+		log.Printf("[%s] inventory of (%s): %d objects added, %d removed, %d held", s.Transport.Addr(), peer.ID(), added, removed, t.Len())
+	}
+	return t, nil
+}
+
+// heldBy asks our peers which of them hold the object key of the node id. Only the
+// leaf of their inventory the object falls in is exchanged.
+func (s *FileServer) heldBy(ctx context.Context, id, key string) []string {
+	name := s.store.inventoryName(key)
+	path := merkle.New(0).Position(name)
+
+	var (
+		lock    sync.Mutex
+		holders []string
+		wg      sync.WaitGroup
+	)
+	for _, peer := range s.peerList() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			keys, err := remoteInventory{s: s, peer: peer, id: id}.Keys(ctx, path)
+			if err != nil {
+				log.Printf("[%s] failed to ask (%s) about (%s): %v", s.Transport.Addr(), peer.ID(), key, err)
+				return
+			}
+			if slices.Contains(keys, name) {
+				lock.Lock()
+				holders = append(holders, peer.ID())
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return holders
+}
+
+// handleMessageInventory answers about the inventory of a namespace: the peer's own, or
+// another one we hold objects of, e.g. asked by heldBy. Others look empty, so asking
+// doesn't make us walk the disk or keep a tree for them.
+func (s *FileServer) handleMessageInventory(from string, msg MessageInventory, st p2p.Stream) error {
+	var resp MessageInventoryResponse
+	var t *merkle.Tree
+	var err error
+	switch {
+	case !validNamespace(msg.ID):
+		err = fmt.Errorf("invalid namespace (%s)", msg.ID)
+	case msg.ID == from || s.store.holds(msg.ID):
+		t, err = s.store.inventory(msg.ID)
+	default:
+		t = merkle.New(0)
+	}
+	if err == nil {
+		switch {
+		case msg.Root:
+			resp.Root = t.Root()
+		case msg.Keys:
+			resp.Keys, err = t.Keys(msg.Path)
+		default:
+			resp.Hashes, err = t.Children(msg.Path)
+		}
+	}
+	if err != nil {
+		resp.Err = err.Error()
+	}
+	return writeMessage(st, &Message{Payload: resp})
+}
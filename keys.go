@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/20af02/MosaicFS/crypto"
+)
+
+// Objects leave the node encrypted with keys of their own rather than the master
+// key: the manifest of a file with the file's data key, a chunk with the key it
+// was first stored with. Data keys are wrapped with the master key in the file's
+// metadata, chunk keys in the database and in the manifests referencing them.
+
+// keyring holds the master key and the keys derived from it.
+type keyring struct {
+	lock    sync.RWMutex
+	master  []byte
+	version int
+	// next is the key a rotation in progress moves to, nil when there is none.
+	// Records already moved to it are unwrapped with it, see RotateKey.
+	next []byte
+	// hash is the key chunks are addressed with, see chunkHash. It stays the first
+	// master key of the node, so chunks keep their hashes across rotations.
+	hash []byte
+	// running is held during a rotation, so rotations never overlap
+	running sync.Mutex
+	// rotate is held by a rotation, and shared by the stores so none wraps a new key
+	// with a master key about to be replaced.
+	rotate sync.RWMutex
+}
+
+// loadKeys sets up the keyring from the master key in the config and what the
+// database remembers of past rotations.
+func (s *FileServer) loadKeys() error {
+	k := &s.keys
+	k.master, k.version = s.EncKey, s.KeyVersion
+	r, err := s.store.dbHandler.Rotation()
+	if err != nil {
+		return err
+	}
+	switch {
+	case r == nil:
+	case r.Version > k.version:
+		// Interrupted, RotateKey resumes it
+		if k.next, err = crypto.UnwrapKey(k.master, r.Key); err != nil {
+			return fmt.Errorf("unwrap the key being rotated to: %w", err)
+		}
+	default:
+		// Interrupted once the config was saved, only the record was left
+		if err := s.store.dbHandler.SetRotation(nil); err != nil {
+			return err
+		}
+	}
+
+	wrapped, err := s.store.dbHandler.HashKey()
+	if err != nil {
+		return err
+	}
+	if wrapped == nil {
+		k.hash = k.master
+		return nil
+	}
+	if k.hash, err = k.unwrap(wrapped); err != nil {
+		return fmt.Errorf("unwrap the chunk hash key: %w", err)
+	}
+	return nil
+}
+
+// current returns the master key and its version.
+func (k *keyring) current() ([]byte, int) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return k.master, k.version
+}
+
+// hashKey returns the key chunks are addressed with.
+func (k *keyring) hashKey() []byte {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return k.hash
+}
+
+// kek returns the master key of the given version, as long as it's in use.
+func (k *keyring) kek(version int) ([]byte, error) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	switch {
+	case version == k.version:
+		return k.master, nil
+	case k.next != nil && version == k.version+1:
+		return k.next, nil
+	}
+	return nil, fmt.Errorf("master key version %d is no longer in use, the current one is %d", version, k.version)
+}
+
+// unwrap unwraps a key wrapped with the master key, or with the next one during a rotation.
+func (k *keyring) unwrap(wrapped []byte) ([]byte, error) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	key, err := crypto.UnwrapKey(k.master, wrapped)
+	if err != nil && k.next != nil {
+		return crypto.UnwrapKey(k.next, wrapped)
+	}
+	return key, err
+}
+
+// dataKey returns the key the manifest of the file fmd is encrypted with.
+func (s *FileServer) dataKey(fmd *FileMetadata) ([]byte, error) {
+	if fmd == nil || fmd.DataKey == nil {
+		// Stored before data keys, no rotation happened since
+		master, _ := s.keys.current()
+		return master, nil
+	}
+	kek, err := s.keys.kek(fmd.KeyVersion)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.UnwrapKey(kek, fmd.DataKey)
+}
+
+// legacyFormat reports whether copies of the file fmd may predate authenticated
+// encryption. Files get a format once a key rotation encrypted them again.
+func legacyFormat(fmd *FileMetadata) bool {
+	return fmd != nil && fmd.Format == 0
+}
+
+// decrypt decrypts src with key to dst, accepting the format from before authenticated
+// encryption only for legacy objects.
+func decrypt(key []byte, legacy bool, src io.Reader, dst io.Writer) (int, error) {
+	if legacy {
+		return crypto.CopyDecryptLegacy(key, src, dst)
+	}
+	return crypto.CopyDecrypt(key, src, dst)
+}
+
+// fileKey returns the data key of our file key.
+func (s *FileServer) fileKey(key string) ([]byte, error) {
+	fmd, _ := s.store.dbHandler.GetFileMetadata(key)
+	return s.dataKey(fmd)
+}
+
+// newDataKey returns a new data key, and the same key wrapped with the master key of the
+// returned version.
+func (s *FileServer) newDataKey() (key, wrapped []byte, version int, err error) {
+	master, version := s.keys.current()
+	key = crypto.NewEncryptionKey()
+	if wrapped, err = crypto.WrapKey(master, key); err != nil {
+		return nil, nil, 0, err
+	}
+	return key, wrapped, version, nil
+}
+
+// chunkDataKey returns the key the chunk ref is encrypted with, refs being its number
+// of references: a new one for a new chunk, else the one it was first stored with.
+// It returns nil for chunks stored before chunk keys.
+func (s *FileServer) chunkDataKey(ref string, refs uint64) ([]byte, error) {
+	if refs == 1 {
+		key, wrapped, _, err := s.newDataKey()
+		if err != nil {
+			return nil, err
+		}
+		return key, s.store.dbHandler.SetChunkKey(ref, wrapped)
+	}
+	wrapped, err := s.store.dbHandler.ChunkKey(ref)
+	if err != nil || wrapped == nil {
+		return nil, err
+	}
+	return s.keys.unwrap(wrapped)
+}
+
+// masterKey returns the current master key, which chunks stored before chunk keys are encrypted with.
+func (s *FileServer) masterKey() []byte {
+	master, _ := s.keys.current()
+	return master
+}
+
+// encKey returns the key the chunk is encrypted with on other nodes.
+func (c ChunkRef) encKey(master []byte) []byte {
+	if c.Key == nil {
+		return master
+	}
+	return c.Key
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/20af02/MosaicFS/crypto"
+)
+
+func TestDataKeys(t *testing.T) {
+	s1, s2, s3 := startRepairServers(t)
+
+	data := make([]byte, 8*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := s1.StoreReplicas("a.bin", bytes.NewReader(data), 2); err != nil {
+		t.Fatalf("Failed to store: %v", err)
+	}
+	if err := s1.StoreReplicas("b.bin", bytes.NewReader(data), 2); err != nil {
+		t.Fatalf("Failed to store: %v", err)
+	}
+
+	keyA, err := s1.fileKey("a.bin")
+	if err != nil {
+		t.Fatalf("Failed to unwrap the data key: %v", err)
+	}
+	keyB, _ := s1.fileKey("b.bin")
+	if bytes.Equal(keyA, s1.EncKey) || bytes.Equal(keyA, keyB) {
+		t.Errorf("Expected every file to get a data key of its own")
+	}
+
+	// Peers hold the manifest encrypted with the data key, not the master key
+	remoteKey := crypto.HashKey("a.bin")
+	holder := s2
+	if !holder.store.Has(s1.ID, remoteKey) {
+		holder = s3
+	}
+	read := func(encKey []byte) error {
+		_, r, err := holder.store.Read(s1.ID, remoteKey)
+		if err != nil {
+			return err
+		}
+		_, err = crypto.CopyDecrypt(encKey, r, new(bytes.Buffer))
+		return err
+	}
+	if err := read(keyA); err != nil {
+		t.Errorf("Expected the copy to decrypt with the data key: %v", err)
+	}
+	if err := read(s1.EncKey); !errors.Is(err, crypto.ErrAuth) {
+		t.Errorf("Expected the copy not to decrypt with the master key, got %v", err)
+	}
+
+	// Shared chunks keep the key they were first stored with
+	mA, _ := s1.readManifest("a.bin")
+	mB, _ := s1.readManifest("b.bin")
+	for i, c := range mA.Chunks {
+		if len(c.Key) == 0 || !bytes.Equal(c.Key, mB.Chunks[i].Key) {
+			t.Errorf("Expected chunk (%s) to have the same key in both files", c.Hash)
+		}
+	}
+
+	// A lost local copy is read back from the peers
+	if err := s1.DeleteLocal("a.bin"); err != nil {
+		t.Fatalf("Failed to delete locally: %v", err)
+	}
+	r, err := s1.Get("a.bin")
+	if err != nil {
+		t.Fatalf("Failed to get: %v", err)
+	}
+	b := new(bytes.Buffer)
+	b.ReadFrom(r)
+	if !bytes.Equal(b.Bytes(), data) {
+		t.Errorf("Unexpected content")
+	}
+}
+
+func TestStrippedCopy(t *testing.T) {
+	s1, s2, s3 := startRepairServers(t)
+
+	if err := s1.StoreReplicas("c.bin", bytes.NewReader([]byte("only authenticated copies")), 2); err != nil {
+		t.Fatalf("Failed to store: %v", err)
+	}
+	if fmd, _ := s1.store.dbHandler.GetFileMetadata("c.bin"); fmd == nil || fmd.Format != crypto.VersionGCM {
+		t.Fatalf("Expected the file to be recorded in the current format, got %+v", fmd)
+	}
+
+	// The holder strips the header off its copy, which would then pass for the legacy format
+	remoteKey := crypto.HashKey("c.bin")
+	holder := s2
+	if !holder.store.Has(s1.ID, remoteKey) {
+		holder = s3
+	}
+	_, r, err := holder.store.Read(s1.ID, remoteKey)
+	if err != nil {
+		t.Fatalf("Failed to read the copy: %v", err)
+	}
+	sealed := new(bytes.Buffer)
+	sealed.ReadFrom(r)
+	if _, err := holder.store.Write(s1.ID, remoteKey, bytes.NewReader(sealed.Bytes()[16:])); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	// Nothing authenticates the legacy format, it would decrypt to garbage without an error
+	dataKey, err := s1.fileKey("c.bin")
+	if err != nil {
+		t.Fatalf("Failed to unwrap the data key: %v", err)
+	}
+	if err := s1.DeleteLocal("c.bin"); err != nil {
+		t.Fatalf("Failed to delete locally: %v", err)
+	}
+	if err := s1.fetch(context.Background(), "c.bin", remoteKey, dataKey, false, nil); err == nil {
+		t.Errorf("Expected the stripped copy to be rejected")
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/20af02/MosaicFS/crypto"
+	"github.com/manifoldco/promptui"
+)
+
+// A key source supplies the key a node's master key is wrapped with in its .env file,
+// so the master key never has to be written to disk in plaintext.
+
+// KeySource supplies the key unlocking a node's master key.
+type KeySource interface {
+	// UnlockKey returns the key of the node configured by c. Sources deriving it from a
+	// passphrase pick a salt and set c.KeySalt when it's empty.
+	UnlockKey(c *NodeConfig) ([]byte, error)
+}
+
+// agentTimeout bounds how long a key agent may take to answer.
+const agentTimeout = 10 * time.Second
+
+// ParseKeySource parses a key source:
+//   - "env:NAME" reads the hex encoded key from the environment variable NAME
+//   - "fd:N" reads the hex encoded key from the file descriptor N, e.g. a pipe
+//   - "agent:PATH" asks the key agent listening on the Unix socket PATH for it
+//   - "passphrase" derives it from a passphrase typed in the terminal, and
+//     "passphrase:env:NAME" or "passphrase:fd:N" from one read from there
+func ParseKeySource(s string) (KeySource, error) {
+	kind, arg, _ := strings.Cut(s, ":")
+	switch kind {
+	case "env", "fd":
+		secret, err := parseSecret(s)
+		if err != nil {
+			return nil, err
+		}
+		return rawKeySource{secret}, nil
+	case "agent":
+		if arg == "" {
+			return nil, errors.New("key agent socket path missing")
+		}
+		return agentKeySource(arg), nil
+	case "passphrase":
+		if arg == "" {
+			return passphraseKeySource{terminalSecret{}}, nil
+		}
+		secret, err := parseSecret(arg)
+		if err != nil {
+			return nil, err
+		}
+		return passphraseKeySource{secret}, nil
+	}
+	return nil, fmt.Errorf("invalid key source %q, want env:NAME, fd:N, agent:PATH or passphrase", s)
+}
+
+// secret is where a key or passphrase is read from.
+type secret interface {
+	read() ([]byte, error)
+}
+
+func parseSecret(s string) (secret, error) {
+	kind, arg, _ := strings.Cut(s, ":")
+	switch kind {
+	case "env":
+		if arg == "" {
+			return nil, errors.New("environment variable name missing")
+		}
+		return envSecret(arg), nil
+	case "fd":
+		fd, err := strconv.Atoi(arg)
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("invalid file descriptor %q", arg)
+		}
+		return fdSecret(fd), nil
+	}
+	return nil, fmt.Errorf("invalid secret %q, want env:NAME or fd:N", s)
+}
+
+// envSecret is read from an environment variable, which is cleared once read.
+type envSecret string
+
+func (e envSecret) read() ([]byte, error) {
+	v, ok := os.LookupEnv(string(e))
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s not set", string(e))
+	}
+	os.Unsetenv(string(e))
+	return []byte(strings.TrimSpace(v)), nil
+}
+
+// fdSecret is read from a file descriptor, which is closed once read.
+type fdSecret int
+
+func (fd fdSecret) read() ([]byte, error) {
+	f := os.NewFile(uintptr(fd), "fd"+strconv.Itoa(int(fd)))
+	if f == nil {
+		return nil, fmt.Errorf("invalid file descriptor %d", int(fd))
+	}
+	defer f.Close()
+	b, err := io.ReadAll(io.LimitReader(f, 4096))
+	if err != nil {
+		return nil, fmt.Errorf("read file descriptor %d: %w", int(fd), err)
+	}
+	return bytes.TrimSpace(b), nil
+}
+
+// terminalSecret is typed in the terminal.
+type terminalSecret struct{}
+
+func (terminalSecret) read() ([]byte, error) {
+	return promptSecret("Passphrase")
+}
+
+func promptSecret(label string) ([]byte, error) {
+	prompt := promptui.Prompt{
+		Label: label,
+		Mask:  '*',
+		Stdin: os.Stdin,
+	}
+	s, err := prompt.Run()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(s), nil
+}
+
+// promptPassphrase asks for a new passphrase twice, a typo in it would go unnoticed
+// until the day it's needed.
+func promptPassphrase(label string) ([]byte, error) {
+	passphrase, err := promptSecret(label)
+	if err != nil {
+		return nil, err
+	}
+	again, err := promptSecret("Confirm " + strings.ToLower(label[:1]) + label[1:])
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(passphrase, again) {
+		return nil, errors.New("passphrases don't match")
+	}
+	return passphrase, nil
+}
+
+// decodeKey decodes a hex encoded 32 bytes key.
+func decodeKey(b []byte) ([]byte, error) {
+	key := make([]byte, hex.DecodedLen(len(b)))
+	if _, err := hex.Decode(key, b); err != nil {
+		return nil, fmt.Errorf("error decoding key: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid key size: %d, want 32", len(key))
+	}
+	return key, nil
+}
+
+// rawKeySource reads the key itself.
+type rawKeySource struct {
+	secret secret
+}
+
+func (s rawKeySource) UnlockKey(c *NodeConfig) ([]byte, error) {
+	b, err := s.secret.read()
+	if err != nil {
+		return nil, err
+	}
+	return decodeKey(b)
+}
+
+// passphraseKeySource derives the key from a passphrase and the salt in the config.
+type passphraseKeySource struct {
+	secret secret
+}
+
+func (s passphraseKeySource) UnlockKey(c *NodeConfig) ([]byte, error) {
+	passphrase, err := s.secret.read()
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	if len(c.KeySalt) == 0 {
+		if len(c.WrappedKey) > 0 {
+			return nil, errors.New("the salt of the passphrase is missing")
+		}
+		// A new passphrase, typos would lock the key away for good
+		if _, ok := s.secret.(terminalSecret); ok {
+			again, err := promptSecret("Confirm passphrase")
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(passphrase, again) {
+				return nil, errors.New("passphrases don't match")
+			}
+		}
+		c.KeySalt = crypto.NewSalt()
+	}
+	return crypto.DeriveKey(passphrase, c.KeySalt)
+}
+
+// agentKeySource asks a key agent listening on a Unix socket. The node sends
+// "KEY <server id>\n", the agent answers "OK <hex encoded key>\n" or "ERR <reason>\n".
+type agentKeySource string
+
+func (path agentKeySource) UnlockKey(c *NodeConfig) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", string(path), agentTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("key agent: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(agentTimeout))
+
+	if _, err := fmt.Fprintf(conn, "KEY %s\n", c.ServerID); err != nil {
+		return nil, fmt.Errorf("key agent: %w", err)
+	}
+	line, err := bufio.NewReader(io.LimitReader(conn, 4096)).ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("key agent: %w", err)
+	}
+	status, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+	switch status {
+	case "OK":
+		return decodeKey([]byte(arg))
+	case "ERR":
+		return nil, fmt.Errorf("key agent: %s", arg)
+	}
+	return nil, fmt.Errorf("key agent: unexpected answer %q", status)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/20af02/MosaicFS/crypto"
+	"github.com/20af02/MosaicFS/p2p"
+)
+
+func TestParseKeySource(t *testing.T) {
+	for _, s := range []string{"env:KEY", "fd:3", "agent:/run/agent.sock", "passphrase", "passphrase:env:PASS", "passphrase:fd:0"} {
+		if _, err := ParseKeySource(s); err != nil {
+			t.Errorf("Failed to parse %q: %v", s, err)
+		}
+	}
+	for _, s := range []string{"", "env", "env:", "fd:x", "fd:-1", "agent:", "passphrase:agent:/run/agent.sock", "file:/etc/key"} {
+		if _, err := ParseKeySource(s); err == nil {
+			t.Errorf("Expected %q to be invalid", s)
+		}
+	}
+}
+
+func TestKeySources(t *testing.T) {
+	key := crypto.NewEncryptionKey()
+	c := &NodeConfig{ServerID: "node1"}
+	unlock := func(source string) []byte {
+		t.Helper()
+		s, err := ParseKeySource(source)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", source, err)
+		}
+		got, err := s.UnlockKey(c)
+		if err != nil {
+			t.Fatalf("Failed to unlock with %q: %v", source, err)
+		}
+		return got
+	}
+
+	// Environment variables are cleared once read
+	t.Setenv("TEST_UNLOCK_KEY", hex.EncodeToString(key))
+	if got := unlock("env:TEST_UNLOCK_KEY"); !bytes.Equal(got, key) {
+		t.Errorf("Unexpected key from the environment")
+	}
+	if _, ok := os.LookupEnv("TEST_UNLOCK_KEY"); ok {
+		t.Errorf("Expected the environment variable to be cleared")
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create a pipe: %v", err)
+	}
+	fd, err := syscall.Dup(int(r.Fd()))
+	if err != nil {
+		t.Fatalf("Failed to dup: %v", err)
+	}
+	r.Close()
+	w.WriteString(hex.EncodeToString(key) + "\n")
+	w.Close()
+	if got := unlock("fd:" + strconv.Itoa(fd)); !bytes.Equal(got, key) {
+		t.Errorf("Unexpected key from the file descriptor")
+	}
+
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			if strings.TrimSpace(line) == "KEY node1" {
+				conn.Write([]byte("OK " + hex.EncodeToString(key) + "\n"))
+			} else {
+				conn.Write([]byte("ERR unknown node\n"))
+			}
+			conn.Close()
+		}
+	}()
+	if got := unlock("agent:" + sock); !bytes.Equal(got, key) {
+		t.Errorf("Unexpected key from the agent")
+	}
+	s, _ := ParseKeySource("agent:" + sock)
+	if _, err := s.UnlockKey(&NodeConfig{ServerID: "node2"}); err == nil || !strings.Contains(err.Error(), "unknown node") {
+		t.Errorf("Expected the agent to refuse, got %v", err)
+	}
+
+	// The passphrase picks a salt the first time, then derives the same key from it
+	t.Setenv("TEST_PASSPHRASE", "correct horse")
+	derived := unlock("passphrase:env:TEST_PASSPHRASE")
+	if len(c.KeySalt) == 0 {
+		t.Fatalf("Expected a salt to be picked")
+	}
+	t.Setenv("TEST_PASSPHRASE", "correct horse")
+	if again := unlock("passphrase:env:TEST_PASSPHRASE"); !bytes.Equal(again, derived) {
+		t.Errorf("Expected the same key from the same passphrase")
+	}
+}
+
+func TestConfigKeySource(t *testing.T) {
+	dir := t.TempDir()
+
+	// A key stored in plaintext is wrapped once there is a key source
+	c, err := loadOrCreateConfig(dir, &NodeConfig{ListenAddr: ":7001"})
+	if err != nil {
+		t.Fatalf("Failed to create config: %v", err)
+	}
+	encKey := c.EncKey
+	unlockKey := hex.EncodeToString(crypto.NewEncryptionKey())
+	load := func() (*NodeConfig, error) {
+		t.Setenv("TEST_UNLOCK_KEY", unlockKey)
+		return loadOrCreateConfig(dir, &NodeConfig{ListenAddr: ":7001", KeySource: "env:TEST_UNLOCK_KEY"})
+	}
+	if c, err = load(); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if !bytes.Equal(c.EncKey, encKey) {
+		t.Errorf("Expected the key to be kept")
+	}
+	env, err := os.ReadFile(filepath.Join(dir, "server_7001.env"))
+	if err != nil {
+		t.Fatalf("Failed to read .env: %v", err)
+	}
+	if bytes.Contains(env, []byte(hex.EncodeToString(encKey))) || !bytes.Contains(env, []byte("MOSAICFS_ENC_KEY_WRAPPED=")) {
+		t.Errorf("Expected only the wrapped key in the .env file, got:\n%s", env)
+	}
+
+	if c, err = load(); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if !bytes.Equal(c.EncKey, encKey) {
+		t.Errorf("Expected the key to be unwrapped")
+	}
+
+	// Saving a rotated key wraps it too
+	c.EncKey, c.KeyVersion = crypto.NewEncryptionKey(), 1
+	if err := c.saveConfig(dir); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+	rotated := c.EncKey
+	if c, err = load(); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if !bytes.Equal(c.EncKey, rotated) || c.KeyVersion != 1 {
+		t.Errorf("Expected the rotated key, version %d", c.KeyVersion)
+	}
+
+	unlockKey = hex.EncodeToString(crypto.NewEncryptionKey())
+	if _, err := load(); err == nil {
+		t.Errorf("Expected another key not to unlock it")
+	}
+	if _, err := loadOrCreateConfig(dir, &NodeConfig{ListenAddr: ":7001"}); err == nil {
+		t.Errorf("Expected the wrapped key to need a key source")
+	}
+}
+
+func TestConfigNodeID(t *testing.T) {
+	dir := t.TempDir()
+	c, err := loadOrCreateConfig(dir, &NodeConfig{ListenAddr: ":7002"})
+	if err != nil {
+		t.Fatalf("Failed to create config: %v", err)
+	}
+	if c.ServerID != p2p.NodeID(c.NodeKey.Public().(ed25519.PublicKey)) {
+		t.Errorf("Expected the server ID to be derived from the node key, got %s", c.ServerID)
+	}
+
+	// The ID of another key can't be claimed
+	other := nodeID(crypto.NewNodeKey())
+	if _, err := loadOrCreateConfig(t.TempDir(), &NodeConfig{ListenAddr: ":7002", ServerID: other}); err == nil {
+		t.Errorf("Expected the ID of another node key to be refused")
+	}
+	c.ServerID = other
+	if err := c.saveConfig(dir); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+	if _, err := loadOrCreateConfig(dir, &NodeConfig{ListenAddr: ":7002"}); err == nil {
+		t.Errorf("Expected the ID of another node key to be refused")
+	}
+
+	// Nodes from before IDs were derived from keys keep theirs
+	legacy := crypto.GenerateID()
+	c.ServerID = legacy
+	if err := c.saveConfig(dir); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+	if l, err := loadOrCreateConfig(dir, &NodeConfig{ListenAddr: ":7002"}); err != nil || l.ServerID != legacy {
+		t.Errorf("Expected the legacy ID to be kept: %v", err)
+	}
+
+	// A .env file with only the node key keeps the node's identity
+	restored := t.TempDir()
+	env := fmt.Sprintf("MOSAICFS_NODE_KEY=%s", hex.EncodeToString(c.NodeKey))
+	if err := os.WriteFile(filepath.Join(restored, "server_7002.env"), []byte(env), 0600); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	r, err := loadOrCreateConfig(restored, &NodeConfig{ListenAddr: ":7002"})
+	if err != nil {
+		t.Fatalf("Failed to create config: %v", err)
+	}
+	if r.ServerID != p2p.NodeID(c.NodeKey.Public().(ed25519.PublicKey)) || len(r.EncKey) == 0 {
+		t.Errorf("Expected the node key to be kept with a new encryption key, got ID %s", r.ServerID)
+	}
+}
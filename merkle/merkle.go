@@ -0,0 +1,367 @@
+// Package merkle keeps a Merkle tree over a set of keys, so two nodes can find
+// the keys they disagree on by comparing hashes and only descending into the
+// ranges that differ.
+//
+// Keys are placed by the hash of their name: every level of the tree splits
+// the range of the level above into Fanout parts, and the leaves hold the keys.
+// Equal sets of keys give equal trees, whatever order they were added in.
+package merkle
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+const (
+	// Fanout is the number of children of every inner node.
+	Fanout = 16
+	// DefaultDepth gives Fanout^3 = 4096 leaves.
+	DefaultDepth = 3
+)
+
+// Hash is the hash of a node. Empty nodes hash to the zero Hash.
+type Hash [sha256.Size]byte
+
+func (h Hash) IsZero() bool {
+	return h == Hash{}
+}
+
+// Tree is a Merkle tree over a set of keys, safe for concurrent use.
+type Tree struct {
+	depth int
+
+	lock sync.Mutex
+	root *node
+	size int
+}
+
+type node struct {
+	hash Hash
+	// dirty is set when something below changed since hash was computed
+	dirty bool
+	// children of inner nodes, created as keys are added
+	children []*node
+	// keys of leaves
+	keys map[string]struct{}
+}
+
+// New returns an empty tree with the given depth, a value <= 0 means DefaultDepth.
+// Trees are only comparable with trees of the same depth.
+func New(depth int) *Tree {
+	if depth <= 0 {
+		depth = DefaultDepth
+	}
+	return &Tree{depth: depth, root: &node{}}
+}
+
+func (t *Tree) Depth() int {
+	return t.depth
+}
+
+// Position returns the path from the root to the leaf holding key, one child index per
+// level. Asking a remote tree for the keys at that path tells whether it holds key.
+func (t *Tree) Position(key string) []byte {
+	sum := sha256.Sum256([]byte(key))
+	path := make([]byte, t.depth)
+	for i := range path {
+		b := sum[i/2]
+		if i%2 == 0 {
+			b >>= 4
+		}
+		path[i] = b & 0xf
+	}
+	return path
+}
+
+// Add inserts key, reporting whether it wasn't there yet.
+func (t *Tree) Add(key string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	n := t.root
+	for _, i := range t.Position(key) {
+		if n.children == nil {
+			n.children = make([]*node, Fanout)
+		}
+		if n.children[i] == nil {
+			n.children[i] = &node{}
+		}
+		n.dirty = true
+		n = n.children[i]
+	}
+	if _, ok := n.keys[key]; ok {
+		return false
+	}
+	if n.keys == nil {
+		n.keys = make(map[string]struct{})
+	}
+	n.keys[key] = struct{}{}
+	n.dirty = true
+	t.size++
+	return true
+}
+
+// Remove deletes key, reporting whether it was there.
+func (t *Tree) Remove(key string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	path := t.Position(key)
+	nodes := []*node{t.root}
+	for _, i := range path {
+		n := nodes[len(nodes)-1]
+		if n.children == nil || n.children[i] == nil {
+			return false
+		}
+		nodes = append(nodes, n.children[i])
+	}
+	leaf := nodes[len(nodes)-1]
+	if _, ok := leaf.keys[key]; !ok {
+		return false
+	}
+	delete(leaf.keys, key)
+	for _, n := range nodes {
+		n.dirty = true
+	}
+	t.size--
+	return true
+}
+
+// Has reports whether key is in the tree.
+func (t *Tree) Has(key string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	n := t.find(t.Position(key))
+	if n == nil {
+		return false
+	}
+	_, ok := n.keys[key]
+	return ok
+}
+
+// Len returns the number of keys in the tree.
+func (t *Tree) Len() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.size
+}
+
+// Root returns the hash of the whole tree.
+func (t *Tree) Root() Hash {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.root.sum()
+}
+
+// Children returns the hashes of the Fanout children of the node at path.
+func (t *Tree) Children(path []byte) ([]Hash, error) {
+	if err := t.checkPath(path, t.depth-1); err != nil {
+		return nil, err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	hashes := make([]Hash, Fanout)
+	n := t.find(path)
+	if n == nil || n.children == nil {
+		return hashes, nil
+	}
+	for i, child := range n.children {
+		if child != nil {
+			hashes[i] = child.sum()
+		}
+	}
+	return hashes, nil
+}
+
+// Keys returns the keys under the node at path, sorted.
+func (t *Tree) Keys(path []byte) ([]string, error) {
+	if err := t.checkPath(path, t.depth); err != nil {
+		return nil, err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var keys []string
+	var walk func(n *node)
+	walk = func(n *node) {
+		if n == nil {
+			return
+		}
+		for key := range n.keys {
+			keys = append(keys, key)
+		}
+		for _, child := range n.children {
+			walk(child)
+		}
+	}
+	walk(t.find(path))
+	slices.Sort(keys)
+	return keys, nil
+}
+
+func (t *Tree) checkPath(path []byte, maxLen int) error {
+	if len(path) > maxLen {
+		return fmt.Errorf("merkle: path of length %d, tree of depth %d", len(path), t.depth)
+	}
+	for _, i := range path {
+		if i >= Fanout {
+			return fmt.Errorf("merkle: invalid child index %d", i)
+		}
+	}
+	return nil
+}
+
+// find returns the node at path, nil if nothing was ever added there.
+func (t *Tree) find(path []byte) *node {
+	n := t.root
+	for _, i := range path {
+		if n.children == nil || n.children[i] == nil {
+			return nil
+		}
+		n = n.children[i]
+	}
+	return n
+}
+
+// sum returns the hash of n, computing it again if something changed below.
+func (n *node) sum() Hash {
+	if !n.dirty {
+		return n.hash
+	}
+	n.dirty = false
+	n.hash = Hash{}
+
+	h := sha256.New()
+	empty := true
+	if n.keys != nil {
+		keys := make([]string, 0, len(n.keys))
+		for key := range n.keys {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			// Length-prefixed, so keys can't run into each other
+			fmt.Fprintf(h, "%d:%s", len(key), key)
+			empty = false
+		}
+	}
+	for _, child := range n.children {
+		var sum Hash
+		if child != nil {
+			sum = child.sum()
+		}
+		h.Write(sum[:])
+		empty = empty && sum.IsZero()
+	}
+	if !empty {
+		copy(n.hash[:], h.Sum(nil))
+	}
+	return n.hash
+}
+
+// Remote is a tree held by another node.
+type Remote interface {
+	Root(ctx context.Context) (Hash, error)
+	Children(ctx context.Context, path []byte) ([]Hash, error)
+	Keys(ctx context.Context, path []byte) ([]string, error)
+}
+
+// Diff compares t to remote, only descending into the nodes whose hashes differ.
+// It returns the keys remote has that t doesn't, and the keys t has that remote doesn't.
+func Diff(ctx context.Context, t *Tree, remote Remote) (added, removed []string, err error) {
+	root, err := remote.Root(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if root == t.Root() {
+		return nil, nil, nil
+	}
+
+	var diff func(path []byte, local, theirs Hash) error
+	diff = func(path []byte, local, theirs Hash) error {
+		switch {
+		case local == theirs:
+			return nil
+		case theirs.IsZero():
+			keys, err := t.Keys(path)
+			removed = append(removed, keys...)
+			return err
+		case local.IsZero() || len(path) == t.depth:
+			// Fetch the whole range rather than descending, there's nothing to skip
+			keys, err := remote.Keys(ctx, path)
+			if err != nil {
+				return err
+			}
+			ours, err := t.Keys(path)
+			if err != nil {
+				return err
+			}
+			a, r := compare(ours, keys)
+			added = append(added, a...)
+			removed = append(removed, r...)
+			return nil
+		}
+
+		ours, err := t.Children(path)
+		if err != nil {
+			return err
+		}
+		hashes, err := remote.Children(ctx, path)
+		if err != nil {
+			return err
+		}
+		if len(hashes) != Fanout {
+			return fmt.Errorf("merkle: remote node has %d children", len(hashes))
+		}
+		for i := range hashes {
+			if err := diff(append(bytes.Clone(path), byte(i)), ours[i], hashes[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := diff(nil, t.Root(), root); err != nil {
+		return nil, nil, err
+	}
+	return added, removed, nil
+}
+
+// compare returns the keys of theirs missing from ours and the other way around. Both are sorted.
+func compare(ours, theirs []string) (added, removed []string) {
+	i, j := 0, 0
+	for i < len(ours) || j < len(theirs) {
+		switch {
+		case j == len(theirs) || (i < len(ours) && ours[i] < theirs[j]):
+			removed = append(removed, ours[i])
+			i++
+		case i == len(ours) || theirs[j] < ours[i]:
+			added = append(added, theirs[j])
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	return added, removed
+}
+
+// Sync updates t to hold the same keys as remote, returning how many were added and removed.
+func Sync(ctx context.Context, t *Tree, remote Remote) (added, removed int, err error) {
+	a, r, err := Diff(ctx, t, remote)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, key := range a {
+		t.Add(key)
+	}
+	for _, key := range r {
+		t.Remove(key)
+	}
+	return len(a), len(r), nil
+}
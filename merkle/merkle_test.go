@@ -0,0 +1,122 @@
+package merkle
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// localRemote serves a tree as a Remote, counting the calls.
+type localRemote struct {
+	t     *Tree
+	calls int
+}
+
+func (r *localRemote) Root(ctx context.Context) (Hash, error) {
+	r.calls++
+	return r.t.Root(), nil
+}
+
+func (r *localRemote) Children(ctx context.Context, path []byte) ([]Hash, error) {
+	r.calls++
+	return r.t.Children(path)
+}
+
+func (r *localRemote) Keys(ctx context.Context, path []byte) ([]string, error) {
+	r.calls++
+	return r.t.Keys(path)
+}
+
+func treeOf(keys ...string) *Tree {
+	t := New(0)
+	for _, key := range keys {
+		t.Add(key)
+	}
+	return t
+}
+
+func testKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	return keys
+}
+
+func TestTreeHash(t *testing.T) {
+	keys := testKeys(1000)
+	a := treeOf(keys...)
+	reversed := slices.Clone(keys)
+	slices.Reverse(reversed)
+	b := treeOf(reversed...)
+	assert.Equal(t, a.Root(), b.Root())
+	assert.Equal(t, 1000, a.Len())
+
+	assert.True(t, b.Add("extra"))
+	assert.False(t, b.Add("extra"))
+	assert.NotEqual(t, a.Root(), b.Root())
+	assert.True(t, b.Has("extra"))
+
+	assert.True(t, b.Remove("extra"))
+	assert.False(t, b.Remove("extra"))
+	assert.Equal(t, a.Root(), b.Root())
+
+	// Emptied trees hash like new ones
+	for _, key := range keys {
+		a.Remove(key)
+	}
+	assert.True(t, a.Root().IsZero())
+	all, err := b.Keys(nil)
+	assert.Nil(t, err)
+	assert.Len(t, all, 1000)
+}
+
+func TestDiff(t *testing.T) {
+	keys := testKeys(10_000)
+	local := treeOf(keys...)
+	remote := treeOf(keys...)
+
+	r := &localRemote{t: remote}
+	added, removed, err := Diff(context.Background(), local, r)
+	assert.Nil(t, err)
+	assert.Empty(t, added)
+	assert.Empty(t, removed)
+	assert.Equal(t, 1, r.calls)
+
+	remote.Add("new")
+	remote.Remove("key-42")
+	r.calls = 0
+	added, removed, err = Diff(context.Background(), local, r)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"new"}, added)
+	assert.Equal(t, []string{"key-42"}, removed)
+	// Two paths down the tree, not the whole of it
+	assert.LessOrEqual(t, r.calls, 2+2*DefaultDepth)
+
+	_, _, err = Sync(context.Background(), local, r)
+	assert.Nil(t, err)
+	assert.Equal(t, remote.Root(), local.Root())
+}
+
+func TestSyncEmpty(t *testing.T) {
+	local := New(0)
+	remote := treeOf(testKeys(500)...)
+
+	r := &localRemote{t: remote}
+	added, removed, err := Sync(context.Background(), local, r)
+	assert.Nil(t, err)
+	assert.Equal(t, 500, added)
+	assert.Equal(t, 0, removed)
+	assert.Equal(t, remote.Root(), local.Root())
+	// Empty ranges are fetched whole
+	assert.LessOrEqual(t, r.calls, 2+Fanout)
+
+	added, removed, err = Sync(context.Background(), local, &localRemote{t: New(0)})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, added)
+	assert.Equal(t, 500, removed)
+	assert.Equal(t, 0, local.Len())
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/20af02/MosaicFS/p2p"
+)
+
+// VersionVector counts the changes each node made to a record, by node ID.
+type VersionVector map[string]uint64
+
+// Ordering is how two versions relate.
+type Ordering int
+
+const (
+	Equal Ordering = iota
+	// Before means the version is an ancestor of the other one.
+	Before
+	// After means the version descends from the other one.
+	After
+	// Concurrent means both versions have changes the other lacks.
+	Concurrent
+)
+
+// Compare tells how v relates to other.
+func (v VersionVector) Compare(other VersionVector) Ordering {
+	less, more := false, false
+	for id, n := range v {
+		if n > other[id] {
+			more = true
+		}
+	}
+	for id, n := range other {
+		if n > v[id] {
+			less = true
+		}
+	}
+	switch {
+	case less && more:
+		return Concurrent
+	case less:
+		return Before
+	case more:
+		return After
+	}
+	return Equal
+}
+
+// Merge returns a version descending from both v and other.
+func (v VersionVector) Merge(other VersionVector) VersionVector {
+	merged := make(VersionVector, len(v))
+	for id, n := range v {
+		merged[id] = n
+	}
+	for id, n := range other {
+		merged[id] = max(merged[id], n)
+	}
+	return merged
+}
+
+// MessageMetadata carries file metadata records of a namespace, and the nodes
+// its owner lets read them.
+type MessageMetadata struct {
+	Namespace string
+	Readers   []string
+	Records   []FileMetadata
+}
+
+// metadataBatchSize caps the records sent in a single message.
+const metadataBatchSize = 256
+
+// ListNamespace returns the files of the namespace ns, as far as we know.
+func (s *FileServer) ListNamespace(ns string) ([]FileMetadata, error) {
+	if !s.mayRead(ns, s.ID) {
+		return nil, fmt.Errorf("not allowed to read namespace (%s)", ns)
+	}
+	return s.store.dbHandler.ListNamespace(ns)
+}
+
+// readers returns the nodes allowed to read the records of namespace ns, besides its owner.
+func (s *FileServer) readers(ns string) []string {
+	if ns == s.ID {
+		return s.MetadataReaders
+	}
+	readers, err := s.store.dbHandler.Readers(ns)
+	if err != nil {
+		log.Printf("[%s] failed to load the readers of (%s): %v", s.Transport.Addr(), ns, err)
+	}
+	return readers
+}
+
+// mayRead reports whether the node id may read the records of namespace ns.
+func (s *FileServer) mayRead(ns, id string) bool {
+	if id == ns {
+		return true
+	}
+	readers := s.readers(ns)
+	return slices.Contains(readers, id) || slices.Contains(readers, "*")
+}
+
+// syncMetadata sends peer the records of our namespace when it may read them. Records
+// it already has are ignored on its side.
+func (s *FileServer) syncMetadata(peer p2p.Peer) {
+	if !s.mayRead(s.ID, peer.ID()) {
+		return
+	}
+	records, err := s.store.dbHandler.Records(s.ID)
+	if err != nil {
+		log.Printf("[%s] failed to load our records: %v", s.Transport.Addr(), err)
+		return
+	}
+	s.sendMetadata(peer, s.ID, records)
+}
+
+// publishMetadata sends records changed on this node to the peers that may read them.
+func (s *FileServer) publishMetadata(records []FileMetadata) {
+	for _, peer := range s.peerList() {
+		if s.mayRead(s.ID, peer.ID()) {
+			s.sendMetadata(peer, s.ID, records)
+		}
+	}
+}
+
+func (s *FileServer) sendMetadata(peer p2p.Peer, ns string, records []FileMetadata) {
+	readers := s.readers(ns)
+	for len(records) > 0 {
+		n := min(len(records), metadataBatchSize)
+		msg := &Message{
+			Payload: MessageMetadata{
+				Namespace: ns,
+				Readers:   readers,
+				Records:   records[:n],
+			},
+		}
+		records = records[n:]
+		if err := s.send(peer, msg); err != nil {
+			log.Printf("[%s] failed to send metadata to (%s): %v", s.Transport.Addr(), peer.ID(), err)
+			return
+		}
+	}
+}
+
+// validNamespace reports whether ns is a node ID: hex digits, and dashes in generated ones.
+func validNamespace(ns string) bool {
+	if ns == "" || len(ns) > 64 {
+		return false
+	}
+	for _, c := range ns {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// handleMessageMetadata stores the records of a namespace sent by its owner. Records are
+// never relayed: a node only learns about the namespaces of the peers it's connected to.
+func (s *FileServer) handleMessageMetadata(from string, msg MessageMetadata) error {
+	ns := msg.Namespace
+	if !validNamespace(ns) || ns != from || ns == s.ID {
+		return fmt.Errorf("[%s] ignoring metadata of (%s) from (%s): not its owner", s.Transport.Addr(), ns, from)
+	}
+	// Only the owner says who may read its namespace
+	if err := s.store.dbHandler.SetReaders(ns, msg.Readers); err != nil {
+		return err
+	}
+	if !s.mayRead(ns, s.ID) {
+		return fmt.Errorf("[%s] ignoring metadata of (%s): not allowed", s.Transport.Addr(), ns)
+	}
+
+	var changed int
+	for _, fmd := range msg.Records {
+		_, ok, err := s.store.dbHandler.MergeFile(ns, fmd)
+		if err != nil {
+			return err
+		}
+		if ok {
+			changed++
+		}
+	}
+	if changed > 0 {
+		log.Printf("[%s] updated %d records of (%s)", s.Transport.Addr(), changed, ns)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/20af02/MosaicFS/crypto"
+)
+
+func TestVersionVector(t *testing.T) {
+	a := VersionVector{"n1": 2, "n2": 1}
+	tests := []struct {
+		other VersionVector
+		want  Ordering
+	}{
+		{VersionVector{"n1": 2, "n2": 1}, Equal},
+		{VersionVector{"n1": 3, "n2": 1}, Before},
+		{VersionVector{"n1": 1}, After},
+		{VersionVector{"n1": 1, "n2": 1, "n3": 1}, Concurrent},
+	}
+	for _, tt := range tests {
+		if got := a.Compare(tt.other); got != tt.want {
+			t.Errorf("Compare(%v) = %d, want %d", tt.other, got, tt.want)
+		}
+	}
+
+	merged := a.Merge(VersionVector{"n1": 1, "n3": 4})
+	if merged.Compare(VersionVector{"n1": 2, "n2": 1, "n3": 4}) != Equal {
+		t.Errorf("Unexpected merged version %v", merged)
+	}
+}
+
+func TestSyncMetadata(t *testing.T) {
+	s1 := MakeTestServer(":3000", []string{})
+	s2 := MakeTestServer(":4000", []string{":3000"})
+	s3 := MakeTestServer(":5000", []string{":3000"})
+	s1.MetadataReaders = []string{s2.ID}
+	defer func() {
+		s1.Stop()
+		s2.Stop()
+		s3.Stop()
+		teardown(t, s1.store)
+		teardown(t, s2.store)
+		teardown(t, s3.store)
+	}()
+
+	// Stored before anyone connects, s2 learns about it on connect
+	go func() { s1.Start() }()
+	time.Sleep(time.Second)
+	if err := s1.StoreReplicas("before.txt", bytes.NewReader([]byte("stored alone")), 1); err != nil {
+		t.Fatalf("Failed to store: %v", err)
+	}
+
+	go func() { s2.Start() }()
+	go func() { s3.Start() }()
+	time.Sleep(2 * time.Second)
+
+	files, err := s2.ListNamespace(s1.ID)
+	if err != nil {
+		t.Fatalf("Failed to list the files of s1: %v", err)
+	}
+	if len(files) != 1 || files[0].Key != "before.txt" {
+		t.Errorf("Expected s2 to know about before.txt, got %+v", files)
+	}
+	if _, err := s3.ListNamespace(s1.ID); err == nil {
+		t.Errorf("Expected s3 not to be allowed to list the files of s1")
+	}
+
+	// Changes made afterwards are sent as they happen
+	if err := s1.StoreReplicas("after.txt", bytes.NewReader([]byte("stored later")), 2); err != nil {
+		t.Fatalf("Failed to store: %v", err)
+	}
+	if err := s1.Delete("before.txt"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	time.Sleep(time.Second)
+
+	files, err = s2.ListNamespace(s1.ID)
+	if err != nil {
+		t.Fatalf("Failed to list the files of s1: %v", err)
+	}
+	if len(files) != 1 || files[0].Key != "after.txt" {
+		t.Fatalf("Expected s2 to only know about after.txt, got %+v", files)
+	}
+	if len(files[0].ReplicaLocations) == 0 || files[0].ReplicaLocations[0] != s1.ID {
+		t.Errorf("Expected after.txt to be located on s1, got %v", files[0].ReplicaLocations)
+	}
+	if files, _ := s3.store.dbHandler.Records(s1.ID); len(files) != 0 {
+		t.Errorf("Expected s3 to hold no records of s1, got %d", len(files))
+	}
+}
+
+func TestMetadataOwner(t *testing.T) {
+	s := MakeTestServer(":3000", []string{})
+	defer func() {
+		s.Stop()
+		teardown(t, s.store)
+	}()
+	if _, err := s.store.dbHandler.UpdateFile(FileMetadata{Key: "ours.txt", Size: 1}); err != nil {
+		t.Fatalf("Failed to update: %v", err)
+	}
+	other, third := crypto.GenerateID(), crypto.GenerateID()
+	record := FileMetadata{Key: "ours.txt", Deleted: true, Version: VersionVector{other: 10}, Modified: time.Now()}
+
+	// Nobody else writes to our namespace
+	if err := s.handleMessageMetadata(other, MessageMetadata{Namespace: s.ID, Records: []FileMetadata{record}}); err == nil {
+		t.Errorf("Expected records of our namespace from another node to be rejected")
+	}
+	if _, err := s.store.dbHandler.GetFileMetadata("ours.txt"); err != nil {
+		t.Errorf("Expected ours.txt to be left alone: %v", err)
+	}
+
+	// Records of a namespace only come from its owner
+	msg := MessageMetadata{Namespace: other, Readers: []string{"*"}, Records: []FileMetadata{record}}
+	if err := s.handleMessageMetadata(third, msg); err == nil {
+		t.Errorf("Expected records of (%s) from (%s) to be rejected", other, third)
+	}
+	if err := s.handleMessageMetadata(other, msg); err != nil {
+		t.Errorf("Expected records from their owner to be accepted: %v", err)
+	}
+	if records, _ := s.store.dbHandler.Records(other); len(records) != 1 {
+		t.Errorf("Expected 1 record of (%s), got %d", other, len(records))
+	}
+
+	// Namespaces don't reach our other buckets
+	bad := s.ID + "/keys"
+	if err := s.handleMessageMetadata(bad, MessageMetadata{Namespace: bad, Readers: []string{"*"}, Records: []FileMetadata{record}}); err == nil {
+		t.Errorf("Expected namespace (%s) to be rejected", bad)
+	}
+	if _, _, err := s.store.dbHandler.MergeFile(s.ID, record); err == nil {
+		t.Errorf("Expected merging into our namespace to fail")
+	}
+}
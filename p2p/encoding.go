@@ -2,6 +2,7 @@ package p2p
 
 import (
 	"encoding/gob"
+	"fmt"
 	"io"
 )
 
@@ -15,30 +16,32 @@ func (dec GOBDecoder) Decode(r io.Reader, msg *RPC) error {
 	return gob.NewDecoder(r).Decode(msg)
 }
 
-type DefaultDecoder struct{}
+// DefaultDecoder decodes length-prefixed frames (see FrameHeader).
+type DefaultDecoder struct {
+	// MaxFrameSize is the largest payload accepted in a single frame.
+	// Defaults to DefaultMaxFrameSize when 0.
+	MaxFrameSize uint32
+}
 
 func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
-	peekBuf := make([]byte, 1)
-	_, err := r.Read(peekBuf)
+	hdr, payload, err := ReadFrame(r, dec.MaxFrameSize)
 	if err != nil {
 		return err
 	}
 
-	// Streaming => don't decode what's sent over the wire
-	// Just set the Stream flag to true amd handle later.
-	stream := peekBuf[0] == IncomingStreamT
-	if stream {
-		msg.Stream = true
-		return nil
-	}
+	msg.FrameType = hdr.Type
+	msg.Payload = payload
 
-	buf := make([]byte, 1028)
-	n, err := r.Read(buf)
-	if err != nil {
-		return err
+	switch {
+	case hdr.Type == IncommingMessageT:
+		// Regular message, handed to the transport consumer as is.
+	case isStreamFrame(hdr.Type):
+		msg.Stream = true
+	case hdr.Type == PingT || hdr.Type == PongT:
+		// Heartbeat, only the FrameType matters.
+	default:
+		return fmt.Errorf("unknown frame type: %#x", hdr.Type)
 	}
 
-	msg.Payload = buf[:n]
-
 	return nil
 }
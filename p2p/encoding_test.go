@@ -0,0 +1,46 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultDecoderLargeMessage(t *testing.T) {
+	payload := bytes.Repeat([]byte("mosaic"), 10_000) // well past a single read
+	buf := new(bytes.Buffer)
+
+	assert.Nil(t, WriteFrame(buf, IncommingMessageT, payload))
+	assert.Nil(t, WriteFrame(buf, StreamDataT, encodeStreamID(7, []byte("chunk"))))
+
+	dec := DefaultDecoder{}
+	rpc := RPC{}
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.False(t, rpc.Stream)
+	assert.Equal(t, payload, rpc.Payload)
+
+	rpc = RPC{}
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.True(t, rpc.Stream)
+	assert.Equal(t, StreamDataT, rpc.FrameType)
+	assert.Equal(t, encodeStreamID(7, []byte("chunk")), rpc.Payload)
+}
+
+func TestDefaultDecoderMaxFrameSize(t *testing.T) {
+	buf := new(bytes.Buffer)
+	assert.Nil(t, WriteFrame(buf, IncommingMessageT, make([]byte, 128)))
+
+	err := DefaultDecoder{MaxFrameSize: 64}.Decode(buf, &RPC{})
+	assert.True(t, errors.Is(err, ErrFrameTooLarge))
+}
+
+func TestReadFrameUnsupportedVersion(t *testing.T) {
+	buf := new(bytes.Buffer)
+	assert.Nil(t, WriteFrame(buf, IncommingMessageT, []byte("hi")))
+	buf.Bytes()[0] = ProtocolVersion + 1
+
+	_, _, err := ReadFrame(buf, 0)
+	assert.True(t, errors.Is(err, ErrUnsupportedVersion))
+}
@@ -0,0 +1,92 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	// ProtocolVersion is the frame version written by this node.
+	ProtocolVersion byte = 2
+	// MinProtocolVersion is the oldest frame version this node still understands.
+	// Frames outside of [MinProtocolVersion, ProtocolVersion] are rejected.
+	// Version 2 replaced the raw "incoming stream" hijack with multiplexed streams.
+	MinProtocolVersion byte = 2
+
+	// DefaultMaxFrameSize is the largest payload accepted when no limit is configured.
+	DefaultMaxFrameSize uint32 = 4 << 20 // 4MB
+
+	// FrameHeaderSize is version (1) + type (1) + payload length (4).
+	FrameHeaderSize = 6
+)
+
+var (
+	ErrFrameTooLarge      = errors.New("frame exceeds max frame size")
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+)
+
+// FrameHeader precedes every frame sent over the wire.
+//
+//	+---------+------+----------------+-----------------+
+//	| version | type | length (BE u32)| payload ...     |
+//	+---------+------+----------------+-----------------+
+type FrameHeader struct {
+	Version byte
+	Type    byte
+	Length  uint32
+}
+
+// WriteFrame writes a single frame of the given type to w.
+// The header and payload are written with one call so frames from concurrent
+// writers sharing a locked writer are never interleaved.
+func WriteFrame(w io.Writer, frameType byte, payload []byte) error {
+	if uint64(len(payload)) > math.MaxUint32 {
+		return ErrFrameTooLarge
+	}
+
+	buf := make([]byte, FrameHeaderSize+len(payload))
+	buf[0] = ProtocolVersion
+	buf[1] = frameType
+	binary.BigEndian.PutUint32(buf[2:FrameHeaderSize], uint32(len(payload)))
+	copy(buf[FrameHeaderSize:], payload)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadFrame reads a single frame from r, rejecting payloads larger than maxSize.
+// A maxSize of 0 means DefaultMaxFrameSize.
+func ReadFrame(r io.Reader, maxSize uint32) (FrameHeader, []byte, error) {
+	if maxSize == 0 {
+		maxSize = DefaultMaxFrameSize
+	}
+
+	var (
+		hdr    FrameHeader
+		rawHdr [FrameHeaderSize]byte
+	)
+	if _, err := io.ReadFull(r, rawHdr[:]); err != nil {
+		return hdr, nil, err
+	}
+
+	hdr.Version = rawHdr[0]
+	hdr.Type = rawHdr[1]
+	hdr.Length = binary.BigEndian.Uint32(rawHdr[2:])
+
+	if hdr.Version < MinProtocolVersion || hdr.Version > ProtocolVersion {
+		return hdr, nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, hdr.Version)
+	}
+	if hdr.Length > maxSize {
+		return hdr, nil, fmt.Errorf("%w: %d > %d", ErrFrameTooLarge, hdr.Length, maxSize)
+	}
+
+	payload := make([]byte, hdr.Length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return hdr, nil, err
+	}
+
+	return hdr, payload, nil
+}
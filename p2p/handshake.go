@@ -1,8 +1,272 @@
 package p2p
 
-// HandshakeFunc... ?
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// HandshakeFunc is run on every new connection before it's handed to OnPeer.
 type HandshakeFunc func(Peer) error
 
 func NOPHandshakeFunc(Peer) error {
 	return nil
 }
+
+const (
+	handshakeVersion byte = 1
+	handshakeTimeout      = 10 * time.Second
+
+	// helloSize is version (1) + ed25519 identity key (32) + X25519 ephemeral key (32).
+	helloSize = 1 + ed25519.PublicKeySize + 32
+)
+
+var (
+	ErrUntrustedPeer      = errors.New("peer identity key is not trusted")
+	ErrHandshakeVersion   = errors.New("unsupported handshake version")
+	ErrHandshakeSignature = errors.New("invalid handshake signature")
+	ErrPeerID             = errors.New("peer ID doesn't match its identity key")
+	ErrReflectedKey       = errors.New("peer presented our own identity key")
+)
+
+// SecureHandshake authenticates both ends of a connection with their long-term
+// ed25519 node keys and encrypts everything sent afterwards.
+//
+// Both sides send a hello carrying their identity key and a fresh X25519 key,
+// then sign the transcript of both hellos along with their role in it, so a
+// signature can't be reflected back. The X25519 shared secret, bound to that
+// transcript, is expanded into one AES-GCM key per direction.
+type SecureHandshake struct {
+	privKey ed25519.PrivateKey
+	// trusted holds the identity keys allowed to connect. When empty, any peer
+	// proving ownership of its key is accepted (encryption only).
+	trusted map[string]struct{}
+}
+
+func NewSecureHandshake(privKey ed25519.PrivateKey, trusted []ed25519.PublicKey) *SecureHandshake {
+	h := &SecureHandshake{
+		privKey: privKey,
+		trusted: make(map[string]struct{}, len(trusted)),
+	}
+	for _, key := range trusted {
+		h.trusted[string(key)] = struct{}{}
+	}
+	return h
+}
+
+// PublicKey returns the identity key this node presents to its peers.
+func (h *SecureHandshake) PublicKey() ed25519.PublicKey {
+	return h.privKey.Public().(ed25519.PublicKey)
+}
+
+// Handshake implements HandshakeFunc. On success the peer's connection is
+// replaced by the encrypted one.
+func (h *SecureHandshake) Handshake(p Peer) error {
+	tp, ok := p.(*TCPPeer)
+	if !ok {
+		return fmt.Errorf("secure handshake: unsupported peer type %T", p)
+	}
+
+	conn, remoteKey, err := h.handshake(tp.Conn)
+	if err != nil {
+		return fmt.Errorf("secure handshake with %s: %w", tp.RemoteAddr(), err)
+	}
+
+	tp.Conn = conn
+	tp.remoteKey = remoteKey
+	return nil
+}
+
+func (h *SecureHandshake) handshake(conn net.Conn) (net.Conn, ed25519.PublicKey, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hello := make([]byte, 0, helloSize)
+	hello = append(hello, handshakeVersion)
+	hello = append(hello, h.PublicKey()...)
+	hello = append(hello, ephemeral.PublicKey().Bytes()...)
+
+	remoteHello := make([]byte, helloSize)
+	if err := exchange(conn, hello, remoteHello); err != nil {
+		return nil, nil, err
+	}
+	if remoteHello[0] != handshakeVersion {
+		return nil, nil, fmt.Errorf("%w: %d", ErrHandshakeVersion, remoteHello[0])
+	}
+
+	remoteKey := ed25519.PublicKey(bytes.Clone(remoteHello[1 : 1+ed25519.PublicKeySize]))
+	if remoteKey.Equal(h.PublicKey()) {
+		return nil, nil, ErrReflectedKey
+	}
+	remoteEphemeral, err := ecdh.X25519().NewPublicKey(remoteHello[1+ed25519.PublicKeySize:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Order the hellos so both sides compute the same transcript.
+	first := bytes.Compare(hello, remoteHello) < 0
+	var transcript []byte
+	if first {
+		transcript = append(append(transcript, hello...), remoteHello...)
+	} else {
+		transcript = append(append(transcript, remoteHello...), hello...)
+	}
+	transcriptHash := sha256.Sum256(transcript)
+
+	// Each side signs its own role, so the two signatures never match.
+	localRole, remoteRole := "first", "second"
+	if !first {
+		localRole, remoteRole = remoteRole, localRole
+	}
+	signed := func(role string) []byte {
+		return append([]byte("mosaicfs handshake "+role), transcriptHash[:]...)
+	}
+
+	remoteSig := make([]byte, ed25519.SignatureSize)
+	if err := exchange(conn, ed25519.Sign(h.privKey, signed(localRole)), remoteSig); err != nil {
+		return nil, nil, err
+	}
+	if !ed25519.Verify(remoteKey, signed(remoteRole), remoteSig) {
+		return nil, nil, ErrHandshakeSignature
+	}
+	if len(h.trusted) > 0 {
+		if _, ok := h.trusted[string(remoteKey)]; !ok {
+			return nil, nil, fmt.Errorf("%w: %x", ErrUntrustedPeer, []byte(remoteKey))
+		}
+	}
+
+	shared, err := ephemeral.ECDH(remoteEphemeral)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		firstKey  = deriveKey(shared, transcriptHash[:], "mosaicfs first->second")
+		secondKey = deriveKey(shared, transcriptHash[:], "mosaicfs second->first")
+	)
+	sendKey, recvKey := firstKey, secondKey
+	if !first {
+		sendKey, recvKey = secondKey, firstKey
+	}
+
+	sc, err := newSecureConn(conn, sendKey, recvKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sc, remoteKey, nil
+}
+
+// exchange sends out while reading len(in) bytes, so both sides can speak first.
+func exchange(conn net.Conn, out []byte, in []byte) error {
+	errch := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(out)
+		errch <- err
+	}()
+
+	if _, err := io.ReadFull(conn, in); err != nil {
+		return err
+	}
+	return <-errch
+}
+
+// deriveKey is a single block HKDF-SHA256 (RFC 5869), enough for a 32 byte key.
+func deriveKey(secret, salt []byte, info string) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	expand := hmac.New(sha256.New, prk)
+	expand.Write([]byte(info))
+	expand.Write([]byte{0x1})
+	return expand.Sum(nil)
+}
+
+// NodeID returns the ID of the node with the identity key pub. Peers authenticated by a
+// SecureHandshake must go by it, so no node can pass itself off as another.
+func NodeID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:16])
+}
+
+// PeerInfo is what nodes tell each other about themselves once connected.
+type PeerInfo struct {
+	ID string
+	// ListenAddr is the address the node accepts connections on, empty if it doesn't.
+	ListenAddr string
+}
+
+// exchangePeerInfo sends our PeerInfo and records the one of the remote on the peer.
+// An authenticated remote goes by the ID of its key, or one verify accepts for it.
+func exchangePeerInfo(p *TCPPeer, info PeerInfo, verify func(string, ed25519.PublicKey) error) error {
+	p.Conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer p.Conn.SetDeadline(time.Time{})
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(info); err != nil {
+		return err
+	}
+
+	errch := make(chan error, 1)
+	go func() {
+		errch <- p.writeFrame(PeerInfoT, buf.Bytes())
+	}()
+
+	hdr, payload, err := ReadFrame(p.Conn, 0)
+	if err != nil {
+		return err
+	}
+	if hdr.Type != PeerInfoT {
+		return fmt.Errorf("expected peer info, got frame type: %#x", hdr.Type)
+	}
+
+	var remote PeerInfo
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&remote); err != nil {
+		return err
+	}
+	if p.remoteKey != nil && remote.ID != NodeID(p.remoteKey) {
+		if verify == nil {
+			return fmt.Errorf("%w: (%s) claims to be (%s)", ErrPeerID, NodeID(p.remoteKey), remote.ID)
+		}
+		if err := verify(remote.ID, p.remoteKey); err != nil {
+			return fmt.Errorf("%w: (%s) claims to be (%s): %w", ErrPeerID, NodeID(p.remoteKey), remote.ID, err)
+		}
+	}
+	p.id = remote.ID
+	p.listenAddr = resolveListenAddr(remote.ListenAddr, p.RemoteAddr())
+
+	return <-errch
+}
+
+// resolveListenAddr turns an advertised address like ":3000" or "0.0.0.0:3000"
+// into one we can dial, using the host the connection came from.
+func resolveListenAddr(advertised string, remote net.Addr) string {
+	host, port, err := net.SplitHostPort(advertised)
+	if err != nil || len(port) == 0 || port == "0" {
+		return ""
+	}
+
+	if ip := net.ParseIP(host); len(host) == 0 || (ip != nil && ip.IsUnspecified()) {
+		remoteHost, _, err := net.SplitHostPort(remote.String())
+		if err != nil {
+			return ""
+		}
+		host = remoteHost
+	}
+	return net.JoinHostPort(host, port)
+}
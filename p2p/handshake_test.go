@@ -0,0 +1,212 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newIdentity(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	return pub, priv
+}
+
+func TestSecureHandshake(t *testing.T) {
+	serverPub, serverPriv := newIdentity(t)
+	clientPub, clientPriv := newIdentity(t)
+
+	peerch := make(chan Peer, 2)
+	onPeer := func(p Peer) error {
+		peerch <- p
+		return nil
+	}
+
+	server := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:0",
+		NodeID:        NodeID(serverPub),
+		AdvertiseAddr: ":4242",
+		HandshakeFunc: NewSecureHandshake(serverPriv, []ed25519.PublicKey{clientPub}).Handshake,
+		Decoder:       DefaultDecoder{},
+		OnPeer:        onPeer,
+	})
+	assert.Nil(t, server.ListenAndAccept())
+	defer server.Close()
+
+	client := NewTCPTransport(TCPTransportOpts{
+		NodeID:        NodeID(clientPub),
+		HandshakeFunc: NewSecureHandshake(clientPriv, []ed25519.PublicKey{serverPub}).Handshake,
+		Decoder:       DefaultDecoder{},
+		OnPeer:        onPeer,
+	})
+	assert.Nil(t, client.Dial(server.listener.Addr().String()))
+
+	a, b := <-peerch, <-peerch
+	defer a.Close()
+	defer b.Close()
+
+	// Each side knows who it is talking to
+	keys := []ed25519.PublicKey{a.(*TCPPeer).PublicKey(), b.(*TCPPeer).PublicKey()}
+	assert.Contains(t, keys, serverPub)
+	assert.Contains(t, keys, clientPub)
+
+	// Peers are known by node ID, and the server's unspecified host was resolved
+	if a.ID() == NodeID(clientPub) {
+		a, b = b, a
+	}
+	assert.Equal(t, NodeID(serverPub), a.ID())
+	assert.Equal(t, "127.0.0.1:4242", a.ListenAddr())
+	assert.Equal(t, NodeID(clientPub), b.ID())
+	assert.Empty(t, b.ListenAddr())
+
+	// Messages and streams flow over the encrypted connection
+	assert.Nil(t, a.Send([]byte("hello over the secure channel")))
+	var rpc RPC
+	select {
+	case rpc = <-server.Consume():
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message received")
+	}
+	assert.Equal(t, "hello over the secure channel", string(rpc.Payload))
+	assert.Equal(t, NodeID(clientPub), rpc.From)
+}
+
+func TestSecureHandshakeUntrusted(t *testing.T) {
+	_, serverPriv := newIdentity(t)
+	_, clientPriv := newIdentity(t)
+	otherPub, _ := newIdentity(t)
+
+	peerch := make(chan Peer, 2)
+	server := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:0",
+		HandshakeFunc: NewSecureHandshake(serverPriv, []ed25519.PublicKey{otherPub}).Handshake,
+		Decoder:       DefaultDecoder{},
+		OnPeer: func(p Peer) error {
+			peerch <- p
+			return nil
+		},
+	})
+	assert.Nil(t, server.ListenAndAccept())
+	defer server.Close()
+
+	client := NewTCPTransport(TCPTransportOpts{
+		HandshakeFunc: NewSecureHandshake(clientPriv, nil).Handshake,
+		Decoder:       DefaultDecoder{},
+	})
+	assert.Nil(t, client.Dial(server.listener.Addr().String()))
+
+	select {
+	case <-peerch:
+		t.Fatal("untrusted peer was accepted")
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestSecureHandshakeReflected(t *testing.T) {
+	_, priv := newIdentity(t)
+	conn, mirror := net.Pipe()
+	defer conn.Close()
+	defer mirror.Close()
+
+	// The mirror answers with our identity key and its own X25519 key, then echoes what we sign
+	go func() {
+		hello := make([]byte, helloSize)
+		if _, err := io.ReadFull(mirror, hello); err != nil {
+			return
+		}
+		ephemeral, _ := ecdh.X25519().GenerateKey(rand.Reader)
+		reflected := append(bytes.Clone(hello[:1+ed25519.PublicKeySize]), ephemeral.PublicKey().Bytes()...)
+		if _, err := mirror.Write(reflected); err != nil {
+			return
+		}
+		sig := make([]byte, ed25519.SignatureSize)
+		if _, err := io.ReadFull(mirror, sig); err != nil {
+			return
+		}
+		mirror.Write(sig)
+	}()
+
+	_, _, err := NewSecureHandshake(priv, nil).handshake(conn)
+	assert.ErrorIs(t, err, ErrReflectedKey)
+}
+
+func TestSecureHandshakeSpoofedID(t *testing.T) {
+	serverPub, serverPriv := newIdentity(t)
+	_, clientPriv := newIdentity(t)
+
+	peerch := make(chan Peer, 2)
+	server := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:0",
+		NodeID:        NodeID(serverPub),
+		HandshakeFunc: NewSecureHandshake(serverPriv, nil).Handshake,
+		Decoder:       DefaultDecoder{},
+		OnPeer: func(p Peer) error {
+			peerch <- p
+			return nil
+		},
+	})
+	assert.Nil(t, server.ListenAndAccept())
+	defer server.Close()
+
+	// The client authenticates with its own key but claims the server's ID
+	client := NewTCPTransport(TCPTransportOpts{
+		NodeID:        NodeID(serverPub),
+		HandshakeFunc: NewSecureHandshake(clientPriv, nil).Handshake,
+		Decoder:       DefaultDecoder{},
+	})
+	assert.Nil(t, client.Dial(server.listener.Addr().String()))
+
+	select {
+	case <-peerch:
+		t.Fatal("peer with a spoofed ID was accepted")
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestSecureHandshakeVerifyPeerID(t *testing.T) {
+	serverPub, serverPriv := newIdentity(t)
+	clientPub, clientPriv := newIdentity(t)
+
+	peerch := make(chan Peer, 2)
+	server := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:0",
+		NodeID:        NodeID(serverPub),
+		HandshakeFunc: NewSecureHandshake(serverPriv, nil).Handshake,
+		Decoder:       DefaultDecoder{},
+		OnPeer: func(p Peer) error {
+			peerch <- p
+			return nil
+		},
+		// Only the client's key may go by the legacy ID
+		VerifyPeerID: func(id string, key ed25519.PublicKey) error {
+			if id != "legacy" || !key.Equal(clientPub) {
+				return ErrPeerID
+			}
+			return nil
+		},
+	})
+	assert.Nil(t, server.ListenAndAccept())
+	defer server.Close()
+
+	client := NewTCPTransport(TCPTransportOpts{
+		NodeID:        "legacy",
+		HandshakeFunc: NewSecureHandshake(clientPriv, nil).Handshake,
+		Decoder:       DefaultDecoder{},
+	})
+	assert.Nil(t, client.Dial(server.listener.Addr().String()))
+
+	select {
+	case p := <-peerch:
+		defer p.Close()
+		assert.Equal(t, "legacy", p.ID())
+	case <-time.After(2 * time.Second):
+		t.Fatal("peer with an accepted ID was refused")
+	}
+}
@@ -2,12 +2,33 @@ package p2p
 
 const (
 	IncommingMessageT byte = 0x1
-	IncomingStreamT   byte = 0x2
+
+	// Multiplexed stream frames. Their payload starts with the 4-byte stream ID.
+	StreamOpenT   byte = 0x3
+	StreamDataT   byte = 0x4
+	StreamWindowT byte = 0x5 // payload: stream ID + 4-byte window increment
+	StreamCloseT  byte = 0x6
+	StreamResetT  byte = 0x7
+
+	// PeerInfoT is exchanged once, right after the handshake.
+	PeerInfoT byte = 0x8
+
+	// Heartbeats, answered and consumed by the transport itself.
+	PingT byte = 0x9
+	PongT byte = 0xa
 )
 
+// isStreamFrame reports whether frames of type t belong to a multiplexed stream.
+func isStreamFrame(t byte) bool {
+	return t >= StreamOpenT && t <= StreamResetT
+}
+
 // RPC holds any arbitrary data that can be sent over each transport between two nodes in the network.
 type RPC struct {
 	From    string
 	Payload []byte
-	Stream  bool
+	// Stream is set when the RPC carries a multiplexed stream frame (see FrameType),
+	// which the transport routes to the peer's stream session instead of Consume().
+	Stream    bool
+	FrameType byte
 }
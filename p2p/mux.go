@@ -0,0 +1,368 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// DefaultStreamWindow is the number of unacknowledged bytes a sender may have in flight on one stream.
+	DefaultStreamWindow uint32 = 256 * 1024
+
+	// maxStreamChunk caps the data carried by a single StreamDataT frame,
+	// so one busy stream can't starve the others sharing the connection.
+	maxStreamChunk = 32 * 1024
+
+	// acceptBacklog is the number of remotely opened streams waiting for AcceptStream.
+	acceptBacklog = 64
+
+	streamIDSize = 4
+)
+
+var (
+	ErrStreamClosed  = errors.New("stream closed")
+	ErrStreamReset   = errors.New("stream reset by peer")
+	ErrSessionClosed = errors.New("session closed")
+	// ErrWindowExceeded is set on a stream whose peer sent more than the receive window allows.
+	ErrWindowExceeded = errors.New("stream receive window exceeded")
+)
+
+// session multiplexes logical streams over a single framed connection.
+type session struct {
+	// writeFrame sends a single frame to the remote side.
+	writeFrame func(frameType byte, payload []byte) error
+
+	lock    sync.Mutex
+	streams map[uint32]*stream
+	nextID  uint32
+
+	acceptch  chan *stream
+	closech   chan struct{}
+	closeOnce sync.Once
+}
+
+func newSession(outbound bool, writeFrame func(byte, []byte) error) *session {
+	// Dialers use odd stream IDs and listeners even ones,
+	// so concurrent opens from both sides never collide.
+	nextID := uint32(2)
+	if outbound {
+		nextID = 1
+	}
+
+	return &session{
+		writeFrame: writeFrame,
+		streams:    make(map[uint32]*stream),
+		nextID:     nextID,
+		acceptch:   make(chan *stream, acceptBacklog),
+		closech:    make(chan struct{}),
+	}
+}
+
+// open creates a new outbound stream and announces it to the remote side.
+func (s *session) open() (*stream, error) {
+	s.lock.Lock()
+	select {
+	case <-s.closech:
+		s.lock.Unlock()
+		return nil, ErrSessionClosed
+	default:
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(id, s)
+	s.streams[id] = st
+	s.lock.Unlock()
+
+	if err := s.writeFrame(StreamOpenT, encodeStreamID(id, nil)); err != nil {
+		s.remove(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// accept blocks until the remote side opens a stream or the session is closed.
+func (s *session) accept() (*stream, error) {
+	select {
+	case st := <-s.acceptch:
+		return st, nil
+	case <-s.closech:
+		return nil, ErrSessionClosed
+	}
+}
+
+// handleFrame routes an incoming stream frame to its stream.
+func (s *session) handleFrame(frameType byte, payload []byte) error {
+	if len(payload) < streamIDSize {
+		return fmt.Errorf("short stream frame (%d bytes)", len(payload))
+	}
+	id := binary.BigEndian.Uint32(payload)
+	data := payload[streamIDSize:]
+
+	if frameType == StreamOpenT {
+		return s.handleOpen(id)
+	}
+
+	s.lock.Lock()
+	st, ok := s.streams[id]
+	s.lock.Unlock()
+	if !ok {
+		// The stream is already gone on our side, make the sender stop.
+		if frameType == StreamDataT {
+			return s.writeFrame(StreamResetT, encodeStreamID(id, nil))
+		}
+		return nil
+	}
+
+	switch frameType {
+	case StreamDataT:
+		if !st.pushData(data) {
+			// The sender ignores flow control, don't buffer for it
+			st.fail(ErrWindowExceeded)
+			return s.writeFrame(StreamResetT, encodeStreamID(id, nil))
+		}
+	case StreamWindowT:
+		if len(data) < 4 {
+			return fmt.Errorf("short window update for stream %d", id)
+		}
+		st.addSendWindow(binary.BigEndian.Uint32(data))
+	case StreamCloseT:
+		st.remoteClose()
+	case StreamResetT:
+		st.fail(ErrStreamReset)
+	default:
+		return fmt.Errorf("unknown stream frame type: %#x", frameType)
+	}
+	return nil
+}
+
+func (s *session) handleOpen(id uint32) error {
+	st := newStream(id, s)
+
+	s.lock.Lock()
+	if _, ok := s.streams[id]; ok {
+		s.lock.Unlock()
+		return fmt.Errorf("duplicate stream id: %d", id)
+	}
+	s.streams[id] = st
+	s.lock.Unlock()
+
+	select {
+	case s.acceptch <- st:
+		return nil
+	default:
+		// Nobody is keeping up with AcceptStream, refuse the stream.
+		s.remove(id)
+		return s.writeFrame(StreamResetT, encodeStreamID(id, nil))
+	}
+}
+
+func (s *session) remove(id uint32) {
+	s.lock.Lock()
+	delete(s.streams, id)
+	s.lock.Unlock()
+}
+
+// close tears down the session, failing every stream that is still open.
+func (s *session) close() {
+	s.closeOnce.Do(func() {
+		s.lock.Lock()
+		close(s.closech)
+		streams := s.streams
+		s.streams = make(map[uint32]*stream)
+		s.lock.Unlock()
+
+		for _, st := range streams {
+			st.fail(ErrSessionClosed)
+		}
+	})
+}
+
+func encodeStreamID(id uint32, data []byte) []byte {
+	buf := make([]byte, streamIDSize+len(data))
+	binary.BigEndian.PutUint32(buf, id)
+	copy(buf[streamIDSize:], data)
+	return buf
+}
+
+// stream is a single logical stream of a session and implements Stream.
+type stream struct {
+	id   uint32
+	sess *session
+
+	lock sync.Mutex
+	cond *sync.Cond
+
+	recvBuf bytes.Buffer
+	// recvConsumed is the number of bytes read since the last window update.
+	recvConsumed uint32
+	sendWindow   uint32
+
+	localClosed  bool
+	remoteClosed bool
+	// err is set once the stream is reset or its session goes away.
+	err error
+}
+
+func newStream(id uint32, sess *session) *stream {
+	st := &stream{
+		id:         id,
+		sess:       sess,
+		sendWindow: DefaultStreamWindow,
+	}
+	st.cond = sync.NewCond(&st.lock)
+	return st
+}
+
+// ID implements the Stream interface.
+func (st *stream) ID() uint32 {
+	return st.id
+}
+
+// Read implements io.Reader. Data the remote side sent before closing
+// stays readable, after that Read returns io.EOF.
+func (st *stream) Read(b []byte) (int, error) {
+	st.lock.Lock()
+	for st.recvBuf.Len() == 0 && !st.localClosed && !st.remoteClosed && st.err == nil {
+		st.cond.Wait()
+	}
+
+	switch {
+	case st.localClosed:
+		st.lock.Unlock()
+		return 0, ErrStreamClosed
+	case st.recvBuf.Len() == 0 && st.err != nil:
+		err := st.err
+		st.lock.Unlock()
+		return 0, err
+	case st.recvBuf.Len() == 0:
+		st.lock.Unlock()
+		return 0, io.EOF
+	}
+
+	n, _ := st.recvBuf.Read(b)
+	st.recvConsumed += uint32(n)
+
+	var delta uint32
+	if st.recvConsumed >= DefaultStreamWindow/2 {
+		delta = st.recvConsumed
+		st.recvConsumed = 0
+	}
+	st.lock.Unlock()
+
+	if delta > 0 {
+		// Let the sender know it can push more data.
+		window := make([]byte, 4)
+		binary.BigEndian.PutUint32(window, delta)
+		if err := st.sess.writeFrame(StreamWindowT, encodeStreamID(st.id, window)); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Write implements io.Writer, blocking while the remote receive window is exhausted.
+func (st *stream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		st.lock.Lock()
+		for st.sendWindow == 0 && !st.localClosed && !st.remoteClosed && st.err == nil {
+			st.cond.Wait()
+		}
+
+		switch {
+		case st.err != nil:
+			err := st.err
+			st.lock.Unlock()
+			return written, err
+		case st.localClosed || st.remoteClosed:
+			st.lock.Unlock()
+			return written, ErrStreamClosed
+		}
+
+		n := min(len(b)-written, int(st.sendWindow), maxStreamChunk)
+		st.sendWindow -= uint32(n)
+		st.lock.Unlock()
+
+		if err := st.sess.writeFrame(StreamDataT, encodeStreamID(st.id, b[written:written+n])); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Close implements io.Closer. It ends the stream in both directions:
+// unread data is discarded and the remote side sees io.EOF once it has drained its buffer.
+func (st *stream) Close() error {
+	st.lock.Lock()
+	if st.localClosed {
+		st.lock.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	st.recvBuf.Reset()
+	done := st.remoteClosed || st.err != nil
+	failed := st.err != nil
+	st.cond.Broadcast()
+	st.lock.Unlock()
+
+	if done {
+		st.sess.remove(st.id)
+	}
+	if failed {
+		return nil
+	}
+	return st.sess.writeFrame(StreamCloseT, encodeStreamID(st.id, nil))
+}
+
+// pushData buffers data received on the stream. It reports false when the data
+// doesn't fit in the receive window: the bytes not yet acknowledged to the sender,
+// buffered or read, never exceed DefaultStreamWindow.
+func (st *stream) pushData(data []byte) bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.localClosed || st.err != nil {
+		return true
+	}
+	if uint64(st.recvBuf.Len())+uint64(st.recvConsumed)+uint64(len(data)) > uint64(DefaultStreamWindow) {
+		return false
+	}
+	st.recvBuf.Write(data)
+	st.cond.Broadcast()
+	return true
+}
+
+func (st *stream) addSendWindow(delta uint32) {
+	st.lock.Lock()
+	st.sendWindow += delta
+	st.cond.Broadcast()
+	st.lock.Unlock()
+}
+
+func (st *stream) remoteClose() {
+	st.lock.Lock()
+	st.remoteClosed = true
+	done := st.localClosed
+	st.cond.Broadcast()
+	st.lock.Unlock()
+
+	if done {
+		st.sess.remove(st.id)
+	}
+}
+
+func (st *stream) fail(err error) {
+	st.lock.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.recvBuf.Reset()
+	st.cond.Broadcast()
+	st.lock.Unlock()
+
+	st.sess.remove(st.id)
+}
@@ -0,0 +1,137 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// connectedPeers returns both ends of a real TCP connection between two transports.
+func connectedPeers(t *testing.T) (Peer, Peer) {
+	peerch := make(chan Peer, 2)
+	onPeer := func(p Peer) error {
+		peerch <- p
+		return nil
+	}
+
+	server := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:0",
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+		OnPeer:        onPeer,
+	})
+	assert.Nil(t, server.ListenAndAccept())
+	t.Cleanup(func() { server.Close() })
+
+	client := NewTCPTransport(TCPTransportOpts{
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+		OnPeer:        onPeer,
+	})
+	assert.Nil(t, client.Dial(server.listener.Addr().String()))
+
+	a, b := <-peerch, <-peerch
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+func TestStreamsConcurrent(t *testing.T) {
+	a, b := connectedPeers(t)
+
+	// Echo every stream b accepts back to the opener.
+	go func() {
+		for {
+			st, err := b.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer st.Close()
+				io.Copy(st, st)
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// Larger than the stream window to exercise flow control.
+			data := make([]byte, 3*int(DefaultStreamWindow)+17)
+			rand.Read(data)
+
+			st, err := a.OpenStream()
+			if !assert.Nil(t, err) {
+				return
+			}
+			defer st.Close()
+
+			go st.Write(data)
+
+			got := make([]byte, len(data))
+			_, err = io.ReadFull(st, got)
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(data, got))
+		}()
+	}
+
+	// Control messages keep flowing while the streams are busy.
+	assert.Nil(t, a.Send([]byte("ping")))
+	wg.Wait()
+}
+
+func TestStreamCloseEOF(t *testing.T) {
+	a, b := connectedPeers(t)
+
+	st, err := a.OpenStream()
+	assert.Nil(t, err)
+	_, err = st.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Nil(t, st.Close())
+
+	remote, err := b.AcceptStream()
+	assert.Nil(t, err)
+	data, err := io.ReadAll(remote)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	_, err = remote.Write([]byte("too late"))
+	assert.ErrorIs(t, err, ErrStreamClosed)
+}
+
+func TestStreamWindowExceeded(t *testing.T) {
+	var resets int
+	sess := newSession(false, func(frameType byte, payload []byte) error {
+		if frameType == StreamResetT {
+			resets++
+		}
+		return nil
+	})
+	assert.Nil(t, sess.handleFrame(StreamOpenT, encodeStreamID(1, nil)))
+	st, err := sess.accept()
+	assert.Nil(t, err)
+
+	// A whole window is fine, a byte more resets the stream
+	chunk := make([]byte, maxStreamChunk)
+	for sent := uint32(0); sent < DefaultStreamWindow; sent += maxStreamChunk {
+		assert.Nil(t, sess.handleFrame(StreamDataT, encodeStreamID(1, chunk)))
+	}
+	assert.Equal(t, 0, resets)
+	assert.Nil(t, sess.handleFrame(StreamDataT, encodeStreamID(1, []byte{0})))
+	assert.Equal(t, 1, resets)
+
+	_, err = st.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, ErrWindowExceeded)
+	sess.lock.Lock()
+	assert.Empty(t, sess.streams)
+	sess.lock.Unlock()
+}
@@ -0,0 +1,121 @@
+package p2p
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// maxRecordSize is the largest plaintext sealed into a single record.
+const maxRecordSize = 16 * 1024
+
+var ErrRecordTooLarge = errors.New("secure record exceeds max size")
+
+// secureConn wraps a net.Conn into AES-GCM sealed records:
+//
+//	+----------------------+---------------------------+
+//	| length (BE u32)      | ciphertext + tag          |
+//	+----------------------+---------------------------+
+//
+// Each direction has its own key and a counter nonce, so replayed, reordered
+// or dropped records fail to open and the connection is torn down.
+type secureConn struct {
+	net.Conn
+
+	readLock  sync.Mutex
+	recv      cipher.AEAD
+	recvNonce uint64
+	pending   []byte // opened but not yet read plaintext
+
+	writeLock sync.Mutex
+	send      cipher.AEAD
+	sendNonce uint64
+}
+
+func newSecureConn(conn net.Conn, sendKey, recvKey []byte) (*secureConn, error) {
+	send, err := newGCM(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := newGCM(recvKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &secureConn{
+		Conn: conn,
+		send: send,
+		recv: recv,
+	}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func recordNonce(aead cipher.AEAD, counter uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+	return nonce
+}
+
+func (c *secureConn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	written := 0
+	for written < len(b) {
+		n := min(len(b)-written, maxRecordSize)
+
+		record := make([]byte, 4, 4+n+c.send.Overhead())
+		record = c.send.Seal(record, recordNonce(c.send, c.sendNonce), b[written:written+n], nil)
+		binary.BigEndian.PutUint32(record, uint32(len(record)-4))
+		c.sendNonce++
+
+		if _, err := c.Conn.Write(record); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+func (c *secureConn) Read(b []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	if len(c.pending) == 0 {
+		var hdr [4]byte
+		if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+			return 0, err
+		}
+		size := binary.BigEndian.Uint32(hdr[:])
+		if size > uint32(maxRecordSize+c.recv.Overhead()) {
+			return 0, ErrRecordTooLarge
+		}
+
+		record := make([]byte, size)
+		if _, err := io.ReadFull(c.Conn, record); err != nil {
+			return 0, err
+		}
+
+		plain, err := c.recv.Open(record[:0], recordNonce(c.recv, c.recvNonce), record, nil)
+		if err != nil {
+			return 0, err
+		}
+		c.recvNonce++
+		c.pending = plain
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
@@ -1,10 +1,12 @@
 package p2p
 
 import (
+	"crypto/ed25519"
 	"errors"
 	"log"
 	"net"
 	"sync"
+	"time"
 )
 
 // TCPPeer is a remote node over an established TCP connection.
@@ -16,41 +18,110 @@ type TCPPeer struct {
 	// false if we accept and retrieve a conn
 	outbound bool
 
-	wg *sync.WaitGroup
+	// writeLock serializes frames written by concurrent streams and messages.
+	writeLock sync.Mutex
+	session   *session
+
+	// remoteKey is the identity key the remote proved during a SecureHandshake.
+	remoteKey ed25519.PublicKey
+
+	// id and listenAddr are what the remote told us about itself when connecting.
+	id         string
+	listenAddr string
 }
 
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
-	return &TCPPeer{
+	p := &TCPPeer{
 		Conn:     conn,
 		outbound: outbound,
-		wg:       &sync.WaitGroup{},
 	}
+	p.session = newSession(outbound, p.writeFrame)
+	return p
+}
+
+func (p *TCPPeer) writeFrame(frameType byte, payload []byte) error {
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+	return WriteFrame(p.Conn, frameType, payload)
 }
 
-func (p *TCPPeer) CloseStream() {
-	p.wg.Done()
+// ID implements the Peer interface, falling back to the remote address
+// for nodes that didn't tell us their ID.
+func (p *TCPPeer) ID() string {
+	if len(p.id) == 0 {
+		return p.RemoteAddr().String()
+	}
+	return p.id
 }
 
-// Send implements the Peer interface and sends a message to the remote peer.
+// ListenAddr implements the Peer interface.
+func (p *TCPPeer) ListenAddr() string {
+	return p.listenAddr
+}
+
+// PublicKey returns the remote identity key, or nil if the connection wasn't authenticated.
+func (p *TCPPeer) PublicKey() ed25519.PublicKey {
+	return p.remoteKey
+}
+
+// Send implements the Peer interface and sends a message frame to the remote peer.
 func (p *TCPPeer) Send(data []byte) error {
-	_, err := p.Conn.Write(data)
-	return err
+	return p.writeFrame(IncommingMessageT, data)
+}
+
+// OpenStream implements the Peer interface and opens a new multiplexed stream to the remote peer.
+func (p *TCPPeer) OpenStream() (Stream, error) {
+	return p.session.open()
+}
+
+// AcceptStream implements the Peer interface and waits for the remote peer to open a stream.
+func (p *TCPPeer) AcceptStream() (Stream, error) {
+	return p.session.accept()
 }
 
 type TCPTransportOpts struct {
-	ListenAddr    string
+	ListenAddr string
+	// NodeID identifies this node to its peers.
+	NodeID string
+	// AdvertiseAddr is the address peers should dial to reach us. Defaults to ListenAddr,
+	// an empty or unspecified host is replaced by peers with the host we connected from.
+	AdvertiseAddr string
 	HandshakeFunc HandshakeFunc
 	Decoder       Decoder
 	OnPeer        func(Peer) error
+	// OnPeerDisconnect is called once the connection of a peer accepted by OnPeer is gone.
+	OnPeerDisconnect func(Peer)
+	// VerifyPeerID decides whether a peer authenticated with key may go by an ID other
+	// than the one of its key, see NodeID. Such peers are rejected when nil.
+	VerifyPeerID func(id string, key ed25519.PublicKey) error
+
+	// HeartbeatInterval is how often a ping is sent to each peer. Defaults to DefaultHeartbeatInterval.
+	HeartbeatInterval time.Duration
+	// HeartbeatTimeout is how long a peer may stay silent before it's dropped. Defaults to DefaultHeartbeatTimeout.
+	HeartbeatTimeout time.Duration
 }
 
+const (
+	DefaultHeartbeatInterval = 5 * time.Second
+	DefaultHeartbeatTimeout  = 15 * time.Second
+)
+
 type TCPTransport struct {
 	TCPTransportOpts
+	// lock guards listener and closed, Close may run before ListenAndAccept or twice.
+	lock     sync.Mutex
 	listener net.Listener
+	closed   bool
 	rpcch    chan RPC
 }
 
 func NewTCPTransport(opts TCPTransportOpts) *TCPTransport { //Transport{
+	if opts.HeartbeatInterval <= 0 {
+		opts.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if opts.HeartbeatTimeout <= 0 {
+		opts.HeartbeatTimeout = DefaultHeartbeatTimeout
+	}
 	return &TCPTransport{
 		TCPTransportOpts: opts,
 		rpcch:            make(chan RPC, 1024),
@@ -67,7 +138,29 @@ func (t *TCPTransport) Consume() <-chan RPC {
 	return t.rpcch
 }
 
+func (t *TCPTransport) peerInfo() PeerInfo {
+	addr := t.AdvertiseAddr
+	if len(addr) == 0 {
+		addr = t.ListenAddr
+	}
+	return PeerInfo{
+		ID:         t.NodeID,
+		ListenAddr: addr,
+	}
+}
+
+// Close implements the Transport interface and stops accepting connections. Once
+// closed, the transport doesn't start listening anymore.
 func (t *TCPTransport) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	if t.listener == nil {
+		return nil
+	}
 	return t.listener.Close()
 }
 
@@ -82,6 +175,12 @@ func (t *TCPTransport) Dial(addr string) error {
 }
 
 func (t *TCPTransport) ListenAndAccept() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return net.ErrClosed
+	}
+
 	var err error
 
 	t.listener, err = net.Listen("tcp", t.ListenAddr)
@@ -119,10 +218,17 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 		conn.Close()
 	}()
 	peer := NewTCPPeer(conn, outbound)
+	defer peer.session.close()
 
 	if err = t.HandshakeFunc(peer); err != nil {
 		return
 	}
+	// The handshake may have wrapped the connection, only use the peer's from here on.
+	conn = peer.Conn
+
+	if err = exchangePeerInfo(peer, t.peerInfo(), t.VerifyPeerID); err != nil {
+		return
+	}
 	// log.Printf("Accepted connection from %+v\n", peer)
 
 	if t.OnPeer != nil {
@@ -130,25 +236,42 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 			return
 		}
 	}
+	if t.OnPeerDisconnect != nil {
+		defer t.OnPeerDisconnect(peer)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go t.heartbeat(peer, done)
+
 	// lenDecodeError := 0
 	//Read Loop
 	for {
 		rpc := RPC{}
 
-		err := t.Decoder.Decode(conn, &rpc)
+		// The remote pings us every HeartbeatInterval, silence means it's gone.
+		conn.SetReadDeadline(time.Now().Add(t.HeartbeatTimeout))
+		err = t.Decoder.Decode(conn, &rpc)
 		if err != nil {
 			// lenDecodeError++
 			// log.Printf("TCP decode error: %s\n", err)
 			return
 		}
 
-		rpc.From = conn.RemoteAddr().String()
+		rpc.From = peer.ID()
+
+		switch rpc.FrameType {
+		case PingT:
+			go peer.writeFrame(PongT, nil)
+			continue
+		case PongT:
+			continue
+		}
 
 		if rpc.Stream {
-			peer.wg.Add(1)
-			log.Printf("[%s] incoming stream...\n", rpc.From)
-			peer.wg.Wait()
-			log.Printf("[%s] stream done\n", rpc.From)
+			if err = peer.session.handleFrame(rpc.FrameType, rpc.Payload); err != nil {
+				return
+			}
 			continue
 		}
 		t.rpcch <- rpc
@@ -156,3 +279,20 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 	}
 
 }
+
+// heartbeat pings the peer until done is closed or the connection fails.
+func (t *TCPTransport) heartbeat(peer *TCPPeer, done <-chan struct{}) {
+	ticker := time.NewTicker(t.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := peer.writeFrame(PingT, nil); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package p2p
 
 import (
+	"net"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -18,3 +20,67 @@ func TestTCPTransport(t *testing.T) {
 	// Server
 	assert.Nil(t, tr.ListenAndAccept())
 }
+
+func TestTCPTransportClose(t *testing.T) {
+	tr := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:0",
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+	})
+	// Closed before listening, and twice
+	assert.Nil(t, tr.Close())
+	assert.Nil(t, tr.Close())
+	assert.ErrorIs(t, tr.ListenAndAccept(), net.ErrClosed)
+
+	tr = NewTCPTransport(TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:0",
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+	})
+	assert.Nil(t, tr.ListenAndAccept())
+	assert.Nil(t, tr.Close())
+	assert.Nil(t, tr.Close())
+}
+
+func TestOnPeerDisconnect(t *testing.T) {
+	connected := make(chan Peer, 1)
+	disconnected := make(chan Peer, 1)
+	clientPeer := make(chan Peer, 1)
+
+	server := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:        "127.0.0.1:0",
+		HandshakeFunc:     NOPHandshakeFunc,
+		Decoder:           DefaultDecoder{},
+		OnPeer:            func(p Peer) error { connected <- p; return nil },
+		OnPeerDisconnect:  func(p Peer) { disconnected <- p },
+		HeartbeatInterval: 20 * time.Millisecond,
+		HeartbeatTimeout:  100 * time.Millisecond,
+	})
+	assert.Nil(t, server.ListenAndAccept())
+	defer server.Close()
+
+	client := NewTCPTransport(TCPTransportOpts{
+		HandshakeFunc:     NOPHandshakeFunc,
+		Decoder:           DefaultDecoder{},
+		OnPeer:            func(p Peer) error { clientPeer <- p; return nil },
+		HeartbeatInterval: 20 * time.Millisecond,
+		HeartbeatTimeout:  100 * time.Millisecond,
+	})
+	assert.Nil(t, client.Dial(server.listener.Addr().String()))
+	p := <-connected
+
+	// Heartbeats keep an idle connection alive well past the timeout.
+	select {
+	case <-disconnected:
+		t.Fatal("idle peer was dropped")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	(<-clientPeer).Close()
+	select {
+	case gone := <-disconnected:
+		assert.Equal(t, p, gone)
+	case <-time.After(time.Second):
+		t.Fatal("disconnect was not detected")
+	}
+}
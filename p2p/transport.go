@@ -1,12 +1,28 @@
 package p2p
 
-import "net"
+import (
+	"io"
+	"net"
+)
 
 // Peer is an interface representing a remote node in the network.
 type Peer interface {
 	net.Conn
 	Send([]byte) error
-	CloseStream()
+	// ID returns the remote node ID, exchanged when the connection is established.
+	ID() string
+	// ListenAddr returns the address the remote node accepts connections on, if it does.
+	ListenAddr() string
+	// OpenStream opens a new logical stream to the remote node.
+	OpenStream() (Stream, error)
+	// AcceptStream blocks until the remote node opens a stream.
+	AcceptStream() (Stream, error)
+}
+
+// Stream is a logical bidirectional byte stream multiplexed with others over a single Peer connection.
+type Stream interface {
+	io.ReadWriteCloser
+	ID() uint32
 }
 
 // Transport is anything that defines communication between peers.
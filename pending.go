@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/20af02/MosaicFS/crypto"
+	"github.com/20af02/MosaicFS/p2p"
+)
+
+// peerResponse is a reply from a peer to one of our requests.
+type peerResponse struct {
+	From string
+	Msg  *Message
+	// Stream is set when the response carries data, the receiver owns (and closes) it.
+	Stream p2p.Stream
+}
+
+// pendingRequest is a request waiting for the answers of the peers it was sent to.
+type pendingRequest struct {
+	ch chan peerResponse
+	// peers holds the IDs of the peers which haven't answered yet.
+	peers map[string]bool
+}
+
+// pendingRequests correlates responses from peers with the request waiting for them.
+type pendingRequests struct {
+	lock sync.Mutex
+	reqs map[string]*pendingRequest
+}
+
+func newPendingRequests() *pendingRequests {
+	return &pendingRequests{
+		reqs: make(map[string]*pendingRequest),
+	}
+}
+
+// register creates a new request ID expecting one response from each of the peers.
+func (p *pendingRequests) register(peers []string) (string, <-chan peerResponse) {
+	id := crypto.GenerateID()
+	req := &pendingRequest{
+		ch:    make(chan peerResponse, len(peers)),
+		peers: make(map[string]bool, len(peers)),
+	}
+	for _, peer := range peers {
+		req.peers[peer] = true
+	}
+
+	p.lock.Lock()
+	p.reqs[id] = req
+	p.lock.Unlock()
+
+	return id, req.ch
+}
+
+// remove forgets the request, later responses to it are dropped.
+func (p *pendingRequests) remove(id string) {
+	p.lock.Lock()
+	delete(p.reqs, id)
+	p.lock.Unlock()
+}
+
+// finish forgets the request ch belongs to, and closes the streams of the responses
+// buffered in ch nobody is going to read.
+func (p *pendingRequests) finish(id string, ch <-chan peerResponse) {
+	p.remove(id)
+	for {
+		select {
+		case resp := <-ch:
+			if resp.Stream != nil {
+				resp.Stream.Close()
+			}
+		default:
+			return
+		}
+	}
+}
+
+// resolve hands a response to the waiting request without blocking.
+// It returns false if nobody is waiting for it anymore, or if resp.From
+// wasn't asked or already answered.
+func (p *pendingRequests) resolve(id string, resp peerResponse) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	req, ok := p.reqs[id]
+	if !ok || !req.peers[resp.From] {
+		return false
+	}
+
+	select {
+	case req.ch <- resp:
+		delete(req.peers, resp.From)
+		return true
+	default:
+		return false
+	}
+}
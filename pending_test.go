@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// closeStream is a stream counting how many times it's closed.
+type closeStream struct {
+	*bytes.Buffer
+	closed *int
+}
+
+func (st closeStream) ID() uint32 { return 0 }
+
+func (st closeStream) Close() error {
+	*st.closed++
+	return nil
+}
+
+func TestPendingFinish(t *testing.T) {
+	p := newPendingRequests()
+	id, ch := p.register([]string{"a", "b", "c"})
+
+	var closed int
+	for _, from := range []string{"a", "b"} {
+		if !p.resolve(id, peerResponse{From: from, Stream: closeStream{Buffer: new(bytes.Buffer), closed: &closed}}) {
+			t.Fatalf("Expected the response to be delivered")
+		}
+	}
+	p.resolve(id, peerResponse{From: "c", Msg: &Message{}})
+
+	// The first answer is read, the others are left over
+	resp := <-ch
+	resp.Stream.Close()
+	p.finish(id, ch)
+	if closed != 2 {
+		t.Errorf("Expected both streams to be closed, got %d", closed)
+	}
+	if p.resolve(id, peerResponse{From: "a"}) {
+		t.Errorf("Expected the request to be forgotten")
+	}
+}
+
+func TestPendingResolveOnlyAskedPeers(t *testing.T) {
+	p := newPendingRequests()
+	id, ch := p.register([]string{"a", "b"})
+
+	if p.resolve(id, peerResponse{From: "mallory"}) {
+		t.Errorf("Expected a response from a peer we didn't ask to be dropped")
+	}
+	if !p.resolve(id, peerResponse{From: "a"}) {
+		t.Fatalf("Expected the response to be delivered")
+	}
+	if p.resolve(id, peerResponse{From: "a"}) {
+		t.Errorf("Expected a second response from the same peer to be dropped")
+	}
+	if resp := <-ch; resp.From != "a" {
+		t.Errorf("Expected the response of (a), got (%s)", resp.From)
+	}
+	p.finish(id, ch)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+
+	"github.com/20af02/MosaicFS/crypto"
+	"github.com/20af02/MosaicFS/hashring"
+)
+
+// Candidate is a peer that may receive a replica.
+type Candidate struct {
+	ID string
+	// Used is the storage the peer last reported using, in bytes.
+	Used int64
+	// Capacity is the storage the peer offers, in bytes. 0 means no limit.
+	Capacity int64
+}
+
+// fits reports whether size more bytes fit in the capacity of the peer.
+func (c Candidate) fits(size int64) bool {
+	return c.Capacity <= 0 || c.Used+size <= c.Capacity
+}
+
+// PlacementPolicy picks which of the candidates receive the n replicas of a file.
+type PlacementPolicy interface {
+	Place(key string, candidates []Candidate, n int) []Candidate
+}
+
+// NewPlacementPolicy returns the policy with the given name: "random" (the default), "hash" or "least-used".
+func NewPlacementPolicy(name string) (PlacementPolicy, error) {
+	switch name {
+	case "", "random":
+		return RandomPlacement{}, nil
+	case "hash":
+		return HashPlacement{}, nil
+	case "least-used":
+		return LeastUsedPlacement{}, nil
+	}
+	return nil, fmt.Errorf("unknown placement policy (%s)", name)
+}
+
+// RandomPlacement spreads replicas uniformly over the peers.
+type RandomPlacement struct{}
+
+func (RandomPlacement) Place(key string, candidates []Candidate, n int) []Candidate {
+	shuffled := slices.Clone(candidates)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return shuffled[:min(n, len(shuffled))]
+}
+
+// HashPlacement places replicas on the peers following the key on a consistent hash ring,
+// so a key keeps landing on the same peers as other nodes come and go.
+type HashPlacement struct {
+	// Ring holds the nodes of the cluster with their weights. When nil, a ring
+	// of equally weighted candidates is used.
+	Ring *hashring.Ring
+}
+
+func (p HashPlacement) Place(key string, candidates []Candidate, n int) []Candidate {
+	ring := p.Ring
+	if ring == nil {
+		ring = hashring.New(0)
+		for _, c := range candidates {
+			ring.Add(c.ID, 1)
+		}
+	}
+
+	byID := make(map[string]Candidate, len(candidates))
+	for _, c := range candidates {
+		byID[c.ID] = c
+	}
+
+	// Walk the ring from the key, skipping the nodes that aren't candidates (e.g. ourselves)
+	placed := make([]Candidate, 0, min(n, len(candidates)))
+	for _, id := range ring.Get(crypto.HashKey(key), len(ring.Nodes())) {
+		if len(placed) == n {
+			break
+		}
+		if c, ok := byID[id]; ok {
+			placed = append(placed, c)
+		}
+	}
+	return placed
+}
+
+// LeastUsedPlacement places replicas on the peers using the least storage.
+type LeastUsedPlacement struct{}
+
+func (LeastUsedPlacement) Place(key string, candidates []Candidate, n int) []Candidate {
+	sorted := slices.Clone(candidates)
+	slices.SortStableFunc(sorted, func(a, b Candidate) int {
+		switch {
+		case a.Used < b.Used:
+			return -1
+		case a.Used > b.Used:
+			return 1
+		}
+		return 0
+	})
+	return sorted[:min(n, len(sorted))]
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/20af02/MosaicFS/crypto"
+	"github.com/20af02/MosaicFS/hashring"
+)
+
+func testCandidates(n int) []Candidate {
+	candidates := make([]Candidate, n)
+	for i := range candidates {
+		candidates[i] = Candidate{ID: fmt.Sprintf("node-%d", i), Used: int64((n - i) * 100)}
+	}
+	return candidates
+}
+
+func TestPlacementPolicies(t *testing.T) {
+	candidates := testCandidates(10)
+
+	for _, name := range []string{"random", "hash", "least-used"} {
+		policy, err := NewPlacementPolicy(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		placed := policy.Place("picture.png", candidates, 3)
+		if len(placed) != 3 {
+			t.Errorf("[%s] Expected 3 replicas, got %d", name, len(placed))
+		}
+		seen := map[string]bool{}
+		for _, c := range placed {
+			if seen[c.ID] {
+				t.Errorf("[%s] Peer %s picked twice", name, c.ID)
+			}
+			seen[c.ID] = true
+		}
+
+		// Never more replicas than peers
+		if placed := policy.Place("picture.png", candidates[:2], 3); len(placed) != 2 {
+			t.Errorf("[%s] Expected 2 replicas, got %d", name, len(placed))
+		}
+	}
+
+	if _, err := NewPlacementPolicy("nope"); err == nil {
+		t.Errorf("Expected an error for an unknown policy")
+	}
+}
+
+func TestHashPlacementStable(t *testing.T) {
+	candidates := testCandidates(10)
+	placed := HashPlacement{}.Place("picture.png", candidates, 3)
+
+	// Losing a peer that doesn't hold a replica doesn't move the others
+	holds := map[string]bool{}
+	for _, c := range placed {
+		holds[c.ID] = true
+	}
+	var (
+		remaining []Candidate
+		dropped   bool
+	)
+	for _, c := range candidates {
+		if !holds[c.ID] && !dropped {
+			dropped = true
+			continue
+		}
+		remaining = append(remaining, c)
+	}
+	again := HashPlacement{}.Place("picture.png", remaining, 3)
+	for i := range placed {
+		if placed[i].ID != again[i].ID {
+			t.Errorf("Expected %s at position %d, got %s", placed[i].ID, i, again[i].ID)
+		}
+	}
+}
+
+func TestLeastUsedPlacement(t *testing.T) {
+	placed := LeastUsedPlacement{}.Place("picture.png", testCandidates(10), 2)
+	if placed[0].ID != "node-9" || placed[1].ID != "node-8" {
+		t.Errorf("Expected the least used peers, got %v", placed)
+	}
+}
+
+func TestHashPlacementRing(t *testing.T) {
+	ring := hashring.New(0)
+	ring.Add("self", 1)
+	candidates := testCandidates(5)
+	for i, c := range candidates {
+		ring.Add(c.ID, i+1)
+	}
+
+	policy := HashPlacement{Ring: ring}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("picture_%d.png", i)
+		placed := policy.Place(key, candidates, 3)
+		if len(placed) != 3 {
+			t.Fatalf("Expected 3 replicas, got %d", len(placed))
+		}
+
+		// Replicas follow the ring order, we (not a candidate) are skipped
+		var expected []string
+		for _, id := range ring.Get(crypto.HashKey(key), 6) {
+			if id != "self" && len(expected) < 3 {
+				expected = append(expected, id)
+			}
+		}
+		for j, c := range placed {
+			if c.ID != expected[j] {
+				t.Errorf("Expected %v, got %v", expected, placed)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/20af02/MosaicFS/crypto"
+	"github.com/20af02/MosaicFS/p2p"
+)
+
+// Consistency is how many copies of a file a write waits for, or a read wants to agree.
+// The zero value stands for the server's default.
+type Consistency int
+
+const (
+	// ConsistencyOne is satisfied by a single copy, or the minimum needed to decode shards.
+	ConsistencyOne Consistency = iota + 1
+	// ConsistencyQuorum is satisfied by a majority of the copies.
+	ConsistencyQuorum
+	// ConsistencyAll is satisfied by every copy.
+	ConsistencyAll
+)
+
+// ErrNoQuorum is returned when fewer copies than the consistency level asks for could be written or agree.
+var ErrNoQuorum = errors.New("consistency level not reached")
+
+// ParseConsistency parses "one", "quorum" or "all", in any case.
+func ParseConsistency(s string) (Consistency, error) {
+	switch strings.ToLower(s) {
+	case "one":
+		return ConsistencyOne, nil
+	case "quorum":
+		return ConsistencyQuorum, nil
+	case "all":
+		return ConsistencyAll, nil
+	}
+	return 0, fmt.Errorf("invalid consistency level %q, want one, quorum or all", s)
+}
+
+func (c Consistency) String() string {
+	switch c {
+	case ConsistencyOne:
+		return "ONE"
+	case ConsistencyQuorum:
+		return "QUORUM"
+	case ConsistencyAll:
+		return "ALL"
+	}
+	return "DEFAULT"
+}
+
+// required returns how many of n copies satisfy c, when at least min of them
+// are needed to read the data back: 1 for replicas, k for k+m shards.
+func (c Consistency) required(n, min int) int {
+	switch c {
+	case ConsistencyOne:
+		return min
+	case ConsistencyAll:
+		return n
+	}
+	// A majority of the copies beyond the minimum, so two quorums always overlap
+	return min + (n-min+1)/2
+}
+
+// MessageStoreFileAck answers a MessageStoreFile on its stream, once the file is
+// on disk or with the reason it isn't.
+type MessageStoreFileAck struct {
+	Key  string
+	Size int64
+	Err  string
+}
+
+// readQuorum makes sure our copy of the manifest of key is one that r replicas, ours
+// included, agree on. A missing or outdated local copy is replaced by it. Copies on
+// our peers are encrypted with encKey.
+func (s *FileServer) readQuorum(ctx context.Context, key string, encKey []byte, legacy bool, r int, locations []string) error {
+	votes := make(map[[sha256.Size]byte]int)
+	var agreed []byte
+	vote := func(data []byte) {
+		sum := sha256.Sum256(data)
+		votes[sum]++
+		if votes[sum] >= r {
+			agreed = data
+		}
+	}
+
+	var local []byte
+	if s.store.Has(s.ID, key) {
+		_, rd, err := s.store.Read(s.ID, key)
+		if err != nil {
+			return err
+		}
+		if local, err = io.ReadAll(rd); err != nil {
+			return err
+		}
+		vote(local)
+	}
+
+	remoteKey := crypto.HashKey(key)
+	peers := s.quorumPeers(ctx, remoteKey, locations)
+	reqID, respch := s.pending.register(peerIDs(peers))
+
+	// Close the streams of the answers we didn't need
+	defer s.pending.finish(reqID, respch)
+
+	msg := Message{
+		RequestID: reqID,
+		Payload: MessageGetFile{
+			ID:  s.ID,
+			Key: remoteKey,
+		},
+	}
+	for _, peer := range peers {
+		if err := s.send(peer, &msg); err != nil {
+			log.Printf("[%s] failed to send to peer (%s): %v", s.Transport.Addr(), peer.ID(), err)
+		}
+	}
+
+	for answered := 0; agreed == nil && answered < len(peers); answered++ {
+		var resp peerResponse
+		select {
+		case resp = <-respch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		data, err := s.receiveBytes(ctx, encKey, legacy, resp)
+		if err != nil {
+			log.Printf("[%s] failed to read (%s) from (%s): %v", s.Transport.Addr(), key, resp.From, err)
+			continue
+		}
+		vote(data)
+	}
+	if agreed == nil {
+		return fmt.Errorf("%w: fewer than %d copies of (%s) agree", ErrNoQuorum, r, key)
+	}
+
+	if local == nil || !bytes.Equal(local, agreed) {
+		if local != nil {
+			log.Printf("[%s] replacing outdated copy of (%s)", s.Transport.Addr(), key)
+		}
+		if _, err := s.store.WriteSync(s.ID, key, bytes.NewReader(agreed)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// receiveBytes decrypts the file carried by a peer's response with encKey into memory.
+func (s *FileServer) receiveBytes(ctx context.Context, encKey []byte, legacy bool, resp peerResponse) ([]byte, error) {
+	v, _ := resp.Msg.Payload.(MessageGetFileResponse)
+	if resp.Stream == nil {
+		if v.NotFound {
+			return nil, ErrFileNotFound
+		}
+		return nil, errors.New(v.Err)
+	}
+	defer resp.Stream.Close()
+
+	stop := context.AfterFunc(ctx, func() { resp.Stream.Close() })
+	defer stop()
+
+	var buf bytes.Buffer
+	n, err := decrypt(encKey, legacy, io.LimitReader(resp.Stream, v.Size), &buf)
+	if err == nil && int64(n) != v.Size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// quorumPeers returns the peers asked for their copy of remoteKey: the providers the DHT
+// lists, the nodes in locations and every other peer we're connected to. Receivers
+// announce their copy in the background, right after a store only some are listed.
+func (s *FileServer) quorumPeers(ctx context.Context, remoteKey string, locations []string) []p2p.Peer {
+	peers := s.providerPeers(ctx, s.ID, remoteKey)
+	seen := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		seen[peer.ID()] = true
+	}
+	for _, id := range locations {
+		if peer, ok := s.peer(id); ok && !seen[id] {
+			seen[id] = true
+			peers = append(peers, peer)
+		}
+	}
+	for _, peer := range s.peerList() {
+		if !seen[peer.ID()] {
+			seen[peer.ID()] = true
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/20af02/MosaicFS/crypto"
+)
+
+func TestConsistencyRequired(t *testing.T) {
+	tests := []struct {
+		level    Consistency
+		n, min   int
+		required int
+	}{
+		{ConsistencyOne, 3, 1, 1},
+		{ConsistencyQuorum, 1, 1, 1},
+		{ConsistencyQuorum, 2, 1, 2},
+		{ConsistencyQuorum, 3, 1, 2},
+		{ConsistencyQuorum, 4, 1, 3},
+		{ConsistencyAll, 3, 1, 3},
+		// 4+2 shards
+		{ConsistencyOne, 6, 4, 4},
+		{ConsistencyQuorum, 6, 4, 5},
+		{ConsistencyAll, 6, 4, 6},
+	}
+	for _, tt := range tests {
+		if got := tt.level.required(tt.n, tt.min); got != tt.required {
+			t.Errorf("%s of %d (min %d): got %d, want %d", tt.level, tt.n, tt.min, got, tt.required)
+		}
+	}
+
+	if _, err := ParseConsistency("most"); err == nil {
+		t.Errorf("Expected an invalid consistency level to fail")
+	}
+	if level, _ := ParseConsistency("QUORUM"); level != ConsistencyQuorum {
+		t.Errorf("Expected QUORUM, got %s", level)
+	}
+}
+
+func TestStoreQuorum(t *testing.T) {
+	s1, _, _ := startRepairServers(t)
+
+	data := []byte("written everywhere")
+	if err := s1.StoreWith("all.txt", bytes.NewReader(data), WriteOptions{Replicas: 3, Consistency: ConsistencyAll}); err != nil {
+		t.Fatalf("Failed to store on every node: %v", err)
+	}
+
+	// Only three nodes for five copies
+	err := s1.StoreWith("five.txt", bytes.NewReader(data), WriteOptions{Replicas: 5, Consistency: ConsistencyAll})
+	if !errors.Is(err, ErrNoQuorum) {
+		t.Errorf("Expected ErrNoQuorum, got %v", err)
+	}
+	if err := s1.StoreWith("five.txt", bytes.NewReader(data), WriteOptions{Replicas: 5, Consistency: ConsistencyQuorum}); err != nil {
+		t.Errorf("Expected three of five copies to be a quorum: %v", err)
+	}
+}
+
+func TestStoreAlone(t *testing.T) {
+	s := MakeTestServer(":3000", []string{})
+	defer func() {
+		s.Stop()
+		teardown(t, s.store)
+	}()
+	go func() { s.Start() }()
+
+	// A node without peers still stores by default
+	data := []byte("kept alone")
+	if err := s.Store("alone.txt", bytes.NewReader(data)); err != nil {
+		t.Fatalf("Failed to store without peers: %v", err)
+	}
+	err := s.StoreWith("all.txt", bytes.NewReader(data), WriteOptions{Replicas: 3, Consistency: ConsistencyAll})
+	if !errors.Is(err, ErrNoQuorum) {
+		t.Fatalf("Expected ErrNoQuorum, got %v", err)
+	}
+	if strings.Contains(err.Error(), "%!") {
+		t.Errorf("Unexpected error message: %v", err)
+	}
+}
+
+func TestGetQuorum(t *testing.T) {
+	s1, s2, _ := startRepairServers(t)
+
+	key := "quorum.txt"
+	data := []byte("agreed upon content")
+	// Every copy acknowledged before reading
+	if err := s1.StoreWith(key, bytes.NewReader(data), WriteOptions{Replicas: 3, Consistency: ConsistencyAll}); err != nil {
+		t.Fatalf("Failed to store: %v", err)
+	}
+
+	// Our copy is outdated, the two others outvote it
+	if _, err := s1.store.Write(s1.ID, key, strings.NewReader("stale")); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s1.GetConsistency(context.Background(), key, ConsistencyQuorum)
+	if err != nil {
+		t.Fatalf("Failed to get with a quorum: %v", err)
+	}
+	b, _ := io.ReadAll(r)
+	if !bytes.Equal(b, data) {
+		t.Errorf("Expected %q, got %q", data, b)
+	}
+
+	// With s2 disagreeing, not every copy matches anymore
+	dataKey, err := s1.fileKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bogus bytes.Buffer
+	if _, err := crypto.CopyEncrypt(dataKey, strings.NewReader("bogus"), &bogus); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s2.store.Write(s1.ID, crypto.HashKey(key), &bogus); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s1.GetConsistency(context.Background(), key, ConsistencyAll); !errors.Is(err, ErrNoQuorum) {
+		t.Errorf("Expected ErrNoQuorum, got %v", err)
+	}
+	if _, err := s1.GetConsistency(context.Background(), key, ConsistencyQuorum); err != nil {
+		t.Errorf("Expected two of three copies to be a quorum: %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter paces transfers to a number of bytes per second.
+// A nil limiter, or one with a rate <= 0, doesn't limit anything.
+type rateLimiter struct {
+	lock sync.Mutex
+	rate int64
+	// next is when the bytes allowed so far will have been sent at rate
+	next time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate}
+}
+
+// wait blocks until n more bytes fit in the budget, or ctx is done.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	if l.rate <= 0 {
+		l.lock.Unlock()
+		return nil
+	}
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(n) * time.Second / time.Duration(l.rate))
+	l.lock.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
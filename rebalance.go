@@ -0,0 +1,448 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/20af02/MosaicFS/crypto"
+	"github.com/20af02/MosaicFS/p2p"
+)
+
+const defaultRebalanceDelay = 30 * time.Second
+
+var errRebalanceRunning = errors.New("a rebalance is already running")
+
+// RebalanceStatus tells what the current or last rebalance pass is doing.
+type RebalanceStatus struct {
+	Running bool
+	Paused  bool
+	// Planned counts the moves of the pass, Done the ones made and Failed the others.
+	Planned int
+	Done    int
+	Failed  int
+	// BytesPlanned is the size of the planned moves, BytesMoved of the ones made.
+	BytesPlanned int64
+	BytesMoved   int64
+	// Moving is the object being moved, if any.
+	Moving  string
+	Started time.Time
+	// ETA is when the pass should end at the rate it moved so far, zero when unknown.
+	ETA time.Time
+}
+
+func (r RebalanceStatus) String() string {
+	state := "idle"
+	switch {
+	case r.Paused:
+		state = "paused"
+	case r.Running:
+		state = "running"
+	}
+	str := fmt.Sprintf("%s, %d of %d moves done (%d failed), %d of %d bytes moved",
+		state, r.Done, r.Planned, r.Failed, r.BytesMoved, r.BytesPlanned)
+	if r.Moving != "" {
+		str += ", moving " + r.Moving
+	}
+	if !r.ETA.IsZero() {
+		str += fmt.Sprintf(", done in %s", time.Until(r.ETA).Round(time.Second))
+	}
+	return str
+}
+
+// rebalancer holds the state of the rebalancer.
+type rebalancer struct {
+	// running is held during a pass, so passes never overlap
+	running sync.Mutex
+	limiter *rateLimiter
+
+	lock   sync.Mutex
+	timer  *time.Timer
+	status RebalanceStatus
+	// bytesFailed is the size of the failed moves of the pass
+	bytesFailed int64
+	// resumed is closed when a paused rebalance may go on, nil unless paused
+	resumed chan struct{}
+}
+
+// rebalanceMove moves our object from a peer to another.
+type rebalanceMove struct {
+	repairObject
+	from, to string
+	size     int64
+}
+
+func (m rebalanceMove) String() string {
+	return fmt.Sprintf("(%s) from (%s) to (%s)", m.remote, m.from, m.to)
+}
+
+// rebalanceGroup is a set of objects meant for distinct peers: the copies of a
+// replicated object, or the shards of a chunk.
+type rebalanceGroup struct {
+	// place is the key the objects were placed by
+	place string
+	keys  []repairObject
+	// n is the number of peers the group is spread over
+	n    int
+	size int64
+}
+
+// RebalanceStatus returns what the current or last rebalance pass did.
+func (s *FileServer) RebalanceStatus() RebalanceStatus {
+	s.rebalance.lock.Lock()
+	defer s.rebalance.lock.Unlock()
+
+	status := s.rebalance.status
+	status.Paused = s.rebalance.resumed != nil
+	left := status.BytesPlanned - status.BytesMoved - s.rebalance.bytesFailed
+	if status.Running && !status.Paused && status.BytesMoved > 0 && left > 0 {
+		elapsed := time.Since(status.Started)
+		status.ETA = time.Now().Add(time.Duration(float64(elapsed) * float64(left) / float64(status.BytesMoved)))
+	}
+	return status
+}
+
+// PauseRebalance stops rebalancing after the move in progress, until ResumeRebalance.
+// Passes starting in the meantime wait too.
+func (s *FileServer) PauseRebalance() {
+	s.rebalance.lock.Lock()
+	defer s.rebalance.lock.Unlock()
+	if s.rebalance.resumed == nil {
+		s.rebalance.resumed = make(chan struct{})
+	}
+}
+
+// ResumeRebalance lets a paused rebalance go on.
+func (s *FileServer) ResumeRebalance() {
+	s.rebalance.lock.Lock()
+	defer s.rebalance.lock.Unlock()
+	if s.rebalance.resumed != nil {
+		close(s.rebalance.resumed)
+		s.rebalance.resumed = nil
+	}
+}
+
+// waitResumed blocks while the rebalance is paused.
+func (s *FileServer) waitResumed(ctx context.Context) error {
+	s.rebalance.lock.Lock()
+	resumed := s.rebalance.resumed
+	s.rebalance.lock.Unlock()
+	if resumed == nil {
+		return nil
+	}
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// scheduleRebalance runs a rebalance pass RebalanceDelay after the last call, so a
+// node joining or leaving triggers a single pass once the cluster settled.
+func (s *FileServer) scheduleRebalance() {
+	if s.RebalanceDelay < 0 {
+		return
+	}
+	s.rebalance.lock.Lock()
+	defer s.rebalance.lock.Unlock()
+	if s.rebalance.timer != nil {
+		s.rebalance.timer.Reset(s.RebalanceDelay)
+		return
+	}
+	s.rebalance.timer = time.AfterFunc(s.RebalanceDelay, s.runRebalance)
+}
+
+// runRebalance runs a rebalance pass until it's done or the server stops.
+func (s *FileServer) runRebalance() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.quitch:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	_, err := s.Rebalance(ctx)
+	switch {
+	case errors.Is(err, errRebalanceRunning):
+		// The running pass may have planned before the last change, go again after it
+		s.scheduleRebalance()
+	case err != nil && ctx.Err() == nil:
+		log.Printf("[%s] rebalance failed: %v", s.Transport.Addr(), err)
+	}
+}
+
+// Rebalance moves the copies of our files held by peers toward where the placement
+// policy would put them now. With HashPlacement, objects move to the peers they hash
+// to; with other policies, from the peers using the most storage to the ones using
+// the least. Peers without room or draining get nothing, and the moves are sent
+// within RebalanceBandwidth. A copy is only dropped once its new holder has it on disk.
+func (s *FileServer) Rebalance(ctx context.Context) (RebalanceStatus, error) {
+	if !s.rebalance.running.TryLock() {
+		return s.RebalanceStatus(), errRebalanceRunning
+	}
+	defer s.rebalance.running.Unlock()
+	if s.Draining() {
+		return s.RebalanceStatus(), errors.New("node is draining")
+	}
+
+	s.rebalance.lock.Lock()
+	s.rebalance.status = RebalanceStatus{Running: true, Started: time.Now()}
+	s.rebalance.bytesFailed = 0
+	s.rebalance.lock.Unlock()
+	defer func() {
+		s.rebalance.lock.Lock()
+		s.rebalance.status.Running = false
+		s.rebalance.status.Moving = ""
+		s.rebalance.lock.Unlock()
+	}()
+
+	files, err := s.store.dbHandler.ListFiles()
+	if err != nil {
+		return s.RebalanceStatus(), err
+	}
+	moves, holders := s.planRebalance(ctx, files)
+
+	s.rebalance.lock.Lock()
+	s.rebalance.status.Planned = len(moves)
+	for _, mv := range moves {
+		s.rebalance.status.BytesPlanned += mv.size
+	}
+	s.rebalance.lock.Unlock()
+	if len(moves) > 0 {
+		log.Printf("[%s] rebalance: moving %d objects", s.Transport.Addr(), len(moves))
+	}
+
+	for _, mv := range moves {
+		if err := s.waitResumed(ctx); err != nil {
+			return s.RebalanceStatus(), err
+		}
+		s.rebalance.lock.Lock()
+		s.rebalance.status.Moving = mv.String()
+		s.rebalance.lock.Unlock()
+
+		err := s.moveObject(ctx, mv)
+
+		s.rebalance.lock.Lock()
+		s.rebalance.status.Moving = ""
+		if err != nil {
+			s.rebalance.status.Failed++
+			s.rebalance.bytesFailed += mv.size
+		} else {
+			s.rebalance.status.Done++
+			s.rebalance.status.BytesMoved += mv.size
+		}
+		s.rebalance.lock.Unlock()
+		if err != nil {
+			if ctx.Err() != nil {
+				return s.RebalanceStatus(), ctx.Err()
+			}
+			log.Printf("[%s] rebalance: failed to move %s: %v", s.Transport.Addr(), mv, err)
+			continue
+		}
+		holders[mv.remote] = slices.DeleteFunc(holders[mv.remote], func(id string) bool { return id == mv.from })
+		holders[mv.remote] = append(holders[mv.remote], mv.to)
+	}
+
+	// Record where the files are now
+	for _, fmd := range files {
+		keys := []string{crypto.HashKey(fmd.Key)}
+		if m, err := s.readManifest(fmd.Key); err == nil {
+			for _, c := range m.Chunks {
+				keys = append(keys, m.objectKeys(c)...)
+			}
+		}
+		placed := make(map[string][]string, len(keys))
+		for _, key := range keys {
+			placed[key] = holders[key]
+		}
+		if err := s.recordLocations(fmd, placed); err != nil {
+			log.Printf("[%s] failed to record where (%s) is: %v", s.Transport.Addr(), fmd.Key, err)
+		}
+	}
+
+	status := s.RebalanceStatus()
+	log.Printf("[%s] rebalance: %s", s.Transport.Addr(), status)
+	return status, nil
+}
+
+// planRebalance returns the moves bringing the objects of files where they belong,
+// and the peers holding each object before them.
+func (s *FileServer) planRebalance(ctx context.Context, files []FileMetadata) ([]rebalanceMove, map[string][]string) {
+	var groups []rebalanceGroup
+	var keys []string
+	for _, fmd := range files {
+		replicas := max(fmd.Replicas, 1)
+		dataKey, err := s.dataKey(&fmd)
+		if err != nil {
+			log.Printf("[%s] rebalance: skipping (%s): %v", s.Transport.Addr(), fmd.Key, err)
+			continue
+		}
+		manifest := repairObject{local: fmd.Key, remote: crypto.HashKey(fmd.Key), encKey: dataKey, legacy: legacyFormat(&fmd)}
+		size, _ := s.store.Size(s.ID, fmd.Key)
+		groups = append(groups, rebalanceGroup{place: manifest.remote, keys: []repairObject{manifest}, n: replicas - 1, size: size})
+		keys = append(keys, manifest.remote)
+
+		m, err := s.readManifest(fmd.Key)
+		if err != nil {
+			continue
+		}
+		for _, c := range m.Chunks {
+			g := rebalanceGroup{place: chunkKey(m.ref(c)), n: replicas - 1, size: c.Size}
+			if m.EC != nil {
+				g.n = m.EC.Total() - 1
+				g.size = (c.Size + int64(m.EC.Data) - 1) / int64(m.EC.Data)
+			}
+			for _, key := range m.objectKeys(c) {
+				if slices.Contains(keys, key) {
+					continue
+				}
+				keys = append(keys, key)
+				g.keys = append(g.keys, repairObject{local: key, remote: key, encKey: c.encKey(s.masterKey())})
+			}
+			if len(g.keys) > 0 {
+				groups = append(groups, g)
+			}
+		}
+	}
+
+	holders := s.holders(ctx, keys)
+	before := make(map[string][]string, len(holders))
+	for key, ids := range holders {
+		before[key] = slices.Clone(ids)
+	}
+
+	s.peerLock.Lock()
+	used := make(map[string]int64, len(s.peers))
+	capacity := make(map[string]int64, len(s.peers))
+	for id := range s.peers {
+		if !s.draining[id] {
+			used[id] = s.usage[id]
+			capacity[id] = s.capacity[id]
+		}
+	}
+	s.peerLock.Unlock()
+
+	var moves []rebalanceMove
+	for _, g := range groups {
+		moves = append(moves, s.planGroup(g, holders, used, capacity)...)
+	}
+	return moves, before
+}
+
+// planGroup returns the moves of the objects of g, updating holders and used as if they were made.
+func (s *FileServer) planGroup(g rebalanceGroup, holders map[string][]string, used, capacity map[string]int64) []rebalanceMove {
+	var held []string
+	for _, o := range g.keys {
+		held = append(held, holders[o.remote]...)
+	}
+
+	// The peers that may hold the group: the ones already holding part of it, and the ones with room for more
+	var candidates []Candidate
+	for id := range used {
+		c := Candidate{ID: id, Used: used[id], Capacity: capacity[id]}
+		if slices.Contains(held, id) || c.fits(g.size) {
+			candidates = append(candidates, c)
+		}
+	}
+	slices.SortFunc(candidates, func(a, b Candidate) int {
+		return cmp.Or(cmp.Compare(a.Used, b.Used), cmp.Compare(a.ID, b.ID))
+	})
+
+	var wanted []string
+	if _, ok := s.Placement.(HashPlacement); ok {
+		for _, c := range s.Placement.Place(g.place, candidates, g.n) {
+			wanted = append(wanted, c.ID)
+		}
+	}
+
+	var moves []rebalanceMove
+	for _, o := range g.keys {
+		for _, from := range slices.Clone(holders[o.remote]) {
+			if wanted != nil && slices.Contains(wanted, from) {
+				continue
+			}
+			to := ""
+			for _, c := range candidates {
+				c.Used = used[c.ID]
+				if slices.Contains(held, c.ID) || !c.fits(g.size) {
+					continue
+				}
+				if wanted != nil && !slices.Contains(wanted, c.ID) {
+					continue
+				}
+				// Without a placement to follow, only move when it narrows the gap between the two peers
+				if wanted == nil && used[from]-c.Used <= 2*g.size {
+					continue
+				}
+				if to == "" || c.Used < used[to] {
+					to = c.ID
+				}
+			}
+			if to == "" {
+				continue
+			}
+
+			moves = append(moves, rebalanceMove{repairObject: o, from: from, to: to, size: g.size})
+			holders[o.remote] = slices.DeleteFunc(holders[o.remote], func(id string) bool { return id == from })
+			holders[o.remote] = append(holders[o.remote], to)
+			held = slices.DeleteFunc(held, func(id string) bool { return id == from })
+			held = append(held, to)
+			if _, ok := used[from]; ok {
+				used[from] -= g.size
+			}
+			used[to] += g.size
+		}
+	}
+	return moves
+}
+
+// moveObject copies our object to mv.to, then tells mv.from to drop its copy. We fetch
+// the object first if we don't hold it, and drop it again once moved.
+func (s *FileServer) moveObject(ctx context.Context, mv rebalanceMove) error {
+	from, ok := s.peer(mv.from)
+	if !ok {
+		return fmt.Errorf("(%s) is gone", mv.from)
+	}
+	to, ok := s.peer(mv.to)
+	if !ok {
+		return fmt.Errorf("(%s) is gone", mv.to)
+	}
+
+	if !s.store.Has(s.ID, mv.local) {
+		if err := s.fetch(ctx, mv.local, mv.remote, mv.encKey, mv.legacy, nil); err != nil {
+			return err
+		}
+		defer s.store.discard(s.ID, mv.local)
+	}
+	_, r, err := s.store.Read(s.ID, mv.local)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	if err := s.rebalance.limiter.wait(ctx, len(data)); err != nil {
+		return err
+	}
+	if _, err := s.sendObject(ctx, []p2p.Peer{to}, mv.remote, mv.encKey, data); err != nil {
+		return err
+	}
+	return s.send(from, &Message{
+		Payload: MessageDeleteFile{
+			ID:  s.ID,
+			Key: mv.remote,
+		},
+	})
+}
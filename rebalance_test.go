@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/20af02/MosaicFS/crypto"
+)
+
+func TestRebalance(t *testing.T) {
+	s1 := MakeTestServer(":3000", []string{})
+	s2 := MakeTestServer(":4000", []string{":3000"})
+	s3 := MakeTestServer(":5000", []string{":3000", ":4000"})
+	s1.ChunkSize = 1024
+	s1.Placement = HashPlacement{Ring: s1.ring}
+	s1.RebalanceDelay = -1
+	t.Cleanup(func() {
+		s1.Stop()
+		s2.Stop()
+		teardown(t, s1.store)
+		teardown(t, s2.store)
+	})
+
+	go func() { s1.Start() }()
+	time.Sleep(500 * time.Millisecond)
+	go func() { s2.Start() }()
+	time.Sleep(2 * time.Second)
+
+	// Every copy lands on s2, the only peer
+	var remoteKeys []string
+	for i := range 4 {
+		key := fmt.Sprintf("file-%d.bin", i)
+		data := make([]byte, 4*1024)
+		rand.New(rand.NewSource(int64(i))).Read(data)
+		if err := s1.StoreReplicas(key, bytes.NewReader(data), 2); err != nil {
+			t.Fatalf("Failed to store: %v", err)
+		}
+		m, err := s1.readManifest(key)
+		if err != nil {
+			t.Fatalf("Failed to read manifest: %v", err)
+		}
+		remoteKeys = append(remoteKeys, crypto.HashKey(key))
+		for _, c := range m.Chunks {
+			remoteKeys = append(remoteKeys, chunkKey(c.Hash))
+		}
+	}
+
+	t.Cleanup(func() {
+		s3.Stop()
+		teardown(t, s3.store)
+	})
+	go func() { s3.Start() }()
+	time.Sleep(2 * time.Second)
+
+	// Nothing moves while paused
+	s1.PauseRebalance()
+	defer s1.ResumeRebalance()
+	done := make(chan RebalanceStatus, 1)
+	go func() {
+		status, err := s1.Rebalance(context.Background())
+		if err != nil {
+			t.Errorf("Failed to rebalance: %v", err)
+		}
+		done <- status
+	}()
+	time.Sleep(time.Second)
+	status := s1.RebalanceStatus()
+	if !status.Running || !status.Paused || status.Done != 0 {
+		t.Errorf("Expected a paused rebalance, got: %s", status)
+	}
+	if status.Planned == 0 {
+		t.Fatalf("Expected moves to s3")
+	}
+
+	s1.ResumeRebalance()
+	status = <-done
+	if status.Done != status.Planned || status.Failed != 0 {
+		t.Fatalf("Expected every move to be done: %s", status)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	// Each object is on the one peer the ring picks for it
+	candidates := []Candidate{{ID: s2.ID}, {ID: s3.ID}}
+	for _, key := range remoteKeys {
+		want := s1.Placement.Place(key, candidates, 1)[0].ID
+		for _, s := range []*FileServer{s2, s3} {
+			if has := s.store.Has(s1.ID, key); has != (s.ID == want) {
+				t.Errorf("[%s] Expected holding (%s) to be %v", s.Transport.Addr(), key, !has)
+			}
+		}
+	}
+
+	// A second pass has nothing left to do
+	status, err := s1.Rebalance(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to rebalance: %v", err)
+	}
+	if status.Planned != 0 {
+		t.Errorf("Expected no moves, got: %s", status)
+	}
+}
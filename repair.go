@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/20af02/MosaicFS/crypto"
+	"github.com/20af02/MosaicFS/erasure"
+	"github.com/20af02/MosaicFS/p2p"
+)
+
+const defaultRepairInterval = time.Minute
+
+// RepairStats counts what the repair loop checked and restored.
+type RepairStats struct {
+	Runs         int64
+	FilesChecked int64
+	// Objects are manifests, chunks and shards.
+	ObjectsChecked  int64
+	ObjectsRepaired int64
+	BytesRepaired   int64
+	// UnderReplicated counts the objects left with fewer copies than wanted for lack of nodes.
+	UnderReplicated int64
+	// Failures counts the files that couldn't be fully repaired, e.g. when every copy of a chunk is gone.
+	Failures     int64
+	LastRun      time.Time
+	LastDuration time.Duration
+}
+
+func (r RepairStats) String() string {
+	return fmt.Sprintf("checked %d files (%d objects), repaired %d objects (%d bytes), %d under-replicated, %d failures in %s",
+		r.FilesChecked, r.ObjectsChecked, r.ObjectsRepaired, r.BytesRepaired, r.UnderReplicated, r.Failures, r.LastDuration.Round(time.Millisecond))
+}
+
+func (r *RepairStats) add(pass RepairStats) {
+	r.Runs += pass.Runs
+	r.FilesChecked += pass.FilesChecked
+	r.ObjectsChecked += pass.ObjectsChecked
+	r.ObjectsRepaired += pass.ObjectsRepaired
+	r.BytesRepaired += pass.BytesRepaired
+	r.UnderReplicated += pass.UnderReplicated
+	r.Failures += pass.Failures
+	r.LastRun = pass.LastRun
+	r.LastDuration = pass.LastDuration
+}
+
+// repairer holds the state of the repair loop.
+type repairer struct {
+	// running is held during a pass, so passes never overlap
+	running sync.Mutex
+	limiter *rateLimiter
+
+	lock  sync.Mutex
+	stats RepairStats
+}
+
+// RepairStats returns the totals of every repair pass so far.
+func (s *FileServer) RepairStats() RepairStats {
+	s.repair.lock.Lock()
+	defer s.repair.lock.Unlock()
+	return s.repair.stats
+}
+
+// repairLoop runs a repair pass every RepairInterval until the server stops.
+func (s *FileServer) repairLoop() {
+	if s.RepairInterval < 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-s.quitch
+		cancel()
+	}()
+
+	ticker := time.NewTicker(s.RepairInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := s.Repair(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("[%s] repair failed: %v", s.Transport.Addr(), err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Repair checks every file we stored has as many copies as it should and restores
+// the missing ones: replicas are copied again from a node still holding them, lost
+// shards are rebuilt from the others. It returns what this pass did.
+func (s *FileServer) Repair(ctx context.Context) (RepairStats, error) {
+	if !s.repair.running.TryLock() {
+		return RepairStats{}, errors.New("a repair is already running")
+	}
+	defer s.repair.running.Unlock()
+
+	pass := RepairStats{Runs: 1, LastRun: time.Now()}
+	defer func() {
+		pass.LastDuration = time.Since(pass.LastRun)
+		s.repair.lock.Lock()
+		s.repair.stats.add(pass)
+		s.repair.lock.Unlock()
+	}()
+
+	files, err := s.store.dbHandler.ListFiles()
+	if err != nil {
+		return pass, err
+	}
+	for _, fmd := range files {
+		if err := ctx.Err(); err != nil {
+			return pass, err
+		}
+		pass.FilesChecked++
+		if err := s.repairFile(ctx, fmd, &pass); err != nil {
+			pass.Failures++
+			log.Printf("[%s] failed to repair (%s): %v", s.Transport.Addr(), fmd.Key, err)
+		}
+	}
+
+	pass.LastDuration = time.Since(pass.LastRun)
+	log.Printf("[%s] repair: %s", s.Transport.Addr(), pass)
+	return pass, nil
+}
+
+// repairObject is a stored object, by its key on our disk and on our peers.
+type repairObject struct {
+	local, remote string
+	// encKey is the key the object is encrypted with on our peers, see legacyFormat for legacy
+	encKey []byte
+	legacy bool
+	verify func() error
+}
+
+func (s *FileServer) repairFile(ctx context.Context, fmd FileMetadata, pass *RepairStats) error {
+	key := fmd.Key
+	replicas := max(fmd.Replicas, 1)
+	dataKey, err := s.dataKey(&fmd)
+	if err != nil {
+		return err
+	}
+
+	// We always keep the manifest, it tells which chunks to check
+	if !s.store.Has(s.ID, key) {
+		if err := s.fetch(ctx, key, crypto.HashKey(key), dataKey, legacyFormat(&fmd), nil); err != nil {
+			return fmt.Errorf("fetch manifest: %w", err)
+		}
+		go s.provide(s.ID, crypto.HashKey(key))
+		pass.ObjectsRepaired++
+	}
+	objects := []repairObject{{local: key, remote: crypto.HashKey(key), encKey: dataKey, legacy: legacyFormat(&fmd)}}
+
+	m, err := s.readManifest(key)
+	if err != nil && !errors.Is(err, errNotManifest) {
+		return err
+	}
+	remoteKeys := []string{crypto.HashKey(key)}
+	if m != nil {
+		for _, c := range m.Chunks {
+			for _, objectKey := range m.objectKeys(c) {
+				if slices.Contains(remoteKeys, objectKey) {
+					continue
+				}
+				remoteKeys = append(remoteKeys, objectKey)
+				if m.EC == nil {
+					objects = append(objects, repairObject{
+						local:  objectKey,
+						remote: objectKey,
+						encKey: c.encKey(s.masterKey()),
+						verify: func() error { return s.verifyChunk(c) },
+					})
+				}
+			}
+		}
+	}
+
+	holders := s.holders(ctx, remoteKeys)
+	var errs []error
+	for _, o := range objects {
+		pass.ObjectsChecked++
+		if err := s.repairReplicas(ctx, o, replicas, holders, pass); err != nil {
+			errs = append(errs, fmt.Errorf("(%s): %w", o.remote, err))
+		}
+	}
+	if m != nil && m.EC != nil {
+		seen := make(map[string]bool)
+		for _, c := range m.Chunks {
+			if seen[c.Hash] {
+				continue
+			}
+			seen[c.Hash] = true
+			pass.ObjectsChecked += int64(m.EC.Total())
+			if err := s.repairShards(ctx, m, c, holders, pass); err != nil {
+				errs = append(errs, fmt.Errorf("chunk (%s): %w", c.Hash, err))
+			}
+		}
+	}
+
+	// Record where the file is now
+	if err := s.recordLocations(fmd, holders); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// recordLocations sets the replica locations of fmd to us and the peers holding its objects.
+func (s *FileServer) recordLocations(fmd FileMetadata, holders map[string][]string) error {
+	locs := []string{s.ID}
+	for _, ids := range holders {
+		for _, id := range ids {
+			locs = appendLoc(locs, id)
+		}
+	}
+	if slices.Equal(locs, fmd.ReplicaLocations) {
+		return nil
+	}
+	fmd.ReplicaLocations = locs
+	_, err := s.store.dbHandler.UpdateFile(fmd)
+	return err
+}
+
+// repairReplicas copies o to new peers until there are replicas copies of it, ours included.
+// The peers receiving a copy are added to holders.
+// While draining, our own copy doesn't count.
+func (s *FileServer) repairReplicas(ctx context.Context, o repairObject, replicas int, holders map[string][]string, pass *RepairStats) error {
+	draining := s.Draining()
+	count := len(holders[o.remote])
+	if s.store.Has(s.ID, o.local) && !draining {
+		count++
+	}
+	if count >= replicas {
+		return nil
+	}
+
+	if !s.store.Has(s.ID, o.local) {
+		if err := s.fetch(ctx, o.local, o.remote, o.encKey, o.legacy, o.verify); err != nil {
+			return err
+		}
+		go s.provide(s.ID, o.remote)
+		pass.ObjectsRepaired++
+		if !draining {
+			count++
+		}
+		if count >= replicas {
+			return nil
+		}
+	}
+
+	_, r, err := s.store.Read(s.ID, o.local)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	peers := s.placeReplicas(o.remote, replicas-count, int64(len(data)), holders[o.remote]...)
+	if len(peers) < replicas-count {
+		// Not a failure, the cluster is just too small for now
+		pass.UnderReplicated++
+	}
+	if len(peers) == 0 {
+		return nil
+	}
+	if err := s.repair.limiter.wait(ctx, len(data)*len(peers)); err != nil {
+		return err
+	}
+	acked, err := s.sendObject(ctx, peers, o.remote, o.encKey, data)
+	for _, peer := range acked {
+		holders[o.remote] = append(holders[o.remote], peer.ID())
+	}
+	pass.ObjectsRepaired += int64(len(acked))
+	pass.BytesRepaired += int64(len(data) * len(acked))
+	if len(acked) > 0 {
+		log.Printf("[%s] repaired (%s): %d new replicas", s.Transport.Addr(), o.remote, len(acked))
+	}
+	return err
+}
+
+// repairShards rebuilds the shards of chunk c no node holds anymore and places
+// them on nodes holding no other shard of it. While draining, the shards only
+// we hold count as missing.
+func (s *FileServer) repairShards(ctx context.Context, m *Manifest, c ChunkRef, holders map[string][]string, pass *RepairStats) error {
+	draining := s.Draining()
+	keys := m.objectKeys(c)
+	var missing []int
+	var held []string
+	local := false
+	lost := 0
+	for i, key := range keys {
+		ids := holders[key]
+		if s.store.Has(s.ID, key) {
+			local = true
+			if !draining {
+				ids = append(ids, s.ID)
+			}
+		} else if len(ids) == 0 {
+			lost++
+		}
+		if len(ids) == 0 {
+			missing = append(missing, i)
+		}
+		held = append(held, ids...)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if len(keys)-lost < m.EC.Data {
+		return fmt.Errorf("%d shards lost: %w", lost, erasure.ErrTooFewShards)
+	}
+
+	// Decode the chunk, then drop the shards only fetched for it
+	fetched, err := s.fetchShards(ctx, m, c)
+	defer func() {
+		for _, key := range fetched {
+			s.store.discard(s.ID, key)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	data, err := s.decodeShards(m, c)
+	if err != nil {
+		return err
+	}
+	coder, err := erasure.New(*m.EC)
+	if err != nil {
+		return err
+	}
+	shards := coder.Split(data)
+
+	peers := s.placeReplicas(chunkKey(m.ref(c)), len(missing), int64(len(shards[0])), held...)
+	for j, i := range missing {
+		switch {
+		case j < len(peers):
+			if err := s.repair.limiter.wait(ctx, len(shards[i])); err != nil {
+				return err
+			}
+			if _, err := s.sendObject(ctx, []p2p.Peer{peers[j]}, keys[i], c.encKey(s.masterKey()), shards[i]); err != nil {
+				return err
+			}
+			holders[keys[i]] = append(holders[keys[i]], peers[j].ID())
+		case !local && !draining:
+			// No peer left without a shard, we hold none yet
+			if _, err := s.store.Write(s.ID, keys[i], bytes.NewReader(shards[i])); err != nil {
+				return err
+			}
+			local = true
+			go s.provide(s.ID, keys[i])
+		default:
+			// Every node already holds a shard, the cluster is too small for now
+			pass.UnderReplicated++
+			continue
+		}
+		pass.ObjectsRepaired++
+		pass.BytesRepaired += int64(len(shards[i]))
+	}
+	log.Printf("[%s] repaired chunk (%s): %d shards missing", s.Transport.Addr(), c.Hash, len(missing))
+	return nil
+}
+
+// holders returns the peers holding each of our objects, by remote key. What they
+// hold is kept in sync with their Merkle trees rather than asked key by key.
+func (s *FileServer) holders(ctx context.Context, keys []string) map[string][]string {
+	var lock sync.Mutex
+	holders := make(map[string][]string)
+
+	var wg sync.WaitGroup
+	for _, peer := range s.peerList() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			inventory, err := s.syncInventory(ctx, peer)
+			if err != nil {
+				log.Printf("[%s] failed to sync inventory with (%s): %v", s.Transport.Addr(), peer.ID(), err)
+				return
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			for _, key := range keys {
+				if inventory.Has(s.store.inventoryName(key)) {
+					holders[key] = append(holders[key], peer.ID())
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return holders
+}
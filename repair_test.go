@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/20af02/MosaicFS/crypto"
+	"github.com/20af02/MosaicFS/erasure"
+)
+
+func startRepairServers(t *testing.T) (*FileServer, *FileServer, *FileServer) {
+	s1 := MakeTestServer(":3000", []string{})
+	s2 := MakeTestServer(":4000", []string{":3000"})
+	s3 := MakeTestServer(":5000", []string{":3000", ":4000"})
+	s1.ChunkSize = 1024
+	t.Cleanup(func() {
+		s1.Stop()
+		s2.Stop()
+		s3.Stop()
+		teardown(t, s1.store)
+		teardown(t, s2.store)
+		teardown(t, s3.store)
+	})
+
+	go func() { s1.Start() }()
+	go func() { s2.Start() }()
+	time.Sleep(2 * time.Second)
+
+	go func() { s3.Start() }()
+	time.Sleep(2 * time.Second)
+	return s1, s2, s3
+}
+
+func TestRepair(t *testing.T) {
+	s1, s2, s3 := startRepairServers(t)
+
+	key := "repaired.bin"
+	data := make([]byte, 8*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := s1.StoreReplicas(key, bytes.NewReader(data), 3); err != nil {
+		t.Fatalf("Failed to store: %v", err)
+	}
+	m, err := s1.readManifest(key)
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	remoteKeys := []string{crypto.HashKey(key)}
+	for _, c := range m.Chunks {
+		remoteKeys = append(remoteKeys, chunkKey(c.Hash))
+	}
+
+	// s2 loses its copies, we drop ours
+	for _, k := range remoteKeys {
+		s2.store.discard(s1.ID, k)
+	}
+	if err := s1.DeleteLocal(key); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+
+	pass, err := s1.Repair(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to repair: %v", err)
+	}
+	if pass.Failures != 0 || pass.ObjectsRepaired != int64(2*len(remoteKeys)) {
+		t.Errorf("Unexpected repair: %s", pass)
+	}
+	if !s1.store.Has(s1.ID, key) {
+		t.Errorf("Expected the manifest to be restored locally")
+	}
+	for _, k := range remoteKeys {
+		if !s2.store.Has(s1.ID, k) || !s3.store.Has(s1.ID, k) {
+			t.Errorf("Expected (%s) to be on every node", k)
+		}
+	}
+	fmd, _ := s1.store.dbHandler.GetFileMetadata(key)
+	if fmd.Replicas != 3 || len(fmd.ReplicaLocations) != 3 {
+		t.Errorf("Unexpected metadata: %+v", fmd)
+	}
+
+	// Nothing left to do
+	pass, err = s1.Repair(context.Background())
+	if err != nil || pass.ObjectsRepaired != 0 {
+		t.Errorf("Expected nothing to repair, got: %s (%v)", pass, err)
+	}
+	if stats := s1.RepairStats(); stats.Runs != 2 {
+		t.Errorf("Expected 2 runs, got %d", stats.Runs)
+	}
+}
+
+func TestRepairShards(t *testing.T) {
+	s1, _, s3 := startRepairServers(t)
+
+	key := "repaired.ec"
+	data := make([]byte, 8*1024)
+	rand.New(rand.NewSource(2)).Read(data)
+	if err := s1.StoreEC(key, bytes.NewReader(data), erasure.Scheme{Data: 2, Parity: 1}); err != nil {
+		t.Fatalf("Failed to store: %v", err)
+	}
+	m, err := s1.readManifest(key)
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+
+	lost := map[string]bool{}
+	for _, c := range m.Chunks {
+		for _, k := range m.objectKeys(c) {
+			if s3.store.Has(s1.ID, k) {
+				lost[k] = true
+				s3.store.discard(s1.ID, k)
+			}
+		}
+	}
+
+	pass, err := s1.Repair(context.Background())
+	if err != nil || pass.Failures != 0 {
+		t.Fatalf("Failed to repair: %s (%v)", pass, err)
+	}
+	for k := range lost {
+		if !s3.store.Has(s1.ID, k) {
+			t.Errorf("Expected shard (%s) to be rebuilt on s3", k)
+		}
+		if s1.store.Has(s1.ID, k) {
+			t.Errorf("Expected the shards fetched to rebuild (%s) to be dropped", k)
+		}
+	}
+}
+
+func TestSyncInventory(t *testing.T) {
+	s1, s2, _ := startRepairServers(t)
+
+	key := "inventory.bin"
+	if err := s1.StoreReplicas(key, bytes.NewReader([]byte("my big data file here!")), 3); err != nil {
+		t.Fatalf("Failed to store: %v", err)
+	}
+	peer, ok := s1.peer(s2.ID)
+	if !ok {
+		t.Fatalf("Expected s2 to be a peer of s1")
+	}
+	inventory, err := s1.syncInventory(context.Background(), peer)
+	if err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	if !inventory.Has(s1.store.inventoryName(crypto.HashKey(key))) {
+		t.Errorf("Expected s2 to hold the manifest")
+	}
+
+	s2.store.discard(s1.ID, crypto.HashKey(key))
+	if _, err := s1.syncInventory(context.Background(), peer); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	if inventory.Has(s1.store.inventoryName(crypto.HashKey(key))) {
+		t.Errorf("Expected the manifest to be gone from s2's inventory")
+	}
+	local, _ := s2.store.inventory(s1.ID)
+	if local.Root() != inventory.Root() {
+		t.Errorf("Expected the inventories to match after sync")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(10_000)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := l.wait(context.Background(), 1000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first 1000 bytes go right away, the next 2000 take 200ms
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond {
+		t.Errorf("Expected the limiter to wait, took %s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l.wait(ctx, 1_000_000)
+	if err := l.wait(ctx, 1); err == nil {
+		t.Errorf("Expected a canceled wait to fail")
+	}
+
+	var unlimited *rateLimiter
+	if err := unlimited.wait(ctx, 1<<30); err != nil {
+		t.Errorf("Expected no limit, got %v", err)
+	}
+}
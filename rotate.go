@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+
+	"github.com/20af02/MosaicFS/crypto"
+	"github.com/20af02/MosaicFS/p2p"
+)
+
+// RotationReport tells how far a key rotation got.
+type RotationReport struct {
+	// Version is the version of the new master key.
+	Version int
+	// Files are our own files, FilesDone the ones whose data key is wrapped with the new key.
+	Files     int
+	FilesDone int
+	// Reencrypted counts the files that were still encrypted with the master key,
+	// in full or in part, and got keys of their own.
+	Reencrypted int
+	// ChunkKeys counts the chunk keys wrapped with the new key.
+	ChunkKeys int
+	// Done is set once the node uses the new key.
+	Done bool
+}
+
+func (r RotationReport) String() string {
+	return fmt.Sprintf("version %d: %d of %d files done, %d re-encrypted, %d chunk keys re-wrapped",
+		r.Version, r.FilesDone, r.Files, r.Reencrypted, r.ChunkKeys)
+}
+
+// RotateKey replaces the master key with a new one. The data keys of our files, the
+// keys of our chunks and the key chunks are addressed with are wrapped with the new
+// key, and each file records the version of the key its data key is wrapped with.
+// Files still encrypted with the master key itself, stored before data keys, get keys
+// of their own and every copy of them is encrypted again. Once nothing depends on the
+// old key, the new one is saved with SaveKey and used from then on.
+//
+// The new key is kept in the database wrapped with the old one until then, an
+// interrupted rotation resumes where it stopped when called again, even after a restart.
+// Stores wait for the rotation to be over. It fails while a repair or rebalance is
+// running, and none starts meanwhile.
+// The shares of the old key escrowed with EscrowKey are kept: escrow the new one again,
+// then have them dropped with RevokeEscrow.
+func (s *FileServer) RotateKey(ctx context.Context) (RotationReport, error) {
+	if s.SaveKey == nil {
+		return RotationReport{}, errors.New("no way to save a new master key")
+	}
+	if !s.keys.running.TryLock() {
+		return RotationReport{}, errors.New("a key rotation is already running")
+	}
+	defer s.keys.running.Unlock()
+
+	// Nothing copies the objects being encrypted again, nor wraps new keys
+	if !s.repair.running.TryLock() {
+		return RotationReport{}, errors.New("a repair is running, try again once it's over")
+	}
+	defer s.repair.running.Unlock()
+	if !s.rebalance.running.TryLock() {
+		return RotationReport{}, errors.New("a rebalance is running, try again once it's over")
+	}
+	defer s.rebalance.running.Unlock()
+	s.keys.rotate.Lock()
+	defer s.keys.rotate.Unlock()
+
+	master, version := s.keys.current()
+	report := RotationReport{Version: version + 1}
+	s.keys.lock.RLock()
+	next := s.keys.next
+	s.keys.lock.RUnlock()
+	if next == nil {
+		next = crypto.NewEncryptionKey()
+		wrapped, err := crypto.WrapKey(master, next)
+		if err != nil {
+			return report, err
+		}
+		if err := s.store.dbHandler.SetRotation(&KeyRotation{Version: report.Version, Key: wrapped}); err != nil {
+			return report, err
+		}
+		s.keys.lock.Lock()
+		s.keys.next = next
+		s.keys.lock.Unlock()
+		log.Printf("[%s] rotating the master key to version %d", s.Transport.Addr(), report.Version)
+	} else {
+		log.Printf("[%s] resuming the rotation of the master key to version %d", s.Transport.Addr(), report.Version)
+	}
+
+	// Our files
+	files, err := s.store.dbHandler.ListFiles()
+	if err != nil {
+		return report, err
+	}
+	report.Files = len(files)
+	var errs []error
+	for _, fmd := range files {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if fmd.KeyVersion == report.Version {
+			report.FilesDone++
+			continue
+		}
+		reencrypted, err := s.reencryptFile(ctx, &fmd)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("(%s): %w", fmd.Key, err))
+			continue
+		}
+		if reencrypted {
+			report.Reencrypted++
+		}
+		dataKey, err := s.dataKey(&fmd)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("(%s): %w", fmd.Key, err))
+			continue
+		}
+		if fmd.DataKey, err = crypto.WrapKey(next, dataKey); err != nil {
+			return report, err
+		}
+		fmd.KeyVersion = report.Version
+		if _, err := s.store.dbHandler.UpdateFile(fmd); err != nil {
+			return report, err
+		}
+		report.FilesDone++
+	}
+	if err := errors.Join(errs...); err != nil {
+		// The old key is still needed for these
+		return report, err
+	}
+
+	// Our chunks, those already re-wrapped unwrap with the new key
+	chunkKeys, err := s.store.dbHandler.ChunkKeys()
+	if err != nil {
+		return report, err
+	}
+	for ref, wrapped := range chunkKeys {
+		if _, err := crypto.UnwrapKey(next, wrapped); err == nil {
+			continue
+		}
+		key, err := crypto.UnwrapKey(master, wrapped)
+		if err != nil {
+			return report, fmt.Errorf("chunk (%s): %w", ref, err)
+		}
+		if wrapped, err = crypto.WrapKey(next, key); err != nil {
+			return report, err
+		}
+		if err := s.store.dbHandler.SetChunkKey(ref, wrapped); err != nil {
+			return report, err
+		}
+		report.ChunkKeys++
+	}
+
+	// Chunks keep their hashes
+	wrapped, err := s.store.dbHandler.HashKey()
+	if err != nil {
+		return report, err
+	}
+	if _, err := crypto.UnwrapKey(next, wrapped); wrapped == nil || err != nil {
+		if wrapped, err = crypto.WrapKey(next, s.keys.hashKey()); err != nil {
+			return report, err
+		}
+		if err := s.store.dbHandler.SetHashKey(wrapped); err != nil {
+			return report, err
+		}
+	}
+
+	// Nothing depends on the old key anymore
+	if err := s.SaveKey(next, report.Version); err != nil {
+		return report, fmt.Errorf("save the new key: %w", err)
+	}
+	s.keys.lock.Lock()
+	s.keys.master, s.keys.version, s.keys.next = next, report.Version, nil
+	s.keys.lock.Unlock()
+	if err := s.store.dbHandler.SetRotation(nil); err != nil {
+		return report, err
+	}
+	report.Done = true
+	log.Printf("[%s] rotated the master key to version %d: %s", s.Transport.Addr(), report.Version, report)
+	return report, nil
+}
+
+// reencryptFile gives fmd a data key and the chunks of the file keys of their own when
+// they are still encrypted with the master key, encrypting every copy of them again.
+// Copies of files without a format are encrypted again too, see legacyFormat.
+// It reports whether there was anything to encrypt again.
+func (s *FileServer) reencryptFile(ctx context.Context, fmd *FileMetadata) (bool, error) {
+	key := fmd.Key
+	dataKey, err := s.dataKey(fmd)
+	if err != nil {
+		return false, err
+	}
+	if !s.store.Has(s.ID, key) {
+		if err := s.fetch(ctx, key, crypto.HashKey(key), dataKey, legacyFormat(fmd), nil); err != nil {
+			return false, fmt.Errorf("fetch manifest: %w", err)
+		}
+		go s.provide(s.ID, crypto.HashKey(key))
+	}
+	m, err := s.readManifest(key)
+	if err != nil && !errors.Is(err, errNotManifest) {
+		return false, err
+	}
+
+	remoteKeys := []string{crypto.HashKey(key)}
+	var legacy []ChunkRef
+	if m != nil {
+		for _, c := range m.Chunks {
+			if c.Key != nil || slices.ContainsFunc(legacy, func(l ChunkRef) bool { return l.Hash == c.Hash }) {
+				continue
+			}
+			legacy = append(legacy, c)
+			remoteKeys = append(remoteKeys, m.objectKeys(c)...)
+		}
+	}
+	if fmd.DataKey != nil && !legacyFormat(fmd) && len(legacy) == 0 {
+		return false, nil
+	}
+	holders := s.holders(ctx, remoteKeys)
+
+	// The chunks first, the manifest lists their keys
+	for _, c := range legacy {
+		ck, err := s.reencryptChunk(ctx, m, c, holders)
+		if err != nil {
+			return false, fmt.Errorf("chunk (%s): %w", c.Hash, err)
+		}
+		for i := range m.Chunks {
+			if m.Chunks[i].Hash == c.Hash {
+				m.Chunks[i].Key = ck
+			}
+		}
+	}
+	if m != nil {
+		manifest, err := m.encode()
+		if err != nil {
+			return false, err
+		}
+		if _, err := s.store.WriteSync(s.ID, key, bytes.NewReader(manifest)); err != nil {
+			return false, err
+		}
+	}
+
+	wrapped := fmd.DataKey
+	if wrapped == nil {
+		if dataKey, wrapped, fmd.KeyVersion, err = s.newDataKey(); err != nil {
+			return false, err
+		}
+	}
+	if err := s.resend(ctx, key, crypto.HashKey(key), dataKey, holders[crypto.HashKey(key)]); err != nil {
+		return false, fmt.Errorf("manifest: %w", err)
+	}
+	fmd.DataKey, fmd.Format = wrapped, crypto.VersionGCM
+	return true, nil
+}
+
+// reencryptChunk gives chunk c of m a key of its own, and encrypts every copy of it, or
+// of its shards, with it. A chunk shared with a file already done keeps the key it got.
+func (s *FileServer) reencryptChunk(ctx context.Context, m *Manifest, c ChunkRef, holders map[string][]string) ([]byte, error) {
+	wrapped, err := s.store.dbHandler.ChunkKey(m.ref(c))
+	if err != nil {
+		return nil, err
+	}
+	if wrapped != nil {
+		return s.keys.unwrap(wrapped)
+	}
+
+	key, wrapped, _, err := s.newDataKey()
+	if err != nil {
+		return nil, err
+	}
+	for _, objectKey := range m.objectKeys(c) {
+		if len(holders[objectKey]) == 0 {
+			continue
+		}
+		if !s.store.Has(s.ID, objectKey) {
+			var verify func() error
+			if m.EC == nil {
+				verify = func() error { return s.verifyChunk(c) }
+			}
+			if err := s.fetch(ctx, objectKey, objectKey, s.masterKey(), false, verify); err != nil {
+				return nil, err
+			}
+			defer s.store.discard(s.ID, objectKey)
+		}
+		if err := s.resend(ctx, objectKey, objectKey, key, holders[objectKey]); err != nil {
+			return nil, err
+		}
+	}
+	// Every copy uses the key now
+	return key, s.store.dbHandler.SetChunkKey(m.ref(c), wrapped)
+}
+
+// resend encrypts our object localKey with encKey again on the peers holding it, by ID.
+func (s *FileServer) resend(ctx context.Context, localKey, remoteKey string, encKey []byte, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	var peers []p2p.Peer
+	for _, id := range ids {
+		peer, ok := s.peer(id)
+		if !ok {
+			return fmt.Errorf("(%s) is gone", id)
+		}
+		peers = append(peers, peer)
+	}
+	_, r, err := s.store.Read(s.ID, localKey)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	_, err = s.sendObject(ctx, peers, remoteKey, encKey, data)
+	return err
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/20af02/MosaicFS/crypto"
+	"github.com/20af02/MosaicFS/p2p"
+)
+
+// storeLegacy stores data under key on s and peer the way it was before data and
+// chunk keys: a single chunk and its manifest, encrypted with the master key.
+func storeLegacy(t *testing.T, s *FileServer, peer p2p.Peer, key string, data []byte) {
+	t.Helper()
+	ctx := context.Background()
+	c := ChunkRef{Hash: chunkHash(s.EncKey, data), Size: int64(len(data))}
+	m := &Manifest{Size: c.Size, ChunkSize: s.ChunkSize, Chunks: []ChunkRef{c}}
+	manifest, err := m.encode()
+	if err != nil {
+		t.Fatalf("Failed to encode the manifest: %v", err)
+	}
+	for localKey, remoteKey := range map[string]string{chunkKey(c.Hash): chunkKey(c.Hash), key: crypto.HashKey(key)} {
+		b := data
+		if localKey == key {
+			b = manifest
+		}
+		if _, err := s.store.Write(s.ID, localKey, bytes.NewReader(b)); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+		if _, err := s.sendObject(ctx, []p2p.Peer{peer}, remoteKey, s.EncKey, b); err != nil {
+			t.Fatalf("Failed to send: %v", err)
+		}
+	}
+	if _, err := s.store.dbHandler.AddChunkRef(c.Hash); err != nil {
+		t.Fatalf("Failed to reference the chunk: %v", err)
+	}
+	if _, err := s.store.dbHandler.UpdateFile(FileMetadata{Key: key, Size: c.Size, Replicas: 2}); err != nil {
+		t.Fatalf("Failed to record the file: %v", err)
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	s1, s2, _ := startRepairServers(t)
+	oldKey := s1.EncKey
+	var savedKey []byte
+	var savedVersion int
+	s1.SaveKey = func(key []byte, version int) error {
+		savedKey, savedVersion = key, version
+		return nil
+	}
+
+	data := make([]byte, 8*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := s1.StoreReplicas("new.bin", bytes.NewReader(data), 2); err != nil {
+		t.Fatalf("Failed to store: %v", err)
+	}
+	dataKey, err := s1.fileKey("new.bin")
+	if err != nil {
+		t.Fatalf("Failed to unwrap the data key: %v", err)
+	}
+	peer, ok := s1.peer(s2.ID)
+	if !ok {
+		t.Fatalf("Expected s2 to be a peer of s1")
+	}
+	legacy := []byte("stored before data keys")
+	storeLegacy(t, s1, peer, "old.bin", legacy)
+
+	// Interrupted before any file is done, the new key is remembered across restarts
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report, err := s1.RotateKey(ctx)
+	if !errors.Is(err, context.Canceled) || report.Done {
+		t.Fatalf("Expected the rotation to be interrupted, got %v: %s", err, report)
+	}
+	s1.keys = keyring{}
+	if err := s1.loadKeys(); err != nil {
+		t.Fatalf("Failed to load keys: %v", err)
+	}
+	if s1.keys.next == nil {
+		t.Fatalf("Expected the rotation in progress to be loaded")
+	}
+
+	report, err = s1.RotateKey(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to rotate: %v", err)
+	}
+	if !report.Done || report.FilesDone != 2 || report.Reencrypted != 1 {
+		t.Errorf("Unexpected report: %s", report)
+	}
+	if savedVersion != 1 || len(savedKey) == 0 || bytes.Equal(savedKey, oldKey) {
+		t.Errorf("Expected a new key to be saved as version 1, got version %d", savedVersion)
+	}
+	if master, _ := s1.keys.current(); !bytes.Equal(master, savedKey) {
+		t.Errorf("Expected the saved key to be in use")
+	}
+	if !bytes.Equal(s1.keys.hashKey(), oldKey) {
+		t.Errorf("Expected chunks to keep their hashes")
+	}
+
+	// Data keys are re-wrapped, files with none get one
+	for _, key := range []string{"new.bin", "old.bin"} {
+		fmd, err := s1.store.dbHandler.GetFileMetadata(key)
+		if err != nil {
+			t.Fatalf("Failed to get metadata: %v", err)
+		}
+		if fmd.KeyVersion != 1 || fmd.DataKey == nil {
+			t.Errorf("Expected (%s) to have a data key wrapped with version 1, got version %d", key, fmd.KeyVersion)
+		}
+		if fmd.Format != crypto.VersionGCM {
+			t.Errorf("Expected (%s) to be in the current format, got %d", key, fmd.Format)
+		}
+	}
+	if newKey, _ := s1.fileKey("new.bin"); !bytes.Equal(newKey, dataKey) {
+		t.Errorf("Expected the data key to be kept")
+	}
+
+	// The copies of the old file no longer depend on the old key
+	_, r, err := s2.store.Read(s1.ID, crypto.HashKey("old.bin"))
+	if err != nil {
+		t.Fatalf("Failed to read the copy: %v", err)
+	}
+	if _, err := crypto.CopyDecrypt(oldKey, r, new(bytes.Buffer)); !errors.Is(err, crypto.ErrAuth) {
+		t.Errorf("Expected the copy not to decrypt with the old key, got %v", err)
+	}
+
+	// Both files read back from the peers
+	for key, want := range map[string][]byte{"new.bin": data, "old.bin": legacy} {
+		if err := s1.DeleteLocal(key); err != nil {
+			t.Fatalf("Failed to delete locally: %v", err)
+		}
+		r, err := s1.Get(key)
+		if err != nil {
+			t.Fatalf("Failed to get (%s): %v", key, err)
+		}
+		b := new(bytes.Buffer)
+		b.ReadFrom(r)
+		if !bytes.Equal(b.Bytes(), want) {
+			t.Errorf("Unexpected content of (%s)", key)
+		}
+	}
+}
+
+func TestRotateKeyWhileRunning(t *testing.T) {
+	s := MakeTestServer(":3000", []string{})
+	defer func() {
+		s.Stop()
+		teardown(t, s.store)
+	}()
+	oldKey := s.EncKey
+	s.SaveKey = func([]byte, int) error { return nil }
+
+	// A rotation doesn't wait for a repair or rebalance, however long it lasts
+	for name, running := range map[string]*sync.Mutex{
+		"repair":    &s.repair.running,
+		"rebalance": &s.rebalance.running,
+	} {
+		if !running.TryLock() {
+			t.Fatalf("Expected no %s to be running", name)
+		}
+		_, err := s.RotateKey(context.Background())
+		running.Unlock()
+		if err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("Expected the rotation to fail while a %s is running, got %v", name, err)
+		}
+	}
+	if !bytes.Equal(s.EncKey, oldKey) {
+		t.Errorf("Expected the key to be kept")
+	}
+}
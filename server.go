@@ -2,19 +2,27 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
+	"crypto/ed25519"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"slices"
 	"time"
 
 	"io"
 	"log"
 	"sync"
 
+	"github.com/20af02/MosaicFS/chunker"
 	"github.com/20af02/MosaicFS/crypto"
+	"github.com/20af02/MosaicFS/dht"
+	"github.com/20af02/MosaicFS/erasure"
+	"github.com/20af02/MosaicFS/hashring"
+	"github.com/20af02/MosaicFS/merkle"
 	"github.com/20af02/MosaicFS/p2p"
 )
 
@@ -28,21 +36,134 @@ type FileServerOpts struct {
 	BootStrapNodes    []string
 	// DB to store our known files
 	DBFile string
+	// RequestTimeout bounds how long Get waits on the network. Defaults to defaultRequestTimeout.
+	RequestTimeout time.Duration
+	// MaxPeers caps how many peers we connect to on our own when learning about them
+	// through peer exchange. Defaults to defaultMaxPeers.
+	MaxPeers int
+	// ReplicationFactor is the number of copies of a file Store keeps, ours included.
+	// Defaults to defaultReplicationFactor.
+	ReplicationFactor int
+	// Placement picks the peers receiving the replicas. Defaults to RandomPlacement.
+	Placement PlacementPolicy
+	// ChunkSize is the average size of the chunks files are split into. Defaults to defaultChunkSize.
+	ChunkSize int
+	// Weight is this node's share of the hash ring relative to the others, e.g. its capacity. Defaults to 1.
+	Weight int
+	// RepairInterval is how often the repair loop checks our files for missing copies.
+	// Defaults to defaultRepairInterval, a negative value disables the loop.
+	RepairInterval time.Duration
+	// RepairBandwidth caps the bytes per second the repair loop sends. 0 means no limit.
+	RepairBandwidth int64
+	// Capacity is the storage this node offers to its peers, in bytes. 0 means no limit.
+	Capacity int64
+	// RebalanceDelay is how long the rebalancer waits after the last node joined or left
+	// before moving replicas. Defaults to defaultRebalanceDelay, a negative value disables it.
+	RebalanceDelay time.Duration
+	// RebalanceBandwidth caps the bytes per second the rebalancer sends. 0 means no limit.
+	RebalanceBandwidth int64
+	// MetadataReaders are the IDs of the nodes our file metadata is shared with, so they can
+	// list and locate our files. "*" shares it with every node of the cluster.
+	MetadataReaders []string
+	// WriteConsistency is how many copies Store waits to be acknowledged on disk,
+	// ours included, before succeeding. Defaults to ConsistencyOne.
+	WriteConsistency Consistency
+	// ReadConsistency is how many copies of a file Get wants to agree on its
+	// content, ours included. Defaults to ConsistencyOne.
+	ReadConsistency Consistency
+	// ErasureCoding makes Store split chunks into k+m shards on distinct nodes
+	// instead of replicating them. Nil means full replication.
+	ErasureCoding *erasure.Scheme
+	// KeyVersion is the version of EncKey, the master key the node starts with.
+	// RotateKey replaces both.
+	KeyVersion int
+	// SaveKey persists the master key RotateKey moved to and its version, so the
+	// node starts with them. Rotations fail without it.
+	SaveKey func(key []byte, version int) error
+	// NodeKey is the identity key of the node. The copies handed to stand-ins are
+	// signed with it, so the node they are meant for takes them, see HintProof.
+	NodeKey ed25519.PrivateKey
 }
 
+const (
+	defaultRequestTimeout    = 30 * time.Second
+	defaultMaxPeers          = 32
+	defaultReplicationFactor = 3
+	// peerDialTimeout is how long a peer we dialed may take to show up in OnPeer
+	// before we consider dialing it again.
+	peerDialTimeout = 30 * time.Second
+)
+
 type FileServer struct {
 	FileServerOpts
 
 	peerLock sync.Mutex
 	peers    map[string]p2p.Peer
+	// dialing holds the peers learned through peer exchange we're connecting to, by when we started.
+	dialing map[string]time.Time
+	// usage is the storage each peer last reported using, in bytes.
+	usage map[string]int64
+	// capacity is the storage each peer offers, in bytes.
+	capacity map[string]int64
 	store    *Store
 	quitch   chan struct{}
+	pending  *pendingRequests
+	// dht locates the nodes holding a file
+	dht *dht.DHT
+	// ring places keys on the nodes we know of, ourselves included
+	ring *hashring.Ring
+	// repair restores the copies of our files that went missing
+	repair repairer
+	// inventories mirror the objects each peer holds for us, see syncInventory.
+	inventories map[string]*merkle.Tree
+	// handoff is held while delivering the objects we hold for other nodes
+	handoff sync.Mutex
+	// drain retires this node, see Drain
+	drain drainer
+	// draining holds the peers retiring themselves, they take no new copies
+	draining map[string]bool
+	// offline holds the ring nodes we lost the connection to, see place
+	offline map[string]offlineNode
+	// rebalance moves replicas to new nodes, see Rebalance
+	rebalance rebalancer
+	// keys holds the master key, see RotateKey
+	keys keyring
 }
 
 func NewFileServer(opts FileServerOpts) *FileServer {
 	if len(opts.ID) == 0 {
 		opts.ID = crypto.GenerateID()
 	}
+	if opts.RequestTimeout == 0 {
+		opts.RequestTimeout = defaultRequestTimeout
+	}
+	if opts.MaxPeers <= 0 {
+		opts.MaxPeers = defaultMaxPeers
+	}
+	if opts.ReplicationFactor <= 0 {
+		opts.ReplicationFactor = defaultReplicationFactor
+	}
+	if opts.Placement == nil {
+		opts.Placement = RandomPlacement{}
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = defaultChunkSize
+	}
+	if opts.Weight <= 0 {
+		opts.Weight = 1
+	}
+	if opts.RepairInterval == 0 {
+		opts.RepairInterval = defaultRepairInterval
+	}
+	if opts.RebalanceDelay == 0 {
+		opts.RebalanceDelay = defaultRebalanceDelay
+	}
+	if opts.WriteConsistency == 0 {
+		opts.WriteConsistency = ConsistencyOne
+	}
+	if opts.ReadConsistency == 0 {
+		opts.ReadConsistency = ConsistencyOne
+	}
 
 	// ensure db file path exists
 	if _, err := os.Stat(opts.DBFile); os.IsNotExist(err) {
@@ -61,40 +182,133 @@ func NewFileServer(opts FileServerOpts) *FileServer {
 		dbHandler:         dbHandle,
 	}
 
-	return &FileServer{
+	s := &FileServer{
 		FileServerOpts: opts,
 		store:          NewStore(storeOpts),
 		quitch:         make(chan struct{}),
+		pending:        newPendingRequests(),
 		// TODO: add peers via channel
-		peers: make(map[string]p2p.Peer),
+		peers:   make(map[string]p2p.Peer),
+		dialing: make(map[string]time.Time),
+		usage:   make(map[string]int64),
+
+		capacity: make(map[string]int64),
+
+		draining: make(map[string]bool),
+		offline:  make(map[string]offlineNode),
+
+		inventories: make(map[string]*merkle.Tree),
 	}
+	s.repair.limiter = newRateLimiter(opts.RepairBandwidth)
+	s.rebalance.limiter = newRateLimiter(opts.RebalanceBandwidth)
+	if err := s.loadKeys(); err != nil {
+		log.Fatalf("Failed to load keys: %v", err)
+	}
+	if draining, _ := dbHandle.Draining(); draining {
+		// Interrupted, Drain resumes it
+		s.drain.active.Store(true)
+	}
+	dbHandle.onUpdate = func(fmd FileMetadata) {
+		go s.publishMetadata([]FileMetadata{fmd})
+	}
+	s.ring = hashring.New(0)
+	s.ring.Add(s.ID, s.Weight)
+	if p, ok := s.Placement.(HashPlacement); ok && p.Ring == nil {
+		s.Placement = HashPlacement{Ring: s.ring}
+	}
+
+	s.dht = dht.New(dht.Opts{
+		Self:    s.self(),
+		Network: dhtNetwork{s: s},
+	})
+	return s
 }
 
 func (s *FileServer) broadcast(msg *Message) error {
-	buf := new(bytes.Buffer)
-
-	if err := gob.NewEncoder(buf).Encode(&msg); err != nil {
+	payload, err := encodeMessage(msg)
+	if err != nil {
 		return err
 	}
-	for _, peer := range s.peers {
-		if err := peer.Send([]byte{p2p.IncommingMessageT}); err != nil {
-			return err
-		}
-		if err := peer.Send(buf.Bytes()); err != nil {
-			return err
+	// A single unreachable peer shouldn't abort the whole operation
+	for _, peer := range s.peerList() {
+		if err := peer.Send(payload); err != nil {
+			log.Printf("[%s] failed to send to peer (%s): %v", s.Transport.Addr(), peer.ID(), err)
 		}
 	}
 	return nil
 }
 
+// peerList returns a snapshot of the currently connected peers.
+func (s *FileServer) peerList() []p2p.Peer {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peers := make([]p2p.Peer, 0, len(s.peers))
+	for _, peer := range s.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// peerIDs returns the IDs of the given peers.
+func peerIDs(peers []p2p.Peer) []string {
+	ids := make([]string, len(peers))
+	for i, peer := range peers {
+		ids[i] = peer.ID()
+	}
+	return ids
+}
+
+func encodeMessage(msg *Message) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeMessage writes msg as a single frame, used to announce what a stream carries.
+func writeMessage(w io.Writer, msg *Message) error {
+	payload, err := encodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	return p2p.WriteFrame(w, p2p.IncommingMessageT, payload)
+}
+
+// readMessage reads a single message frame written by writeMessage.
+func readMessage(r io.Reader) (*Message, error) {
+	_, payload, err := p2p.ReadFrame(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	var msg Message
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// ErrFileNotFound is returned when neither this node nor any of its peers hold a file.
+var ErrFileNotFound = errors.New("file not found")
+
 type Message struct {
-	Payload any
+	// RequestID correlates a response with the request it answers.
+	RequestID string
+	Payload   any
 }
 
 type MessageStoreFile struct {
 	ID   string
 	Key  string
 	Size int64
+	// Hint is set when the receiver stands in for a node that couldn't be reached,
+	// it holds the object until it can hand it to that node.
+	Hint string
+	// Proof is the owner's consent for the object to be handed to the node it's meant
+	// for, see HintProof. Other nodes only store the objects of the sender otherwise,
+	// or those of any node while the sender is draining.
+	Proof *HintProof
 }
 
 type MessageGetFile struct {
@@ -102,131 +316,559 @@ type MessageGetFile struct {
 	Key string
 }
 
+// MessageGetFileResponse answers a MessageGetFile. When the file was found it is
+// sent at the start of a stream, followed by Size bytes of file data.
+type MessageGetFileResponse struct {
+	Key      string
+	Size     int64
+	NotFound bool
+	Err      string
+}
+
+// MessagePeerExchange carries the peers a node is connected to, so the receiver can connect to them too.
+type MessagePeerExchange struct {
+	Peers []p2p.PeerInfo
+}
+
+// MessageWeight tells peers the weight of a node on the hash ring.
+type MessageWeight struct {
+	Weight int
+}
+
+// MessageUsage tells peers how much storage a node is using, for placement decisions.
+type MessageUsage struct {
+	Used int64
+	// Capacity is the storage the node offers, 0 means no limit.
+	Capacity int64
+}
+
 type MessageDeleteFile struct {
 	ID  string
 	Key string
 }
 
+// Get fetches the file, waiting at most RequestTimeout for the network.
 func (s *FileServer) Get(key string) (io.Reader, error) {
-	if s.store.Has(s.ID, key) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.RequestTimeout)
+	defer cancel()
+
+	return s.GetContext(ctx, key)
+}
+
+// GetContext reassembles the file from its chunks, fetching the manifest and the chunks
+// we don't have on disk from the first peer holding them.
+// Each fetch returns as soon as a replica answered, every peer reported a miss or ctx is done.
+func (s *FileServer) GetContext(ctx context.Context, key string) (io.Reader, error) {
+	return s.GetConsistency(ctx, key, s.ReadConsistency)
+}
+
+// GetConsistency is GetContext reading the manifest from as many replicas as level asks
+// for, and only succeeding if they agree. Chunks are addressed by their content, a
+// single copy of them is enough.
+func (s *FileServer) GetConsistency(ctx context.Context, key string, level Consistency) (io.Reader, error) {
+	if level == 0 {
+		level = s.ReadConsistency
+	}
+	replicas := s.ReplicationFactor
+	fmd, _ := s.store.dbHandler.GetFileMetadata(key)
+	if fmd != nil && fmd.Replicas > 0 {
+		replicas = fmd.Replicas
+	}
+	dataKey, err := s.dataKey(fmd)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] get (%s): %w", s.Transport.Addr(), key, err)
+	}
+
+	had := s.store.Has(s.ID, key)
+	switch {
+	case level.required(replicas, 1) > 1:
+		var locations []string
+		if fmd != nil {
+			locations = fmd.ReplicaLocations
+		}
+		if err := s.readQuorum(ctx, key, dataKey, legacyFormat(fmd), level.required(replicas, 1), locations); err != nil {
+			return nil, fmt.Errorf("[%s] get (%s): %w", s.Transport.Addr(), key, err)
+		}
+	case had:
 		log.Printf("[%s] serving file [%s] localy\n", s.Transport.Addr(), key)
-		_, r, err := s.store.Read(s.ID, key)
+	default:
+		log.Printf("[%s] don't have file [%s] localy, fetching from network...\n", s.Transport.Addr(), key)
+
+		if err := s.fetch(ctx, key, crypto.HashKey(key), dataKey, legacyFormat(fmd), nil); err != nil {
+			return nil, fmt.Errorf("[%s] get (%s): %w", s.Transport.Addr(), key, err)
+		}
+	}
+	if !had {
+		// Update the file metadata
+		if err := s.store.dbHandler.AddLocalMetaDataToExistingKey(key, s.ID); err != nil {
+			fmt.Printf("Error updating file metadata: %v", err)
+		}
+		go s.provide(s.ID, crypto.HashKey(key))
+	}
 
+	m, err := s.readManifest(key)
+	if errors.Is(err, errNotManifest) {
+		// Stored as a single blob before chunking
+		_, r, err := s.store.Read(s.ID, key)
 		return r, err
 	}
+	if err != nil {
+		return nil, err
+	}
 
-	log.Printf("[%s] don't have file [%s] localy, fetching from network...\n", s.Transport.Addr(), key)
+	for _, c := range m.Chunks {
+		if m.EC != nil {
+			fetched, err := s.fetchShards(ctx, m, c)
+			if err != nil {
+				return nil, fmt.Errorf("[%s] get (%s) chunk (%s): %w", s.Transport.Addr(), key, c.Hash, err)
+			}
+			for _, shard := range fetched {
+				go s.provide(s.ID, shard)
+			}
+			continue
+		}
+		if s.store.Has(s.ID, chunkKey(c.Hash)) {
+			continue
+		}
+		verify := func() error { return s.verifyChunk(c) }
+		if err := s.fetch(ctx, chunkKey(c.Hash), chunkKey(c.Hash), c.encKey(s.masterKey()), false, verify); err != nil {
+			return nil, fmt.Errorf("[%s] get (%s) chunk (%s): %w", s.Transport.Addr(), key, c.Hash, err)
+		}
+		go s.provide(s.ID, chunkKey(c.Hash))
+	}
+	return s.chunkReader(m), nil
+}
+
+// fetch downloads our object remoteKey from the first peer holding it, decrypts it with encKey
+// and writes it to disk as localKey. When given, verify checks what was received, a failure
+// moves on to the next peer. Only legacy objects may be unauthenticated, see legacyFormat.
+func (s *FileServer) fetch(ctx context.Context, localKey, remoteKey string, encKey []byte, legacy bool, verify func() error) error {
+	// Only ask the nodes the DHT knows to hold the object
+	peers := s.providerPeers(ctx, s.ID, remoteKey)
+	reqID, respch := s.pending.register(peerIDs(peers))
+	defer s.pending.finish(reqID, respch)
 
 	msg := Message{
+		RequestID: reqID,
 		Payload: MessageGetFile{
 			ID:  s.ID,
-			Key: crypto.HashKey(key),
+			Key: remoteKey,
 		},
 	}
 
-	if err := s.broadcast(&msg); err != nil {
-		return nil, err
+	for _, peer := range peers {
+		if err := s.send(peer, &msg); err != nil {
+			log.Printf("[%s] failed to send to peer (%s): %v", s.Transport.Addr(), peer.ID(), err)
+		}
 	}
 
-	time.Sleep(500 * time.Millisecond)
-	// Open stream
-	for _, peer := range s.peers {
-		// n, err := s.store.writeStream(key, peer)
-		// First read the filesize to limit amount of bytes read
-		// to avoid hanging on the stream
-		var fileSize int64
-		binary.Read(peer, binary.LittleEndian, &fileSize)
-		// n, err := s.store.Write(key, io.LimitReader(peer, fileSize))
-		n, err := s.store.WriteDecrypt(s.EncKey, s.ID, key, io.LimitReader(peer, fileSize))
+	for answered := 0; answered < len(peers); answered++ {
+		var resp peerResponse
+		select {
+		case resp = <-respch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		n, err := s.receiveFile(ctx, localKey, encKey, legacy, resp)
+		if err == nil && verify != nil {
+			if err = verify(); err != nil {
+				s.store.discard(s.ID, localKey)
+			}
+		}
 		if err != nil {
-			log.Printf("[%s] failed to write to disk: %v", s.Transport.Addr(), err)
-			return nil, err
+			log.Printf("[%s] failed to fetch (%s) from (%s): %v", s.Transport.Addr(), localKey, resp.From, err)
+			continue
 		}
-		log.Printf("[%s] received  ([%d]) bytes from (%s)", s.Transport.Addr(), n, peer.RemoteAddr())
-		peer.CloseStream()
+		log.Printf("[%s] received  ([%d]) bytes from (%s)", s.Transport.Addr(), n, resp.From)
+		return nil
 	}
-	_, r, err := s.store.Read(s.ID, key)
-	if err == nil {
-		// Update the file metadata
-		if err := s.store.dbHandler.AddLocalMetaDataToExistingKey(key, s.Transport.Addr()); err != nil {
-			fmt.Printf("Error updating file metadata: %v", err)
+
+	return ErrFileNotFound
+}
+
+// receiveFile decrypts the file carried by a peer's response with encKey and writes it to disk.
+func (s *FileServer) receiveFile(ctx context.Context, key string, encKey []byte, legacy bool, resp peerResponse) (int64, error) {
+	v, _ := resp.Msg.Payload.(MessageGetFileResponse)
+	if resp.Stream == nil {
+		if v.NotFound {
+			return 0, ErrFileNotFound
 		}
+		return 0, errors.New(v.Err)
+	}
+	defer resp.Stream.Close()
+
+	// Abort the transfer if the caller gives up
+	stop := context.AfterFunc(ctx, func() { resp.Stream.Close() })
+	defer stop()
+
+	n, err := s.store.WriteDecrypt(encKey, legacy, s.ID, key, io.LimitReader(resp.Stream, v.Size))
+	if err == nil && n != v.Size {
+		err = io.ErrUnexpectedEOF
 	}
-	return r, err
+	if err != nil {
+		// Don't leave a partial file around to be served later
+		s.store.discard(s.ID, key)
+	}
+	return n, err
 }
 
+// Store writes the file to disk and replicates it to our peers, keeping ReplicationFactor copies,
+// or erasure codes it when ErasureCoding is set. It succeeds once WriteConsistency copies are on disk.
 func (s *FileServer) Store(key string, r io.Reader) error {
-	// // 1. Store this file to disk
-	// // 2. Broadcast this file to all known peers in the network
-	var (
-		fileBuffer = new(bytes.Buffer)
-		tee        = io.TeeReader(r, fileBuffer)
-	)
+	return s.StoreWith(key, r, WriteOptions{})
+}
+
+// StoreReplicas is Store with an explicit number of copies, ours included.
+func (s *FileServer) StoreReplicas(key string, r io.Reader, replicas int) error {
+	if replicas < 1 {
+		return fmt.Errorf("invalid number of replicas: %d", replicas)
+	}
+	return s.StoreWith(key, r, WriteOptions{Replicas: replicas})
+}
 
-	size, err := s.store.Write(s.ID, key, tee)
+// StoreEC is Store with erasure coding: every chunk is split into k data and m parity
+// shards held by k+m distinct nodes, any k of them are enough to read it back.
+// The manifest is small and gets m+1 full copies instead, surviving as many failures.
+func (s *FileServer) StoreEC(key string, r io.Reader, ec erasure.Scheme) error {
+	return s.StoreWith(key, r, WriteOptions{EC: &ec})
+}
+
+// WriteOptions tune a single Store, zero values fall back to the server's settings.
+type WriteOptions struct {
+	// Replicas is the number of copies, ours included.
+	Replicas int
+	// EC erasure codes the file instead of replicating it.
+	EC *erasure.Scheme
+	// Consistency is how many copies must be acknowledged on disk for the store to succeed.
+	Consistency Consistency
+}
+
+// StoreWith is Store with the given options.
+func (s *FileServer) StoreWith(key string, r io.Reader, opts WriteOptions) error {
+	if opts.Consistency == 0 {
+		opts.Consistency = s.WriteConsistency
+	}
+	if opts.Replicas == 0 && opts.EC == nil {
+		opts.Replicas = s.ReplicationFactor
+		opts.EC = s.ErasureCoding
+	}
+	if opts.EC != nil {
+		if err := opts.EC.Validate(); err != nil {
+			return err
+		}
+		return s.storeChunks(key, r, opts.EC.Parity+1, opts.EC, opts.Consistency)
+	}
+	if opts.Replicas < 1 {
+		return fmt.Errorf("invalid number of replicas: %d", opts.Replicas)
+	}
+	return s.storeChunks(key, r, opts.Replicas, nil, opts.Consistency)
+}
+
+// storeChunks splits the file into content-defined chunks, each stored under its content
+// hash and placed on its own set of peers, either as replicas or as erasure coded shards.
+// Chunks we already hold, from this file or any other, are only referenced again.
+// A manifest listing the chunks is stored under key, with replicas copies.
+// Every object must be acknowledged by as many nodes as level asks for.
+func (s *FileServer) storeChunks(key string, r io.Reader, replicas int, ec *erasure.Scheme, level Consistency) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.RequestTimeout)
+	defer cancel()
+
+	// New keys are wrapped with the master key, which can't change until we're done
+	s.keys.rotate.RLock()
+	defer s.keys.rotate.RUnlock()
+
+	// Replacing a file releases the chunks of its previous version, and keeps its data key
+	previous, _ := s.readManifest(key)
+	var dataKey, wrappedKey []byte
+	var keyVersion int
+	if fmd, _ := s.store.dbHandler.GetFileMetadata(key); fmd != nil && fmd.DataKey != nil {
+		wrappedKey, keyVersion = fmd.DataKey, fmd.KeyVersion
+		dataKey, err = s.dataKey(fmd)
+	} else {
+		dataKey, wrappedKey, keyVersion, err = s.newDataKey()
+	}
 	if err != nil {
 		return err
 	}
 
-	msg := Message{
-		Payload: MessageStoreFile{
-			ID:   s.ID,
-			Key:  crypto.HashKey(key),
-			Size: size + 16, /* IV size */
-		},
+	m := &Manifest{ChunkSize: s.ChunkSize, EC: ec}
+	defer func() {
+		// Don't leave references to a file that never made it
+		if err != nil {
+			s.releaseChunks(ctx, m)
+		}
+	}()
+
+	// Replicas are tracked by node ID, which survives restarts and redials
+	replicaLocs := []string{s.ID /* Local replica */}
+	addLocs := func(peers []p2p.Peer) {
+		for _, peer := range peers {
+			if !slices.Contains(replicaLocs, peer.ID()) {
+				replicaLocs = append(replicaLocs, peer.ID())
+			}
+		}
+	}
+	var shardLocs [][]string
+	if ec != nil {
+		shardLocs = make([][]string, ec.Total())
 	}
 
-	if err := s.broadcast(&msg); err != nil {
+	// Only a few chunks are held in memory at a time
+	chunks, err := chunker.New(r, chunker.NewOpts(s.ChunkSize))
+	if err != nil {
 		return err
 	}
+	for {
+		data, err := chunks.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
 
-	time.Sleep(5 * time.Millisecond)
+		c := ChunkRef{Hash: chunkHash(s.keys.hashKey(), data), Size: int64(len(data))}
+		refs, err := s.store.dbHandler.AddChunkRef(m.ref(c))
+		if err != nil {
+			return err
+		}
+		if c.Key, err = s.chunkDataKey(m.ref(c), refs); err != nil {
+			s.store.dbHandler.ReleaseChunkRef(m.ref(c))
+			return err
+		}
+		m.Chunks = append(m.Chunks, c)
+		m.Size += c.Size
 
-	peers := []io.Writer{}
+		if ec != nil {
+			// Shards referenced before are already spread
+			if refs > 1 {
+				continue
+			}
+			peers, err := s.storeShards(ctx, m.ref(c), c.encKey(s.masterKey()), data, *ec, level.required(ec.Total(), ec.Data))
+			if err != nil {
+				return err
+			}
+			shardLocs[0] = appendLoc(shardLocs[0], s.ID)
+			for i, peer := range peers {
+				if peer != nil {
+					addLocs([]p2p.Peer{peer})
+					shardLocs[i+1] = appendLoc(shardLocs[i+1], peer.ID())
+				}
+			}
+			continue
+		}
 
-	for _, peer := range s.peers {
-		peers = append(peers, peer)
+		if !s.store.Has(s.ID, chunkKey(c.Hash)) {
+			if _, err := s.store.WriteSync(s.ID, chunkKey(c.Hash), bytes.NewReader(data)); err != nil {
+				return err
+			}
+			go s.provide(s.ID, chunkKey(c.Hash))
+		}
+		// Chunks referenced before are already replicated
+		if refs > 1 {
+			continue
+		}
+		peers, err := s.replicate(ctx, chunkKey(c.Hash), c.encKey(s.masterKey()), data, replicas-1, level.required(replicas, 1)-1)
+		if err != nil {
+			return err
+		}
+		addLocs(peers)
 	}
-	mw := io.MultiWriter(peers...)
-	mw.Write([]byte{p2p.IncomingStreamT})
-	n, err := crypto.CopyEncrypt(s.EncKey, fileBuffer, mw)
+
+	manifest, err := m.encode()
 	if err != nil {
 		return err
 	}
-
-	replicaLocs := []string{}
-	replicaLocs = append(replicaLocs, s.Transport.Addr() /* Local replica */)
-	for _, peer := range s.peers {
-		replicaLocs = append(replicaLocs, peer.RemoteAddr().String())
+	if _, err := s.store.WriteSync(s.ID, key, bytes.NewReader(manifest)); err != nil {
+		return err
+	}
+	peers, err := s.replicate(ctx, crypto.HashKey(key), dataKey, manifest, replicas-1, level.required(replicas, 1)-1)
+	if err != nil {
+		return err
 	}
+	addLocs(peers)
 
 	fmd := &FileMetadata{
 		Key:              key,
-		Size:             size + 16, /* IV size */
-		Replicas:         len(s.peers) + 1,
+		Size:             m.Size,
+		Replicas:         replicas,
 		ReplicaLocations: replicaLocs,
+		ShardLocations:   shardLocs,
+		DataKey:          wrappedKey,
+		KeyVersion:       keyVersion,
+		Format:           crypto.VersionGCM,
+	}
+	if ec != nil {
+		fmd.ErasureCoding = ec.String()
 	}
 
 	if _, err := s.store.dbHandler.UpdateFile(*fmd); err != nil {
 		return err
 	}
-	log.Printf("[%s] received and written: (%d) bytes\n", s.Transport.Addr(), n)
+	go s.provide(s.ID, crypto.HashKey(key))
+	if previous != nil {
+		s.releaseChunks(ctx, previous)
+	}
+	log.Printf("[%s] received and written: (%d) bytes in (%d) chunks\n", s.Transport.Addr(), m.Size, len(m.Chunks))
 
 	return nil
 }
 
-func (s *FileServer) Delete(key string) error {
-	msg := Message{
-		Payload: MessageDeleteFile{
-			ID:  s.ID,
-			Key: crypto.HashKey(key),
-		},
+// replicate encrypts data with encKey and sends it to n peers picked by the placement policy,
+// which store it as remoteKey. Peers failing to acknowledge it are replaced by others
+// while there are any left, they hold the copy until they can hand it off.
+// It fails if fewer than required peers have it on disk.
+func (s *FileServer) replicate(ctx context.Context, remoteKey string, encKey []byte, data []byte, n, required int) ([]p2p.Peer, error) {
+	var (
+		acked []p2p.Peer
+		tried []string
+		// unreachable are the peers the copies still to place are meant for
+		unreachable []string
+		errs        []error
+	)
+	for len(acked) < n {
+		// The nodes the remaining copies belong to, those offline get theirs through a stand-in
+		owners, offline := s.place(remoteKey, n-len(acked)-len(unreachable), int64(len(data)), true, tried...)
+		tried = append(tried, offline...)
+		unreachable = append(unreachable, offline...)
+		for _, peer := range owners {
+			tried = append(tried, peer.ID())
+		}
+		standIns := s.placeReplicas(remoteKey, min(len(unreachable), n-len(acked)-len(owners)), int64(len(data)), tried...)
+		for _, peer := range standIns {
+			tried = append(tried, peer.ID())
+		}
+		peers := append(standIns, owners...)
+		if len(peers) == 0 {
+			break
+		}
+		hints := unreachable[:len(standIns)]
+		unreachable = unreachable[len(hints):]
+
+		ok, err := s.sendObject(ctx, peers, remoteKey, encKey, data, hints...)
+		if err != nil {
+			log.Printf("[%s] failed to replicate (%s): %v", s.Transport.Addr(), remoteKey, err)
+			errs = append(errs, err)
+		}
+		acked = append(acked, ok...)
+		for i, peer := range peers {
+			if slices.Contains(ok, peer) {
+				continue
+			}
+			if i < len(hints) {
+				// The stand-in failed too, the copy is still meant for the original peer
+				unreachable = append(unreachable, hints[i])
+			} else {
+				unreachable = append(unreachable, peer.ID())
+			}
+		}
+	}
+	if len(acked) < required {
+		err := fmt.Errorf("%w: (%s) acknowledged by %d of %d peers", ErrNoQuorum, remoteKey, len(acked), required)
+		if len(errs) > 0 {
+			err = fmt.Errorf("%w: %w", err, errors.Join(errs...))
+		}
+		return acked, err
+	}
+	return acked, nil
+}
+
+// sendObject encrypts data with encKey and stores it on peers under our remoteKey. When given, hints[i] is
+// the unreachable node peers[i] holds its copy for. It returns the peers that acknowledged
+// having it on disk, the error tells what happened to the others.
+func (s *FileServer) sendObject(ctx context.Context, peers []p2p.Peer, remoteKey string, encKey []byte, data []byte, hints ...string) ([]p2p.Peer, error) {
+	var buf bytes.Buffer
+	if _, err := crypto.CopyEncrypt(encKey, bytes.NewReader(data), &buf); err != nil {
+		return nil, err
+	}
+
+	errs := make([]error, len(peers))
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		v := MessageStoreFile{
+			ID:   s.ID,
+			Key:  remoteKey,
+			Size: int64(buf.Len()),
+		}
+		if i < len(hints) {
+			v.Hint = hints[i]
+			v.Proof = s.signHint(remoteKey, hints[i], buf.Bytes())
+		}
+		msg := Message{Payload: v}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.sendObjectTo(ctx, peer, &msg, buf.Bytes()); err != nil {
+				errs[i] = fmt.Errorf("peer (%s): %w", peer.ID(), err)
+			}
+		}()
 	}
-	log.Printf("[%s] broadcasting delete message for file (%s)\n", s.Transport.Addr(), key)
-	if err := s.broadcast(&msg); err != nil {
+	wg.Wait()
+
+	var acked []p2p.Peer
+	for i, peer := range peers {
+		if errs[i] == nil {
+			acked = append(acked, peer)
+		}
+	}
+	return acked, errors.Join(errs...)
+}
+
+// sendObjectTo streams an encrypted object to peer and waits for its acknowledgement.
+func (s *FileServer) sendObjectTo(ctx context.Context, peer p2p.Peer, msg *Message, encrypted []byte) error {
+	st, err := peer.OpenStream()
+	if err != nil {
 		return err
 	}
+	defer st.Close()
+
+	stop := context.AfterFunc(ctx, func() { st.Close() })
+	defer stop()
+
+	if err := writeMessage(st, msg); err != nil {
+		return err
+	}
+	if _, err := st.Write(encrypted); err != nil {
+		return err
+	}
+	resp, err := readMessage(st)
+	if err != nil {
+		return fmt.Errorf("no acknowledgement: %w", err)
+	}
+	ack, ok := resp.Payload.(MessageStoreFileAck)
+	if !ok {
+		return fmt.Errorf("unexpected store response: %T", resp.Payload)
+	}
+	if ack.Err != "" {
+		return errors.New(ack.Err)
+	}
+	return nil
+}
+
+// Delete removes the file from this node and from every peer holding it,
+// along with the chunks no other file uses.
+func (s *FileServer) Delete(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.RequestTimeout)
+	defer cancel()
+
+	// We need the manifest to know which chunks to release
+	if !s.store.Has(s.ID, key) {
+		fmd, _ := s.store.dbHandler.GetFileMetadata(key)
+		dataKey, err := s.dataKey(fmd)
+		if err == nil {
+			err = s.fetch(ctx, key, crypto.HashKey(key), dataKey, legacyFormat(fmd), nil)
+		}
+		if err != nil {
+			log.Printf("[%s] failed to fetch manifest of (%s): %v", s.Transport.Addr(), key, err)
+		}
+	}
+
+	log.Printf("[%s] sending delete message for file (%s)\n", s.Transport.Addr(), key)
+	s.deleteRemote(ctx, crypto.HashKey(key))
+
 	if !s.store.Has(s.ID, key) {
+		s.unprovide(s.ID, crypto.HashKey(key))
 		// try deleting the metadata from the db
 		s.store.dbHandler.DeleteFileMetadata(key)
 
@@ -236,7 +878,91 @@ func (s *FileServer) Delete(key string) error {
 	if err := s.store.dbHandler.DeleteFileMetadata(key); err != nil {
 		return err
 	}
-	return s.store.Delete(s.ID, key)
+	if m, err := s.readManifest(key); err == nil {
+		s.releaseChunks(ctx, m)
+	}
+	if err := s.store.Delete(s.ID, key); err != nil {
+		return err
+	}
+	s.unprovide(s.ID, crypto.HashKey(key))
+	return nil
+}
+
+// DeleteLocal removes the file from this node only. The chunks other files
+// still reference stay, the rest can be fetched back from our peers.
+func (s *FileServer) DeleteLocal(key string) error {
+	if m, err := s.readManifest(key); err == nil {
+		uses := make(map[string]uint64)
+		chunks := make(map[string]ChunkRef)
+		for _, c := range m.Chunks {
+			uses[m.ref(c)]++
+			chunks[m.ref(c)] = c
+		}
+		for ref, n := range uses {
+			refs, err := s.store.dbHandler.ChunkRefs(ref)
+			if err != nil {
+				return err
+			}
+			if refs > n {
+				continue
+			}
+			for _, objectKey := range m.objectKeys(chunks[ref]) {
+				if err := s.store.discard(s.ID, objectKey); err != nil && !errors.Is(err, os.ErrNotExist) {
+					return err
+				}
+				s.unprovide(s.ID, objectKey)
+			}
+		}
+	}
+	if err := s.store.Delete(s.ID, key); err != nil {
+		return err
+	}
+	s.unprovide(s.ID, crypto.HashKey(key))
+	return nil
+}
+
+// releaseChunks drops the references of m to its chunks. Chunks no file uses
+// anymore are deleted from this node and from the peers holding them.
+func (s *FileServer) releaseChunks(ctx context.Context, m *Manifest) {
+	for _, c := range m.Chunks {
+		refs, err := s.store.dbHandler.ReleaseChunkRef(m.ref(c))
+		if err != nil {
+			log.Printf("[%s] failed to release chunk (%s): %v", s.Transport.Addr(), c.Hash, err)
+			continue
+		}
+		if refs > 0 {
+			continue
+		}
+
+		for _, objectKey := range m.objectKeys(c) {
+			s.deleteRemote(ctx, objectKey)
+			if err := s.store.discard(s.ID, objectKey); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("[%s] failed to delete chunk (%s): %v", s.Transport.Addr(), c.Hash, err)
+			}
+			s.unprovide(s.ID, objectKey)
+		}
+	}
+}
+
+// deleteRemote asks the peers holding our object remoteKey to delete it.
+func (s *FileServer) deleteRemote(ctx context.Context, remoteKey string) {
+	msg := Message{
+		Payload: MessageDeleteFile{
+			ID:  s.ID,
+			Key: remoteKey,
+		},
+	}
+	for _, peer := range s.providerPeers(ctx, s.ID, remoteKey) {
+		if err := s.send(peer, &msg); err != nil {
+			log.Printf("[%s] failed to send to peer (%s): %v", s.Transport.Addr(), peer.ID(), err)
+		}
+	}
+}
+
+// ReplicaNodes returns the IDs of the n nodes a file belongs to on the hash ring.
+// It only depends on the nodes we know of and their weights, so it's the same on every node.
+func (s *FileServer) ReplicaNodes(key string, n int) []string {
+	return s.ring.Get(crypto.HashKey(key), n)
 }
 
 func (s *FileServer) ListFiles() ([]FileMetadata, error) {
@@ -246,21 +972,268 @@ func (s *FileServer) ListFiles() ([]FileMetadata, error) {
 func (s *FileServer) Stop() {
 	close(s.quitch)
 
+	s.rebalance.lock.Lock()
+	if s.rebalance.timer != nil {
+		s.rebalance.timer.Stop()
+	}
+	s.rebalance.lock.Unlock()
+
 	s.store.dbHandler.Close()
 
-	// return s.Transport.Close()
+	// Release the listen address right away rather than once loop notices quitch
+	s.Transport.Close()
+}
+
+// verifyPeerID lets nodes created before IDs were derived from identity keys keep
+// their legacy ID, bound to the first key it's presented with. See p2p.TCPTransportOpts.
+func (s *FileServer) verifyPeerID(id string, key ed25519.PublicKey) error {
+	if !isLegacyID(id) {
+		return errors.New("not a legacy ID")
+	}
+	return s.store.dbHandler.BindPeerKey(id, key)
 }
 
 func (s *FileServer) OnPeer(p p2p.Peer) error {
 	s.peerLock.Lock()
 	defer s.peerLock.Unlock()
-	s.peers[p.RemoteAddr().String()] = p
+	// A node reconnecting (e.g. after a restart) replaces its stale connection
+	old, ok := s.peers[p.ID()]
+	if ok && old != p {
+		old.Close()
+	}
+	if !ok {
+		// Until the peer tells us its weight
+		s.ring.Add(p.ID(), max(s.offline[p.ID()].weight, 1))
+		s.scheduleRebalance()
+	}
+	s.peers[p.ID()] = p
+	delete(s.dialing, p.ID())
+	delete(s.offline, p.ID())
 
-	log.Printf("Connected with remote: %s", p.RemoteAddr())
-	// TODO: do db exchange here
+	log.Printf("Connected with remote: %s (%s, listening on %s)", p.ID(), p.RemoteAddr(), p.ListenAddr())
+	if len(p.ListenAddr()) > 0 {
+		s.dht.Table().Update(dht.NewContact(p.ID(), p.ListenAddr()))
+	}
+	go s.acceptStreams(p)
+	go s.sharePeers(p)
+	go s.reportUsage(p)
+	go func() {
+		if err := s.send(p, &Message{Payload: MessageWeight{Weight: s.Weight}}); err != nil {
+			log.Printf("[%s] failed to send weight to (%s): %v", s.Transport.Addr(), p.ID(), err)
+		}
+	}()
+	go s.announcePeer(p)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), s.RequestTimeout)
+		defer cancel()
+		if _, err := s.syncInventory(ctx, p); err != nil {
+			log.Printf("[%s] failed to sync inventory with (%s): %v", s.Transport.Addr(), p.ID(), err)
+		}
+	}()
+	go s.syncMetadata(p)
+	go s.deliverHints(p)
+	if s.Draining() {
+		go func() {
+			if err := s.send(p, &Message{Payload: MessageDrain{Draining: true}}); err != nil {
+				log.Printf("[%s] failed to tell (%s) we're draining: %v", s.Transport.Addr(), p.ID(), err)
+			}
+		}()
+	}
 	return nil
 }
 
+// placeReplicas picks n peers to receive a copy of the file, as many as we have if there aren't enough.
+// The peers in exclude, e.g. already holding the file, aren't picked.
+func (s *FileServer) placeReplicas(key string, n int, size int64, exclude ...string) []p2p.Peer {
+	peers, _ := s.place(key, n, size, false, exclude...)
+	return peers
+}
+
+// place is placeReplicas, also placing copies on the ring nodes we lost the connection to
+// less than hintWindow ago when withOffline is set and keys are placed on the hash ring.
+// The IDs of those nodes are returned apart, their copies have to go through a stand-in.
+func (s *FileServer) place(key string, n int, size int64, withOffline bool, exclude ...string) ([]p2p.Peer, []string) {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	candidates := make([]Candidate, 0, len(s.peers))
+	for id := range s.peers {
+		if slices.Contains(exclude, id) || s.draining[id] {
+			continue
+		}
+		c := Candidate{ID: id, Used: s.usage[id], Capacity: s.capacity[id]}
+		if !c.fits(size) {
+			continue
+		}
+		candidates = append(candidates, c)
+	}
+	policy := s.Placement
+	if p, ok := policy.(HashPlacement); ok && p.Ring != nil && withOffline {
+		var ring *hashring.Ring
+		for id, node := range s.offline {
+			if time.Since(node.since) > hintWindow {
+				delete(s.offline, id)
+				continue
+			}
+			if slices.Contains(exclude, id) {
+				continue
+			}
+			if ring == nil {
+				ring = p.Ring.Clone()
+			}
+			ring.Add(id, node.weight)
+			candidates = append(candidates, Candidate{ID: id})
+		}
+		if ring != nil {
+			policy = HashPlacement{Ring: ring}
+		}
+	}
+	if len(candidates) < n {
+		log.Printf("[%s] only %d peers available for %d replicas of (%s)", s.Transport.Addr(), len(candidates), n, key)
+	}
+
+	var (
+		peers   []p2p.Peer
+		offline []string
+	)
+	for _, c := range policy.Place(key, candidates, n) {
+		peer, ok := s.peers[c.ID]
+		if !ok {
+			if _, ok := s.offline[c.ID]; ok {
+				offline = append(offline, c.ID)
+			}
+			continue
+		}
+		// Count the replica right away, so stores in a row don't all pick the same peer
+		s.usage[c.ID] += size
+		peers = append(peers, peer)
+	}
+	return peers, offline
+}
+
+// reportUsage tells peers how much storage we're using.
+func (s *FileServer) reportUsage(peers ...p2p.Peer) {
+	used, err := s.store.Usage()
+	if err != nil {
+		log.Printf("[%s] failed to compute storage usage: %v", s.Transport.Addr(), err)
+		return
+	}
+
+	msg := &Message{
+		Payload: MessageUsage{Used: used, Capacity: s.Capacity},
+	}
+	for _, peer := range peers {
+		if err := s.send(peer, msg); err != nil {
+			log.Printf("[%s] failed to report usage to (%s): %v", s.Transport.Addr(), peer.ID(), err)
+		}
+	}
+}
+
+// OnPeerDisconnect forgets a peer whose connection is gone and, when we can reach it, dials it back.
+func (s *FileServer) OnPeerDisconnect(p p2p.Peer) {
+	s.peerLock.Lock()
+	current, ok := s.peers[p.ID()]
+	if ok && current == p {
+		// Until it's back, copies meant for it are handed to a stand-in. Not
+		// for a node retiring itself, it isn't coming back
+		if !s.draining[p.ID()] {
+			s.offline[p.ID()] = offlineNode{weight: s.ring.Weight(p.ID()), since: time.Now()}
+		}
+		delete(s.peers, p.ID())
+		delete(s.usage, p.ID())
+		delete(s.capacity, p.ID())
+		s.ring.Remove(p.ID())
+	}
+	s.peerLock.Unlock()
+
+	// Nothing to do if the peer has already been replaced by a newer connection
+	if !ok || current != p {
+		return
+	}
+	log.Printf("Disconnected from remote: %s", p.ID())
+	s.scheduleRebalance()
+
+	// Both sides redial, the one with the greater ID only after redialDelay: most of
+	// the time the other side is back first, and no duplicate connection is dialed
+	if addr := p.ListenAddr(); len(addr) > 0 {
+		var delay time.Duration
+		if s.ID > p.ID() {
+			delay = redialDelay
+		}
+		go func() {
+			select {
+			case <-time.After(delay):
+			case <-s.quitch:
+				return
+			}
+			s.dialWithRetry(addr, 0, func() bool {
+				_, ok := s.peer(p.ID())
+				return ok
+			})
+		}()
+	}
+}
+
+// acceptStreams serves the streams opened by a peer until its connection goes away.
+func (s *FileServer) acceptStreams(p p2p.Peer) {
+	for {
+		st, err := p.AcceptStream()
+		if err != nil {
+			return
+		}
+		go s.handleStream(p, st)
+	}
+}
+
+// handleStream reads the message announcing what the stream carries and dispatches it.
+func (s *FileServer) handleStream(p p2p.Peer, st p2p.Stream) {
+	from := p.ID()
+	msg, err := readMessage(st)
+	if err != nil {
+		log.Printf("Failed to decode stream message: %v", err)
+		st.Close()
+		return
+	}
+
+	switch v := msg.Payload.(type) {
+	case MessageGetFileResponse:
+		// The waiting request takes ownership of the stream
+		if s.pending.resolve(msg.RequestID, peerResponse{From: from, Msg: msg, Stream: st}) {
+			return
+		}
+		err = fmt.Errorf("no pending request (%s) for file (%s)", msg.RequestID, v.Key)
+	case MessageStoreFile:
+		fmt.Printf("Received data message: %+v\n", v)
+		err = s.handleMessageStoreFile(from, v, st)
+	case MessageDHTRequest:
+		err = s.handleMessageDHTRequest(from, v, st)
+	case MessageInventory:
+		err = s.handleMessageInventory(from, v, st)
+	case MessageEscrow:
+		err = s.handleMessageEscrow(p, v, st)
+	default:
+		err = fmt.Errorf("unexpected stream message: %T", v)
+	}
+	st.Close()
+
+	if err != nil {
+		log.Printf("Failed to handle stream message: %v", err)
+	}
+}
+
+// peer returns the connected peer with the given address.
+func (s *FileServer) peer(addr string) (p2p.Peer, bool) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	p, ok := s.peers[addr]
+	return p, ok
+}
+
 func (s *FileServer) loop() {
 	defer func() {
 		log.Printf("Shutting down server from error or user quit action")
@@ -288,28 +1261,65 @@ func (s *FileServer) loop() {
 
 func (s *FileServer) handleMessage(from string, msg *Message) error {
 	switch v := msg.Payload.(type) {
-	case MessageStoreFile:
-		fmt.Printf("Received data message: %+v\n", v)
-		return s.handleMessageStoreFile(from, v)
 	case MessageGetFile:
 		fmt.Printf("Received get message: %+v\n", v)
-		return s.handleMessageGetFile(from, v)
+		// Serve in the background so a large transfer doesn't hold up other messages
+		go func() {
+			if err := s.handleMessageGetFile(from, msg.RequestID, v); err != nil {
+				log.Printf("Failed to handle get message: %v", err)
+			}
+		}()
+	case MessageGetFileResponse:
+		if !s.pending.resolve(msg.RequestID, peerResponse{From: from, Msg: msg}) {
+			return fmt.Errorf("no pending request (%s) for file (%s)", msg.RequestID, v.Key)
+		}
 	case MessageDeleteFile:
 		fmt.Printf("Received delete message: %+v\n", v)
 		return s.handleMessageDeleteFile(from, v)
+	case MessagePeerExchange:
+		return s.handleMessagePeerExchange(from, v)
+	case MessageWeight:
+		s.peerLock.Lock()
+		if _, ok := s.peers[from]; ok {
+			s.ring.Add(from, v.Weight)
+		}
+		s.peerLock.Unlock()
+	case MessageUsage:
+		s.peerLock.Lock()
+		s.usage[from] = v.Used
+		s.capacity[from] = v.Capacity
+		s.peerLock.Unlock()
+	case MessageMetadata:
+		return s.handleMessageMetadata(from, v)
+	case MessageDrain:
+		return s.handleMessageDrain(from, v)
 	}
 	return nil
 }
 
-func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error {
+func (s *FileServer) handleMessageGetFile(from string, reqID string, msg MessageGetFile) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("received message from unknown peer: %s", from)
+	}
+
+	resp := Message{
+		RequestID: reqID,
+		Payload:   MessageGetFileResponse{Key: msg.Key},
+	}
+
 	if !s.store.Has(msg.ID, msg.Key) {
+		resp.Payload = MessageGetFileResponse{Key: msg.Key, NotFound: true}
+		if err := s.send(peer, &resp); err != nil {
+			return err
+		}
 		return fmt.Errorf("[%s] needs to serve (%s), but it does not exist on disk", s.Transport.Addr(), msg.Key)
 	}
 
-	log.Printf("[%s] Sending file (%s) to peer (%s)\n", s.Transport.Addr(), msg.Key, from)
-
 	fileSize, r, err := s.store.Read(msg.ID, msg.Key)
 	if err != nil {
+		resp.Payload = MessageGetFileResponse{Key: msg.Key, Err: err.Error()}
+		s.send(peer, &resp)
 		return err
 	}
 	if rc, ok := r.(io.ReadCloser); ok {
@@ -317,81 +1327,253 @@ func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error
 		// defer fmt.Println("Closed file")
 	}
 
-	peer, ok := s.peers[from]
-	if !ok {
-		return fmt.Errorf("received message from unknown peer: %s", from)
+	log.Printf("[%s] Sending file (%s) to peer (%s)\n", s.Transport.Addr(), msg.Key, from)
+
+	st, err := peer.OpenStream()
+	if err != nil {
+		return err
 	}
+	defer st.Close()
 
-	// First send the "incomingStream" byte to the peer,
-	// then send the filesize (int64) and finally the file itself
-	peer.Send([]byte{p2p.IncomingStreamT})
-	binary.Write(peer, binary.LittleEndian, fileSize)
-	n, err := io.Copy(peer, r)
+	// First send the response carrying the filesize and then the file itself
+	resp.Payload = MessageGetFileResponse{Key: msg.Key, Size: fileSize}
+	if err := writeMessage(st, &resp); err != nil {
+		return err
+	}
+	n, err := io.Copy(st, r)
 	if err != nil {
 		return err
 	}
 
 	log.Printf("[%s] wrote (%d) bytes to peer (%s)\n", s.Transport.Addr(), n, from)
 	return nil
+}
 
+// send delivers a single message to the peer over the control channel.
+func (s *FileServer) send(peer p2p.Peer, msg *Message) error {
+	payload, err := encodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	return peer.Send(payload)
 }
 
-func (s *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile) error {
-	peer, ok := s.peers[from]
-	if !ok {
-		return fmt.Errorf("received message from unknown peer: %s", from)
+// handleMessageStoreFile writes the object carried by the stream to disk, and
+// acknowledges it on the stream once it's durable.
+func (s *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile, st p2p.Stream) error {
+	if s.Draining() {
+		writeMessage(st, &Message{Payload: MessageStoreFileAck{Key: msg.Key, Err: "node is draining"}})
+		return fmt.Errorf("[%s] refusing (%s) from (%s): draining", s.Transport.Addr(), msg.Key, from)
+	}
+	s.peerLock.Lock()
+	draining := s.draining[from]
+	s.peerLock.Unlock()
+	foreign := msg.ID != from && !draining
+	if foreign && msg.Proof == nil {
+		writeMessage(st, &Message{Payload: MessageStoreFileAck{Key: msg.Key, Err: "not the owner"}})
+		return fmt.Errorf("[%s] refusing (%s) of (%s) from (%s): not the owner", s.Transport.Addr(), msg.Key, msg.ID, from)
+	}
+	held := s.store.Has(msg.ID, msg.Key)
+	if s.Capacity > 0 && !held {
+		if used, err := s.store.Usage(); err == nil && used+msg.Size > s.Capacity {
+			writeMessage(st, &Message{Payload: MessageStoreFileAck{Key: msg.Key, Err: "node is full"}})
+			return fmt.Errorf("[%s] refusing (%s) from (%s): full", s.Transport.Addr(), msg.Key, from)
+		}
+	}
+	var r io.Reader = io.LimitReader(st, msg.Size)
+	if foreign {
+		// The signature covers the object, nothing is written before it's checked
+		data, err := io.ReadAll(r)
+		if err == nil {
+			err = s.verifyHint(msg, data)
+		}
+		if err != nil {
+			writeMessage(st, &Message{Payload: MessageStoreFileAck{Key: msg.Key, Err: "not the owner"}})
+			return fmt.Errorf("[%s] refusing (%s) of (%s) from (%s): %w", s.Transport.Addr(), msg.Key, msg.ID, from, err)
+		}
+		r = bytes.NewReader(data)
+	}
+	n, err := s.store.WriteSync(msg.ID, msg.Key, r)
+	if err == nil && n != msg.Size {
+		err = io.ErrUnexpectedEOF
 	}
-	n, err := s.store.Write(msg.ID, msg.Key, io.LimitReader(peer, msg.Size))
 	if err != nil {
+		s.store.discard(msg.ID, msg.Key)
+		writeMessage(st, &Message{Payload: MessageStoreFileAck{Key: msg.Key, Size: n, Err: err.Error()}})
 		return err
 	}
-	log.Printf("[%s] written (%d) bytes to disk\n", s.Transport.Addr(), n)
-
-	peer.CloseStream()
-	return nil
+	log.Printf("[%s] written (%d) bytes to disk from (%s)\n", s.Transport.Addr(), n, from)
+	if err := s.store.dbHandler.AddHeld(msg.ID, msg.Key); err != nil {
+		log.Printf("[%s] failed to record (%s): %v", s.Transport.Addr(), msg.Key, err)
+	}
+	if msg.Hint != "" && msg.Hint != s.ID {
+		s.recordHint(msg, held)
+	}
+	// The sender only waits for the object to be on disk
+	go s.provide(msg.ID, msg.Key)
+	go s.reportUsage(s.peerList()...)
+	return writeMessage(st, &Message{Payload: MessageStoreFileAck{Key: msg.Key, Size: n}})
 }
 
 func (s *FileServer) handleMessageDeleteFile(from string, msg MessageDeleteFile) error {
+	if msg.ID != from {
+		return fmt.Errorf("[%s] refusing to delete (%s) of (%s) for (%s): not the owner", s.Transport.Addr(), msg.Key, msg.ID, from)
+	}
 	if !s.store.Has(msg.ID, msg.Key) {
 		fmt.Printf("[%s] needs to delete (%s), but it does not exist on disk\n", s.Transport.Addr(), msg.Key)
 		return nil
 	}
 	log.Printf("[%s] deleting file (%s) from disk on request from [%s]\n", s.Transport.Addr(), msg.Key, from)
-	return s.store.Delete(msg.ID, msg.Key)
+	if err := s.store.Delete(msg.ID, msg.Key); err != nil {
+		return err
+	}
+	if err := s.store.dbHandler.RemoveHeld(msg.ID, msg.Key); err != nil {
+		return err
+	}
+	go s.unprovide(msg.ID, msg.Key)
+	go s.reportUsage(s.peerList()...)
+	return nil
 }
 
-func (s *FileServer) bootstrapNetwork() error {
+// sharePeers tells p about the other peers we're connected to.
+func (s *FileServer) sharePeers(p p2p.Peer) {
+	var known []p2p.PeerInfo
+	for _, peer := range s.peerList() {
+		// Peers without a listen address can't be dialed
+		if peer.ID() == p.ID() || len(peer.ListenAddr()) == 0 {
+			continue
+		}
+		known = append(known, p2p.PeerInfo{ID: peer.ID(), ListenAddr: peer.ListenAddr()})
+	}
 
-	maxAttempts := 3                // Maximum number of retry attempts
-	initialDelay := 2 * time.Second // Initial backoff delay
+	msg := &Message{
+		Payload: MessagePeerExchange{Peers: known},
+	}
+	if err := s.send(p, msg); err != nil {
+		log.Printf("[%s] failed to share peers with (%s): %v", s.Transport.Addr(), p.ID(), err)
+	}
+}
 
-	for _, addr := range s.BootStrapNodes {
-		if len(addr) == 0 {
+// announcePeer tells our other peers about a newly connected one.
+func (s *FileServer) announcePeer(p p2p.Peer) {
+	if len(p.ListenAddr()) == 0 {
+		return
+	}
+
+	msg := &Message{
+		Payload: MessagePeerExchange{Peers: []p2p.PeerInfo{{ID: p.ID(), ListenAddr: p.ListenAddr()}}},
+	}
+	payload, err := encodeMessage(msg)
+	if err != nil {
+		log.Printf("[%s] failed to announce peer (%s): %v", s.Transport.Addr(), p.ID(), err)
+		return
+	}
+	for _, peer := range s.peerList() {
+		if peer.ID() == p.ID() {
 			continue
 		}
+		if err := peer.Send(payload); err != nil {
+			log.Printf("[%s] failed to announce peer (%s) to (%s): %v", s.Transport.Addr(), p.ID(), peer.ID(), err)
+		}
+	}
+}
 
-		var err error
-		delay := initialDelay
+func (s *FileServer) handleMessagePeerExchange(from string, msg MessagePeerExchange) error {
+	for _, info := range msg.Peers {
+		// Both ends of a new link hear about each other, only the lower ID dials
+		if info.ID <= s.ID || len(info.ListenAddr) == 0 || !s.reserveDial(info.ID) {
+			continue
+		}
 
-		// Retry loop
-		for attempt := 0; attempt < maxAttempts; attempt++ {
-			fmt.Printf("[%s] dialing to remote %s (attempt %d)\n", s.Transport.Addr(), addr, attempt+1)
-			if err = s.Transport.Dial(addr); err == nil {
-				break // Successful connection, exit retry loop
+		log.Printf("[%s] learned about peer (%s) at %s from (%s)", s.Transport.Addr(), info.ID, info.ListenAddr, from)
+		go func(info p2p.PeerInfo) {
+			if err := s.Transport.Dial(info.ListenAddr); err != nil {
+				log.Printf("[%s] failed to dial learned peer (%s): %v", s.Transport.Addr(), info.ID, err)
+				s.peerLock.Lock()
+				delete(s.dialing, info.ID)
+				s.peerLock.Unlock()
 			}
+		}(info)
+	}
+	return nil
+}
 
-			log.Printf("[%s] Failed to dial: %v (retrying in %v)", s.Transport.Addr(), err, delay)
-			time.Sleep(delay)
-			delay *= 2 // Exponential backoff
+// reserveDial reports whether we should connect to the peer with the given ID, marking it as being dialed.
+// Peers we're already connected or connecting to are skipped, as is everyone once MaxPeers is reached.
+func (s *FileServer) reserveDial(id string) bool {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
 
-			delay += time.Duration(rand.Intn(1000)) * time.Millisecond
+	if _, ok := s.peers[id]; ok {
+		return false
+	}
+	for dialID, started := range s.dialing {
+		if time.Since(started) > peerDialTimeout {
+			delete(s.dialing, dialID)
 		}
+	}
+	if _, ok := s.dialing[id]; ok {
+		return false
+	}
+	if len(s.peers)+len(s.dialing) >= s.MaxPeers {
+		return false
+	}
 
-		// If the retry loop finishes with an error, it's persistent
-		if err != nil {
-			log.Printf("[%s] Failed to dial after %d attempts: %v", s.Transport.Addr(), maxAttempts, err)
+	s.dialing[id] = time.Now()
+	return true
+}
+
+const (
+	maxDialAttempts  = 3               // Maximum number of retry attempts
+	initialDialDelay = 2 * time.Second // Initial backoff delay
+	maxDialDelay     = time.Minute
+	// redialDelay is how long the node with the greater ID waits before redialing a lost peer.
+	redialDelay = 5 * time.Second
+)
+
+// dialWithRetry dials addr with exponential backoff until it succeeds, connected
+// reports true or the server stops. maxAttempts <= 0 retries forever.
+func (s *FileServer) dialWithRetry(addr string, maxAttempts int, connected func() bool) error {
+	var err error
+	delay := initialDialDelay
+
+	// Retry loop
+	for attempt := 0; maxAttempts <= 0 || attempt < maxAttempts; attempt++ {
+		if connected != nil && connected() {
 			return nil
 		}
+
+		fmt.Printf("[%s] dialing to remote %s (attempt %d)\n", s.Transport.Addr(), addr, attempt+1)
+		if err = s.Transport.Dial(addr); err == nil {
+			return nil // Successful connection, exit retry loop
+		}
+
+		log.Printf("[%s] Failed to dial: %v (retrying in %v)", s.Transport.Addr(), err, delay)
+		select {
+		case <-time.After(delay):
+		case <-s.quitch:
+			return err
+		}
+		delay *= 2 // Exponential backoff
+
+		delay += time.Duration(rand.Intn(1000)) * time.Millisecond
+		delay = min(delay, maxDialDelay)
+	}
+	return err
+}
+
+func (s *FileServer) bootstrapNetwork() error {
+	for _, addr := range s.BootStrapNodes {
+		if len(addr) == 0 {
+			continue
+		}
+
+		// If the retry loop finishes with an error, it's persistent,
+		// keep trying in the background without holding up the others
+		if err := s.dialWithRetry(addr, maxDialAttempts, nil); err != nil {
+			log.Printf("[%s] Failed to dial after %d attempts: %v", s.Transport.Addr(), maxDialAttempts, err)
+			go s.dialWithRetry(addr, 0, nil)
+		}
 	}
 	return nil
 
@@ -405,12 +1587,27 @@ func (s *FileServer) Start() error {
 
 	s.bootstrapNetwork()
 
+	go s.repairLoop()
+	go s.republishLoop()
 	s.loop()
 	return nil
 }
 
 func init() {
 	gob.Register(MessageStoreFile{})
+	gob.Register(MessageStoreFileAck{})
 	gob.Register(MessageGetFile{})
+	gob.Register(MessageGetFileResponse{})
 	gob.Register(MessageDeleteFile{})
+	gob.Register(MessagePeerExchange{})
+	gob.Register(MessageUsage{})
+	gob.Register(MessageWeight{})
+	gob.Register(MessageDHTRequest{})
+	gob.Register(MessageDHTResponse{})
+	gob.Register(MessageMetadata{})
+	gob.Register(MessageDrain{})
+	gob.Register(MessageInventory{})
+	gob.Register(MessageInventoryResponse{})
+	gob.Register(MessageEscrow{})
+	gob.Register(MessageEscrowResponse{})
 }
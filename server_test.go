@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/20af02/MosaicFS/crypto"
+	"github.com/20af02/MosaicFS/p2p"
+)
+
+func TestRedial(t *testing.T) {
+	lo := MakeTestServer(":3000", []string{})
+	hi := MakeTestServer(":4000", []string{})
+	if lo.ID > hi.ID {
+		lo, hi = hi, lo
+	}
+	t.Cleanup(func() {
+		lo.Stop()
+		hi.Stop()
+		teardown(t, lo.store)
+		teardown(t, hi.store)
+	})
+	// Nothing listens where hi says it does, only hi can restore the link
+	hi.Transport.(*p2p.TCPTransport).AdvertiseAddr = ":1"
+
+	go func() { lo.Start() }()
+	go func() { hi.Start() }()
+	time.Sleep(time.Second)
+	if err := hi.Transport.Dial(lo.Transport.Addr()); err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	time.Sleep(time.Second)
+	peer, ok := hi.peer(lo.ID)
+	if !ok {
+		t.Fatalf("Expected the nodes to be connected")
+	}
+
+	peer.Close()
+	deadline := time.Now().Add(redialDelay + 5*time.Second)
+	for time.Now().Before(deadline) {
+		p, ok := hi.peer(lo.ID)
+		if _, back := lo.peer(hi.ID); ok && back && p != peer {
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	t.Errorf("Expected hi to redial lo")
+}
+
+func TestForeignObjectsRefused(t *testing.T) {
+	s1, s2, s3 := startRepairServers(t)
+	ctx := context.Background()
+	key := crypto.HashKey("owned.txt")
+
+	// s2 stores its object on s3
+	peer, ok := s2.peer(s3.ID)
+	if !ok {
+		t.Fatalf("Expected s3 to be a peer of s2")
+	}
+	if _, err := s2.sendObject(ctx, []p2p.Peer{peer}, key, s2.EncKey, []byte("of s2")); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+
+	// s1 can neither overwrite it nor delete it
+	if peer, ok = s1.peer(s3.ID); !ok {
+		t.Fatalf("Expected s3 to be a peer of s1")
+	}
+	data := []byte("not of s2")
+	msg := &Message{Payload: MessageStoreFile{ID: s2.ID, Key: key, Size: int64(len(data))}}
+	if err := s1.sendObjectTo(ctx, peer, msg, data); err == nil {
+		t.Errorf("Expected s3 to refuse an object of s2 from s1")
+	}
+	// Nor by claiming s2 signed it over
+	msg = &Message{Payload: MessageStoreFile{ID: s2.ID, Key: key, Size: int64(len(data)), Proof: s1.signHint(key, s3.ID, data)}}
+	if err := s1.sendObjectTo(ctx, peer, msg, data); err == nil {
+		t.Errorf("Expected s3 to refuse an object of s2 signed by s1")
+	}
+	proof := s2.signHint(key, s1.ID, data)
+	msg = &Message{Payload: MessageStoreFile{ID: s2.ID, Key: key, Size: int64(len(data)), Proof: proof}}
+	if err := s1.sendObjectTo(ctx, peer, msg, data); err == nil {
+		t.Errorf("Expected s3 to refuse an object of s2 signed over to another node")
+	}
+	if err := s3.handleMessageDeleteFile(s1.ID, MessageDeleteFile{ID: s2.ID, Key: key}); err == nil {
+		t.Errorf("Expected s3 to refuse deleting an object of s2 for s1")
+	}
+
+	_, r, err := s3.store.Read(s2.ID, key)
+	if err != nil {
+		t.Fatalf("Expected s3 to still hold the object of s2: %v", err)
+	}
+	got, _ := io.ReadAll(r)
+	if bytes.Equal(got, data) {
+		t.Errorf("Expected the object of s2 to be left as is")
+	}
+}
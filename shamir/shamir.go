@@ -0,0 +1,125 @@
+// Package shamir implements Shamir's secret sharing over GF(2^8).
+//
+// A secret is split into n shares, any t of which give it back while fewer tell
+// nothing about it. Every byte of the secret is the constant term of a random
+// polynomial of degree t-1, and a share holds the value of each polynomial at x.
+package shamir
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Share is one of the shares of a secret: X and the values at X of its polynomials.
+type Share struct {
+	X byte
+	Y []byte
+}
+
+// ErrInvalidShares is returned by Combine for shares that can't come from the same secret.
+var ErrInvalidShares = errors.New("shamir: invalid shares")
+
+// Split splits secret into n shares, any t of them being enough to combine it back.
+func Split(secret []byte, n, t int) ([]Share, error) {
+	if t < 2 || n < t || n > 255 {
+		return nil, fmt.Errorf("shamir: invalid threshold %d of %d shares", t, n)
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("shamir: empty secret")
+	}
+
+	shares := make([]Share, n)
+	for i := range shares {
+		shares[i] = Share{X: byte(i + 1), Y: make([]byte, len(secret))}
+	}
+	coeffs := make([]byte, t)
+	for j, b := range secret {
+		coeffs[0] = b
+		if _, err := io.ReadFull(rand.Reader, coeffs[1:]); err != nil {
+			return nil, err
+		}
+		for _, sh := range shares {
+			sh.Y[j] = eval(coeffs, sh.X)
+		}
+	}
+	return shares, nil
+}
+
+// Combine returns the secret the shares were split from. Given fewer shares than the
+// threshold, it returns a wrong secret: callers check it, e.g. by decrypting with it.
+func Combine(shares []Share) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, fmt.Errorf("%w: need at least 2", ErrInvalidShares)
+	}
+	size := len(shares[0].Y)
+	seen := make(map[byte]bool)
+	for _, sh := range shares {
+		if sh.X == 0 || seen[sh.X] || len(sh.Y) != size {
+			return nil, ErrInvalidShares
+		}
+		seen[sh.X] = true
+	}
+
+	// Lagrange interpolation at 0: the secret is the sum of y_i * l_i(0), with
+	// l_i(0) the product of x_j / (x_j - x_i) over the other shares
+	secret := make([]byte, size)
+	for i, si := range shares {
+		l := byte(1)
+		for j, sj := range shares {
+			if i != j {
+				l = mul(l, div(sj.X, sj.X^si.X))
+			}
+		}
+		for k, y := range si.Y {
+			secret[k] ^= mul(y, l)
+		}
+	}
+	return secret, nil
+}
+
+// eval evaluates the polynomial with the given coefficients, constant term first, at x.
+func eval(coeffs []byte, x byte) byte {
+	var y byte
+	for i := len(coeffs) - 1; i >= 0; i-- {
+		y = mul(y, x) ^ coeffs[i]
+	}
+	return y
+}
+
+// Arithmetic in GF(2^8) with the polynomial x^8 + x^4 + x^3 + x^2 + 1 (0x11d), as in
+// the erasure package. Addition and subtraction are XOR.
+
+var (
+	expTable [510]byte // Doubled so exp[log a + log b] needs no modulo
+	logTable [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+// div returns a / b, b must not be 0.
+func div(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+255-int(logTable[b])]
+}
@@ -0,0 +1,60 @@
+package shamir
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGalois(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		assert.Equal(t, byte(1), mul(byte(a), div(1, byte(a))))
+		assert.Equal(t, byte(a), div(mul(byte(a), 7), 7))
+	}
+	assert.Equal(t, byte(0), div(0, 7))
+}
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	shares, err := Split(secret, 5, 3)
+	assert.Nil(t, err)
+	assert.Len(t, shares, 5)
+
+	// Any 3 shares, in any order, give the secret back
+	for i := 0; i < 5; i++ {
+		for j := i + 1; j < 5; j++ {
+			for k := j + 1; k < 5; k++ {
+				got, err := Combine([]Share{shares[k], shares[i], shares[j]})
+				assert.Nil(t, err)
+				assert.Equal(t, secret, got)
+			}
+		}
+	}
+	got, err := Combine(shares)
+	assert.Nil(t, err)
+	assert.Equal(t, secret, got)
+
+	// 2 don't
+	got, err = Combine(shares[:2])
+	assert.Nil(t, err)
+	assert.False(t, bytes.Equal(secret, got))
+}
+
+func TestInvalid(t *testing.T) {
+	for _, nt := range [][2]int{{3, 1}, {2, 3}, {256, 2}} {
+		_, err := Split([]byte("secret"), nt[0], nt[1])
+		assert.NotNil(t, err, nt)
+	}
+	_, err := Split(nil, 3, 2)
+	assert.NotNil(t, err)
+
+	shares, err := Split([]byte("secret"), 3, 2)
+	assert.Nil(t, err)
+	_, err = Combine(shares[:1])
+	assert.ErrorIs(t, err, ErrInvalidShares)
+	_, err = Combine([]Share{shares[0], shares[0]})
+	assert.ErrorIs(t, err, ErrInvalidShares)
+	_, err = Combine([]Share{shares[0], {X: 2, Y: []byte("short")}})
+	assert.ErrorIs(t, err, ErrInvalidShares)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strconv"
+
+	"github.com/20af02/MosaicFS/erasure"
+	"github.com/20af02/MosaicFS/p2p"
+)
+
+// shardKey is the store key of shard i of an erasure coded chunk.
+func shardKey(ref string, i int) string {
+	return chunkKey(ref) + "/" + strconv.Itoa(i)
+}
+
+func appendLoc(locs []string, id string) []string {
+	if slices.Contains(locs, id) {
+		return locs
+	}
+	return append(locs, id)
+}
+
+// storeShards erasure codes a chunk. We keep shard 0 and every other shard goes
+// to a distinct peer encrypted with encKey, returned in shard order: peers[i] holds
+// shard i+1, or is nil when no node took it. It fails if fewer than required shards,
+// ours included, are on disk.
+func (s *FileServer) storeShards(ctx context.Context, ref string, encKey []byte, data []byte, ec erasure.Scheme, required int) ([]p2p.Peer, error) {
+	coder, err := erasure.New(ec)
+	if err != nil {
+		return nil, err
+	}
+	shards := coder.Split(data)
+
+	size := int64(len(shards[0]))
+	peers := s.placeReplicas(chunkKey(ref), ec.Total()-1, size)
+	if len(peers)+1 < required {
+		return nil, fmt.Errorf("erasure coding %s needs %d nodes, only %d available", ec, required, len(peers)+1)
+	}
+
+	if _, err := s.store.WriteSync(s.ID, shardKey(ref, 0), bytes.NewReader(shards[0])); err != nil {
+		return nil, err
+	}
+	go s.provide(s.ID, shardKey(ref, 0))
+
+	tried := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		tried = append(tried, peer.ID())
+	}
+	placed := make([]p2p.Peer, ec.Total()-1)
+	stored := 1
+	var errs []error
+	for i, peer := range peers {
+		// hint is the peer meant for the shard, once a stand-in holds it
+		var hint []string
+		for peer != nil {
+			_, err := s.sendObject(ctx, []p2p.Peer{peer}, shardKey(ref, i+1), encKey, shards[i+1], hint...)
+			if err == nil {
+				placed[i] = peer
+				stored++
+				break
+			}
+			errs = append(errs, err)
+			if hint == nil {
+				hint = []string{peer.ID()}
+			}
+			// Try a node holding no shard of the chunk yet
+			peer = nil
+			if spare := s.placeReplicas(chunkKey(ref), 1, size, tried...); len(spare) > 0 {
+				peer = spare[0]
+				tried = append(tried, peer.ID())
+			}
+		}
+	}
+	if stored < required {
+		err := fmt.Errorf("%w: %d of %d shards of (%s) stored", ErrNoQuorum, stored, required, ref)
+		if len(errs) > 0 {
+			err = fmt.Errorf("%w: %w", err, errors.Join(errs...))
+		}
+		return nil, err
+	}
+	return placed, nil
+}
+
+// fetchShards downloads shards of chunk c until we hold enough of them to decode it.
+// It returns the keys of the shards it downloaded.
+func (s *FileServer) fetchShards(ctx context.Context, m *Manifest, c ChunkRef) ([]string, error) {
+	keys := m.objectKeys(c)
+	have := 0
+	for _, key := range keys {
+		if s.store.Has(s.ID, key) {
+			have++
+		}
+	}
+
+	var fetched []string
+	for _, key := range keys {
+		if have >= m.EC.Data {
+			return fetched, nil
+		}
+		if s.store.Has(s.ID, key) {
+			continue
+		}
+		if err := s.fetch(ctx, key, key, c.encKey(s.masterKey()), false, nil); err != nil {
+			log.Printf("[%s] failed to fetch shard (%s): %v", s.Transport.Addr(), key, err)
+			continue
+		}
+		fetched = append(fetched, key)
+		have++
+	}
+
+	if have < m.EC.Data {
+		return fetched, fmt.Errorf("%d of %d shards found: %w", have, m.EC.Data, erasure.ErrTooFewShards)
+	}
+	return fetched, nil
+}
+
+// decodeShards rebuilds chunk c from the shards on disk.
+func (s *FileServer) decodeShards(m *Manifest, c ChunkRef) ([]byte, error) {
+	coder, err := erasure.New(*m.EC)
+	if err != nil {
+		return nil, err
+	}
+
+	shards := make([][]byte, m.EC.Total())
+	for i, key := range m.objectKeys(c) {
+		_, r, err := s.store.Read(s.ID, key)
+		if err != nil {
+			continue
+		}
+		if shards[i], err = io.ReadAll(r); err != nil {
+			shards[i] = nil
+		}
+	}
+	if err := coder.Reconstruct(shards); err != nil {
+		return nil, err
+	}
+	data, err := coder.Join(shards, int(c.Size))
+	if err != nil {
+		return nil, err
+	}
+	// Reed-Solomon can't tell a corrupt shard from a good one, the chunk hash can
+	if !hmac.Equal([]byte(chunkHash(s.keys.hashKey(), data)), []byte(c.Hash)) {
+		return nil, fmt.Errorf("chunk (%s) is corrupt", c.Hash)
+	}
+	return data, nil
+}
@@ -6,13 +6,15 @@ import (
 	"encoding/hex"
 	"errors"
 	"io"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 
-	"github.com/20af02/MosaicFS/crypto"
+	"github.com/20af02/MosaicFS/merkle"
 )
 
 const defaultRootFolderName = "default_network_store"
@@ -73,6 +75,15 @@ var DefaultPathTransformFunc = func(key string) PathKey {
 
 type Store struct {
 	StoreOpts
+
+	invLock sync.Mutex
+	// inventories hold the objects on disk per namespace, built on first use
+	inventories map[string]*merkle.Tree
+
+	usageLock sync.Mutex
+	// used is the number of bytes on disk, walked on first use and kept up to date since
+	used      int64
+	usedKnown bool
 }
 
 func NewStore(opts StoreOpts) *Store {
@@ -84,7 +95,8 @@ func NewStore(opts StoreOpts) *Store {
 	}
 
 	return &Store{
-		StoreOpts: opts,
+		StoreOpts:   opts,
+		inventories: make(map[string]*merkle.Tree),
 	}
 }
 
@@ -99,6 +111,14 @@ func (s *Store) Has(id string, key string) bool {
 }
 
 func (s *Store) Clear() error {
+	s.invLock.Lock()
+	s.inventories = make(map[string]*merkle.Tree)
+	s.invLock.Unlock()
+
+	s.usageLock.Lock()
+	s.used, s.usedKnown = 0, false
+	s.usageLock.Unlock()
+
 	return os.RemoveAll(s.Root)
 }
 
@@ -107,18 +127,101 @@ func (s *Store) Delete(id string, key string) error {
 	defer func() {
 		log.Printf("Deleted [%s] from disk", pathKey.Filename)
 	}()
-	firstPathNameWithNS := filepath.Join(id, pathKey.FirstPathName())
-	firstPathNameWithRoot := filepath.Join(s.Root, firstPathNameWithNS)
-	log.Printf("Deleting [%s]", firstPathNameWithRoot)
+	fullPathWithRoot := filepath.Join(s.Root, id, pathKey.FullPath())
+	log.Printf("Deleting [%s]", fullPathWithRoot)
 
 	// log.Printf("Deleting metadata for [%s]", pathKey.Filename)
 
 	if err := s.dbHandler.RemoveLocalMetadata(key); err != nil {
 		log.Printf("Error deleting metadata: %v", err)
 	}
-	log.Printf("[%s] deleting [%s]", id, firstPathNameWithRoot)
+	log.Printf("[%s] deleting [%s]", id, fullPathWithRoot)
+
+	if err := s.discard(id, key); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Size returns the size of the file on disk.
+func (s *Store) Size(id string, key string) (int64, error) {
+	pathKey := s.PathTransformFunc(key)
+	fi, err := os.Stat(filepath.Join(s.Root, id, pathKey.FullPath()))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// Usage returns the number of bytes stored on disk, across all namespaces.
+// The store is only walked the first time, writes and removals keep it up to date after.
+func (s *Store) Usage() (int64, error) {
+	s.usageLock.Lock()
+	defer s.usageLock.Unlock()
+	if s.usedKnown {
+		return s.used, nil
+	}
+
+	var used int64
+	err := filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		// Files may go away while we walk, and there's nothing to count before the first write
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		used += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.used, s.usedKnown = used, true
+	return used, nil
+}
 
-	return os.RemoveAll(firstPathNameWithRoot)
+// addUsage records that delta bytes were written to disk, or removed when negative.
+func (s *Store) addUsage(delta int64) {
+	s.usageLock.Lock()
+	defer s.usageLock.Unlock()
+	if s.usedKnown {
+		s.used += delta
+	}
+}
+
+// discard removes the file from disk without touching its metadata.
+// Directories left empty are removed too, files sharing a path prefix stay.
+func (s *Store) discard(id string, key string) error {
+	pathKey := s.PathTransformFunc(key)
+	fullPathWithRoot := filepath.Join(s.Root, id, pathKey.FullPath())
+	fi, err := os.Stat(fullPathWithRoot)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(fullPathWithRoot); err != nil {
+		return err
+	}
+	s.addUsage(-fi.Size())
+	s.updateInventory(id, key, false)
+
+	nsRoot := filepath.Join(s.Root, id)
+	for dir := filepath.Join(nsRoot, pathKey.PathName); dir != nsRoot && dir != "."; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break // Not empty
+		}
+	}
+	return nil
 }
 
 func (s *Store) Write(id string, key string, r io.Reader) (int64, error) {
@@ -128,7 +231,8 @@ func (s *Store) Write(id string, key string, r io.Reader) (int64, error) {
 	return s.writeStream(id, key, r)
 }
 
-func (s *Store) WriteDecrypt(encKey []byte, id string, key string, r io.Reader) (int64, error) {
+// WriteDecrypt decrypts r with encKey into the file, see decrypt for legacy.
+func (s *Store) WriteDecrypt(encKey []byte, legacy bool, id string, key string, r io.Reader) (int64, error) {
 
 	f, err := s.openFileForWriting(id, key)
 	if err != nil {
@@ -136,10 +240,31 @@ func (s *Store) WriteDecrypt(encKey []byte, id string, key string, r io.Reader)
 	}
 	defer f.Close()
 
-	n, err := crypto.CopyDecrypt(encKey, r, f)
+	// n counts the ciphertext read, headers and tags included, the disk holds less
+	n, err := decrypt(encKey, legacy, r, f)
+	if fi, serr := f.Stat(); serr == nil {
+		s.addUsage(fi.Size())
+	}
 	return int64(n), err
 }
 
+// WriteSync is Write, returning once the file is flushed to stable storage.
+func (s *Store) WriteSync(id string, key string, r io.Reader) (int64, error) {
+	f, err := s.openFileForWriting(id, key)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	s.addUsage(n)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
 func (s *Store) openFileForWriting(id string, key string) (*os.File, error) {
 	pathKey := s.PathTransformFunc(key)
 	pathNameWithRoot := filepath.Join(s.Root, id, pathKey.PathName)
@@ -150,7 +275,18 @@ func (s *Store) openFileForWriting(id string, key string) (*os.File, error) {
 	fullPath := pathKey.FullPath()
 	fullPathWithRoot := filepath.Join(s.Root, id, fullPath)
 	// log.Printf("Writing to_: %s", fullPathWithRoot)
-	return os.Create(fullPathWithRoot)
+	// An overwritten file no longer takes its old size, see addUsage
+	var oldSize int64
+	if fi, err := os.Stat(fullPathWithRoot); err == nil {
+		oldSize = fi.Size()
+	}
+	f, err := os.Create(fullPathWithRoot)
+	if err != nil {
+		return nil, err
+	}
+	s.addUsage(-oldSize)
+	s.updateInventory(id, key, true)
+	return f, nil
 }
 
 func (s *Store) writeStream(id string, key string, r io.Reader) (int64, error) {
@@ -159,8 +295,9 @@ func (s *Store) writeStream(id string, key string, r io.Reader) (int64, error) {
 		return 0, err
 	}
 	defer f.Close()
-	return io.Copy(f, r)
-
+	n, err := io.Copy(f, r)
+	s.addUsage(n)
+	return n, err
 }
 
 // @FIXME: Instead of copying directly to a reader, we first copy this into a buffer. Maybe just return the File from the readStream?
@@ -218,3 +355,67 @@ func (s *Store) readStream(id string, key string) (int64, io.ReadCloser, error)
 	return fi.Size(), file, nil
 
 }
+
+// inventory returns the Merkle tree over the objects held for the node with the given ID,
+// named by inventoryName. Peers compare it to find which objects they disagree on.
+func (s *Store) inventory(id string) (*merkle.Tree, error) {
+	s.invLock.Lock()
+	defer s.invLock.Unlock()
+
+	if t, ok := s.inventories[id]; ok {
+		return t, nil
+	}
+
+	// Keys can't be recovered from disk, the paths they map to name them instead
+	t := merkle.New(0)
+	nsRoot := filepath.Join(s.Root, id)
+	err := filepath.WalkDir(nsRoot, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(nsRoot, path)
+		if err != nil {
+			return err
+		}
+		t.Add(filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if s.inventories == nil {
+		s.inventories = make(map[string]*merkle.Tree)
+	}
+	s.inventories[id] = t
+	return t, nil
+}
+
+// holds reports whether we hold objects for the node with the given ID.
+func (s *Store) holds(id string) bool {
+	_, err := os.Stat(filepath.Join(s.Root, id))
+	return err == nil
+}
+
+// inventoryName is the name of the object key in inventories: its path on disk.
+func (s *Store) inventoryName(key string) string {
+	return filepath.ToSlash(s.PathTransformFunc(key).FullPath())
+}
+
+// updateInventory records key was added to or removed from the namespace id.
+func (s *Store) updateInventory(id, key string, added bool) {
+	s.invLock.Lock()
+	defer s.invLock.Unlock()
+
+	t, ok := s.inventories[id]
+	if !ok {
+		return // Built from disk on first use
+	}
+	if added {
+		t.Add(s.inventoryName(key))
+	} else {
+		t.Remove(s.inventoryName(key))
+	}
+}
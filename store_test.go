@@ -2,13 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/20af02/MosaicFS/crypto"
+	"github.com/20af02/MosaicFS/erasure"
 )
 
 func TestPathTransformFunc(t *testing.T) {
@@ -78,6 +84,9 @@ func TestStoreFT(t *testing.T) {
 	defer teardown(t, s1.store)
 	defer teardown(t, s2.store)
 	defer teardown(t, s3.store)
+	defer s1.Stop()
+	defer s2.Stop()
+	defer s3.Stop()
 
 	go func() { s1.Start() }()
 	time.Sleep(2 * time.Second)
@@ -123,6 +132,9 @@ func TestNetDelete(t *testing.T) {
 	defer teardown(t, s1.store)
 	defer teardown(t, s2.store)
 	defer teardown(t, s3.store)
+	defer s1.Stop()
+	defer s2.Stop()
+	defer s3.Stop()
 
 	go func() { s1.Start() }()
 	go func() { s2.Start() }()
@@ -141,6 +153,144 @@ func TestNetDelete(t *testing.T) {
 
 }
 
+func TestGetNotFound(t *testing.T) {
+	s1 := MakeTestServer(":3000", []string{})
+	s2 := MakeTestServer(":4000", []string{":3000"})
+	defer teardown(t, s1.store)
+	defer teardown(t, s2.store)
+	defer s1.Stop()
+	defer s2.Stop()
+
+	go func() { s1.Start() }()
+	time.Sleep(time.Second)
+	go func() { s2.Start() }()
+	time.Sleep(time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	_, err := s2.GetContext(ctx, "does_not_exist.png")
+	if !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("Expected ErrFileNotFound, got: %v", err)
+	}
+	// Every peer answered, so we must not have waited for the deadline
+	if time.Since(start) > time.Second {
+		t.Errorf("Get took too long: %v", time.Since(start))
+	}
+}
+
+func TestStoreInventory(t *testing.T) {
+	store := NewStore(StoreOpts{PathTransformFunc: CASPathTransformFunc})
+	defer teardown(t, store)
+	id := crypto.GenerateID()
+
+	for i := 0; i < 20; i++ {
+		if _, err := store.writeStream(id, fmt.Sprintf("foo_%d", i), bytes.NewReader([]byte("data"))); err != nil {
+			t.Fatalf("Failed to writeStream: %v", err)
+		}
+	}
+	inventory, err := store.inventory(id)
+	if err != nil {
+		t.Fatalf("Failed to build inventory: %v", err)
+	}
+	if inventory.Len() != 20 || !inventory.Has(store.inventoryName("foo_3")) {
+		t.Errorf("Expected the 20 keys on disk, got %d", inventory.Len())
+	}
+
+	// Kept up to date, and rebuilt the same from disk
+	store.discard(id, "foo_3")
+	store.writeStream(id, "bar", bytes.NewReader([]byte("data")))
+	if inventory.Has(store.inventoryName("foo_3")) || !inventory.Has(store.inventoryName("bar")) {
+		t.Errorf("Expected the inventory to follow writes and deletes")
+	}
+	rebuilt, err := NewStore(store.StoreOpts).inventory(id)
+	if err != nil {
+		t.Fatalf("Failed to build inventory: %v", err)
+	}
+	if rebuilt.Root() != inventory.Root() {
+		t.Errorf("Expected the inventory rebuilt from disk to match")
+	}
+}
+
+func TestInventoryNamespaces(t *testing.T) {
+	s := MakeTestServer(":3000", []string{})
+	defer func() {
+		s.Stop()
+		teardown(t, s.store)
+	}()
+	owner, other := crypto.GenerateID(), crypto.GenerateID()
+	if _, err := s.store.writeStream(owner, "foo", bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatal(err)
+	}
+	call := func(from string, msg MessageInventory) MessageInventoryResponse {
+		var closed int
+		st := closeStream{Buffer: new(bytes.Buffer), closed: &closed}
+		if err := s.handleMessageInventory(from, msg, st); err != nil {
+			t.Fatalf("Failed to handle: %v", err)
+		}
+		resp, err := readMessage(st)
+		if err != nil {
+			t.Fatalf("Failed to read the response: %v", err)
+		}
+		return resp.Payload.(MessageInventoryResponse)
+	}
+
+	if resp := call(other, MessageInventory{ID: "../..", Root: true}); resp.Err == "" {
+		t.Errorf("Expected a path to be refused as a namespace")
+	}
+	// Namespaces we hold objects of are answered for, to anyone
+	if resp := call(other, MessageInventory{ID: owner, Root: true}); resp.Root.IsZero() {
+		t.Errorf("Expected the inventory of the namespace we hold")
+	}
+	// Others look empty, and aren't kept
+	if resp := call(owner, MessageInventory{ID: crypto.GenerateID(), Root: true}); !resp.Root.IsZero() || resp.Err != "" {
+		t.Errorf("Expected an empty inventory, got %+v", resp)
+	}
+	if len(s.store.inventories) != 1 {
+		t.Errorf("Expected a single inventory kept, got %d", len(s.store.inventories))
+	}
+}
+
+func TestStoreUsage(t *testing.T) {
+	store := NewStore(StoreOpts{PathTransformFunc: CASPathTransformFunc})
+	defer teardown(t, store)
+	id := crypto.GenerateID()
+
+	if _, err := store.writeStream(id, "before", bytes.NewReader([]byte("on disk"))); err != nil {
+		t.Fatalf("Failed to writeStream: %v", err)
+	}
+	used, err := store.Usage()
+	if err != nil || used != 7 {
+		t.Fatalf("Expected 7 bytes walked from disk, got %d: %v", used, err)
+	}
+
+	// Writes, overwrites and removals are counted from then on
+	store.WriteSync(id, "after", bytes.NewReader([]byte("0123456789")))
+	store.WriteSync(id, "before", bytes.NewReader([]byte("new")))
+	store.discard(id, "after")
+	if used, _ := store.Usage(); used != 3 {
+		t.Errorf("Expected 3 bytes used, got %d", used)
+	}
+
+	// Decrypted objects take their plaintext size, not the ciphertext read
+	key := crypto.NewEncryptionKey()
+	var enc bytes.Buffer
+	if _, err := crypto.CopyEncrypt(key, bytes.NewReader([]byte("plaintext")), &enc); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.WriteDecrypt(key, false, id, "fetched", &enc); err != nil {
+		t.Fatalf("Failed to WriteDecrypt: %v", err)
+	}
+	if used, _ := store.Usage(); used != 12 {
+		t.Errorf("Expected 12 bytes used, got %d", used)
+	}
+	store.discard(id, "fetched")
+	if walked, _ := NewStore(store.StoreOpts).Usage(); walked != 3 {
+		t.Errorf("Expected the count to match the disk, got %d", walked)
+	}
+}
+
 func newStore() *Store {
 	db, _ := NewDBHandler("test", "./.env/.db/test.db")
 	opts := StoreOpts{
@@ -155,3 +305,329 @@ func teardown(t *testing.T, s *Store) {
 		t.Errorf("Failed to clear store: %v", err)
 	}
 }
+
+func TestPeerExchange(t *testing.T) {
+	s1 := MakeTestServer(":3000", []string{})
+	s2 := MakeTestServer(":4000", []string{":3000"})
+	s3 := MakeTestServer(":5000", []string{":3000"})
+	defer teardown(t, s1.store)
+	defer teardown(t, s2.store)
+	defer teardown(t, s3.store)
+	defer s1.Stop()
+	defer s2.Stop()
+	defer s3.Stop()
+
+	go func() { s1.Start() }()
+	time.Sleep(time.Second)
+	go func() { s2.Start() }()
+	time.Sleep(time.Second)
+	go func() { s3.Start() }()
+	time.Sleep(2 * time.Second)
+
+	// s2 and s3 only know :3000, but should have found each other through it
+	for _, s := range []*FileServer{s1, s2, s3} {
+		if n := len(s.peerList()); n != 2 {
+			t.Errorf("[%s] Expected 2 peers, got %d", s.Transport.Addr(), n)
+		}
+	}
+	if _, ok := s3.peer(s2.ID); !ok {
+		t.Errorf("Expected %s to be connected to %s", s3.Transport.Addr(), s2.Transport.Addr())
+	}
+
+	// Knowing the same nodes, everybody agrees on where a file lives
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("picture_%d.png", i)
+		expected := fmt.Sprint(s1.ReplicaNodes(key, 2))
+		for _, s := range []*FileServer{s2, s3} {
+			if nodes := fmt.Sprint(s.ReplicaNodes(key, 2)); nodes != expected {
+				t.Errorf("[%s] Expected replica nodes %s, got %s", s.Transport.Addr(), expected, nodes)
+			}
+		}
+	}
+}
+
+func TestStoreProviders(t *testing.T) {
+	s1 := MakeTestServer(":3000", []string{})
+	s2 := MakeTestServer(":4000", []string{":3000"})
+	s3 := MakeTestServer(":5000", []string{":3000"})
+	defer teardown(t, s1.store)
+	defer teardown(t, s2.store)
+	defer teardown(t, s3.store)
+	defer s1.Stop()
+	defer s2.Stop()
+	defer s3.Stop()
+
+	go func() { s1.Start() }()
+	time.Sleep(time.Second)
+	go func() { s2.Start() }()
+	time.Sleep(time.Second)
+	go func() { s3.Start() }()
+	time.Sleep(2 * time.Second)
+
+	key := "providers.png"
+	if err := s1.Store(key, bytes.NewReader([]byte("my big data file here!"))); err != nil {
+		t.Fatalf("Failed to store: %v", err)
+	}
+	// Replicas are announced once acknowledged
+	time.Sleep(500 * time.Millisecond)
+
+	// Every node holding a replica announced itself
+	dhtKey := providerKey(s1.ID, crypto.HashKey(key))
+	providers, err := s3.dht.FindProviders(context.Background(), dhtKey)
+	if err != nil {
+		t.Fatalf("Failed to find providers: %v", err)
+	}
+	if len(providers) != 3 {
+		t.Errorf("Expected 3 providers, got %d", len(providers))
+	}
+
+	if err := s1.Delete(key); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	providers, err = s2.dht.FindProviders(context.Background(), dhtKey)
+	if err != nil {
+		t.Fatalf("Failed to find providers: %v", err)
+	}
+	if len(providers) != 0 {
+		t.Errorf("Expected no providers after delete, got %d", len(providers))
+	}
+}
+
+func TestStoreReplicas(t *testing.T) {
+	s1 := MakeTestServer(":3000", []string{})
+	s2 := MakeTestServer(":4000", []string{":3000"})
+	s3 := MakeTestServer(":5000", []string{":3000"})
+	defer teardown(t, s1.store)
+	defer teardown(t, s2.store)
+	defer teardown(t, s3.store)
+	defer s1.Stop()
+	defer s2.Stop()
+	defer s3.Stop()
+
+	go func() { s1.Start() }()
+	time.Sleep(time.Second)
+	go func() { s2.Start() }()
+	time.Sleep(time.Second)
+	go func() { s3.Start() }()
+	time.Sleep(2 * time.Second)
+
+	for replicas := 1; replicas <= 3; replicas++ {
+		key := fmt.Sprintf("replicas_%d.png", replicas)
+		if err := s1.StoreReplicas(key, bytes.NewReader([]byte("my big data file here!")), replicas); err != nil {
+			t.Fatalf("Failed to store: %v", err)
+		}
+
+		held := 0
+		for _, s := range []*FileServer{s2, s3} {
+			if s.store.Has(s1.ID, crypto.HashKey(key)) {
+				held++
+			}
+		}
+		if held != replicas-1 {
+			t.Errorf("Expected %d remote replicas, got %d", replicas-1, held)
+		}
+	}
+}
+
+func TestStoreChunks(t *testing.T) {
+	s1 := MakeTestServer(":3000", []string{})
+	s2 := MakeTestServer(":4000", []string{":3000"})
+	s1.ChunkSize = 16
+	defer teardown(t, s1.store)
+	defer teardown(t, s2.store)
+	defer s1.Stop()
+	defer s2.Stop()
+
+	go func() { s1.Start() }()
+	time.Sleep(time.Second)
+	go func() { s2.Start() }()
+	time.Sleep(time.Second)
+
+	key := "chunked.png"
+	data := bytes.Repeat([]byte("my big data file here!"), 5)
+	if err := s1.StoreReplicas(key, bytes.NewReader(data), 2); err != nil {
+		t.Fatalf("Failed to store: %v", err)
+	}
+
+	m, err := s1.readManifest(key)
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	var total int64
+	for _, c := range m.Chunks {
+		total += c.Size
+	}
+	if m.Size != int64(len(data)) || total != m.Size || len(m.Chunks) < 2 {
+		t.Errorf("Unexpected manifest: size %d, %d bytes in %d chunks", m.Size, total, len(m.Chunks))
+	}
+	for _, c := range m.Chunks {
+		if !s2.store.Has(s1.ID, chunkKey(c.Hash)) {
+			t.Errorf("Expected chunk (%s) to be replicated", c.Hash)
+		}
+	}
+
+	// Reassembled from the chunks on s2
+	if err := s1.DeleteLocal(key); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	r, err := s1.Get(key)
+	if err != nil {
+		t.Fatalf("Failed to get: %v", err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Failed to readAll: %v", err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("Expected: [%s] Actual: [%s]", string(data), string(b))
+	}
+
+	// A chunk corrupted on disk isn't returned as content
+	c := m.Chunks[0]
+	if _, err := s1.store.Write(s1.ID, chunkKey(c.Hash), bytes.NewReader(make([]byte, c.Size))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(s1.chunkReader(m)); err == nil || !strings.Contains(err.Error(), "is corrupt") {
+		t.Errorf("Expected the corrupt chunk to be detected, got %v", err)
+	}
+}
+
+func TestStoreDedup(t *testing.T) {
+	s1 := MakeTestServer(":3000", []string{})
+	s2 := MakeTestServer(":4000", []string{":3000"})
+	s1.ChunkSize = 1024
+	defer teardown(t, s1.store)
+	defer teardown(t, s2.store)
+	defer s1.Stop()
+	defer s2.Stop()
+
+	go func() { s1.Start() }()
+	time.Sleep(time.Second)
+	go func() { s2.Start() }()
+	time.Sleep(time.Second)
+
+	data := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	edited := append([]byte("a new header"), data...)
+
+	if err := s1.StoreReplicas("v1.bin", bytes.NewReader(data), 2); err != nil {
+		t.Fatalf("Failed to store: %v", err)
+	}
+	if err := s1.StoreReplicas("v2.bin", bytes.NewReader(edited), 2); err != nil {
+		t.Fatalf("Failed to store: %v", err)
+	}
+
+	m1, _ := s1.readManifest("v1.bin")
+	m2, _ := s1.readManifest("v2.bin")
+	shared := 0
+	for _, c := range m2.Chunks {
+		if refs, _ := s1.store.dbHandler.ChunkRefs(c.Hash); refs == 2 {
+			shared++
+		}
+	}
+	if shared < len(m1.Chunks)-2 {
+		t.Errorf("Expected most of the %d chunks to be shared, got %d", len(m1.Chunks), shared)
+	}
+
+	// Deleting one version keeps the chunks the other still uses
+	if err := s1.Delete("v1.bin"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for _, c := range m2.Chunks {
+		if !s1.store.Has(s1.ID, chunkKey(c.Hash)) || !s2.store.Has(s1.ID, chunkKey(c.Hash)) {
+			t.Errorf("Expected chunk (%s) to be kept", c.Hash)
+		}
+	}
+	for _, c := range m1.Chunks {
+		kept := slices.ContainsFunc(m2.Chunks, func(c2 ChunkRef) bool { return c2.Hash == c.Hash })
+		if !kept && s1.store.Has(s1.ID, chunkKey(c.Hash)) {
+			t.Errorf("Expected chunk (%s) to be deleted", c.Hash)
+		}
+	}
+
+	r, err := s1.Get("v2.bin")
+	if err != nil {
+		t.Fatalf("Failed to get: %v", err)
+	}
+	b, _ := io.ReadAll(r)
+	if !bytes.Equal(b, edited) {
+		t.Errorf("Unexpected content after deleting the other version")
+	}
+}
+
+func TestStoreEC(t *testing.T) {
+	s1 := MakeTestServer(":3000", []string{})
+	s2 := MakeTestServer(":4000", []string{":3000"})
+	s3 := MakeTestServer(":5000", []string{":3000", ":4000"})
+	s1.ChunkSize = 1024
+	defer teardown(t, s1.store)
+	defer teardown(t, s2.store)
+	defer teardown(t, s3.store)
+	defer s1.Stop()
+	defer s2.Stop()
+	defer s3.Stop()
+
+	go func() { s1.Start() }()
+	go func() { s2.Start() }()
+	time.Sleep(2 * time.Second)
+
+	go func() { s3.Start() }()
+	time.Sleep(2 * time.Second)
+
+	key := "coded.bin"
+	data := make([]byte, 8*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	if err := s1.StoreEC(key, bytes.NewReader(data), erasure.Scheme{Data: 4, Parity: 2}); err == nil {
+		t.Errorf("Expected 4+2 to fail with 3 nodes")
+	}
+	if err := s1.StoreEC(key, bytes.NewReader(data), erasure.Scheme{Data: 2, Parity: 1}); err != nil {
+		t.Fatalf("Failed to store: %v", err)
+	}
+
+	fmd, err := s1.store.dbHandler.GetFileMetadata(key)
+	if err != nil {
+		t.Fatalf("Failed to get metadata: %v", err)
+	}
+	if fmd.ErasureCoding != "2+1" || len(fmd.ShardLocations) != 3 {
+		t.Errorf("Unexpected metadata: %+v", fmd)
+	}
+
+	// Every node holds a single shard of each chunk
+	m, err := s1.readManifest(key)
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	for _, c := range m.Chunks {
+		for _, s := range []*FileServer{s1, s2, s3} {
+			held := 0
+			for _, shard := range m.objectKeys(c) {
+				if s.store.Has(s1.ID, shard) {
+					held++
+				}
+			}
+			if held != 1 {
+				t.Errorf("Expected [%s] to hold 1 shard of (%s), holds %d", s.Transport.Addr(), c.Hash, held)
+			}
+		}
+	}
+
+	// Losing a data shard, the chunks are rebuilt from the other two
+	for _, c := range m.Chunks {
+		s1.store.discard(s1.ID, m.objectKeys(c)[0])
+	}
+	r, err := s1.Get(key)
+	if err != nil {
+		t.Fatalf("Failed to get: %v", err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Failed to readAll: %v", err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("Reconstructed data doesn't match")
+	}
+}